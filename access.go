@@ -0,0 +1,71 @@
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Networks is a list of IP networks, for example for the access lists of a
+// Server.
+type Networks []*net.IPNet
+
+// ParseNetworks parses networks in CIDR notation, like "192.0.2.0/24" or
+// "2001:db8::/32". A single IP address is a network with only that address.
+func ParseNetworks(cidrs ...string) (Networks, error) {
+	networks := make(Networks, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("smtpd: invalid network %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("smtpd: invalid network %q", cidr)
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// Contains reports whether ip is in one of the networks.
+func (n Networks) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAddr reports whether the IP address of addr is in one of the
+// networks.
+func (n Networks) ContainsAddr(addr net.Addr) bool {
+	return n.Contains(remoteIP(addr))
+}
+
+var errAccessDenied = errors.New("554 5.7.1 Access denied")
+
+// checkAccess applies the access lists of the server to the client address,
+// it returns false if the client is denied
+func (s *session) checkAccess() bool {
+	if s.server.DeniedNetworks.ContainsAddr(s.RemoteAddr) {
+		return false
+	}
+	s.Relay = s.server.RelayNetworks.ContainsAddr(s.RemoteAddr)
+	s.exempt = s.server.ExemptNetworks.ContainsAddr(s.RemoteAddr)
+	return true
+}
@@ -0,0 +1,102 @@
+package smtpd
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+
+	networks, err := ParseNetworks("192.0.2.0/24", "198.51.100.7", "2001:db8::/32")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	for _, test := range []struct {
+		ip       string
+		expected bool
+	}{
+		{"192.0.2.1", true},
+		{"::ffff:192.0.2.1", true},
+		{"192.0.3.1", false},
+		{"198.51.100.7", true},
+		{"198.51.100.8", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	} {
+		if networks.Contains(net.ParseIP(test.ip)) != test.expected {
+			t.Errorf("%s: expected %t", test.ip, test.expected)
+		}
+	}
+	if networks.Contains(nil) {
+		t.Errorf("nil IP in networks")
+	}
+	if _, err := ParseNetworks("192.0.2.0/33"); err == nil {
+		t.Errorf("expected error for invalid network")
+	}
+	if _, err := ParseNetworks("localhost"); err == nil {
+		t.Errorf("expected error for invalid address")
+	}
+}
+
+func TestAccessLists(t *testing.T) {
+
+	loopback, _ := ParseNetworks("127.0.0.0/8")
+
+	// denied at connect
+	c, done := dialServer(t, &Server{DeniedNetworks: loopback}, testHandler{})
+	if _, _, err := c.ReadResponse(554); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	<-done
+	c.Close()
+
+	// relay clients need not authenticate and are exempt from rate limits
+	server := &Server{
+		RequireAuth:    true,
+		RelayNetworks:  loopback,
+		ExemptNetworks: loopback,
+		RateLimiter:    &TokenBucketLimiter{Rates: map[string]Rate{"MAIL": {Burst: 0}}},
+	}
+	c, done = dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "HELO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
+
+type testDNSBL []string
+
+func (l testDNSBL) Lookup(ctx context.Context, ip net.IP) ([]string, bool, error) {
+	return l, len(l) > 0, nil
+}
+
+func TestDNSBL(t *testing.T) {
+
+	server := &Server{DNSBL: testDNSBL{"zen.example.org"}, DNSBLReject: true}
+	c, done := dialServer(t, server, testHandler{})
+	if _, msg, err := c.ReadResponse(554); err != nil {
+		t.Fatalf("%s", err.Error())
+	} else if msg != "5.7.1 Client host [127.0.0.1] listed on zen.example.org" {
+		t.Fatalf("unexpected reply %q", msg)
+	}
+	<-done
+	c.Close()
+
+	// exempt clients are not looked up
+	loopback, _ := ParseNetworks("127.0.0.1")
+	server.ExemptNetworks = loopback
+	c, done = dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
@@ -0,0 +1,197 @@
+/*
+Package archive stores accepted messages in object storage, for example for
+compliance archiving.
+
+A Sink writes each message to a Store under keys built from a template, for
+example by date or by recipient, optionally with the metadata of the mail
+transaction in JSON next to it. S3 is a Store for S3-compatible services
+with optional server-side encryption, other services can be plugged in by
+implementing Store.
+
+A Sink can be used as the handler of a server, in which case a message is
+only accepted when it was archived, or messages can be archived with
+Archive from another handler before they are delivered.
+*/
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+)
+
+// Store stores objects.
+type Store interface {
+	// Put stores the object read from r, which has the given size, under
+	// key. contentType is the media type of the object.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+}
+
+// DefaultKey is the default template of the keys of archived messages.
+const DefaultKey = `{{.Received.Format "2006/01/02"}}/{{.ID}}.eml`
+
+var errArchive = errors.New("451 4.3.0 Message could not be archived, try again later")
+
+// Key holds the values for the key template of an archived message. Slashes
+// in addresses are replaced with underscores.
+type Key struct {
+	ID       string    // random identifier of the message
+	Received time.Time // in UTC
+
+	Sender    string
+	Recipient string
+	Domain    string // lowercase domain of Recipient
+}
+
+// Sink archives messages. The members other than Message are handled by the
+// embedded ContextHandler, which decides which clients, senders and
+// recipients are accepted. A Sink can be shared by sessions.
+type Sink struct {
+	smtpd.ContextHandler
+
+	Store Store
+
+	// Template of the keys, see Key, DefaultKey if empty. A message is
+	// stored once for each distinct key of its recipients, for example
+	// once for each recipient with "{{.Recipient}}/{{.ID}}.eml".
+	KeyTemplate string
+
+	// Set to store the metadata of the transaction in JSON, see
+	// smtpd.Metadata, under the key of the message with ".json" appended
+	Metadata bool
+
+	// Directory for the temporary copy of a message that is made to
+	// determine its size, the default directory for temporary files if
+	// empty
+	TempDir string
+
+	// Optional hook called with archiving errors
+	OnError func(err error)
+}
+
+// Message archives the message, the client gets a temporary error reply when
+// archiving fails.
+func (s *Sink) Message(ctx context.Context, r io.Reader) error {
+	if _, err := s.Archive(ctx, smtpd.SessionFromContext(ctx), r); err != nil {
+		if s.OnError != nil {
+			s.OnError(err)
+		}
+		return errArchive
+	}
+	return nil
+}
+
+// Archive stores the message read from r with the envelope of the current
+// transaction of sess, and returns the keys of the stored messages.
+func (s *Sink) Archive(ctx context.Context, sess *smtpd.Session, r io.Reader) ([]string, error) {
+	tmpl, err := template.New("key").Parse(s.keyTemplate())
+	if err != nil {
+		return nil, fmt.Errorf("archive: %v", err)
+	}
+	meta := sess.Metadata(time.Now().UTC())
+	keys, err := s.keys(tmpl, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile(s.TempDir, "archive")
+	if err != nil {
+		return nil, fmt.Errorf("archive: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return nil, fmt.Errorf("archive: %v", err)
+	}
+	var metaJSON []byte
+	if s.Metadata {
+		if metaJSON, err = smtpd.MarshalMetadata(meta); err != nil {
+			return nil, fmt.Errorf("archive: %v", err)
+		}
+	}
+	for _, key := range keys {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("archive: %v", err)
+		}
+		if err := s.Store.Put(ctx, key, f, size, "message/rfc822"); err != nil {
+			return nil, fmt.Errorf("archive: %s: %v", key, err)
+		}
+		if metaJSON != nil {
+			if err := s.Store.Put(ctx, key+".json", bytes.NewReader(metaJSON), int64(len(metaJSON)), "application/json"); err != nil {
+				return nil, fmt.Errorf("archive: %s.json: %v", key, err)
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (s *Sink) keyTemplate() string {
+	if s.KeyTemplate != "" {
+		return s.KeyTemplate
+	}
+	return DefaultKey
+}
+
+// keys returns the distinct keys for the recipients of a message
+func (s *Sink) keys(tmpl *template.Template, meta *smtpd.Metadata) ([]string, error) {
+	data := Key{
+		ID:       randomID(),
+		Received: meta.Received,
+		Sender:   sanitize(meta.Envelope.Sender),
+	}
+	rcpts := meta.Envelope.Recipients
+	if len(rcpts) == 0 {
+		rcpts = []smtpd.Recipient{{}}
+	}
+	var keys []string
+	seen := make(map[string]bool)
+	for _, rcpt := range rcpts {
+		data.Recipient = sanitize(rcpt.Address)
+		data.Domain = ""
+		if i := strings.LastIndexByte(data.Recipient, '@'); i >= 0 {
+			data.Domain = strings.ToLower(data.Recipient[i+1:])
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("archive: %v", err)
+		}
+		key := b.String()
+		if key == "" {
+			return nil, errors.New("archive: empty key")
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// sanitize replaces characters of an address that are special in keys
+func sanitize(address string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, address)
+}
+
+// randomID returns a random identifier in hex
+func randomID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
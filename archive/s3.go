@@ -0,0 +1,218 @@
+package archive
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server-side encryption modes of S3
+const (
+	SSES3  = "AES256"  // with keys managed by the service
+	SSEKMS = "aws:kms" // with a key in the key management service
+)
+
+// S3 is a Store that puts objects in a bucket of an S3-compatible service
+// with requests signed with AWS Signature Version 4.
+type S3 struct {
+	// URL of the service, e.g. "https://s3.eu-west-1.amazonaws.com"
+	Endpoint string
+	Region   string // "us-east-1" if empty
+	Bucket   string
+
+	// Set to address the bucket in the path of the URL instead of the
+	// hostname, as required by most S3-compatible services
+	PathStyle bool
+
+	// Credentials, the session token is only needed for temporary
+	// credentials
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// Server-side encryption, SSES3 or SSEKMS, none if empty. KMSKeyID is
+	// the key for SSEKMS, the default key of the account if empty.
+	ServerSideEncryption string
+	KMSKeyID             string
+
+	// Storage class of the objects, e.g. "STANDARD_IA", the default of the
+	// bucket if empty
+	StorageClass string
+
+	// Client used for requests, defaults to a client with a timeout of 5
+	// minutes
+	Client *http.Client
+}
+
+// Put puts an object in the bucket. The payload is signed when r is an
+// io.ReadSeeker, otherwise it is sent unsigned.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return err
+	}
+	u := *endpoint
+	path := "/" + key
+	if s.PathStyle {
+		path = "/" + s.Bucket + path
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(endpoint.Path, "/") + path
+	u.RawPath = strings.TrimSuffix(endpoint.EscapedPath(), "/") + escapePath(path)
+
+	payloadHash := "UNSIGNED-PAYLOAD"
+	if rs, ok := r.(io.ReadSeeker); ok {
+		start, err := rs.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, io.LimitReader(rs, size)); err != nil {
+			return err
+		}
+		if _, err := rs.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		payloadHash = hex.EncodeToString(h.Sum(nil))
+	}
+
+	req, err := http.NewRequest("PUT", u.String(), ioutil.NopCloser(io.LimitReader(r, size)))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.ServerSideEncryption != "" {
+		req.Header.Set("X-Amz-Server-Side-Encryption", s.ServerSideEncryption)
+		if s.ServerSideEncryption == SSEKMS && s.KMSKeyID != "" {
+			req.Header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", s.KMSKeyID)
+		}
+	}
+	if s.StorageClass != "" {
+		req.Header.Set("X-Amz-Storage-Class", s.StorageClass)
+	}
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	s.sign(req, payloadHash, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Minute}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// sign adds the AWS Signature Version 4 of a request to its headers. The
+// host and all headers of the request are signed.
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, escape(name, true)+"="+escape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// escapePath escapes a path as required by S3, with all characters other
+// than unreserved characters and slashes encoded
+func escapePath(path string) string {
+	return escape(path, false)
+}
+
+func escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(strconv.FormatUint(uint64(c)|0x100, 16)[1:]))
+		}
+	}
+	return b.String()
+}
+
+func hashHex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,341 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// SASLMechanism is a server side SASL mechanism (RFC 4422) that can be
+// offered with AUTH by adding it to Server.SASLMechanisms.
+type SASLMechanism interface {
+	// Name returns the name of the mechanism in upper case, e.g. "PLAIN"
+	Name() string
+
+	// Start begins an authentication exchange. The context is the session
+	// context, the Session is available with SessionFromContext.
+	Start(ctx context.Context) (SASLServer, error)
+}
+
+// SASLServer is the server side of an authentication exchange.
+type SASLServer interface {
+	// Next processes a response of the client and returns the next
+	// challenge. The first call receives the initial response of the
+	// client, or nil when the client did not send one. Next returns done
+	// when authentication succeeded, a challenge returned together with done
+	// is sent to the client as additional data. Return an error to fail
+	// authentication, errors are replied as for Handler.
+	Next(response []byte) (challenge []byte, done bool, err error)
+
+	// Identity returns the authorization identity and the username after
+	// authentication succeeded. The identity is empty unless it was
+	// provided by the client.
+	Identity() (identity, username string)
+}
+
+var errAuthCancelled = errors.New("501 5.0.0 Authentication cancelled")
+
+// PasswordAuthenticator can optionally be implemented by a Handler or
+// ContextHandler to verify the password of PLAIN and LOGIN itself, for
+// example when passwords are stored hashed or checked with an LDAP bind.
+// Authenticate returns nil when the password is valid. AuthUser is then
+// only called for CRAM-MD5.
+type PasswordAuthenticator interface {
+	Authenticate(ctx context.Context, identity, username, password string) error
+}
+
+var errInvalidCredentials = errors.New("535 5.7.8 Authentication credentials invalid")
+
+// checkPassword verifies the password of PLAIN and LOGIN with the virtual
+// host, Server.Credentials, the handler's Authenticate or the password
+// returned by AuthUser
+func (s *session) checkPassword(identity, username, password string) error {
+	if s.vhost == nil || s.vhost.AuthUser == nil {
+		if s.server.Credentials != nil {
+			return s.server.Credentials.Verify(s.ctx, username, password)
+		}
+		if a, ok := s.impl.(PasswordAuthenticator); ok {
+			return a.Authenticate(s.ctx, identity, username, password)
+		}
+	}
+	expected, err := s.authUser(identity, username)
+	if err != nil {
+		return err
+	}
+	// compare digests, which unlike the passwords have a fixed length
+	got, want := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(expected))
+	if expected == "" || subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+var errAuthTemporary = errors.New("454 4.7.0 Temporary authentication failure")
+
+// authError returns the reply for a failed authentication. Failures are
+// replied alike, so that clients can not tell unknown users from wrong
+// passwords, except temporary failures of the backend and syntax errors.
+func authError(err error) error {
+	code := replyCode(err.Error())
+	switch {
+	case code >= 400 && code < 500:
+		return errAuthTemporary
+	case code >= 500 && code <= 504:
+		return err
+	}
+	return errInvalidCredentials
+}
+
+// authFailureDelay is the maximum random delay before a failed
+// authentication is replied
+var authFailureDelay = 300 * time.Millisecond
+
+// authFailed replies err, see authError, after a delay that hides timing differences between
+// failures and slows down guessing. The failure is counted by
+// Server.AuthThrottle, username is empty when not known.
+func (s *session) authFailed(username string, err error) {
+	var delay time.Duration
+	if authFailureDelay > 0 {
+		delay = time.Duration(rand.Int63n(int64(authFailureDelay)))
+	}
+	if t := s.server.AuthThrottle; t != nil {
+		delay += t.fail(s.ctx, remoteIP(s.RemoteAddr), username)
+	}
+	if m := s.server.Metrics; m != nil {
+		m.AuthFailed(s.authMech)
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-s.ctx.Done():
+			timer.Stop()
+		}
+	}
+	s.conn.ErrorReply(authError(err))
+}
+
+// userLocked returns true if the username is locked out by
+// Server.AuthThrottle. Attempts are then failed with authFailed like a wrong
+// password, so that guesses are not confirmed during the lockout.
+func (s *session) userLocked(username string) bool {
+	t := s.server.AuthThrottle
+	return t != nil && t.userLocked(username)
+}
+
+// authSucceeded completes authentication, unless the username is locked out
+// by Server.AuthThrottle. The lockout is checked again for mechanisms that
+// only know the username after verifying the credentials.
+func (s *session) authSucceeded(identity, username string) {
+	if s.userLocked(username) {
+		s.authFailed(username, errInvalidCredentials)
+		return
+	}
+	if t := s.server.AuthThrottle; t != nil {
+		t.succeed(username)
+	}
+	s.AuthIdentity = identity
+	s.AuthUsername = username
+	s.conn.Reply("235 2.7.0 OK, you are now authenticated")
+}
+
+// authMechanisms returns the names of the mechanisms offered with AUTH
+func (s *session) authMechanisms() []string {
+	if s.server.DisableAuth {
+		return nil
+	}
+	names := s.server.AuthMechanisms
+	if names == nil {
+		if s.tls {
+			names = []string{"PLAIN", "LOGIN", "EXTERNAL", "OAUTHBEARER", "XOAUTH2"}
+		} else {
+			names = []string{"CRAM-MD5"}
+		}
+		names = append(names, "SCRAM-SHA-256", "SCRAM-SHA-256-PLUS")
+		for _, m := range s.server.SASLMechanisms {
+			names = append(names, m.Name())
+		}
+	}
+	var mechs []string
+	for _, name := range names {
+		name = strings.ToUpper(name)
+		if !containsFold(mechs, name) && s.authAvailable(name) {
+			mechs = append(mechs, name)
+		}
+	}
+	return mechs
+}
+
+// defaultAuthTLSMechanisms are the built-in mechanisms that require TLS when
+// Server.AuthTLSMechanisms is nil
+var defaultAuthTLSMechanisms = []string{"PLAIN", "LOGIN", "OAUTHBEARER", "XOAUTH2"}
+
+// authRequiresTLS returns true if the mechanism may only be used with TLS,
+// added is true for a mechanism of Server.SASLMechanisms
+func (s *Server) authRequiresTLS(name string, added bool) bool {
+	if s.AuthTLSMechanisms != nil {
+		return containsFold(s.AuthTLSMechanisms, name)
+	}
+	return !added && containsFold(defaultAuthTLSMechanisms, name)
+}
+
+// authAvailable returns true if the mechanism can be used in the session
+func (s *session) authAvailable(name string) bool {
+	added := s.server.saslMechanism(name) != nil
+	if !s.tls && s.server.authRequiresTLS(name, added) {
+		return false
+	}
+	if added {
+		return true
+	}
+	switch name {
+	case "PLAIN", "LOGIN", "CRAM-MD5":
+		return true
+	case "EXTERNAL":
+		return s.canAuthExternal()
+	case "SCRAM-SHA-256":
+		_, ok := s.impl.(SCRAMAuthenticator)
+		return ok
+	case "SCRAM-SHA-256-PLUS":
+		// channel binding requires TLS
+		_, ok := s.impl.(SCRAMAuthenticator)
+		return ok && s.tls
+	case "OAUTHBEARER", "XOAUTH2":
+		_, ok := s.impl.(OAuthBearerAuthenticator)
+		return ok
+	}
+	return false
+}
+
+// containsFold returns true if list contains s ignoring case
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// saslMechanism returns the added mechanism with name, or nil
+func (s *Server) saslMechanism(name string) SASLMechanism {
+	for _, m := range s.SASLMechanisms {
+		if strings.EqualFold(m.Name(), name) {
+			return m
+		}
+	}
+	return nil
+}
+
+// authSASL runs an authentication exchange with the mechanism m, cred is
+// the initial response given with AUTH
+func (s *session) authSASL(m SASLMechanism, cred string) {
+	server, err := m.Start(s.ctx)
+	if err != nil {
+		s.conn.ErrorReply(err)
+		return
+	}
+	var response []byte // nil without initial response
+	switch cred {
+	case "":
+	case "=": // empty initial response
+		response = []byte{}
+	default:
+		response, err = base64.StdEncoding.DecodeString(cred)
+		if err != nil {
+			s.conn.Reply("501 5.5.2 Couldn't decode your credentials")
+			return
+		}
+	}
+	for {
+		challenge, done, err := server.Next(response)
+		if err != nil {
+			_, username := server.Identity()
+			s.authFailed(username, err)
+			return
+		}
+		if done && len(challenge) == 0 {
+			break
+		}
+		s.conn.Reply("334 %s", base64.StdEncoding.EncodeToString(challenge))
+		response, err = s.readAuthResp()
+		if err != nil {
+			s.conn.ErrorReply(err)
+			return
+		}
+		if done {
+			// additional data was acknowledged by the client
+			if len(response) != 0 {
+				s.conn.Reply("501 5.5.2 Unexpected response")
+				return
+			}
+			break
+		}
+	}
+	s.authSucceeded(server.Identity())
+}
+
+// ExternalAuthenticator can optionally be implemented by a Handler or
+// ContextHandler to support the EXTERNAL SASL mechanism (RFC 4422) with TLS
+// client certificates. AUTH EXTERNAL is offered when the client presented a
+// certificate that was verified with Server.TLSConfig, which must request
+// client certificates with ClientAuth set to VerifyClientCertIfGiven or
+// stricter. AuthExternal maps the certificate to the username, the identity
+// is the authorization identity requested by the client or empty.
+type ExternalAuthenticator interface {
+	AuthExternal(ctx context.Context, identity string, cert *x509.Certificate) (username string, err error)
+}
+
+// clientCert returns the verified client certificate, or nil
+func (s *session) clientCert() *x509.Certificate {
+	if s.TLS == nil || len(s.TLS.VerifiedChains) == 0 || len(s.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return s.TLS.VerifiedChains[0][0]
+}
+
+// canAuthExternal returns true if AUTH EXTERNAL can be offered
+func (s *session) canAuthExternal() bool {
+	_, ok := s.impl.(ExternalAuthenticator)
+	return ok && s.clientCert() != nil
+}
+
+func (s *session) authExternal(cred string) {
+	cert := s.clientCert()
+	a, ok := s.impl.(ExternalAuthenticator)
+	if !ok || cert == nil {
+		s.conn.Reply("504 5.5.4 AUTH EXTERNAL requires a verified client certificate")
+		return
+	}
+	var data []byte
+	var err error
+	switch cred {
+	case "":
+		s.conn.Reply("334 ")
+		data, err = s.readAuthResp()
+		if err != nil {
+			s.conn.ErrorReply(err)
+			return
+		}
+	case "=": // empty initial response
+	default:
+		data, err = base64.StdEncoding.DecodeString(cred)
+		if err != nil {
+			s.conn.Reply("501 5.5.2 Couldn't decode your credentials")
+			return
+		}
+	}
+	identity := string(data)
+	username, err := a.AuthExternal(s.ctx, identity, cert)
+	if err != nil {
+		s.authFailed(username, err)
+		return
+	}
+	s.authSucceeded(identity, username)
+}
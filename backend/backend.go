@@ -0,0 +1,283 @@
+/*
+Package backend proxies the handler calls of a server over gRPC to a remote
+service, so that the SMTP frontend and the policy and delivery logic can be
+separate services.
+
+The remote service implements the Backend service of backend.proto. Each
+call carries the session with its identifier and the metadata of the
+client and the current mail transaction, and the service replies with the
+SMTP reply to the command. The message is streamed to the service in chunks
+while it is received.
+
+The Client implements the gRPC protocol over HTTP/2 with the standard
+library. HTTP/2 is used over TLS by default, a service without TLS requires
+an HTTPClient with a transport that supports unencrypted HTTP/2.
+*/
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+)
+
+const service = "/smtpd.backend.v1.Backend/"
+
+// chunkSize is the maximum size of the message data in a chunk
+const chunkSize = 32 * 1024
+
+var errUnavailable = errors.New("451 4.3.0 Service temporarily unavailable")
+
+// Client calls a remote Backend service.
+type Client struct {
+	// URL of the service, e.g. "https://backend.example.com:8443"
+	Target string
+
+	// Client used for requests, it must support HTTP/2. Defaults to a client
+	// with the default transport, which supports HTTP/2 over TLS.
+	HTTPClient *http.Client
+
+	// Additional request headers, for example for authorization
+	Header http.Header
+
+	// Timeout of the calls other than Message, 10 seconds if zero
+	Timeout time.Duration
+
+	// Optional hook called with errors of calls, the client gets a
+	// temporary error reply when a call fails
+	OnError func(err error)
+}
+
+// NewHandler returns a handler for a session that proxies its calls, for use
+// as Server.NewContextHandler.
+func (c *Client) NewHandler() smtpd.ContextHandler {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return &handler{c: c, id: hex.EncodeToString(b)}
+}
+
+type handler struct {
+	c  *Client
+	id string
+}
+
+func (h *handler) Connect(ctx context.Context, source string) error {
+	req := appendString(h.request(ctx), 2, source)
+	return h.c.unary(ctx, "Connect", req)
+}
+
+func (h *handler) Hello(ctx context.Context, hostname string) error {
+	req := appendString(h.request(ctx), 2, hostname)
+	return h.c.unary(ctx, "Hello", req)
+}
+
+func (h *handler) AuthUser(ctx context.Context, identity, username string) (string, error) {
+	req := appendString(h.request(ctx), 2, identity)
+	req = appendString(req, 3, username)
+	fields, err := h.c.call(ctx, "Auth", req)
+	if err != nil {
+		return "", err
+	}
+	var reply []field
+	if f, ok := lookup(fields, 1); ok {
+		if reply, err = decode(f.bytes); err != nil {
+			return "", h.c.error("Auth", err)
+		}
+	}
+	if err := replyError(reply); err != nil {
+		return "", err
+	}
+	password, _ := lookup(fields, 2)
+	return string(password.bytes), nil
+}
+
+func (h *handler) Sender(ctx context.Context, address string) error {
+	req := appendString(h.request(ctx), 2, address)
+	return h.c.unary(ctx, "Sender", req)
+}
+
+func (h *handler) Recipient(ctx context.Context, address string) error {
+	req := appendString(h.request(ctx), 2, address)
+	return h.c.unary(ctx, "Recipient", req)
+}
+
+// Message streams the message to the service.
+func (h *handler) Message(ctx context.Context, r io.Reader) error {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := bufio.NewWriterSize(pw, chunkSize+16)
+		err := writeFrame(w, h.request(ctx))
+		buf := make([]byte, chunkSize)
+		for err == nil {
+			var n int
+			n, err = io.ReadFull(r, buf)
+			if n > 0 {
+				if werr := writeFrame(w, appendBytes(nil, 2, buf[:n])); werr != nil {
+					err = werr
+				}
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = w.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	fields, err := h.c.invoke(ctx, "Message", pr)
+	pr.Close() // stops streaming when the service replied early
+	<-done
+	if err != nil {
+		return err
+	}
+	return replyError(fields)
+}
+
+// request returns the start of a request, the session as field 1
+func (h *handler) request(ctx context.Context) []byte {
+	session := appendString(nil, 1, h.id)
+	if sess := smtpd.SessionFromContext(ctx); sess != nil {
+		if metadata, err := smtpd.MarshalMetadata(sess.Metadata(time.Now())); err == nil {
+			session = appendBytes(session, 2, metadata)
+		}
+	}
+	return appendBytes(nil, 1, session)
+}
+
+// unary makes a call that returns a Reply and returns the reply as error
+func (c *Client) unary(ctx context.Context, method string, req []byte) error {
+	fields, err := c.call(ctx, method, req)
+	if err != nil {
+		return err
+	}
+	return replyError(fields)
+}
+
+// call makes a unary call with the timeout of the client
+func (c *Client) call(ctx context.Context, method string, req []byte) ([]field, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var buf bytes.Buffer
+	writeFrame(&buf, req)
+	return c.invoke(ctx, method, &buf)
+}
+
+// invoke makes a call with the request frames read from body and returns
+// the fields of the response
+func (c *Client) invoke(ctx context.Context, method string, body io.Reader) ([]field, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.Target, "/") + service + method)
+	if err != nil {
+		return nil, c.error(method, err)
+	}
+	req := &http.Request{
+		Method:        "POST",
+		URL:           u,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(body),
+		ContentLength: -1,
+		Host:          u.Host,
+	}
+	req = req.WithContext(ctx)
+	for name, values := range c.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("Te", "trailers")
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set("Grpc-Timeout", fmt.Sprintf("%dm", time.Until(deadline)/time.Millisecond))
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, c.error(method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, c.error(method, fmt.Errorf("%s", resp.Status))
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, c.error(method, err)
+	}
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" { // trailers-only response
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		if msg, err := url.PathUnescape(message); err == nil {
+			message = msg
+		}
+		return nil, c.error(method, fmt.Errorf("status %s: %s", status, message))
+	}
+	if len(data) < 5 || data[0] != 0 || binary.BigEndian.Uint32(data[1:5]) != uint32(len(data)-5) {
+		return nil, c.error(method, errors.New("invalid response"))
+	}
+	fields, err := decode(data[5:])
+	if err != nil {
+		return nil, c.error(method, err)
+	}
+	return fields, nil
+}
+
+// error reports the error of a call and returns the error for the client
+func (c *Client) error(method string, err error) error {
+	if c.OnError != nil {
+		c.OnError(fmt.Errorf("backend: %s: %v", method, err))
+	}
+	return errUnavailable
+}
+
+// writeFrame writes a message with the gRPC length prefix
+func writeFrame(w io.Writer, msg []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// replyError returns the fields of a Reply as error, nil when the command is
+// accepted
+func replyError(fields []field) error {
+	var code int
+	var enhancedCode, message string
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			code = int(int32(f.varint))
+		case 2:
+			enhancedCode = string(f.bytes)
+		case 3:
+			message = string(f.bytes)
+		}
+	}
+	if code == 0 || code >= 200 && code < 300 {
+		return nil
+	}
+	if code < 400 || code > 599 {
+		return errUnavailable
+	}
+	return smtpd.NewReply(code, enhancedCode, message)
+}
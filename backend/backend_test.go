@@ -0,0 +1,159 @@
+package backend
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emailfabric/smtpd"
+)
+
+// testService implements the Backend service
+type testService struct {
+	mu       sync.Mutex
+	sessions map[string]bool
+	messages []string
+	metadata string
+}
+
+func (s *testService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc+proto" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+	var msgs [][]byte
+	for len(data) >= 5 {
+		size := binary.BigEndian.Uint32(data[1:5])
+		msgs = append(msgs, data[5:5+size])
+		data = data[5+size:]
+	}
+	fields, _ := decode(msgs[0])
+	f, _ := lookup(fields, 1)
+	session, _ := decode(f.bytes)
+	id, _ := lookup(session, 1)
+	metadata, _ := lookup(session, 2)
+	arg, _ := lookup(fields, 2)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]bool)
+	}
+	s.sessions[string(id.bytes)] = true
+
+	var reply []byte
+	switch strings.TrimPrefix(r.URL.Path, service) {
+	case "Connect", "Hello", "Sender":
+	case "Recipient":
+		if strings.HasPrefix(string(arg.bytes), "unknown@") {
+			reply = appendInt(appendString(appendString(nil, 2, "5.1.1"), 3, "No such user"), 1, 550)
+		}
+	case "Message":
+		var msg []byte
+		for _, chunk := range msgs[1:] {
+			fields, _ := decode(chunk)
+			data, _ := lookup(fields, 2)
+			msg = append(msg, data.bytes...)
+		}
+		s.messages = append(s.messages, string(msg))
+		s.metadata = string(metadata.bytes)
+		if strings.Contains(string(msg), "spam") {
+			reply = appendInt(appendString(nil, 3, "Spam"), 1, 554)
+		}
+	default:
+		w.Header().Set("Grpc-Status", "12")
+		w.Header().Set("Grpc-Message", "unimplemented")
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	w.Header().Set("Trailer", "Grpc-Status")
+	writeFrame(w, reply)
+	w.Header().Set("Grpc-Status", "0")
+}
+
+// state returns the received messages, the number of sessions and the
+// metadata of the last message
+func (s *testService) state() ([]string, int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...), len(s.sessions), s.metadata
+}
+
+func TestBackend(t *testing.T) {
+
+	service := &testService{}
+	backend := httptest.NewUnstartedServer(service)
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	var errs []error
+	c := &Client{Target: backend.URL, HTTPClient: backend.Client(), OnError: func(err error) {
+		service.mu.Lock()
+		errs = append(errs, err)
+		service.mu.Unlock()
+	}}
+	server := &smtpd.Server{NewContextHandler: c.NewHandler}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	go server.Serve(l)
+	defer server.Close()
+	send := func(rcpts []string, msg string) error {
+		return smtp.SendMail(l.Addr().String(), nil, "sender@example.com", rcpts, []byte(msg))
+	}
+
+	msg := "Subject: test\r\n\r\n" + strings.Repeat("line of the message\r\n", 5000)
+	if err := send([]string{"a@example.org"}, msg); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	messages, sessions, metadata := service.state()
+	if len(messages) != 1 || messages[0] != msg || sessions != 1 {
+		t.Fatalf("unexpected messages %d %d", len(messages), sessions)
+	}
+	if !strings.Contains(metadata, `"recipients":[{"address":"a@example.org"}]`) {
+		t.Fatalf("unexpected metadata %s", metadata)
+	}
+
+	err = send([]string{"unknown@example.org"}, msg)
+	if reply, ok := err.(*textproto.Error); !ok || reply.Code != 550 || reply.Msg != "5.1.1 No such user" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = send([]string{"a@example.org"}, "Subject: spam\r\n\r\n")
+	if reply, ok := err.(*textproto.Error); !ok || reply.Code != 554 {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// unavailable
+	backend.Close()
+	err = send([]string{"a@example.org"}, msg)
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if reply, ok := err.(*textproto.Error); !ok || reply.Code != 451 || len(errs) == 0 {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	b := appendInt(appendString(nil, 2, "text"), 1, 550)
+	b = append(b, 0x1d, 1, 2, 3, 4) // 32-bit field 3 is skipped
+	fields, err := decode(b)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(fields) != 2 || string(fields[0].bytes) != "text" || fields[1].varint != 550 {
+		t.Fatalf("unexpected fields %+v", fields)
+	}
+	if _, err := decode([]byte{0x12, 5, 'a'}); err == nil {
+		t.Fatalf("expected error for truncated field")
+	}
+}
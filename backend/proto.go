@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Protocol buffers wire encoding of the messages of backend.proto
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+var errInvalidMessage = errors.New("backend: invalid message")
+
+// field is a decoded field of a message
+type field struct {
+	num    int
+	varint uint64
+	bytes  []byte
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	return binary.AppendUvarint(b, v)
+}
+
+func appendTag(b []byte, num, wire int) []byte {
+	return appendVarint(b, uint64(num)<<3|uint64(wire))
+}
+
+// appendBytes appends a length-delimited field, omitted when empty
+func appendBytes(b []byte, num int, data []byte) []byte {
+	if len(data) == 0 {
+		return b
+	}
+	b = appendTag(b, num, wireBytes)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendString(b []byte, num int, s string) []byte {
+	return appendBytes(b, num, []byte(s))
+}
+
+// appendInt appends a varint field, omitted when zero
+func appendInt(b []byte, num int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, num, wireVarint)
+	return appendVarint(b, uint64(v))
+}
+
+// decode decodes the fields of a message, fields of other wire types than
+// varint and length-delimited are skipped
+func decode(b []byte) ([]field, error) {
+	var fields []field
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errInvalidMessage
+		}
+		b = b[n:]
+		f := field{num: int(tag >> 3)}
+		switch tag & 7 {
+		case wireVarint:
+			if f.varint, n = binary.Uvarint(b); n <= 0 {
+				return nil, errInvalidMessage
+			}
+			b = b[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return nil, errInvalidMessage
+			}
+			f.bytes = b[n : n+int(size)]
+			b = b[n+int(size):]
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return nil, errInvalidMessage
+			}
+			b = b[8:]
+			continue
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return nil, errInvalidMessage
+			}
+			b = b[4:]
+			continue
+		default:
+			return nil, errInvalidMessage
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// lookup returns the last field with a number, as protocol buffers do for
+// repeated scalar fields
+func lookup(fields []field, num int) (field, bool) {
+	for i := len(fields) - 1; i >= 0; i-- {
+		if fields[i].num == num {
+			return fields[i], true
+		}
+	}
+	return field{}, false
+}
@@ -0,0 +1,206 @@
+package smtpd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errBDATAborted is returned by the bdatReader when the client sends another
+// command instead of the next BDAT chunk
+var errBDATAborted = errors.New("554 5.5.0 Message transfer aborted")
+
+// bdatReader reads message data sent in chunks with BDAT commands (RFC 3030).
+// After a chunk is consumed, it acknowledges the chunk and reads the next
+// BDAT command from the connection, until the last chunk is consumed. Chunks
+// are passed as-is without dot unstuffing, so binary data (BODY=BINARYMIME)
+// is preserved.
+type bdatReader struct {
+	s       *session
+	n       int64 // remaining bytes of the current chunk
+	last    bool  // current chunk is the last chunk
+	size    int64 // number of message bytes consumed
+	max     int64 // fail with ErrMessageTooLarge when size exceeds max, if set
+	aborted bool  // another command was received instead of BDAT
+	err     error
+}
+
+func (r *bdatReader) Read(b []byte) (n int, err error) {
+	for r.n == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	if int64(len(b)) > r.n {
+		b = b[:r.n]
+	}
+	n, err = r.s.conn.r.R.Read(b)
+	r.n -= int64(n)
+	r.size += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		r.err = err
+	} else if r.max > 0 && r.size > r.max {
+		err = ErrMessageTooLarge
+	}
+	return n, err
+}
+
+// next acknowledges the current chunk and reads the next BDAT command
+func (r *bdatReader) next() error {
+	r.s.conn.Reply("250 2.0.0 %d octets received", r.size)
+	r.s.record("BDAT")
+	line, err := r.s.readCommand()
+	if err != nil {
+		return err
+	}
+	verb, params := split1(strings.TrimSpace(line))
+	if !strings.EqualFold(verb, "BDAT") {
+		// let the session process the command
+		r.s.pending = &line
+		r.aborted = true
+		return errBDATAborted
+	}
+	size, last, err := parseBDAT(params)
+	if err != nil {
+		r.s.conn.Reply("501 5.5.4 Syntax: BDAT size [LAST]")
+		r.s.record("BDAT")
+		r.aborted = true
+		return errBDATAborted
+	}
+	r.n = size
+	r.last = last
+	return nil
+}
+
+// discardChunk discards the remaining data of the current chunk
+func (r *bdatReader) discardChunk() {
+	if r.n > 0 && r.err == nil {
+		io.CopyN(ioutil.Discard, r.s.conn.r.R, r.n)
+		r.n = 0
+	}
+}
+
+// parseBDAT parses the arguments of the BDAT command
+func parseBDAT(params string) (size int64, last bool, err error) {
+	fields := strings.Fields(params)
+	if len(fields) < 1 || len(fields) > 2 {
+		return 0, false, errors.New("invalid BDAT arguments")
+	}
+	size, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		return 0, false, errors.New("invalid BDAT size")
+	}
+	if len(fields) == 2 {
+		if !strings.EqualFold(fields[1], "LAST") {
+			return 0, false, errors.New("invalid BDAT arguments")
+		}
+		last = true
+	}
+	return size, last, nil
+}
+
+// discardBDAT discards the chunk of a BDAT command that was not processed
+// and fails the transaction, it returns an error when the session must end
+func (s *session) discardBDAT(params string) error {
+	size, _, err := parseBDAT(params)
+	if err != nil {
+		return nil // refused by the built-in implementation as well
+	}
+	s.conn.SetReadTimeout(s.server.dataTimeout())
+	_, err = io.CopyN(ioutil.Discard, s.conn.r.R, size)
+	s.conn.SetReadTimeout(0)
+	if isTimeout(err) {
+		return s.timeout(ErrDataTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	s.reset()
+	return nil
+}
+
+// bdat receives message data in chunks and passes it to the handler as a
+// single stream, it returns an error when the session must end
+func (s *session) bdat(params string) error {
+	size, last, err := parseBDAT(params)
+	if err != nil {
+		s.conn.Reply("501 5.5.4 Syntax: BDAT size [LAST]")
+		return nil
+	}
+	if s.hasRcpt == false {
+		// the chunk is sent anyway and must be consumed
+		s.conn.SetReadTimeout(s.server.dataTimeout())
+		_, err := io.CopyN(ioutil.Discard, s.conn.r.R, size)
+		s.conn.SetReadTimeout(0)
+		if isTimeout(err) {
+			return ErrDataTimeout
+		}
+		s.conn.Reply("503 5.5.1 BDAT without RCPT TO")
+		return nil
+	}
+	start := time.Now()
+	s.server.countTransfer(1)
+	defer s.server.countTransfer(-1)
+	reader := &bdatReader{
+		s:    s,
+		n:    size,
+		last: last,
+		max:  s.server.MaxMessageSize,
+	}
+	tr := &timeoutReader{r: s.recordData(reader), conn: s.conn, timeout: s.server.dataTimeout()}
+	defer s.conn.SetReadTimeout(0)
+	err = s.handler.Message(s.ctx, s.messageReader(tr))
+	s.numMessages++
+	if tr.timedOut {
+		return ErrDataTimeout
+	}
+	if reader.aborted {
+		// the last chunk was acknowledged already
+		s.reset()
+		return nil
+	}
+	if err == nil {
+		reader.max = 0
+		io.Copy(ioutil.Discard, tr) // discard any remaining chunks
+		if tr.timedOut {
+			return ErrDataTimeout
+		}
+		if reader.aborted {
+			s.reset()
+			return nil
+		}
+		err = reader.err
+	}
+	if s.server.MaxMessageSize > 0 && reader.size > s.server.MaxMessageSize {
+		err = ErrMessageTooLarge
+	}
+	if s.server.LMTP {
+		reader.discardChunk()
+		s.lmtpReply(err)
+		s.countMessage(reader.size, start)
+		s.reset()
+		return nil
+	}
+	if err = messageError(err); err != nil {
+		// fail the transaction, any following chunks are rejected
+		reader.discardChunk()
+		s.reset()
+		s.conn.ErrorReply(err)
+		s.countMessage(reader.size, start)
+		return nil
+	}
+	s.reset()
+	s.conn.Reply("250 2.0.0 %s, %d octets received", s.acceptedReply(), reader.size)
+	s.countMessage(reader.size, start)
+	return nil
+}
@@ -0,0 +1,246 @@
+/*
+Package clamd scans messages for malware with ClamAV's clamd.
+
+A Client streams a message to clamd with the INSTREAM command. Client.Reader
+wraps the reader passed to Handler.Message, so the message is scanned while
+it is received and stored:
+
+	func (h *handler) Message(ctx context.Context, r io.Reader) error {
+		scan := h.clamd.Reader(ctx, r)
+		defer scan.Close()
+		id, err := h.store(scan)
+		if err != nil {
+			return err
+		}
+		result, err := scan.Result()
+		if err != nil {
+			return errors.New("451 4.7.0 Malware scan failed")
+		}
+		if result.Infected && result.Action == clamd.Quarantine {
+			return h.quarantine(id)
+		}
+		return result.Err()
+	}
+*/
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// Action is the action taken on infected messages.
+type Action int
+
+const (
+	// Reject refuses infected messages with a 554 reply
+	Reject Action = iota
+
+	// Quarantine accepts infected messages, the handler stores them apart
+	Quarantine
+
+	// Tag accepts infected messages, the handler adds Result.Header
+	Tag
+)
+
+// Result is the result of scanning a message.
+type Result struct {
+	Infected bool
+	Virus    string // name of the signature that matched
+	Action   Action // Client.Action for infected messages
+}
+
+// Err returns the error a handler returns to reject the message when it is
+// infected and the action is Reject, or nil.
+func (r *Result) Err() error {
+	if !r.Infected || r.Action != Reject {
+		return nil
+	}
+	return fmt.Errorf("554 5.7.1 Message contains malware (%s)", r.Virus)
+}
+
+// Header returns an X-Virus-Status header field with the result, including
+// CRLF, for tagging the message.
+func (r *Result) Header() string {
+	if r.Infected {
+		return "X-Virus-Status: Infected (" + r.Virus + ")\r\n"
+	}
+	return "X-Virus-Status: Clean\r\n"
+}
+
+// Client is a clamd client. A Client can be shared by sessions, each scan
+// uses a new connection.
+type Client struct {
+	// Network and address of clamd, "tcp" and "localhost:3310" if empty.
+	// The network can be "unix" with the path of a socket as address.
+	Network string
+	Address string
+
+	// Action on infected messages
+	Action Action
+
+	// Maximum time to connect, send a chunk of data to clamd and to wait
+	// for the result, 30 seconds if zero
+	Timeout time.Duration
+
+	// Dial connects to clamd, defaults to net.Dialer.DialContext
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return 30 * time.Second
+}
+
+// Scan scans the message read from r.
+func (c *Client) Scan(ctx context.Context, r io.Reader) (*Result, error) {
+	return c.Reader(ctx, r).Result()
+}
+
+// Reader returns a reader that passes the data read from r and streams it
+// to clamd.
+func (c *Client) Reader(ctx context.Context, r io.Reader) *Reader {
+	return &Reader{c: c, ctx: ctx, r: r}
+}
+
+// Reader reads a message and scans it.
+type Reader struct {
+	c    *Client
+	ctx  context.Context
+	r    io.Reader
+	conn net.Conn
+	err  error // first error talking to clamd
+	eof  bool
+}
+
+// Read reads message data from the underlying reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 && r.err == nil {
+		r.err = r.send(p[:n])
+	}
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// send sends a chunk of data, the connection is opened with the first chunk
+func (r *Reader) send(p []byte) error {
+	if r.conn == nil {
+		if err := r.dial(); err != nil {
+			return err
+		}
+	}
+	r.conn.SetWriteDeadline(time.Now().Add(r.c.timeout()))
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(p)))
+	if _, err := r.conn.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := r.conn.Write(p)
+	return err
+}
+
+// dial connects to clamd and starts the INSTREAM command
+func (r *Reader) dial() error {
+	network, address := r.c.Network, r.c.Address
+	if network == "" {
+		network = "tcp"
+	}
+	if address == "" {
+		address = "localhost:3310"
+	}
+	dial := r.c.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, r.c.timeout())
+	defer cancel()
+	conn, err := dial(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.conn.SetWriteDeadline(time.Now().Add(r.c.timeout()))
+	_, err = io.WriteString(r.conn, "zINSTREAM\x00")
+	return err
+}
+
+// Result reads the rest of the message and returns the scan result. An
+// error is returned when the message could not be scanned.
+func (r *Reader) Result() (*Result, error) {
+	if !r.eof {
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			r.close()
+			return nil, fmt.Errorf("clamd: %v", err)
+		}
+	}
+	if r.err == nil && r.conn == nil {
+		r.err = r.dial() // empty message
+	}
+	if r.err == nil {
+		r.err = r.send(nil) // end of stream
+	}
+	if r.err != nil {
+		r.close()
+		return nil, fmt.Errorf("clamd: %v", r.err)
+	}
+	defer r.close()
+	r.conn.SetReadDeadline(time.Now().Add(r.c.timeout()))
+	reply, err := bufio.NewReader(r.conn).ReadString(0)
+	if err != nil {
+		return nil, fmt.Errorf("clamd: %v", err)
+	}
+	result, err := parseReply(strings.TrimSuffix(reply, "\x00"))
+	if err != nil {
+		return nil, fmt.Errorf("clamd: %v", err)
+	}
+	if result.Infected {
+		result.Action = r.c.Action
+	}
+	return result, nil
+}
+
+var errClosed = errors.New("reader closed")
+
+// Close closes the connection to clamd, for example when the message could
+// not be stored and Result is not called. Result fails after Close, Close
+// can be called after Result.
+func (r *Reader) Close() error {
+	r.close()
+	if r.err == nil {
+		r.err = errClosed
+	}
+	return nil
+}
+
+func (r *Reader) close() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+}
+
+// parseReply parses a reply like "stream: OK" or "stream: Eicar-Signature
+// FOUND"
+func parseReply(reply string) (*Result, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return &Result{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return &Result{Infected: true, Virus: strings.TrimSuffix(reply, " FOUND")}, nil
+	}
+	return nil, errors.New(reply)
+}
@@ -0,0 +1,149 @@
+package clamd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// serveClamd answers INSTREAM requests on l, streams containing "EICAR"
+// are infected
+func serveClamd(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+				io.WriteString(conn, "UNKNOWN COMMAND\x00")
+				return
+			}
+			var data bytes.Buffer
+			for {
+				var size uint32
+				if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+					return
+				}
+				if size == 0 {
+					break
+				}
+				if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+					return
+				}
+			}
+			if bytes.Contains(data.Bytes(), []byte("EICAR")) {
+				io.WriteString(conn, "stream: Eicar-Signature FOUND\x00")
+			} else {
+				io.WriteString(conn, "stream: OK\x00")
+			}
+		}()
+	}
+}
+
+func TestReader(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer l.Close()
+	go serveClamd(l)
+	c := &Client{Address: l.Addr().String(), Action: Quarantine}
+	ctx := context.Background()
+
+	const clean = "Subject: test\r\n\r\nHello\r\n"
+	r := c.Reader(ctx, iotest.OneByteReader(strings.NewReader(clean)))
+	if data, _ := ioutil.ReadAll(r); string(data) != clean {
+		t.Fatalf("unexpected data %q", data)
+	}
+	result, err := r.Result()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if result.Infected || result.Err() != nil || result.Header() != "X-Virus-Status: Clean\r\n" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	// the rest of the message is read by Result
+	r = c.Reader(ctx, strings.NewReader("Subject: test\r\n\r\nEICAR\r\n"))
+	io.CopyN(ioutil.Discard, r, 5)
+	if result, err = r.Result(); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !result.Infected || result.Virus != "Eicar-Signature" || result.Action != Quarantine || result.Err() != nil {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	c.Action = Reject
+	if result, err = c.Scan(ctx, strings.NewReader("EICAR")); err != nil || result.Err() == nil {
+		t.Fatalf("unexpected result %+v %v", result, err)
+	}
+	if err := result.Err(); err.Error() != "554 5.7.1 Message contains malware (Eicar-Signature)" {
+		t.Fatalf("unexpected error %q", err.Error())
+	}
+
+	if result, err = c.Scan(ctx, strings.NewReader("")); err != nil || result.Infected {
+		t.Fatalf("unexpected result %+v %v", result, err)
+	}
+
+	l.Close()
+	if _, err = c.Scan(ctx, strings.NewReader(clean)); err == nil {
+		t.Fatalf("expected error without clamd")
+	}
+}
+
+// closeConn records that a connection was closed
+type closeConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c *closeConn) Close() error {
+	close(c.closed)
+	return c.Conn.Close()
+}
+
+func TestReaderClose(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer l.Close()
+	go serveClamd(l)
+	closed := make(chan struct{})
+	c := &Client{
+		Address: l.Addr().String(),
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return &closeConn{Conn: conn, closed: closed}, nil
+		},
+	}
+
+	// message not completely read, e.g. when storing it failed
+	r := c.Reader(context.Background(), strings.NewReader("Subject: test\r\n\r\nHello\r\n"))
+	io.CopyN(ioutil.Discard, r, 5)
+	r.Close()
+	select {
+	case <-closed:
+	default:
+		t.Fatalf("connection not closed")
+	}
+	if _, err := r.Result(); err == nil {
+		t.Fatalf("expected error after Close")
+	}
+	r.Close()
+}
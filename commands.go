@@ -0,0 +1,224 @@
+package smtpd
+
+import (
+	"context"
+	"strings"
+)
+
+// DefaultVerifyReply is the reply to VRFY when the handler does not verify
+// addresses and Server.VerifyReply is not set.
+const DefaultVerifyReply = "252 2.5.0 Cannot VRFY user, but will accept message and attempt delivery"
+
+// Verifier can optionally be implemented by a Handler or ContextHandler to
+// answer VRFY commands. Verify returns the mailbox for the address, usually
+// in the form "Full Name <user@example.com>", which is returned in a 250
+// reply. Return an error to reply otherwise, for example a Reply with code 252
+// when the address cannot be verified or 550 when it does not exist.
+type Verifier interface {
+	Verify(ctx context.Context, address string) (string, error)
+}
+
+func (s *session) vrfy(params string) {
+	if params == "" {
+		s.conn.Reply("501 5.5.4 Syntax: VRFY address")
+		return
+	}
+	v, ok := s.impl.(Verifier)
+	if !ok {
+		reply := s.server.VerifyReply
+		if reply == "" {
+			reply = DefaultVerifyReply
+		}
+		s.conn.Reply("%s", reply)
+		return
+	}
+	addr, _ := parsePath(params)
+	mailbox, err := v.Verify(s.ctx, addr)
+	if err != nil {
+		s.conn.ErrorReply(err)
+		return
+	}
+	s.conn.Reply("250 2.1.5 %s", mailbox)
+}
+
+// Expander can optionally be implemented by a Handler or ContextHandler to
+// answer EXPN commands. Expand returns the members of the mailing list, each
+// usually in the form "Full Name <user@example.com>", which are returned in a
+// multiline 250 reply. Return an error to reply otherwise, for example a Reply
+// with code 550 when the list does not exist. EXPN is rejected with 502 when
+// the handler does not implement Expander.
+type Expander interface {
+	Expand(ctx context.Context, list string) ([]string, error)
+}
+
+func (s *session) expn(params string) {
+	e, ok := s.impl.(Expander)
+	if !ok {
+		s.conn.Reply("502 5.5.1 EXPN not supported")
+		return
+	}
+	if params == "" {
+		s.conn.Reply("501 5.5.4 Syntax: EXPN list")
+		return
+	}
+	members, err := e.Expand(s.ctx, params)
+	if err != nil {
+		s.conn.ErrorReply(err)
+		return
+	}
+	if len(members) == 0 {
+		s.conn.Reply("550 5.1.1 List has no members")
+		return
+	}
+	lines := make([]string, len(members))
+	for i, member := range members {
+		lines[i] = "2.1.5 " + member
+	}
+	s.conn.MultiLineReply(250, lines...)
+}
+
+// Helper can optionally be implemented by a Handler or ContextHandler to
+// answer HELP commands. Help returns the lines of the 214 reply for the
+// topic, which is upper case and empty when HELP was given without argument.
+// Return nil lines to fall back to Server.HelpTopics and the default help
+// text, or an error to reply otherwise.
+type Helper interface {
+	Help(ctx context.Context, topic string) ([]string, error)
+}
+
+// commands returns the commands supported by the session
+func (s *session) commands() []string {
+	cmds := []string{"HELO", "EHLO"}
+	if s.server.LMTP {
+		cmds = []string{"LHLO"}
+	}
+	if s.server.TLSConfig != nil && s.tls == false {
+		cmds = append(cmds, "STARTTLS")
+	}
+	if !s.server.DisableAuth {
+		cmds = append(cmds, "AUTH")
+	}
+	cmds = append(cmds, "MAIL", "RCPT", "DATA", "BDAT", "RSET", "VRFY")
+	if _, ok := s.impl.(Expander); ok {
+		cmds = append(cmds, "EXPN")
+	}
+	if _, ok := s.impl.(QueueFlusher); ok {
+		cmds = append(cmds, "ETRN")
+	}
+	if s.server.trusted(s.netConn.RemoteAddr()) {
+		cmds = append(cmds, "XCLIENT", "XFORWARD")
+	}
+	supported := cmds[:0]
+	for _, cmd := range cmds {
+		if ext, ok := commandExtensions[cmd]; !ok || !s.server.disabled(ext) {
+			supported = append(supported, cmd)
+		}
+	}
+	return append(supported, "HELP", "NOOP", "QUIT")
+}
+
+func (s *session) help(params string) {
+	topic := strings.ToUpper(strings.TrimSpace(params))
+	if h, ok := s.impl.(Helper); ok {
+		lines, err := h.Help(s.ctx, topic)
+		if err != nil {
+			s.conn.ErrorReply(err)
+			return
+		}
+		if len(lines) > 0 {
+			s.conn.MultiLineReply(214, withHelpCode(lines)...)
+			return
+		}
+	}
+	if text, ok := s.server.HelpTopics[topic]; ok {
+		s.conn.MultiLineReply(214, withHelpCode(strings.Split(text, "\n"))...)
+		return
+	}
+	if topic != "" {
+		s.conn.Reply("504 5.5.4 No help available for %s", topic)
+		return
+	}
+	s.conn.MultiLineReply(214,
+		"2.0.0 Supported commands:",
+		"2.0.0 "+strings.Join(s.commands(), " "))
+}
+
+// withHelpCode prefixes lines of help text with the enhanced status code
+func withHelpCode(lines []string) []string {
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		out[i] = "2.0.0 " + line
+	}
+	return out
+}
+
+// NoopHandler can optionally be implemented by a Handler or ContextHandler to
+// be notified of NOOP commands, for example to reset idle time accounting.
+// Return an error to reply otherwise than 250.
+type NoopHandler interface {
+	Noop(ctx context.Context) error
+}
+
+func (s *session) noop() {
+	if h, ok := s.impl.(NoopHandler); ok {
+		if err := h.Noop(s.ctx); err != nil {
+			s.conn.ErrorReply(err)
+			return
+		}
+	}
+	s.conn.Reply("250 2.0.0 OK")
+}
+
+// QueueFlusher can optionally be implemented by a Handler or ContextHandler to
+// support ETRN (RFC 1985). ETRN is advertised when the handler implements
+// QueueFlusher. FlushQueue is called with the node given by the client, which
+// is a domain, a domain prefixed with "@" to include subdomains, or a queue
+// name prefixed with "#". It should start delivery of the queued messages and
+// return without waiting for delivery to complete. A nil error is replied with
+// 250, return a Reply to reply with 251 (no messages waiting), 252 or 253
+// (messages pending), 458 (unable to queue messages) or 459 (node not
+// allowed).
+type QueueFlusher interface {
+	FlushQueue(ctx context.Context, node string) error
+}
+
+func (s *session) etrn(params string) {
+	f, ok := s.impl.(QueueFlusher)
+	if !ok {
+		s.conn.Reply("502 5.5.1 ETRN not supported")
+		return
+	}
+	node := strings.TrimSpace(params)
+	if !validNode(node) {
+		s.conn.Reply("501 5.5.4 Syntax: ETRN node")
+		return
+	}
+	if err := f.FlushQueue(s.ctx, node); err != nil {
+		s.conn.ErrorReply(err)
+		return
+	}
+	s.conn.Reply("250 2.0.0 Queuing for node %s started", node)
+}
+
+// validNode checks the syntax of the ETRN argument
+func validNode(node string) bool {
+	if strings.HasPrefix(node, "#") {
+		return len(node) > 1 && strings.IndexAny(node, " \t") == -1
+	}
+	node = strings.TrimPrefix(node, "@")
+	if node == "" {
+		return false
+	}
+	for _, label := range strings.Split(node, ".") {
+		if label == "" {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
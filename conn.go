@@ -2,44 +2,120 @@ package smtpd
 
 import (
 	"bufio"
-	//"bytes"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/textproto"
 	"strings"
+	"time"
 	"unicode"
 )
 
 // conn represents a connection to the smtp server
 type conn struct {
+	c net.Conn
 	r *textproto.Reader
 	//r *bufio.Reader
 	w *bufio.Writer
+	// status code of the last reply
+	code int
+	// delay flushing replies while pipelined commands are buffered
+	pipelining bool
+	// maximum time to send buffered replies, zero means no timeout
+	writeTimeout time.Duration
+	// read deadlines are not set beyond the end of the session, if set
+	deadline time.Time
+	// maximum length of a line including CRLF, zero means no limit
+	maxLine int
+	// number of replies to invalid commands, each delayed by errorDelay
+	// times the number of errors
+	errors     int
+	errorDelay time.Duration
 }
 
-func newConn(c net.Conn) *conn {
-	var r io.Reader
-	var w io.Writer
-	if Debug {
-		r = io.TeeReader(c, new(logReadWriter))
-		w = io.MultiWriter(c, new(logWriter))
-	} else {
-		r = c
-		w = c
-	}
+// newConn returns a conn for c that reads from r and writes to w, which
+// may tee the data of c
+func newConn(c net.Conn, r io.Reader, w io.Writer, pipelining bool) *conn {
 	//reader := bufio.NewReader(r)
 	reader := textproto.NewReader(bufio.NewReader(r))
 	writer := bufio.NewWriter(w)
-	return &conn{reader, writer}
+	return &conn{c: c, r: reader, w: writer, pipelining: pipelining}
+}
+
+// bufferedConn is a net.Conn that first returns data buffered by r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// SetReadTimeout sets the deadline for subsequent reads. A zero timeout
+// clears the deadline. The deadline is limited to the end of the session.
+func (c *conn) SetReadTimeout(timeout time.Duration) error {
+	var t time.Time
+	if timeout != 0 {
+		t = time.Now().Add(timeout)
+	}
+	if !c.deadline.IsZero() && (t.IsZero() || c.deadline.Before(t)) {
+		t = c.deadline
+	}
+	return c.c.SetReadDeadline(t)
 }
 
 // ReadLine reads a single line from c, without the final \n or \r\n.
+// Pending replies are flushed when the read would block.
 func (c *conn) ReadLine() (string, error) {
-	//line, err := h.readLineSlice()
-	//return string(line), err
-	return c.r.ReadLine()
+	if c.r.R.Buffered() == 0 {
+		if err := c.Flush(); err != nil {
+			return "", err
+		}
+	}
+	return c.readLine()
+}
+
+var errLineTooLong = errors.New("500 5.5.2 Line too long")
+
+// readLine reads a line of at most maxLine bytes including the line ending,
+// longer lines are consumed and errLineTooLong is returned
+func (c *conn) readLine() (string, error) {
+	if c.maxLine <= 0 {
+		return c.r.ReadLine()
+	}
+	var line []byte
+	tooLong := false
+	for {
+		b, err := c.r.R.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(b) > c.maxLine {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, b...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	if tooLong {
+		return "", errLineTooLong
+	}
+	line = bytes.TrimSuffix(line, []byte{'\n'})
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	return string(line), nil
 }
 
 // DotReader returns a new io.Reader. The Reader's Read method
@@ -94,10 +170,11 @@ var crlf = []byte{'\r', '\n'}
 
 // Reply writes the formatted output followed by \r\n.
 func (c *conn) Reply(format string, args ...interface{}) error {
-	fmt.Fprintf(c.w, format, args...)
+	msg := fmt.Sprintf(format, args...)
+	c.setCode(replyCode(msg))
+	c.w.WriteString(msg)
 	c.w.Write(crlf)
-	// TODO: reset write deadline and read deadline
-	return c.w.Flush()
+	return c.flush()
 }
 
 func (c *conn) ErrorReply(err error) error {
@@ -106,44 +183,100 @@ func (c *conn) ErrorReply(err error) error {
 	if strings.IndexFunc(msg, func(r rune) bool {
 		return unicode.IsNumber(r) == false
 	}) == 3 {
-		fmt.Fprintf(c.w, "%s\r\n", msg)
+		c.setCode(replyCode(msg))
+		fmt.Fprintf(c.w, "%s\r\n", withEnhancedCode(msg))
 	} else {
-		fmt.Fprintf(c.w, "451 Requested action aborted: %s\r\n", msg)
+		c.setCode(451)
+		fmt.Fprintf(c.w, "451 4.3.0 Requested action aborted: %s\r\n", msg)
 	}
-	return c.w.Flush()
+	return c.flush()
 }
 
 func (c *conn) MultiLineReply(status int, args ...string) error {
+	c.setCode(status)
 	i := 0
 	for ; i < len(args)-1; i++ {
 		fmt.Fprintf(c.w, "%d-%s\r\n", status, args[i])
 	}
 	fmt.Fprintf(c.w, "%d %s\r\n", status, args[i])
+	return c.flush()
+}
+
+// setCode sets the status code of the reply being sent. Replies to invalid
+// commands are counted and delayed with an increasing delay.
+func (c *conn) setCode(code int) {
+	c.code = code
+	if code == 500 || code == 501 || code == 503 {
+		c.errors++
+		if c.errorDelay > 0 {
+			time.Sleep(time.Duration(c.errors) * c.errorDelay)
+		}
+	}
+}
+
+// replyCode returns the status code at the start of a reply or 0 if the reply
+// does not start with three digits
+func replyCode(msg string) int {
+	if len(msg) < 3 {
+		return 0
+	}
+	code := 0
+	for i := 0; i < 3; i++ {
+		if msg[i] < '0' || msg[i] > '9' {
+			return 0
+		}
+		code = code*10 + int(msg[i]-'0')
+	}
+	return code
+}
+
+// flush writes buffered replies to the connection. With pipelining, replies
+// are kept in the buffer while more commands are available for reading, so
+// the replies to a batch of commands are sent together.
+func (c *conn) flush() error {
+	if c.pipelining && c.r.R.Buffered() > 0 {
+		return nil
+	}
+	return c.Flush()
+}
+
+// Flush writes any buffered replies to the connection. It must be called at
+// synchronization points where the client waits for a reply before sending
+// more data.
+func (c *conn) Flush() error {
+	if c.writeTimeout > 0 && c.w.Buffered() > 0 {
+		c.c.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
 	return c.w.Flush()
 }
 
-// logReadWriter writes each read line preceded with "-> "
+// logReadWriter writes each read line preceded with the session ID and "-> "
 type logReadWriter struct {
-	total int
+	logger *log.Logger
+	id     string
+	total  int
 }
 
 func (w *logReadWriter) Write(p []byte) (n int, err error) {
 	// split on intermediate CRLFs (not trailing CRLF)
 	lines := strings.Split(strings.TrimSuffix(string(p), "\r\n"), "\r\n")
 	for _, l := range lines {
-		log.Printf("-> %s", l)
+		w.logger.Printf("%s: -> %s", w.id, l)
 	}
 	w.total += len(p)
 	return len(p), nil
 }
 
-// logWriter writes each line preceded with "<- "
-type logWriter struct{}
+// logWriter writes each line preceded with the session ID and "<- "
+type logWriter struct {
+	logger *log.Logger
+	id     string
+}
 
 func (w *logWriter) Write(p []byte) (n int, err error) {
 	lines := strings.Split(strings.TrimSuffix(string(p), "\r\n"), "\r\n")
 	for _, l := range lines {
-		log.Printf("<- %s", l)
+		w.logger.Printf("%s: <- %s", w.id, l)
 	}
 	return len(p), nil
 }
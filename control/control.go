@@ -0,0 +1,136 @@
+/*
+Package control serves a control channel for operating a running server
+without restarting it, usually on a unix socket that is only accessible to
+the administrators:
+
+	l, err := smtpd.ListenUnix("/run/smtpd/control.sock", 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go control.Serve(l, server)
+
+The control channel is a line based text protocol. The reply to each
+command ends with a line "OK", or "ERR" followed by a message, which may be
+preceded by lines of output. The commands are:
+
+	SESSIONS          list the active sessions, one per line with the ID,
+	                  remote address, start time, HELO hostname, user, TLS,
+	                  transaction in progress and number of commands
+	KILL id           close the connection of a session
+	DRAIN [seconds]   shut down the server gracefully, see Server.Shutdown,
+	                  and close the remaining sessions after seconds if given
+	STATS             the statistics of the server in JSON, see Server.Stats
+	QUIT              close the control connection
+
+Empty fields of sessions are given as "-".
+*/
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+)
+
+// Serve accepts connections on l and serves the control channel of server
+// until l is closed.
+func Serve(l net.Listener, server *smtpd.Server) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go ServeConn(conn, server)
+	}
+}
+
+// ServeConn serves the control channel of server on conn and closes conn.
+func ServeConn(conn net.Conn, server *smtpd.Server) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb, arg := split(strings.TrimSpace(line))
+		if verb == "QUIT" {
+			fmt.Fprintf(w, "OK\n")
+			w.Flush()
+			return
+		}
+		if err := command(w, server, verb, arg); err != nil {
+			fmt.Fprintf(w, "ERR %v\n", err)
+		} else {
+			fmt.Fprintf(w, "OK\n")
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// command runs a command and writes its output to w
+func command(w *bufio.Writer, server *smtpd.Server, verb, arg string) error {
+	switch verb {
+	case "SESSIONS":
+		for _, info := range server.Sessions() {
+			fmt.Fprintf(w, "%s %s %s %s %s %t %t %d\n", info.ID, info.RemoteAddr,
+				info.Start.UTC().Format(time.RFC3339), field(info.Helo), field(info.AuthUsername),
+				info.TLS, info.Transaction, info.Commands)
+		}
+	case "KILL":
+		if arg == "" {
+			return fmt.Errorf("usage: KILL id")
+		}
+		if !server.KillSession(arg) {
+			return fmt.Errorf("no session %s", arg)
+		}
+	case "DRAIN":
+		ctx := context.Background()
+		if arg != "" {
+			seconds, err := strconv.Atoi(arg)
+			if err != nil || seconds < 0 {
+				return fmt.Errorf("usage: DRAIN [seconds]")
+			}
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+			defer cancel()
+		}
+		return server.Shutdown(ctx)
+	case "STATS":
+		data, err := json.Marshal(server.Stats())
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	default:
+		return fmt.Errorf("unknown command %q", verb)
+	}
+	return nil
+}
+
+// split splits a line into the verb in upper case and the argument
+func split(line string) (verb, arg string) {
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		line, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	return strings.ToUpper(line), arg
+}
+
+// field returns s or "-" when s is empty
+func field(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,124 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+)
+
+type testHandler struct{}
+
+func (testHandler) Connect(source string) error    { return nil }
+func (testHandler) Hello(hostname string) error    { return nil }
+func (testHandler) Sender(address string) error    { return nil }
+func (testHandler) Recipient(address string) error { return nil }
+func (testHandler) Message(r io.Reader) error      { return nil }
+func (testHandler) AuthUser(identity, username string) (string, error) {
+	return "", fmt.Errorf("535 5.7.8 Authentication failed")
+}
+
+// control sends a command and returns the output and the status line
+func control(t *testing.T, r *bufio.Reader, w net.Conn, command string) ([]string, string) {
+	t.Helper()
+	fmt.Fprintf(w, "%s\n", command)
+	var output []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "OK" || strings.HasPrefix(line, "ERR ") {
+			return output, line
+		}
+		output = append(output, line)
+	}
+}
+
+func TestControl(t *testing.T) {
+
+	server := &smtpd.Server{NewHandler: func() smtpd.Handler { return testHandler{} }}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(l)
+	}()
+
+	client, err := textproto.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer client.Close()
+	if _, _, err := client.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	client.PrintfLine("EHLO client.example.com")
+	if _, _, err := client.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	c, s := net.Pipe()
+	defer c.Close()
+	go ServeConn(s, server)
+	r := bufio.NewReader(c)
+
+	output, status := control(t, r, c, "sessions")
+	if status != "OK" || len(output) != 1 {
+		t.Fatalf("unexpected sessions %v %s", output, status)
+	}
+	fields := strings.Fields(output[0])
+	if len(fields) != 8 || fields[3] != "client.example.com" || fields[4] != "-" || fields[7] != "1" {
+		t.Fatalf("unexpected session %q", output[0])
+	}
+
+	output, status = control(t, r, c, "STATS")
+	var stats smtpd.Stats
+	if status != "OK" || len(output) != 1 {
+		t.Fatalf("unexpected stats %v %s", output, status)
+	}
+	if err := json.Unmarshal([]byte(output[0]), &stats); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if stats.Connections != 1 || stats.Replies[250] != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if _, status := control(t, r, c, "KILL unknown"); status != "ERR no session unknown" {
+		t.Fatalf("unexpected status %s", status)
+	}
+	if _, status := control(t, r, c, "KILL "+fields[0]); status != "OK" {
+		t.Fatalf("unexpected status %s", status)
+	}
+	client.R.ReadString('\n') // wait for the connection to close
+	deadline := time.Now().Add(time.Second)
+	for len(server.Sessions()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sessions := server.Sessions(); len(sessions) != 0 {
+		t.Fatalf("unexpected sessions %v", sessions)
+	}
+
+	if _, status := control(t, r, c, "FOO"); status != `ERR unknown command "FOO"` {
+		t.Fatalf("unexpected status %s", status)
+	}
+	if _, status := control(t, r, c, "DRAIN 1"); status != "OK" {
+		t.Fatalf("unexpected status %s", status)
+	}
+	if err := <-served; err != smtpd.ErrServerClosed {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, status := control(t, r, c, "QUIT"); status != "OK" {
+		t.Fatalf("unexpected status %s", status)
+	}
+}
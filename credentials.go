@@ -0,0 +1,129 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// CredentialStore verifies the passwords of PLAIN and LOGIN when set as
+// Server.Credentials. Verify returns nil when the password is valid.
+type CredentialStore interface {
+	Verify(ctx context.Context, username, password string) error
+}
+
+// StaticCredentials is a CredentialStore of plaintext passwords by username.
+type StaticCredentials map[string]string
+
+// Verify implements CredentialStore.
+func (c StaticCredentials) Verify(ctx context.Context, username, password string) error {
+	expected, ok := c[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+// PasswordScheme verifies passwords against hashes of one format.
+type PasswordScheme interface {
+	// Match returns true if the hash has the format of the scheme
+	Match(hash string) bool
+
+	// Compare returns nil if the password matches the hash
+	Compare(hash, password string) error
+}
+
+// HashedCredentials is a CredentialStore of password hashes, e.g. bcrypt or
+// argon2id, verified with the first matching scheme.
+type HashedCredentials struct {
+	// Hashes by username, used when Lookup is nil
+	Hashes map[string]string
+
+	// Lookup returns the hash of a user, an empty hash when the user does
+	// not exist
+	Lookup func(ctx context.Context, username string) (hash string, err error)
+
+	Schemes []PasswordScheme
+}
+
+// Verify implements CredentialStore.
+func (c *HashedCredentials) Verify(ctx context.Context, username, password string) error {
+	var hash string
+	if c.Lookup != nil {
+		var err error
+		if hash, err = c.Lookup(ctx, username); err != nil {
+			return err
+		}
+	} else {
+		hash = c.Hashes[username]
+	}
+	if hash == "" {
+		return errInvalidCredentials
+	}
+	for _, scheme := range c.Schemes {
+		if scheme.Match(hash) {
+			if scheme.Compare(hash, password) != nil {
+				return errInvalidCredentials
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("454 4.7.0 Unsupported password hash for %s", username)
+}
+
+// BcryptScheme returns a scheme for bcrypt hashes ("$2a$", "$2b$" or
+// "$2y$") with a compare function, e.g. bcrypt.CompareHashAndPassword of
+// golang.org/x/crypto/bcrypt.
+func BcryptScheme(compare func(hash, password []byte) error) PasswordScheme {
+	return bcryptScheme(compare)
+}
+
+type bcryptScheme func(hash, password []byte) error
+
+func (s bcryptScheme) Match(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (s bcryptScheme) Compare(hash, password string) error {
+	return s([]byte(hash), []byte(password))
+}
+
+// Argon2Scheme returns a scheme for argon2id hashes in the PHC string format,
+// e.g. "$argon2id$v=19$m=65536,t=3,p=4$salt$hash", with a key derivation
+// function, e.g. argon2.IDKey of golang.org/x/crypto/argon2.
+func Argon2Scheme(idKey func(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte) PasswordScheme {
+	return argon2Scheme(idKey)
+}
+
+type argon2Scheme func(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte
+
+func (s argon2Scheme) Match(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (s argon2Scheme) Compare(hash, password string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != "v=19" {
+		return errInvalidCredentials
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return errInvalidCredentials
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return errInvalidCredentials
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return errInvalidCredentials
+	}
+	derived := s([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(derived, key) != 1 {
+		return errInvalidCredentials
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// fakeIDKey stands in for argon2.IDKey
+func fakeIDKey(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%d|%d", password, salt, time, memory, threads)))
+	return sum[:keyLen]
+}
+
+func TestHashedCredentials(t *testing.T) {
+
+	salt := []byte("somesalt")
+	key := fakeIDKey([]byte("secret"), salt, 3, 65536, 4, 32)
+	argon := fmt.Sprintf("$argon2id$v=19$m=65536,t=3,p=4$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	store := &HashedCredentials{
+		Hashes: map[string]string{
+			"argon@example.com":  argon,
+			"bcrypt@example.com": "$2a$10$secret",
+			"md5@example.com":    "$1$secret",
+		},
+		Schemes: []PasswordScheme{
+			BcryptScheme(func(hash, password []byte) error {
+				if string(hash) != "$2a$10$"+string(password) {
+					return errors.New("mismatch")
+				}
+				return nil
+			}),
+			Argon2Scheme(fakeIDKey),
+		},
+	}
+	tests := []struct {
+		username string
+		password string
+		valid    bool
+	}{
+		{"argon@example.com", "secret", true},
+		{"argon@example.com", "wrong", false},
+		{"bcrypt@example.com", "secret", true},
+		{"bcrypt@example.com", "wrong", false},
+		{"md5@example.com", "secret", false},
+		{"unknown@example.com", "secret", false},
+	}
+	for _, test := range tests {
+		err := store.Verify(context.Background(), test.username, test.password)
+		if (err == nil) != test.valid {
+			t.Errorf("%s %s: unexpected error %v", test.username, test.password, err)
+		}
+	}
+
+	static := StaticCredentials{"user@example.com": "secret"}
+	if static.Verify(context.Background(), "user@example.com", "secret") != nil ||
+		static.Verify(context.Background(), "user@example.com", "password") == nil {
+		t.Fatalf("unexpected static credentials result")
+	}
+}
@@ -0,0 +1,87 @@
+package smtpd
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// watch detects a disconnect of the client while a handler call runs, and
+// then cancels the context of the session. The connection must not be read
+// until the returned function is called to stop watching. Data sent by the
+// client in the meantime, e.g. pipelined commands, remains buffered.
+func (s *session) watch() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := s.conn.r.R.Peek(1); err != nil && !isTimeout(err) {
+			s.cancel()
+		}
+	}()
+	return func() {
+		s.conn.c.SetReadDeadline(time.Now()) // interrupt Peek
+		<-done
+		s.conn.SetReadTimeout(0)
+	}
+}
+
+// watchedHandler is a ContextHandler that watches the connection for a
+// disconnect while the members of the handler of the application run
+type watchedHandler struct {
+	ContextHandler
+	s *session
+}
+
+func (h watchedHandler) Connect(ctx context.Context, source string) error {
+	defer h.s.watch()()
+	return h.ContextHandler.Connect(ctx, source)
+}
+
+func (h watchedHandler) Hello(ctx context.Context, hostname string) error {
+	defer h.s.watch()()
+	return h.ContextHandler.Hello(ctx, hostname)
+}
+
+func (h watchedHandler) AuthUser(ctx context.Context, identity, username string) (string, error) {
+	defer h.s.watch()()
+	return h.ContextHandler.AuthUser(ctx, identity, username)
+}
+
+func (h watchedHandler) Sender(ctx context.Context, address string) error {
+	defer h.s.watch()()
+	return h.ContextHandler.Sender(ctx, address)
+}
+
+func (h watchedHandler) Recipient(ctx context.Context, address string) error {
+	defer h.s.watch()()
+	return h.ContextHandler.Recipient(ctx, address)
+}
+
+// Message watches the connection once the handler has read all message
+// data, as the connection is read until then
+func (h watchedHandler) Message(ctx context.Context, r io.Reader) error {
+	wr := &watchedReader{r: r, s: h.s}
+	defer wr.stop()
+	return h.ContextHandler.Message(ctx, wr)
+}
+
+// watchedReader starts watching the connection when r returns io.EOF
+type watchedReader struct {
+	r       io.Reader
+	s       *session
+	unwatch func()
+}
+
+func (r *watchedReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if err == io.EOF && r.unwatch == nil {
+		r.unwatch = r.s.watch()
+	}
+	return n, err
+}
+
+func (r *watchedReader) stop() {
+	if r.unwatch != nil {
+		r.unwatch()
+	}
+}
@@ -0,0 +1,97 @@
+package smtpd
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// blockingCtxHandler blocks in Recipient and after reading the message until
+// the context is canceled
+type blockingCtxHandler struct {
+	ctxHandler
+	canceled chan error
+}
+
+func (h *blockingCtxHandler) Recipient(ctx context.Context, address string) error {
+	if address != "block@example.com" {
+		return nil
+	}
+	<-ctx.Done()
+	h.canceled <- ctx.Err()
+	return ctx.Err()
+}
+
+func (h *blockingCtxHandler) Message(ctx context.Context, r io.Reader) error {
+	if _, err := ioutil.ReadAll(r); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	h.canceled <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestDisconnectCancelsContext(t *testing.T) {
+
+	for _, data := range []bool{false, true} {
+		handler := &blockingCtxHandler{canceled: make(chan error, 1)}
+		c, done := dialServerContext(t, &Server{}, handler)
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		cmd(t, c, 250, "HELO localhost")
+		cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+		if data {
+			cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+			cmd(t, c, 354, "DATA")
+			c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+		} else {
+			c.PrintfLine("RCPT TO:<block@example.com>")
+		}
+		time.Sleep(50 * time.Millisecond)
+		c.Close()
+
+		select {
+		case err := <-handler.canceled:
+			if err != context.Canceled {
+				t.Fatalf("unexpected error %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("context not canceled after disconnect (data %t)", data)
+		}
+		<-done
+	}
+}
+
+func TestShutdownCancelsContext(t *testing.T) {
+
+	handler := &blockingCtxHandler{canceled: make(chan error, 1)}
+	server := &Server{}
+	c, done := dialServerContext(t, server, handler)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "HELO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	c.PrintfLine("RCPT TO:<block@example.com>")
+	time.Sleep(50 * time.Millisecond)
+
+	// the running handler is canceled when the context of Shutdown expires
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v", err)
+	}
+	select {
+	case err := <-handler.canceled:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("context not canceled after shutdown")
+	}
+	<-done
+}
@@ -0,0 +1,412 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chain validation status of ARC (RFC 8617)
+const (
+	ChainNone = "none"
+	ChainPass = "pass"
+	ChainFail = "fail"
+)
+
+// maxARCInstances is the maximum number of ARC sets
+const maxARCInstances = 50
+
+// FormatResults returns the DKIM results as a resinfo list of an
+// Authentication-Results or ARC-Authentication-Results field (RFC 8601), or
+// "dkim=none" without results.
+func FormatResults(results []*Result) string {
+	if len(results) == 0 {
+		return "dkim=none"
+	}
+	parts := make([]string, 0, len(results))
+	for _, r := range results {
+		part := "dkim=" + r.Status
+		if r.Domain != "" {
+			part += " header.d=" + r.Domain
+		}
+		if r.Selector != "" {
+			part += " header.s=" + r.Selector
+		}
+		if r.Identifier != "" {
+			part += " header.i=" + r.Identifier
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ";\r\n\t")
+}
+
+// SealOptions configures a Sealer.
+type SealOptions struct {
+	// Signing domain and selector of the public key record
+	Domain   string
+	Selector string
+
+	// Private key, an *rsa.PrivateKey or ed25519.PrivateKey
+	Key crypto.Signer
+
+	// Authentication service identifier of the ARC-Authentication-Results,
+	// usually the hostname of the server
+	AuthServID string
+
+	// Authentication results collected during the session, the resinfo
+	// list of an Authentication-Results field like "spf=pass
+	// smtp.mailfrom=example.com; dkim=pass header.d=example.com", see
+	// FormatResults. "none" if empty.
+	Results string
+
+	// Header fields signed by the ARC-Message-Signature, like
+	// SignOptions.Headers
+	Headers []string
+
+	// Verifier used to validate the existing ARC chain of the message
+	Verifier *Verifier
+}
+
+// Sealer adds an ARC set to a message written to it and writes the sealed
+// message to the underlying writer when it is closed. Like Signer, the
+// message is buffered.
+type Sealer struct {
+	w      io.Writer
+	opts   SealOptions
+	alg    string
+	header []byte
+	body   bytes.Buffer
+	inBody bool
+	hasher *bodyHasher
+	chain  string
+	closed bool
+}
+
+// NewSealer returns a Sealer that writes the sealed message to w.
+func NewSealer(w io.Writer, opts *SealOptions) (*Sealer, error) {
+	s := &Sealer{w: w, opts: *opts}
+	switch opts.Key.(type) {
+	case *rsa.PrivateKey:
+		s.alg = "rsa-sha256"
+	case ed25519.PrivateKey:
+		s.alg = "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("dkim: unsupported key type %T", opts.Key)
+	}
+	if opts.Domain == "" || opts.Selector == "" || opts.AuthServID == "" {
+		return nil, errors.New("dkim: domain, selector and authserv-id required")
+	}
+	if s.opts.Verifier == nil {
+		s.opts.Verifier = &Verifier{}
+	}
+	s.hasher = newBodyHasher(sha256.New(), true, -1)
+	return s, nil
+}
+
+// Write writes message data.
+func (s *Sealer) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("dkim: write after close")
+	}
+	if s.inBody {
+		s.hasher.Write(p)
+		return s.body.Write(p)
+	}
+	start := len(s.header) - 2
+	if start < 0 {
+		start = 0
+	}
+	s.header = append(s.header, p...)
+	if end := headerEnd(s.header, start); end != -1 {
+		s.inBody = true
+		rest := s.header[end:]
+		s.header = s.header[:end]
+		s.hasher.Write(rest)
+		s.body.Write(rest)
+	} else if len(s.header) > maxHeaderSize {
+		return 0, errors.New("dkim: header too large")
+	}
+	return len(p), nil
+}
+
+// Close validates the existing ARC chain, and writes a new ARC set followed
+// by the message to the underlying writer.
+func (s *Sealer) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	fields := splitFields(s.header)
+	sets, err := arcSets(fields)
+	instance := len(sets) + 1
+	switch {
+	case err != nil:
+		s.chain = ChainFail
+		instance = maxInstance(fields) + 1
+	case len(sets) == 0:
+		s.chain = ChainNone
+	default:
+		s.chain = s.validate(fields, sets)
+	}
+	if instance > maxARCInstances {
+		return errors.New("dkim: too many ARC sets")
+	}
+
+	results := s.opts.Results
+	if results == "" {
+		results = "none"
+	}
+	aar := fmt.Sprintf("ARC-Authentication-Results: i=%d; %s;\r\n\t%s\r\n", instance, s.opts.AuthServID, results)
+
+	// message signature of the fields other than ARC sets
+	var msgFields []string
+	for _, field := range fields {
+		if name, _ := splitField(field); !strings.HasPrefix(strings.ToLower(name), "arc-") {
+			msgFields = append(msgFields, field)
+		}
+	}
+	signed, err := signedFields(msgFields, s.opts.Headers)
+	if err != nil {
+		return err
+	}
+	bodyHash, _ := s.hasher.sum()
+	now := time.Now()
+	ams, err := signField("ARC-Message-Signature", []string{
+		fmt.Sprintf("i=%d", instance),
+		"a=" + s.alg,
+		"c=relaxed/relaxed",
+		"d=" + s.opts.Domain,
+		"s=" + s.opts.Selector,
+		fmt.Sprintf("t=%d", now.Unix()),
+		"h=" + strings.ToLower(strings.Join(signed, ":")),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash),
+	}, s.opts.Key, func(field string, w io.Writer) {
+		sig := &signature{field: field, headers: signed, relaxedH: true}
+		sig.writeHeaders(w, msgFields)
+	})
+	if err != nil {
+		return err
+	}
+
+	sets = append(sets, arcSet{aar: aar, ams: ams})
+	seal, err := signField("ARC-Seal", []string{
+		fmt.Sprintf("i=%d", instance),
+		"a=" + s.alg,
+		fmt.Sprintf("t=%d", now.Unix()),
+		"cv=" + s.chain,
+		"d=" + s.opts.Domain,
+		"s=" + s.opts.Selector,
+	}, s.opts.Key, func(field string, w io.Writer) {
+		sets[len(sets)-1].seal = field
+		writeSets(w, sets)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, field := range []string{seal, ams, aar} {
+		if _, err := io.WriteString(s.w, field); err != nil {
+			return err
+		}
+	}
+	if _, err := s.w.Write(s.header); err != nil {
+		return err
+	}
+	_, err = s.body.WriteTo(s.w)
+	return err
+}
+
+// Chain returns the chain validation status of the message after Close.
+func (s *Sealer) Chain() string {
+	return s.chain
+}
+
+// arcSet is the set of ARC fields of an instance
+type arcSet struct {
+	aar, ams, seal string
+}
+
+// arcSets returns the ARC sets of a message in order of instance, or an
+// error when the sets are incomplete
+func arcSets(fields []string) ([]arcSet, error) {
+	byInstance := make(map[int]*arcSet)
+	max := 0
+	for _, field := range fields {
+		name, value := splitField(field)
+		var target *string
+		i := arcInstance(value)
+		set := byInstance[i]
+		if set == nil {
+			set = &arcSet{}
+		}
+		switch strings.ToLower(name) {
+		case "arc-authentication-results":
+			target = &set.aar
+		case "arc-message-signature":
+			target = &set.ams
+		case "arc-seal":
+			target = &set.seal
+		default:
+			continue
+		}
+		if i < 1 || i > maxARCInstances || *target != "" {
+			return nil, errors.New("invalid ARC instance")
+		}
+		*target = field
+		byInstance[i] = set
+		if i > max {
+			max = i
+		}
+	}
+	sets := make([]arcSet, max)
+	for i := 1; i <= max; i++ {
+		set := byInstance[i]
+		if set == nil || set.aar == "" || set.ams == "" || set.seal == "" {
+			return nil, fmt.Errorf("incomplete ARC set %d", i)
+		}
+		sets[i-1] = *set
+	}
+	return sets, nil
+}
+
+// maxInstance returns the highest ARC instance of the fields
+func maxInstance(fields []string) int {
+	max := 0
+	for _, field := range fields {
+		name, value := splitField(field)
+		if strings.HasPrefix(strings.ToLower(name), "arc-") {
+			if i := arcInstance(value); i > max && i <= maxARCInstances {
+				max = i
+			}
+		}
+	}
+	return max
+}
+
+// arcInstance returns the instance of an ARC field value, or 0
+func arcInstance(value string) int {
+	// the instance tag is the first tag
+	first := strings.SplitN(value, ";", 2)[0]
+	i := strings.IndexByte(first, '=')
+	if i == -1 || strings.TrimSpace(first[:i]) != "i" {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(first[i+1:]))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// writeSets writes the relaxed canonical ARC sets for the seal of the last
+// set, which is written without signature data and CRLF
+func writeSets(w io.Writer, sets []arcSet) {
+	for i, set := range sets {
+		io.WriteString(w, canonicalHeader(set.aar, true))
+		io.WriteString(w, canonicalHeader(set.ams, true))
+		if i < len(sets)-1 {
+			io.WriteString(w, canonicalHeader(set.seal, true))
+		} else {
+			io.WriteString(w, strings.TrimSuffix(canonicalHeader(removeSignature(set.seal), true), "\r\n"))
+		}
+	}
+}
+
+// validate returns the validation status of the ARC chain
+func (s *Sealer) validate(fields []string, sets []arcSet) string {
+	v := s.opts.Verifier
+	timeout := v.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// the cv of the last seal must not be fail, of the first none and of
+	// others pass
+	for i, set := range sets {
+		_, value := splitField(set.seal)
+		tags, err := parseTags(value)
+		if err != nil {
+			return ChainFail
+		}
+		expected := ChainPass
+		if i == 0 {
+			expected = ChainNone
+		}
+		if tags["cv"] != expected {
+			return ChainFail
+		}
+	}
+
+	// the latest message signature
+	ams := parseSignatureTags(sets[len(sets)-1].ams, 0, true)
+	if ams.err != nil {
+		return ChainFail
+	}
+	ams.startLookup(ctx, v.lookupTXT())
+	ams.body.Write(s.body.Bytes())
+	var msgFields []string
+	for _, field := range fields {
+		if name, _ := splitField(field); !strings.HasPrefix(strings.ToLower(name), "arc-") {
+			msgFields = append(msgFields, field)
+		}
+	}
+	if result := ams.verify(msgFields, ctx.Done()); result.Status != StatusPass {
+		return ChainFail
+	}
+
+	// all seals
+	for i := range sets {
+		if !s.verifySeal(ctx, sets[:i+1]) {
+			return ChainFail
+		}
+	}
+	return ChainPass
+}
+
+// verifySeal verifies the seal of the last set
+func (s *Sealer) verifySeal(ctx context.Context, sets []arcSet) bool {
+	_, value := splitField(sets[len(sets)-1].seal)
+	tags, err := parseTags(value)
+	if err != nil {
+		return false
+	}
+	var alg string
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		alg = "rsa"
+	case "ed25519-sha256":
+		alg = "ed25519"
+	default:
+		return false
+	}
+	data, err := decodeBase64(tags["b"])
+	if err != nil {
+		return false
+	}
+	key, err := lookupKey(ctx, s.opts.Verifier.lookupTXT(), tags["s"]+"._domainkey."+tags["d"], alg)
+	if err != nil {
+		return false
+	}
+	h := sha256.New()
+	writeSets(h, sets)
+	hashed := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed, data) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, hashed, data)
+	}
+	return false
+}
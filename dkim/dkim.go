@@ -0,0 +1,703 @@
+/*
+Package dkim verifies and creates DomainKeys Identified Mail signatures (RFC
+6376) of messages received by smtpd.
+
+A Verifier returns a Reader that verifies the signatures while the message
+data streams through it, so the handler does not need to buffer the
+message. The public keys are looked up as soon as the header is read, and
+the results are available after the message was read to the end.
+
+	func (h *handler) Message(ctx context.Context, r io.Reader) error {
+		dr := verifier.Reader(ctx, r)
+		if err := h.store(dr); err != nil {
+			return err
+		}
+		for _, result := range dr.Results() {
+			log.Printf("dkim=%s header.d=%s", result.Status, result.Domain)
+		}
+		return nil
+	}
+
+A Signer signs messages that are relayed, for example after submission. It
+writes the signed message to the underlying writer when it is closed.
+*/
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status of a verified signature, as used in Authentication-Results
+// (RFC 8601)
+const (
+	StatusPass      = "pass"
+	StatusFail      = "fail"
+	StatusNeutral   = "neutral"
+	StatusTempError = "temperror"
+	StatusPermError = "permerror"
+)
+
+// maxHeaderSize limits the size of the header buffered for verification
+const maxHeaderSize = 1 << 20
+
+// minRSABits is the minimum size of RSA keys (RFC 8301)
+const minRSABits = 1024
+
+// Result is the result of verifying a signature.
+type Result struct {
+	Status     string
+	Domain     string // d= tag
+	Selector   string // s= tag
+	Identifier string // i= tag, defaults to "@" and the domain
+	Algorithm  string // a= tag
+
+	// Reason of a status other than pass
+	Err error
+}
+
+// Verifier verifies DKIM signatures. A Verifier can be shared by sessions.
+type Verifier struct {
+	// LookupTXT looks up the TXT records of a name, defaults to
+	// net.DefaultResolver.LookupTXT
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	// Maximum number of signatures verified per message, 5 if zero.
+	// Further signatures are ignored.
+	MaxSignatures int
+
+	// Time to wait for key lookups after the message was read, 10 seconds
+	// if zero
+	Timeout time.Duration
+}
+
+// Reader reads a message and verifies its signatures.
+type Reader struct {
+	v      *Verifier
+	ctx    context.Context
+	r      io.Reader
+	header []byte // header being read
+	body   bool   // reading the body
+	sigs   []*signature
+	fields []string // header fields in CRLF form
+	err    error    // error of the header
+	eof    bool
+}
+
+// Reader returns a Reader that reads the message from r and verifies its
+// signatures as the data is read. Key lookups use ctx.
+func (v *Verifier) Reader(ctx context.Context, r io.Reader) *Reader {
+	return &Reader{v: v, ctx: ctx, r: r}
+}
+
+// Read reads message data from the underlying reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.process(p[:n])
+	}
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// process passes message data to the header parser or body hashes
+func (r *Reader) process(p []byte) {
+	if r.body {
+		for _, sig := range r.sigs {
+			sig.body.Write(p)
+		}
+		return
+	}
+	if r.err != nil {
+		return
+	}
+	start := len(r.header) - 2
+	if start < 0 {
+		start = 0
+	}
+	r.header = append(r.header, p...)
+	end := headerEnd(r.header, start)
+	if end == -1 {
+		if len(r.header) > maxHeaderSize {
+			r.err = errors.New("dkim: header too large")
+			r.header = nil
+		}
+		return
+	}
+	r.body = true
+	r.parseHeader(r.header[:end])
+	rest := r.header[end:]
+	for _, sig := range r.sigs {
+		sig.body.Write(rest)
+	}
+	r.header = nil
+}
+
+// headerEnd returns the offset of the body after the empty line that ends
+// the header, searching from start, or -1
+func headerEnd(b []byte, start int) int {
+	if start == 0 {
+		if bytes.HasPrefix(b, []byte("\r\n")) {
+			return 2
+		}
+		if bytes.HasPrefix(b, []byte("\n")) {
+			return 1
+		}
+	}
+	for i := start; i < len(b); i++ {
+		if b[i] != '\n' {
+			continue
+		}
+		if i+1 < len(b) && b[i+1] == '\n' {
+			return i + 2
+		}
+		if i+2 < len(b) && b[i+1] == '\r' && b[i+2] == '\n' {
+			return i + 3
+		}
+	}
+	return -1
+}
+
+// parseHeader splits the header in fields and sets up the signatures
+func (r *Reader) parseHeader(header []byte) {
+	r.fields = splitFields(header)
+	max := r.v.MaxSignatures
+	if max <= 0 {
+		max = 5
+	}
+	for i, field := range r.fields {
+		name, _ := splitField(field)
+		if !strings.EqualFold(name, "DKIM-Signature") {
+			continue
+		}
+		if len(r.sigs) == max {
+			break
+		}
+		sig := parseSignature(field, i)
+		if sig.err == nil {
+			sig.startLookup(r.ctx, r.v.lookupTXT())
+		}
+		r.sigs = append(r.sigs, sig)
+	}
+}
+
+// splitFields splits a header in fields with CRLF line endings
+func splitFields(header []byte) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header), "\n") {
+		if line == "" || line == "\n" || line == "\r\n" {
+			continue
+		}
+		line = strings.TrimRight(line, "\r\n") + "\r\n"
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func (v *Verifier) lookupTXT() func(ctx context.Context, name string) ([]string, error) {
+	if v.LookupTXT != nil {
+		return v.LookupTXT
+	}
+	return net.DefaultResolver.LookupTXT
+}
+
+// Results returns the results of the signatures after reading the rest of
+// the message. It returns no results for a message without signatures.
+func (r *Reader) Results() []*Result {
+	if !r.eof {
+		io.Copy(ioutil.Discard, r)
+	}
+	if r.err != nil {
+		return []*Result{{Status: StatusPermError, Err: r.err}}
+	}
+	if !r.body {
+		// message without body, the header may lack the empty line
+		r.body = true
+		r.parseHeader(r.header)
+	}
+	timeout := r.v.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	results := make([]*Result, 0, len(r.sigs))
+	for _, sig := range r.sigs {
+		results = append(results, sig.verify(r.fields, ctx.Done()))
+	}
+	return results
+}
+
+// signature is a DKIM-Signature header field being verified
+type signature struct {
+	field     string // raw header field
+	index     int    // index of the field in the header
+	tags      map[string]string
+	result    Result
+	hash      crypto.Hash
+	headerAlg string // "rsa" or "ed25519"
+	relaxedH  bool   // relaxed header canonicalization
+	arc       bool   // ARC-Message-Signature with instance tag i=
+	body      *bodyHasher
+	bodyHash  []byte
+	sig       []byte
+	headers   []string
+	err       error // permerror found when parsing
+	key       chan keyResult
+}
+
+type keyResult struct {
+	key interface{}
+	err error
+}
+
+// parseSignature parses a DKIM-Signature header field
+func parseSignature(field string, index int) *signature {
+	return parseSignatureTags(field, index, false)
+}
+
+// parseSignatureTags parses a DKIM-Signature, or an ARC-Message-Signature
+// when arc is set
+func parseSignatureTags(field string, index int, arc bool) *signature {
+	sig := &signature{field: field, index: index, arc: arc}
+	_, value := splitField(field)
+	tags, err := parseTags(value)
+	if err != nil {
+		sig.err = err
+		return sig
+	}
+	sig.tags = tags
+	sig.result = Result{
+		Domain:     tags["d"],
+		Selector:   tags["s"],
+		Identifier: tags["i"],
+		Algorithm:  tags["a"],
+	}
+	sig.err = sig.parse()
+	return sig
+}
+
+// parse validates the tags of the signature
+func (sig *signature) parse() error {
+	tags := sig.tags
+	required := []string{"v", "a", "b", "bh", "d", "h", "s"}
+	if sig.arc {
+		required[0] = "i"
+	}
+	for _, name := range required {
+		if _, ok := tags[name]; !ok {
+			return fmt.Errorf("missing tag %s=", name)
+		}
+	}
+	if !sig.arc && tags["v"] != "1" {
+		return fmt.Errorf("unsupported version %q", tags["v"])
+	}
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		sig.headerAlg, sig.hash = "rsa", crypto.SHA256
+	case "ed25519-sha256":
+		sig.headerAlg, sig.hash = "ed25519", crypto.SHA256
+	default:
+		// rsa-sha1 must not be used, RFC 8301
+		return fmt.Errorf("unsupported algorithm %q", tags["a"])
+	}
+
+	header, body := "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		header = strings.ToLower(c)
+		if i := strings.IndexByte(header, '/'); i != -1 {
+			header, body = header[:i], header[i+1:]
+		}
+	}
+	if header != "simple" && header != "relaxed" || body != "simple" && body != "relaxed" {
+		return fmt.Errorf("unsupported canonicalization %q", tags["c"])
+	}
+	sig.relaxedH = header == "relaxed"
+
+	limit := int64(-1)
+	if l, ok := tags["l"]; ok {
+		n, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid body length %q", l)
+		}
+		limit = n
+	}
+	sig.body = newBodyHasher(sha256.New(), body == "relaxed", limit)
+
+	var err error
+	if sig.bodyHash, err = decodeBase64(tags["bh"]); err != nil {
+		return errors.New("invalid body hash")
+	}
+	if sig.sig, err = decodeBase64(tags["b"]); err != nil || len(sig.sig) == 0 {
+		return errors.New("invalid signature data")
+	}
+
+	domain := strings.ToLower(tags["d"])
+	if sig.arc {
+		sig.result.Identifier = ""
+		for _, name := range strings.Split(tags["h"], ":") {
+			sig.headers = append(sig.headers, strings.TrimSpace(name))
+		}
+		return nil
+	}
+	if sig.result.Identifier == "" {
+		sig.result.Identifier = "@" + tags["d"]
+	} else {
+		at := strings.LastIndexByte(sig.result.Identifier, '@')
+		idDomain := strings.ToLower(sig.result.Identifier[at+1:])
+		if at == -1 || idDomain != domain && !strings.HasSuffix(idDomain, "."+domain) {
+			return errors.New("identifier not in signing domain")
+		}
+	}
+
+	hasFrom := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		if strings.EqualFold(name, "From") {
+			hasFrom = true
+		}
+		sig.headers = append(sig.headers, name)
+	}
+	if !hasFrom {
+		return errors.New("From field not signed")
+	}
+
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid expiration %q", x)
+		}
+		if time.Now().Unix() > expires {
+			return errors.New("signature expired")
+		}
+	}
+	return nil
+}
+
+// startLookup looks up the public key in the background
+func (sig *signature) startLookup(ctx context.Context, lookup func(ctx context.Context, name string) ([]string, error)) {
+	sig.key = make(chan keyResult, 1)
+	name := sig.tags["s"] + "._domainkey." + sig.tags["d"]
+	go func() {
+		key, err := lookupKey(ctx, lookup, name, sig.headerAlg)
+		sig.key <- keyResult{key, err}
+	}()
+}
+
+// verify returns the result of the signature after the message was read, or
+// a temperror when the key lookup is not done before done is closed
+func (sig *signature) verify(fields []string, done <-chan struct{}) *Result {
+	result := sig.result
+	if sig.err != nil {
+		result.Status, result.Err = StatusPermError, sig.err
+		return &result
+	}
+	var key keyResult
+	select {
+	case key = <-sig.key:
+	case <-done:
+		key.err = tempError{errors.New("key lookup timed out")}
+	}
+	if key.err != nil {
+		result.Status, result.Err = StatusPermError, key.err
+		if _, ok := key.err.(tempError); ok {
+			result.Status = StatusTempError
+		}
+		return &result
+	}
+
+	bodyHash, err := sig.body.sum()
+	if err != nil {
+		result.Status, result.Err = StatusPermError, err
+		return &result
+	}
+	if !bytes.Equal(bodyHash, sig.bodyHash) {
+		result.Status, result.Err = StatusFail, errors.New("body hash did not verify")
+		return &result
+	}
+
+	h := sig.hash.New()
+	sig.writeHeaders(h, fields)
+	hashed := h.Sum(nil)
+	switch k := key.key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, sig.hash, hashed, sig.sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, hashed, sig.sig) {
+			err = errors.New("ed25519 verification error")
+		}
+	}
+	if err != nil {
+		result.Status, result.Err = StatusFail, fmt.Errorf("signature did not verify: %v", err)
+		return &result
+	}
+	result.Status = StatusPass
+	return &result
+}
+
+// writeHeaders writes the canonicalized signed header fields and the
+// signature field without the signature data
+func (sig *signature) writeHeaders(w io.Writer, fields []string) {
+	used := make(map[int]bool)
+	for _, name := range sig.headers {
+		// use the last unused instance of the field
+		for i := len(fields) - 1; i >= 0; i-- {
+			fieldName, _ := splitField(fields[i])
+			if !used[i] && strings.EqualFold(fieldName, name) {
+				used[i] = true
+				io.WriteString(w, canonicalHeader(fields[i], sig.relaxedH))
+				break
+			}
+		}
+	}
+	field := canonicalHeader(removeSignature(sig.field), sig.relaxedH)
+	io.WriteString(w, strings.TrimSuffix(field, "\r\n"))
+}
+
+// tempError is an error of a lookup that may succeed later
+type tempError struct{ error }
+
+// lookupKey looks up and parses the public key record of name
+func lookupKey(ctx context.Context, lookup func(ctx context.Context, name string) ([]string, error), name, alg string) (interface{}, error) {
+	txts, err := lookup(ctx, name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, fmt.Errorf("no key for %s", name)
+		}
+		return nil, tempError{err}
+	}
+	if len(txts) == 0 {
+		return nil, fmt.Errorf("no key for %s", name)
+	}
+	// a record may be split in multiple strings
+	tags, err := parseTags(txts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key record for %s", name)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("invalid key record version for %s", name)
+	}
+	keyType := "rsa"
+	if k, ok := tags["k"]; ok {
+		keyType = strings.ToLower(k)
+	}
+	if keyType != alg {
+		return nil, fmt.Errorf("key type %s does not match algorithm", keyType)
+	}
+	data, err := decodeBase64(tags["p"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key data for %s", name)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("key for %s revoked", name)
+	}
+	if keyType == "ed25519" {
+		if len(data) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key for %s", name)
+		}
+		return ed25519.PublicKey(data), nil
+	}
+	pub, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
+		if pub, err = x509.ParsePKCS1PublicKey(data); err != nil {
+			return nil, fmt.Errorf("invalid RSA key for %s", name)
+		}
+	}
+	rsaKey, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid RSA key for %s", name)
+	}
+	if rsaKey.N.BitLen() < minRSABits {
+		return nil, fmt.Errorf("RSA key for %s too short", name)
+	}
+	return rsaKey, nil
+}
+
+// parseTags parses a tag list like "v=1; a=rsa-sha256", whitespace around
+// tags and values is removed
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.IndexByte(part, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid tag %q", part)
+		}
+		name := strings.TrimSpace(part[:i])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag %s=", name)
+		}
+		tags[name] = strings.TrimSpace(part[i+1:])
+	}
+	return tags, nil
+}
+
+// decodeBase64 decodes base64 data that may contain folding whitespace
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// splitField returns the name and value of a header field
+func splitField(field string) (string, string) {
+	i := strings.IndexByte(field, ':')
+	if i == -1 {
+		return strings.TrimSpace(field), ""
+	}
+	return strings.TrimRight(field[:i], " \t"), field[i+1:]
+}
+
+// removeSignature removes the value of the b= tag of a DKIM-Signature field
+func removeSignature(field string) string {
+	i := strings.IndexByte(field, ':')
+	parts := strings.Split(field[i+1:], ";")
+	for j, part := range parts {
+		eq := strings.IndexByte(part, '=')
+		if eq != -1 && strings.TrimSpace(part[:eq]) == "b" {
+			end := ""
+			if j == len(parts)-1 && strings.HasSuffix(part, "\r\n") {
+				end = "\r\n"
+			}
+			parts[j] = part[:eq+1] + end
+		}
+	}
+	return field[:i+1] + strings.Join(parts, ";")
+}
+
+// canonicalHeader returns the canonicalized header field including CRLF
+func canonicalHeader(field string, relaxed bool) string {
+	if !relaxed {
+		return field
+	}
+	name, value := splitField(field)
+	value = strings.Replace(value, "\r\n", "", -1)
+	value = strings.Join(strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == '\t'
+	}), " ")
+	return strings.ToLower(name) + ":" + value + "\r\n"
+}
+
+// bodyHasher hashes the canonicalized body as it is written
+type bodyHasher struct {
+	h       hash.Hash
+	relaxed bool
+	limit   int64 // number of canonicalized bytes to hash, or -1
+	n       int64 // number of canonicalized bytes
+	line    []byte
+	empty   int  // empty lines not yet written
+	nonzero bool // written a non-empty line
+}
+
+func newBodyHasher(h hash.Hash, relaxed bool, limit int64) *bodyHasher {
+	return &bodyHasher{h: h, relaxed: relaxed, limit: limit}
+}
+
+// Write canonicalizes the body data in p
+func (b *bodyHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i == -1 {
+			b.line = append(b.line, p...)
+			break
+		}
+		b.line = append(b.line, p[:i]...)
+		b.endLine()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// endLine canonicalizes a line without line ending
+func (b *bodyHasher) endLine() {
+	line := bytes.TrimSuffix(b.line, []byte{'\r'})
+	if b.relaxed {
+		line = relaxLine(line)
+	}
+	if len(line) == 0 {
+		b.empty++
+	} else {
+		for ; b.empty > 0; b.empty-- {
+			b.write([]byte("\r\n"))
+		}
+		b.write(line)
+		b.write([]byte("\r\n"))
+		b.nonzero = true
+	}
+	b.line = b.line[:0]
+}
+
+// write hashes canonicalized data up to the limit
+func (b *bodyHasher) write(p []byte) {
+	if b.limit >= 0 && b.n+int64(len(p)) > b.limit {
+		if b.n < b.limit {
+			b.h.Write(p[:b.limit-b.n])
+		}
+	} else {
+		b.h.Write(p)
+	}
+	b.n += int64(len(p))
+}
+
+// sum returns the body hash at the end of the body
+func (b *bodyHasher) sum() ([]byte, error) {
+	if len(b.line) > 0 {
+		b.endLine()
+	}
+	if !b.nonzero && !b.relaxed {
+		// the simple canonical empty body is a single CRLF
+		b.write([]byte("\r\n"))
+	}
+	if b.limit > b.n {
+		return nil, errors.New("body length exceeds body")
+	}
+	return b.h.Sum(nil), nil
+}
+
+// relaxLine reduces whitespace sequences to a single space and removes
+// whitespace at the end of the line
+func relaxLine(line []byte) []byte {
+	out := line[:0:0]
+	space := false
+	for _, c := range line {
+		if c == ' ' || c == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			out = append(out, ' ')
+			space = false
+		}
+		out = append(out, c)
+	}
+	return out
+}
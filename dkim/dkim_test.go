@@ -0,0 +1,233 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// signed message of RFC 8463 appendix A
+const testMessage = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+var testKeys = map[string][]string{
+	"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+}
+
+func testLookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txts, ok := testKeys[name]; ok {
+		return txts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestVerify(t *testing.T) {
+
+	v := &Verifier{LookupTXT: testLookupTXT}
+
+	// data is passed through unchanged, in small reads
+	r := v.Reader(context.Background(), iotest.OneByteReader(strings.NewReader(testMessage)))
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if string(data) != testMessage {
+		t.Fatalf("unexpected data")
+	}
+	results := r.Results()
+	if len(results) != 1 || results[0].Status != StatusPass {
+		t.Fatalf("unexpected results %+v", results[0])
+	}
+	if results[0].Domain != "football.example.com" || results[0].Identifier != "@football.example.com" {
+		t.Fatalf("unexpected result %+v", results[0])
+	}
+
+	// modified body
+	modified := strings.Replace(testMessage, "hungry", "thirsty", 1)
+	r = v.Reader(context.Background(), strings.NewReader(modified))
+	if results := r.Results(); len(results) != 1 || results[0].Status != StatusFail {
+		t.Fatalf("unexpected results %+v", results[0])
+	}
+
+	// modified header
+	modified = strings.Replace(testMessage, "dinner", "lunch", 1)
+	r = v.Reader(context.Background(), strings.NewReader(modified))
+	if results := r.Results(); len(results) != 1 || results[0].Status != StatusFail {
+		t.Fatalf("unexpected results %+v", results[0])
+	}
+
+	// unknown key
+	modified = strings.Replace(testMessage, "s=brisbane", "s=sydney", 1)
+	r = v.Reader(context.Background(), strings.NewReader(modified))
+	if results := r.Results(); len(results) != 1 || results[0].Status != StatusPermError {
+		t.Fatalf("unexpected results %+v", results[0])
+	}
+
+	// unsigned message
+	r = v.Reader(context.Background(), strings.NewReader("From: a@example.com\r\n\r\nbody\r\n"))
+	if results := r.Results(); len(results) != 0 {
+		t.Fatalf("unexpected results %+v", results)
+	}
+}
+
+func TestBodyHash(t *testing.T) {
+
+	// examples of RFC 6376 section 3.4.5
+	body := " C \r\nD \t E\r\n\r\n\r\n"
+	for _, test := range []struct {
+		relaxed  bool
+		expected string
+	}{
+		{false, " C \r\nD \t E\r\n"},
+		{true, " C\r\nD E\r\n"},
+	} {
+		var buf bytes.Buffer
+		b := newBodyHasher(nopHash{&buf}, test.relaxed, -1)
+		io.WriteString(b, body)
+		b.sum()
+		if buf.String() != test.expected {
+			t.Errorf("relaxed %t: unexpected canonical body %q", test.relaxed, buf.String())
+		}
+	}
+
+	// empty body
+	for relaxed, expected := range map[bool]string{false: "\r\n", true: ""} {
+		var buf bytes.Buffer
+		b := newBodyHasher(nopHash{&buf}, relaxed, -1)
+		b.sum()
+		if buf.String() != expected {
+			t.Errorf("relaxed %t: unexpected empty body %q", relaxed, buf.String())
+		}
+	}
+
+	if h := canonicalHeader("SUBJect \t: AbC  \r\n\tdef \r\n", true); h != "subject:AbC def\r\n" {
+		t.Errorf("unexpected canonical header %q", h)
+	}
+}
+
+// nopHash collects the hashed data
+type nopHash struct {
+	*bytes.Buffer
+}
+
+func (h nopHash) Sum(b []byte) []byte { return append(b, h.Bytes()...) }
+func (h nopHash) Size() int           { return 0 }
+func (h nopHash) BlockSize() int      { return 1 }
+
+func TestSigner(t *testing.T) {
+
+	_, edKey, _ := ed25519.GenerateKey(nil)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	rsaPub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	testKeys["ed._domainkey.example.com"] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey))}
+	testKeys["rsa._domainkey.example.com"] = []string{"v=DKIM1; p=" + base64.StdEncoding.EncodeToString(rsaPub)}
+
+	const message = "From: user@example.com\r\nTo: rcpt@example.org\r\nSubject:  signed\r\n\tmessage\r\n\r\nThis  is a test. \r\n\r\n\r\n"
+	v := &Verifier{LookupTXT: testLookupTXT}
+	for _, opts := range []*SignOptions{
+		{Domain: "example.com", Selector: "ed", Key: edKey},
+		{Domain: "example.com", Selector: "rsa", Key: rsaKey, HeaderCanonicalization: "simple", BodyCanonicalization: "simple"},
+		{Domain: "example.com", Selector: "rsa", Key: rsaKey, Identifier: "user@example.com", Expiration: time.Hour},
+	} {
+		var buf bytes.Buffer
+		s, err := NewSigner(&buf, opts)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		// written in small chunks
+		io.Copy(s, iotest.OneByteReader(strings.NewReader(message)))
+		if err := s.Close(); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if !strings.HasPrefix(buf.String(), "DKIM-Signature: ") || !strings.HasSuffix(buf.String(), message) {
+			t.Fatalf("unexpected signed message %q", buf.String())
+		}
+		if !strings.Contains(s.Signature(), "h=from:from:subject:subject:to:to;") {
+			t.Fatalf("unexpected signed headers %q", s.Signature())
+		}
+		results := v.Reader(context.Background(), &buf).Results()
+		if len(results) != 1 || results[0].Status != StatusPass {
+			t.Fatalf("%s: unexpected result %+v", opts.Selector, results[0])
+		}
+	}
+
+	if _, err := NewSigner(ioutil.Discard, &SignOptions{Domain: "example.com", Selector: "x"}); err == nil {
+		t.Fatalf("expected error without key")
+	}
+	s, _ := NewSigner(ioutil.Discard, &SignOptions{Domain: "example.com", Selector: "ed", Key: edKey})
+	io.WriteString(s, "Subject: no from\r\n\r\n")
+	if err := s.Close(); err == nil {
+		t.Fatalf("expected error without From")
+	}
+}
+
+func TestSealer(t *testing.T) {
+
+	_, key, _ := ed25519.GenerateKey(nil)
+	testKeys["arc._domainkey.example.net"] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))}
+	v := &Verifier{LookupTXT: testLookupTXT}
+	seal := func(message string) (string, string) {
+		var buf bytes.Buffer
+		s, err := NewSealer(&buf, &SealOptions{Domain: "example.net", Selector: "arc", Key: key, AuthServID: "mx.example.net", Results: "spf=pass smtp.mailfrom=example.com", Verifier: v})
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		io.Copy(s, iotest.OneByteReader(strings.NewReader(message)))
+		if err := s.Close(); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		return buf.String(), s.Chain()
+	}
+
+	const message = "From: user@example.com\r\nTo: list@example.net\r\nSubject: sealed\r\n\r\nThis is a test.\r\n"
+	sealed, chain := seal(message)
+	if chain != ChainNone || !strings.HasPrefix(sealed, "ARC-Seal: i=1;") || !strings.HasSuffix(sealed, message) {
+		t.Fatalf("unexpected first seal %s %q", chain, sealed)
+	}
+	if !strings.Contains(sealed, "ARC-Authentication-Results: i=1; mx.example.net;") {
+		t.Fatalf("missing authentication results %q", sealed)
+	}
+	resealed, chain := seal(sealed)
+	if chain != ChainPass || !strings.HasPrefix(resealed, "ARC-Seal: i=2;") || !strings.Contains(resealed, "cv=pass") {
+		t.Fatalf("unexpected second seal %s %q", chain, resealed)
+	}
+	_, chain = seal(strings.Replace(sealed, "a test", "modified", 1))
+	if chain != ChainFail {
+		t.Fatalf("modified message chain %s", chain)
+	}
+
+	results := []*Result{{Status: StatusPass, Domain: "example.com", Selector: "ed"}, {Status: StatusFail, Domain: "example.org"}}
+	if s := FormatResults(results); s != "dkim=pass header.d=example.com header.s=ed;\r\n\tdkim=fail header.d=example.org" {
+		t.Fatalf("unexpected results %q", s)
+	}
+}
@@ -0,0 +1,239 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// defaultSignedHeaders are the header fields signed by default when present
+var defaultSignedHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// SignOptions configures a Signer.
+type SignOptions struct {
+	// Signing domain and selector of the public key record
+	Domain   string
+	Selector string
+
+	// Private key, an *rsa.PrivateKey or ed25519.PrivateKey
+	Key crypto.Signer
+
+	// Agent or user identifier, e.g. "@mail.example.com", omitted if empty
+	Identifier string
+
+	// Canonicalization of the header and the body, "relaxed" or "simple",
+	// "relaxed" if empty
+	HeaderCanonicalization string
+	BodyCanonicalization   string
+
+	// Header fields to sign when present, a default list of common fields
+	// if nil. From is always signed. Each signed field is also signed once
+	// more so it can not be added after signing.
+	Headers []string
+
+	// Time after which the signature expires, no expiration if zero
+	Expiration time.Duration
+}
+
+// Signer signs a message written to it and writes the signed message to the
+// underlying writer when it is closed. The body is hashed as it is written,
+// but the message is buffered as the DKIM-Signature field precedes it.
+type Signer struct {
+	w         io.Writer
+	opts      SignOptions
+	alg       string
+	header    []byte
+	body      bytes.Buffer
+	inBody    bool
+	hasher    *bodyHasher
+	signature string
+	closed    bool
+}
+
+// NewSigner returns a Signer that writes the signed message to w.
+func NewSigner(w io.Writer, opts *SignOptions) (*Signer, error) {
+	s := &Signer{w: w, opts: *opts}
+	switch opts.Key.(type) {
+	case *rsa.PrivateKey:
+		s.alg = "rsa-sha256"
+	case ed25519.PrivateKey:
+		s.alg = "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("dkim: unsupported key type %T", opts.Key)
+	}
+	if opts.Domain == "" || opts.Selector == "" {
+		return nil, errors.New("dkim: domain and selector required")
+	}
+	if s.opts.HeaderCanonicalization == "" {
+		s.opts.HeaderCanonicalization = "relaxed"
+	}
+	if s.opts.BodyCanonicalization == "" {
+		s.opts.BodyCanonicalization = "relaxed"
+	}
+	for _, c := range []string{s.opts.HeaderCanonicalization, s.opts.BodyCanonicalization} {
+		if c != "relaxed" && c != "simple" {
+			return nil, fmt.Errorf("dkim: unsupported canonicalization %q", c)
+		}
+	}
+	s.hasher = newBodyHasher(sha256.New(), s.opts.BodyCanonicalization == "relaxed", -1)
+	return s, nil
+}
+
+// Write writes message data.
+func (s *Signer) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("dkim: write after close")
+	}
+	if s.inBody {
+		s.hasher.Write(p)
+		return s.body.Write(p)
+	}
+	start := len(s.header) - 2
+	if start < 0 {
+		start = 0
+	}
+	s.header = append(s.header, p...)
+	if end := headerEnd(s.header, start); end != -1 {
+		s.inBody = true
+		rest := s.header[end:]
+		s.header = s.header[:end]
+		s.hasher.Write(rest)
+		s.body.Write(rest)
+	} else if len(s.header) > maxHeaderSize {
+		return 0, errors.New("dkim: header too large")
+	}
+	return len(p), nil
+}
+
+// Close signs the message and writes the DKIM-Signature field followed by
+// the message to the underlying writer.
+func (s *Signer) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	fields := splitFields(s.header)
+	signed, err := signedFields(fields, s.opts.Headers)
+	if err != nil {
+		return err
+	}
+	bodyHash, _ := s.hasher.sum()
+	tags := []string{
+		"v=1",
+		"a=" + s.alg,
+		"c=" + s.opts.HeaderCanonicalization + "/" + s.opts.BodyCanonicalization,
+		"d=" + s.opts.Domain,
+		"s=" + s.opts.Selector,
+	}
+	if s.opts.Identifier != "" {
+		tags = append(tags, "i="+s.opts.Identifier)
+	}
+	now := time.Now()
+	tags = append(tags, fmt.Sprintf("t=%d", now.Unix()))
+	if s.opts.Expiration > 0 {
+		tags = append(tags, fmt.Sprintf("x=%d", now.Add(s.opts.Expiration).Unix()))
+	}
+	tags = append(tags,
+		"h="+strings.ToLower(strings.Join(signed, ":")),
+		"bh="+base64.StdEncoding.EncodeToString(bodyHash))
+	relaxed := s.opts.HeaderCanonicalization == "relaxed"
+	s.signature, err = signField("DKIM-Signature", tags, s.opts.Key, func(field string, w io.Writer) {
+		sig := &signature{field: field, headers: signed, relaxedH: relaxed}
+		sig.writeHeaders(w, fields)
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(s.w, s.signature); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(s.header); err != nil {
+		return err
+	}
+	_, err = s.body.WriteTo(s.w)
+	return err
+}
+
+// signedFields returns the names of the fields to sign from names, or from
+// the default list if nil. Each name is included once more than the number
+// of fields with that name, and From is required.
+func signedFields(fields []string, names []string) ([]string, error) {
+	if names == nil {
+		names = defaultSignedHeaders
+	}
+	var signed []string
+	seen := make(map[string]bool)
+	for _, name := range append([]string{"From"}, names...) {
+		key := strings.ToLower(name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		n := 0
+		for _, field := range fields {
+			if fieldName, _ := splitField(field); strings.EqualFold(fieldName, name) {
+				n++
+			}
+		}
+		if n == 0 {
+			if key == "from" {
+				return nil, errors.New("dkim: message without From field")
+			}
+			continue
+		}
+		for i := 0; i <= n; i++ {
+			signed = append(signed, name)
+		}
+	}
+	return signed, nil
+}
+
+// signField returns a signature header field with the tags and the
+// signature of the data written by writeData, which is passed the field
+// with an empty b= tag
+func signField(name string, tags []string, key crypto.Signer, writeData func(field string, w io.Writer)) (string, error) {
+	field := name + ": " + strings.Join(append(tags, "b="), ";\r\n\t")
+	h := sha256.New()
+	writeData(field+"\r\n", h)
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		opts = crypto.Hash(0)
+	}
+	data, err := key.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return "", err
+	}
+	return field + foldBase64(base64.StdEncoding.EncodeToString(data)) + "\r\n", nil
+}
+
+// Signature returns the DKIM-Signature header field including CRLF after
+// Close.
+func (s *Signer) Signature() string {
+	return s.signature
+}
+
+// foldBase64 folds base64 data in lines of at most 72 characters
+func foldBase64(s string) string {
+	var b strings.Builder
+	for len(s) > 72 {
+		b.WriteString(s[:72])
+		b.WriteString("\r\n\t")
+		s = s[72:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
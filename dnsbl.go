@@ -0,0 +1,38 @@
+package smtpd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DNSBL checks client IP addresses against DNS blocklists, see package
+// github.com/emailfabric/smtpd/dnsbl.
+type DNSBL interface {
+	// Lookup returns the blocklists that list ip, and whether the client
+	// should be blocked
+	Lookup(ctx context.Context, ip net.IP) (listed []string, block bool, err error)
+}
+
+// checkDNSBL looks up the client in Server.DNSBL before Connect, it returns
+// an error when the client must be refused
+func (s *session) checkDNSBL() error {
+	if s.server.DNSBL == nil || s.exempt {
+		return nil
+	}
+	ip := remoteIP(s.RemoteAddr)
+	if ip == nil {
+		return nil
+	}
+	listed, block, err := s.server.DNSBL.Lookup(s.ctx, ip)
+	if err != nil {
+		s.logf("DNSBL lookup of %s failed: %v", ip, err)
+		return nil
+	}
+	s.DNSBLListed, s.DNSBLBlocked = listed, block
+	if block && s.server.DNSBLReject {
+		return fmt.Errorf("554 5.7.1 Client host [%s] listed on %s", ip, strings.Join(listed, ", "))
+	}
+	return nil
+}
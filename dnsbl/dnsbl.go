@@ -0,0 +1,204 @@
+/*
+Package dnsbl checks client IP addresses against DNS blocklists like
+zen.spamhaus.org.
+
+A Checker queries its lists in parallel, adds up the weights of the lists
+that list an address and caches the results. It implements smtpd.DNSBL, so
+a server refuses listed clients at connect when Server.DNSBLReject is set,
+or the listings are passed to the handler in the Session.
+*/
+package dnsbl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// List is a DNS blocklist.
+type List struct {
+	// Zone of the list, e.g. "zen.spamhaus.org"
+	Zone string
+
+	// Weight added to the score when an address is listed, 1 if zero
+	Weight float64
+
+	// Return codes that count as a listing, e.g. "127.0.0.2". Any address
+	// in 127.0.0.0/8 counts when empty, except 127.255.255.0/24 which is
+	// used for errors like refused queries.
+	Codes []string
+}
+
+// Result is the result of checking an IP address.
+type Result struct {
+	Listed []string // zones of the lists that list the address
+	Score  float64  // sum of the weights of the listing lists
+}
+
+// Checker checks IP addresses against blocklists. A Checker can be shared
+// by servers.
+type Checker struct {
+	Lists []List
+
+	// Score at which an address is blocked, 1 if zero
+	Threshold float64
+
+	// Maximum time for the lookups of an address, 5 seconds if zero. Lists
+	// that do not answer in time do not list the address.
+	Timeout time.Duration
+
+	// Time to cache results, 5 minutes if zero
+	CacheTTL time.Duration
+
+	// LookupHost looks up the addresses of a name, defaults to
+	// net.DefaultResolver.LookupHost
+	LookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mu      sync.Mutex
+	cache   map[string]*cacheEntry
+	pruneAt int
+}
+
+type cacheEntry struct {
+	result  *Result
+	expires time.Time
+}
+
+func (c *Checker) threshold() float64 {
+	if c.Threshold > 0 {
+		return c.Threshold
+	}
+	return 1
+}
+
+// Check returns the lists that list ip and the score. Failed lookups are
+// treated as not listed, an error is only returned for an invalid address.
+func (c *Checker) Check(ctx context.Context, ip net.IP) (*Result, error) {
+	name := reverse(ip)
+	if name == "" {
+		return nil, fmt.Errorf("dnsbl: invalid IP address %v", ip)
+	}
+	now := time.Now()
+	c.mu.Lock()
+	if e := c.cache[name]; e != nil && now.Before(e.expires) {
+		c.mu.Unlock()
+		return e.result, nil
+	}
+	c.mu.Unlock()
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	listed := make([]bool, len(c.Lists))
+	var wg sync.WaitGroup
+	for i := range c.Lists {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			listed[i] = c.lookup(ctx, name, &c.Lists[i])
+		}(i)
+	}
+	wg.Wait()
+
+	result := &Result{}
+	for i, l := range c.Lists {
+		if !listed[i] {
+			continue
+		}
+		result.Listed = append(result.Listed, l.Zone)
+		if l.Weight != 0 {
+			result.Score += l.Weight
+		} else {
+			result.Score++
+		}
+	}
+	if ctx.Err() == nil || len(result.Listed) > 0 {
+		c.store(name, result, now)
+	}
+	return result, nil
+}
+
+// Lookup implements smtpd.DNSBL, the address is blocked when the score
+// reaches the threshold.
+func (c *Checker) Lookup(ctx context.Context, ip net.IP) (listed []string, block bool, err error) {
+	result, err := c.Check(ctx, ip)
+	if err != nil {
+		return nil, false, err
+	}
+	return result.Listed, result.Score >= c.threshold(), nil
+}
+
+// lookup returns true if the reversed address name is listed on l
+func (c *Checker) lookup(ctx context.Context, name string, l *List) bool {
+	lookup := c.LookupHost
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupHost
+	}
+	addrs, err := lookup(ctx, name+"."+strings.TrimSuffix(l.Zone, "."))
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if len(l.Codes) > 0 {
+			for _, code := range l.Codes {
+				if addr == code {
+					return true
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(addr, "127.") && !strings.HasPrefix(addr, "127.255.255.") {
+			return true
+		}
+	}
+	return false
+}
+
+// store caches a result and removes expired entries when the cache grows
+func (c *Checker) store(name string, result *Result, now time.Time) {
+	ttl := c.CacheTTL
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = make(map[string]*cacheEntry)
+	}
+	if len(c.cache) >= c.pruneAt {
+		for key, e := range c.cache {
+			if !now.Before(e.expires) {
+				delete(c.cache, key)
+			}
+		}
+		c.pruneAt = 2 * len(c.cache)
+		if c.pruneAt < 1024 {
+			c.pruneAt = 1024
+		}
+	}
+	c.cache[name] = &cacheEntry{result: result, expires: now.Add(ttl)}
+}
+
+// reverse returns the name of ip for DNSBL queries, the octets of an IPv4
+// address or the nibbles of an IPv6 address in reverse order
+func reverse(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	if len(ip) != net.IPv6len {
+		return ""
+	}
+	const hex = "0123456789abcdef"
+	b := make([]byte, 0, 4*net.IPv6len)
+	for i := net.IPv6len - 1; i >= 0; i-- {
+		b = append(b, hex[ip[i]&0xf], '.', hex[ip[i]>>4], '.')
+	}
+	return string(b[:len(b)-1])
+}
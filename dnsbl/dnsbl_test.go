@@ -0,0 +1,67 @@
+package dnsbl
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReverse(t *testing.T) {
+
+	for ip, expected := range map[string]string{
+		"192.0.2.99":  "99.2.0.192",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2",
+	} {
+		if name := reverse(net.ParseIP(ip)); name != expected {
+			t.Errorf("%s: unexpected name %q", ip, name)
+		}
+	}
+}
+
+func TestChecker(t *testing.T) {
+
+	var lookups int32
+	records := map[string][]string{
+		"2.0.0.127.zen.example.org":  {"127.0.0.2"},
+		"2.0.0.127.bl.example.net":   {"127.0.0.4"},
+		"2.0.0.127.weak.example.com": {"127.0.0.2"},
+		"3.0.0.127.zen.example.org":  {"127.255.255.254"}, // query refused
+	}
+	c := &Checker{
+		Lists: []List{
+			{Zone: "zen.example.org"},
+			{Zone: "bl.example.net", Codes: []string{"127.0.0.2"}},
+			{Zone: "weak.example.com", Weight: 0.5},
+		},
+		Threshold: 1.5,
+		LookupHost: func(ctx context.Context, host string) ([]string, error) {
+			atomic.AddInt32(&lookups, 1)
+			if addrs, ok := records[host]; ok {
+				return addrs, nil
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		},
+	}
+	ctx := context.Background()
+
+	listed, block, err := c.Lookup(ctx, net.ParseIP("127.0.0.2"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(listed) != 2 || listed[0] != "zen.example.org" || listed[1] != "weak.example.com" || !block {
+		t.Fatalf("unexpected result %v %t", listed, block)
+	}
+	// result is cached
+	if c.Lookup(ctx, net.ParseIP("127.0.0.2")); lookups != 3 {
+		t.Fatalf("unexpected lookups %d", lookups)
+	}
+
+	listed, block, _ = c.Lookup(ctx, net.ParseIP("127.0.0.3"))
+	if len(listed) != 0 || block {
+		t.Fatalf("unexpected result %v %t", listed, block)
+	}
+	if _, err := c.Check(ctx, nil); err == nil {
+		t.Fatalf("expected error for invalid address")
+	}
+}
@@ -0,0 +1,273 @@
+/*
+Package dsn builds delivery status notifications (RFC 3464), the bounce
+messages sent to the sender when a message could not be delivered or is
+delayed.
+
+A Report collects the status of recipients, for example from the OnFailed
+hook of a queue.Queue, and writes a multipart/report message that includes
+the headers of the original message, or the full message when the sender
+requested it with RET=FULL. Messages sent with SMTPUTF8 are reported with
+the internationalized types of RFC 6533.
+*/
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+	"github.com/emailfabric/smtpd/spool"
+)
+
+// Actions of recipients
+const (
+	ActionFailed    = "failed"
+	ActionDelayed   = "delayed"
+	ActionDelivered = "delivered"
+	ActionRelayed   = "relayed"
+	ActionExpanded  = "expanded"
+)
+
+// ErrNullSender is returned when the sender is empty, no notifications are
+// sent for messages with a null reverse-path.
+var ErrNullSender = errors.New("dsn: null reverse-path")
+
+// RecipientStatus is the status of a recipient.
+type RecipientStatus struct {
+	Recipient smtpd.Recipient
+	Action    string
+	Status    string // enhanced status code, e.g. "5.1.1"
+
+	// Reply of the remote server and its hostname, empty if not known
+	Diagnostic string
+	RemoteMTA  string
+
+	LastAttempt time.Time
+}
+
+// Report is a delivery status notification.
+type Report struct {
+	// Hostname of the server that reports
+	ReportingMTA string
+
+	// Envelope of the original message and the time it was received
+	Envelope smtpd.Envelope
+	Arrival  time.Time
+
+	Recipients []RecipientStatus
+}
+
+// NewReport returns a report for a spooled message.
+func NewReport(hostname string, e *spool.Entry) *Report {
+	return &Report{ReportingMTA: hostname, Envelope: e.Envelope, Arrival: e.Received}
+}
+
+var reReply = regexp.MustCompile(`^([245])\d\d[ -](?:([245]\.\d{1,3}\.\d{1,3}) )?`)
+
+// Add adds the status of a recipient for the reply of a failed or delayed
+// delivery attempt, given as error like the errors of a queue.Deliverer.
+// The recipient is not added when its NOTIFY parameter excludes the
+// notification, and false is returned.
+func (r *Report) Add(rcpt smtpd.Recipient, action string, err error) bool {
+	if !notify(rcpt, action) {
+		return false
+	}
+	s := RecipientStatus{Recipient: rcpt, Action: action, LastAttempt: time.Now()}
+	class := "5"
+	if action == ActionDelayed {
+		class = "4"
+	}
+	s.Status = class + ".0.0"
+	if err != nil {
+		msg := err.Error()
+		if reply, ok := err.(*smtpd.Reply); ok && reply.EnhancedCode != "" {
+			s.Status = reply.EnhancedCode
+			s.Diagnostic = msg
+		} else if m := reReply.FindStringSubmatch(msg); m != nil {
+			if m[2] != "" {
+				s.Status = m[2]
+			} else {
+				s.Status = m[1] + ".0.0"
+			}
+			s.Diagnostic = msg
+		}
+	}
+	r.Recipients = append(r.Recipients, s)
+	return true
+}
+
+// notify returns true if the NOTIFY parameter of rcpt requests a
+// notification for action. Without NOTIFY failures and delays are reported.
+func notify(rcpt smtpd.Recipient, action string) bool {
+	if len(rcpt.Notify) == 0 {
+		return action == ActionFailed || action == ActionDelayed
+	}
+	want := map[string]string{
+		ActionFailed:    "FAILURE",
+		ActionDelayed:   "DELAY",
+		ActionDelivered: "SUCCESS",
+		ActionRelayed:   "SUCCESS",
+		ActionExpanded:  "SUCCESS",
+	}[action]
+	for _, n := range rcpt.Notify {
+		if strings.EqualFold(n, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes the notification message to w, original is the original
+// message with CRLF line endings. Only the header of the original is
+// included unless the sender requested the full message with RET=FULL.
+func (r *Report) Write(w io.Writer, original io.Reader) error {
+	if r.Envelope.Sender == "" {
+		return ErrNullSender
+	}
+	if len(r.Recipients) == 0 {
+		return errors.New("dsn: no recipients")
+	}
+	boundary := randomID()
+	now := time.Now()
+	deliveryStatus, messageType, headersType := "message/delivery-status", "message/rfc822", "text/rfc822-headers"
+	if r.Envelope.SMTPUTF8 {
+		deliveryStatus, messageType, headersType = "message/global-delivery-status", "message/global", "message/global-headers"
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", r.ReportingMTA)
+	fmt.Fprintf(bw, "To: <%s>\r\n", r.Envelope.Sender)
+	fmt.Fprintf(bw, "Subject: %s\r\n", r.subject())
+	fmt.Fprintf(bw, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(bw, "Message-ID: <%s@%s>\r\n", randomID(), r.ReportingMTA)
+	bw.WriteString("Auto-Submitted: auto-replied\r\nMIME-Version: 1.0\r\n")
+	fmt.Fprintf(bw, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+	bw.WriteString("This is a MIME-encapsulated message.\r\n\r\n")
+
+	fmt.Fprintf(bw, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", boundary)
+	r.writeText(bw)
+
+	fmt.Fprintf(bw, "\r\n--%s\r\nContent-Type: %s\r\n\r\n", boundary, deliveryStatus)
+	r.writeStatus(bw)
+
+	full := strings.EqualFold(r.Envelope.Ret, "FULL")
+	if full {
+		fmt.Fprintf(bw, "--%s\r\nContent-Type: %s\r\n\r\n", boundary, messageType)
+	} else {
+		fmt.Fprintf(bw, "--%s\r\nContent-Type: %s\r\n\r\n", boundary, headersType)
+	}
+	if err := writeOriginal(bw, original, full); err != nil {
+		return err
+	}
+	fmt.Fprintf(bw, "\r\n--%s--\r\n", boundary)
+	return bw.Flush()
+}
+
+func (r *Report) subject() string {
+	for _, s := range r.Recipients {
+		if s.Action == ActionFailed {
+			return "Undelivered Mail Returned to Sender"
+		}
+	}
+	for _, s := range r.Recipients {
+		if s.Action == ActionDelayed {
+			return "Delayed Mail (still being retried)"
+		}
+	}
+	return "Successful Mail Delivery Report"
+}
+
+// writeText writes the human readable part
+func (r *Report) writeText(w *bufio.Writer) {
+	fmt.Fprintf(w, "This is the mail system at host %s.\r\n\r\n", r.ReportingMTA)
+	for _, s := range r.Recipients {
+		switch s.Action {
+		case ActionFailed:
+			fmt.Fprintf(w, "Your message could not be delivered to <%s>.\r\n", s.Recipient.Address)
+		case ActionDelayed:
+			fmt.Fprintf(w, "Your message could not be delivered to <%s> yet, delivery will be retried.\r\n", s.Recipient.Address)
+		default:
+			fmt.Fprintf(w, "Your message was %s to <%s>.\r\n", s.Action, s.Recipient.Address)
+		}
+		if s.Diagnostic != "" {
+			fmt.Fprintf(w, "The server replied: %s\r\n", s.Diagnostic)
+		}
+		w.WriteString("\r\n")
+	}
+}
+
+// writeStatus writes the per-message and per-recipient fields
+func (r *Report) writeStatus(w *bufio.Writer) {
+	fmt.Fprintf(w, "Reporting-MTA: dns; %s\r\n", r.ReportingMTA)
+	if r.Envelope.EnvID != "" {
+		fmt.Fprintf(w, "Original-Envelope-Id: %s\r\n", r.Envelope.EnvID)
+	}
+	if !r.Arrival.IsZero() {
+		fmt.Fprintf(w, "Arrival-Date: %s\r\n", r.Arrival.Format(time.RFC1123Z))
+	}
+	addressType := "rfc822"
+	if r.Envelope.SMTPUTF8 {
+		addressType = "utf-8"
+	}
+	for _, s := range r.Recipients {
+		fmt.Fprintf(w, "\r\nFinal-Recipient: %s; %s\r\n", addressType, s.Recipient.Address)
+		if s.Recipient.ORcpt != "" {
+			orcptType := s.Recipient.ORcptType
+			if orcptType == "" {
+				orcptType = "rfc822"
+			}
+			fmt.Fprintf(w, "Original-Recipient: %s; %s\r\n", orcptType, s.Recipient.ORcpt)
+		}
+		fmt.Fprintf(w, "Action: %s\r\nStatus: %s\r\n", s.Action, s.Status)
+		if s.RemoteMTA != "" {
+			fmt.Fprintf(w, "Remote-MTA: dns; %s\r\n", s.RemoteMTA)
+		}
+		if s.Diagnostic != "" {
+			fmt.Fprintf(w, "Diagnostic-Code: smtp; %s\r\n", s.Diagnostic)
+		}
+		if !s.LastAttempt.IsZero() {
+			fmt.Fprintf(w, "Last-Attempt-Date: %s\r\n", s.LastAttempt.Format(time.RFC1123Z))
+		}
+	}
+	w.WriteString("\r\n")
+}
+
+// writeOriginal writes the original message, or only its header
+func writeOriginal(w *bufio.Writer, original io.Reader, full bool) error {
+	if full {
+		_, err := io.Copy(w, original)
+		return err
+	}
+	br := bufio.NewReader(original)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return nil // end of header
+		}
+		w.Write(line)
+		if err == io.EOF {
+			if !bytes.HasSuffix(line, []byte("\n")) {
+				w.WriteString("\r\n")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// randomID returns a random identifier in hex
+func randomID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,93 @@
+package dsn
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+	"github.com/emailfabric/smtpd/spool"
+)
+
+func TestReport(t *testing.T) {
+
+	const original = "Subject: test\r\nFrom: sender@example.com\r\n\r\nThis is a test.\r\n"
+	e := &spool.Entry{Metadata: smtpd.Metadata{
+		Received: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		Envelope: smtpd.Envelope{Sender: "sender@example.com", EnvID: "env1"},
+	}}
+	r := NewReport("mx.example.net", e)
+	if !r.Add(smtpd.Recipient{Address: "a@example.org", ORcptType: "rfc822", ORcpt: "A@example.org"}, ActionFailed, smtpd.NewReply(550, "5.1.1", "No such user")) {
+		t.Fatalf("recipient not added")
+	}
+	r.Add(smtpd.Recipient{Address: "b@example.org"}, ActionFailed, errors.New("connection refused"))
+	if r.Add(smtpd.Recipient{Address: "c@example.org", Notify: []string{"NEVER"}}, ActionFailed, nil) {
+		t.Fatalf("recipient with NOTIFY=NEVER added")
+	}
+	r.Recipients[1].RemoteMTA = "mx.example.org"
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf, strings.NewReader(original)); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	msg, err := mail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg.Header.Get("To") != "<sender@example.com>" || msg.Header.Get("Subject") != "Undelivered Mail Returned to Sender" {
+		t.Fatalf("unexpected header %v", msg.Header)
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("unexpected content type %q", msg.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var types, bodies []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		data, _ := ioutil.ReadAll(p)
+		types = append(types, p.Header.Get("Content-Type"))
+		bodies = append(bodies, string(data))
+	}
+	if len(types) != 3 || types[1] != "message/delivery-status" || types[2] != "text/rfc822-headers" {
+		t.Fatalf("unexpected parts %q", types)
+	}
+	for _, field := range []string{
+		"Reporting-MTA: dns; mx.example.net\r\nOriginal-Envelope-Id: env1\r\nArrival-Date: Fri, 01 Mar 2024 12:00:00 +0000\r\n",
+		"\r\nFinal-Recipient: rfc822; a@example.org\r\nOriginal-Recipient: rfc822; A@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\nDiagnostic-Code: smtp; 550 5.1.1 No such user\r\n",
+		"\r\nFinal-Recipient: rfc822; b@example.org\r\nAction: failed\r\nStatus: 5.0.0\r\nRemote-MTA: dns; mx.example.org\r\n",
+	} {
+		if !strings.Contains(bodies[1], field) {
+			t.Fatalf("missing %q in %q", field, bodies[1])
+		}
+	}
+	if bodies[2] != "Subject: test\r\nFrom: sender@example.com\r\n" {
+		t.Fatalf("unexpected headers %q", bodies[2])
+	}
+
+	// full message, delayed
+	r = &Report{ReportingMTA: "mx.example.net", Envelope: smtpd.Envelope{Sender: "sender@example.com", Ret: "FULL", SMTPUTF8: true}}
+	r.Add(smtpd.Recipient{Address: "a@example.org"}, ActionDelayed, errors.New("451 Try again"))
+	if r.Recipients[0].Status != "4.0.0" {
+		t.Fatalf("unexpected status %q", r.Recipients[0].Status)
+	}
+	buf.Reset()
+	r.Write(&buf, strings.NewReader(original))
+	if s := buf.String(); !strings.Contains(s, "Subject: Delayed Mail") || !strings.Contains(s, "Content-Type: message/global\r\n\r\n"+original) {
+		t.Fatalf("unexpected report %q", s)
+	}
+
+	r.Envelope.Sender = ""
+	if err := r.Write(&buf, strings.NewReader(original)); err != ErrNullSender {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package smtpd
+
+import (
+	"errors"
+)
+
+// ErrEarlyTalker is the reply to clients that send data before the greeting.
+var ErrEarlyTalker = errors.New("554 5.5.1 Protocol error, data received before greeting")
+
+// greetDelay waits for Server.GreetDelay before the greeting is sent and
+// returns ErrEarlyTalker if the client sent data in the meantime. Such early
+// talkers are almost always spambots that do not wait for the server.
+func (s *session) greetDelay() error {
+	s.conn.SetReadTimeout(s.server.GreetDelay)
+	_, err := s.conn.r.R.Peek(1)
+	s.conn.SetReadTimeout(0)
+	if err == nil {
+		return ErrEarlyTalker
+	}
+	if isTimeout(err) {
+		return nil
+	}
+	return err
+}
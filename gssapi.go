@@ -0,0 +1,122 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+)
+
+// GSSAPIContext is the acceptor side of a GSS-API security context, e.g. an
+// adapter for a Kerberos library.
+type GSSAPIContext interface {
+	// Accept processes a context token of the client and returns the token
+	// to send back, established is true when the context is complete
+	Accept(token []byte) (output []byte, established bool, err error)
+
+	// Wrap and Unwrap protect the messages that negotiate the security layer
+	Wrap(msg []byte) ([]byte, error)
+	Unwrap(token []byte) ([]byte, error)
+
+	// Principal returns the name of the authenticated client, e.g.
+	// "alice@EXAMPLE.COM"
+	Principal() string
+}
+
+// GSSAPIMechanism returns the GSSAPI mechanism (RFC 4752) for
+// Server.SASLMechanisms. NewContext returns a security context for an
+// exchange, MapPrincipal maps the authenticated principal and the requested
+// authorization identity, which may be empty, to the username.
+// No security layer is offered, use TLS instead.
+func GSSAPIMechanism(newContext func(ctx context.Context) (GSSAPIContext, error),
+	mapPrincipal func(ctx context.Context, principal, identity string) (username string, err error)) SASLMechanism {
+	return gssapiMechanism{newContext, mapPrincipal}
+}
+
+type gssapiMechanism struct {
+	newContext   func(ctx context.Context) (GSSAPIContext, error)
+	mapPrincipal func(ctx context.Context, principal, identity string) (string, error)
+}
+
+func (m gssapiMechanism) Name() string { return "GSSAPI" }
+
+func (m gssapiMechanism) Start(ctx context.Context) (SASLServer, error) {
+	gss, err := m.newContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &gssapiExchange{ctx: ctx, mech: m, gss: gss}, nil
+}
+
+// states of a GSSAPI exchange
+const (
+	gssapiAccepting   = iota // establishing the security context
+	gssapiEstablished        // waiting for the empty response to the final token
+	gssapiNegotiating        // waiting for the security layer of the client
+)
+
+// gssapiNoSecurityLayer is the security layer bit for no protection
+const gssapiNoSecurityLayer = 1
+
+var errGSSAPI = errors.New("535 5.7.8 GSSAPI authentication failed")
+
+type gssapiExchange struct {
+	ctx      context.Context
+	mech     gssapiMechanism
+	gss      GSSAPIContext
+	state    int
+	identity string
+	username string
+}
+
+func (e *gssapiExchange) Next(response []byte) ([]byte, bool, error) {
+	switch e.state {
+	case gssapiAccepting:
+		if len(response) == 0 {
+			// ask for the first context token
+			return []byte{}, false, nil
+		}
+		output, established, err := e.gss.Accept(response)
+		if err != nil {
+			return nil, false, errGSSAPI
+		}
+		if !established {
+			return output, false, nil
+		}
+		if len(output) > 0 {
+			e.state = gssapiEstablished
+			return output, false, nil
+		}
+		return e.securityLayer()
+	case gssapiEstablished:
+		if len(response) != 0 {
+			return nil, false, errGSSAPI
+		}
+		return e.securityLayer()
+	case gssapiNegotiating:
+		msg, err := e.gss.Unwrap(response)
+		if err != nil || len(msg) < 4 || msg[0]&gssapiNoSecurityLayer == 0 {
+			return nil, false, errGSSAPI
+		}
+		e.identity = string(msg[4:])
+		e.username, err = e.mech.mapPrincipal(e.ctx, e.gss.Principal(), e.identity)
+		if err != nil {
+			return nil, false, err
+		}
+		return nil, true, nil
+	}
+	return nil, false, errGSSAPI
+}
+
+// securityLayer returns the wrapped message that offers no security layer
+// and no maximum message size
+func (e *gssapiExchange) securityLayer() ([]byte, bool, error) {
+	msg, err := e.gss.Wrap([]byte{gssapiNoSecurityLayer, 0, 0, 0})
+	if err != nil {
+		return nil, false, errGSSAPI
+	}
+	e.state = gssapiNegotiating
+	return msg, false, nil
+}
+
+func (e *gssapiExchange) Identity() (string, string) {
+	return e.identity, e.username
+}
@@ -0,0 +1,89 @@
+package smtpd
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fakeGSSAPI establishes the context with the tokens "hello" and "ticket",
+// and wraps messages with a "wrapped:" prefix
+type fakeGSSAPI struct {
+	tokens int
+}
+
+func (g *fakeGSSAPI) Accept(token []byte) ([]byte, bool, error) {
+	g.tokens++
+	switch {
+	case g.tokens == 1 && string(token) == "hello":
+		return []byte("continue"), false, nil
+	case g.tokens == 2 && string(token) == "ticket":
+		return []byte("mutual"), true, nil
+	}
+	return nil, false, errors.New("invalid token")
+}
+
+func (g *fakeGSSAPI) Wrap(msg []byte) ([]byte, error) {
+	return append([]byte("wrapped:"), msg...), nil
+}
+
+func (g *fakeGSSAPI) Unwrap(token []byte) ([]byte, error) {
+	if !strings.HasPrefix(string(token), "wrapped:") {
+		return nil, errors.New("invalid token")
+	}
+	return token[8:], nil
+}
+
+func (g *fakeGSSAPI) Principal() string { return "alice@EXAMPLE.COM" }
+
+func TestGSSAPI(t *testing.T) {
+
+	mech := GSSAPIMechanism(
+		func(ctx context.Context) (GSSAPIContext, error) { return &fakeGSSAPI{}, nil },
+		func(ctx context.Context, principal, identity string) (string, error) {
+			if identity != "" && identity != "alice@example.com" {
+				return "", NewReply(535, "5.7.8", "Not authorized")
+			}
+			return strings.ToLower(principal), nil
+		})
+	handler := &sessionHandler{}
+	c, done := dialServerContext(t, &Server{SASLMechanisms: []SASLMechanism{mech}}, handler)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 250, "EHLO localhost"); !strings.Contains(msg, "AUTH CRAM-MD5 GSSAPI\n") {
+		t.Fatalf("mechanism not advertised: %q", msg)
+	}
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	cmd(t, c, 535, "AUTH GSSAPI %s", encode("bogus"))
+	cmd(t, c, 334, "AUTH GSSAPI %s", encode("hello"))
+	cmd(t, c, 334, "%s", encode("ticket"))
+	if msg := cmd(t, c, 334, ""); msg != encode("wrapped:\x01\x00\x00\x00") {
+		t.Fatalf("unexpected security layer %q", msg)
+	}
+	cmd(t, c, 535, "%s", encode("wrapped:\x01\x00\x00\x00bob@example.com"))
+
+	if msg := cmd(t, c, 334, "AUTH GSSAPI"); msg != "" {
+		t.Fatalf("unexpected challenge %q", msg)
+	}
+	cmd(t, c, 334, "%s", encode("hello"))
+	cmd(t, c, 334, "%s", encode("ticket"))
+	cmd(t, c, 334, "")
+	cmd(t, c, 235, "%s", encode("wrapped:\x01\x00\x00\x00"))
+	cmd(t, c, 250, "MAIL FROM:<alice@example.com>")
+	cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+	if handler.session.AuthUsername != "alice@example.com" {
+		t.Fatalf("unexpected username %q", handler.session.AuthUsername)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Package filestore keeps items in a directory, each as a data file and a
+metadata file in JSON, for the spool and the quarantine.
+
+The data file is written and synced first. The metadata is written to a
+temporary file, synced and renamed into place, which commits the item, and
+the directory is synced so the rename is persisted.
+*/
+package filestore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TempExt is the extension of metadata files that are not yet committed.
+const TempExt = ".tmp"
+
+// Store is a directory of items.
+type Store struct {
+	Dir     string
+	DataExt string // extension of the data files
+	MetaExt string // extension of the metadata files
+}
+
+// Path returns the name of the file of the item id with extension ext.
+func (s *Store) Path(id, ext string) string {
+	return filepath.Join(s.Dir, id+ext)
+}
+
+// WriteData writes the data of the item id read from r and syncs it. The
+// file must not exist.
+func (s *Store) WriteData(id string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(s.Path(id, s.DataExt), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// WriteMeta writes v as the metadata of the item id to a temporary file and
+// renames it into place.
+func (s *Store) WriteMeta(id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := s.Path(id, TempExt)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path(id, s.MetaExt))
+}
+
+// Add writes the data of the item id read from r and then the metadata
+// returned by meta for the size of the data. The files are removed when
+// that fails.
+func (s *Store) Add(id string, r io.Reader, meta func(size int64) interface{}) error {
+	size, err := s.WriteData(id, r)
+	if err == nil {
+		err = s.WriteMeta(id, meta(size))
+	}
+	if err == nil {
+		err = s.SyncDir()
+	}
+	if err != nil {
+		os.Remove(s.Path(id, TempExt))
+		os.Remove(s.Path(id, s.DataExt))
+	}
+	return err
+}
+
+// SyncDir syncs the directory so renamed and removed files are persisted.
+func (s *Store) SyncDir() error {
+	d, err := os.Open(s.Dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// IDs returns the IDs of the committed items.
+func (s *Store) IDs() ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(s.Dir, "*"+s.MetaExt))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(names))
+	for _, name := range names {
+		if id := strings.TrimSuffix(filepath.Base(name), s.MetaExt); ValidID(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// ReadMeta decodes the metadata of the item id into v.
+func (s *Store) ReadMeta(id string, v interface{}) error {
+	f, err := os.Open(s.Path(id, s.MetaExt))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+// Remove removes the item id, the metadata first so an item is not listed
+// with its data missing. The error satisfies os.IsNotExist when the item
+// does not exist.
+func (s *Store) Remove(id string) error {
+	if err := os.Remove(s.Path(id, s.MetaExt)); err != nil {
+		return err
+	}
+	if err := os.Remove(s.Path(id, s.DataExt)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// NewID returns a random item ID.
+func NewID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidID reports whether id is an item ID, which prevents access to files
+// outside the directory.
+func ValidID(id string) bool {
+	if len(id) != 24 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,62 @@
+package filestore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+type failReader struct{}
+
+func (failReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	s := &Store{Dir: dir, DataExt: ".msg", MetaExt: ".env"}
+	id := NewID()
+	if !ValidID(id) || ValidID("../"+id[3:]) {
+		t.Fatalf("unexpected ID validation")
+	}
+	var meta struct{ Size int64 }
+	err = s.Add(id, strings.NewReader("data"), func(size int64) interface{} {
+		meta.Size = size
+		return meta
+	})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	meta.Size = 0
+	if err := s.ReadMeta(id, &meta); err != nil || meta.Size != 4 {
+		t.Fatalf("unexpected metadata %+v: %v", meta, err)
+	}
+
+	// the files of a failed item are removed
+	failed := NewID()
+	if err := s.Add(failed, failReader{}, func(size int64) interface{} { return nil }); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := os.Stat(s.Path(failed, s.DataExt)); !os.IsNotExist(err) {
+		t.Fatalf("data of failed item not removed")
+	}
+
+	ids, err := s.IDs()
+	if err != nil || len(ids) != 1 || ids[0] != id {
+		t.Fatalf("unexpected IDs %v: %v", ids, err)
+	}
+	if err := s.Remove(id); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := s.Remove(id); !os.IsNotExist(err) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
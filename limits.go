@@ -0,0 +1,54 @@
+package smtpd
+
+import (
+	"errors"
+)
+
+// errTooManyConnections is the greeting of connections over the limits of
+// Server.MaxConnections or Server.MaxConnectionsPerIP
+var errTooManyConnections = errors.New("421 4.3.2 Too many connections, try again later")
+
+// ConnectionCounts returns the number of open connections, and the number
+// of open connections by remote IP address.
+func (s *Server) ConnectionCounts() (total int, perIP map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	perIP = make(map[string]int, len(s.ipConns))
+	for ip, n := range s.ipConns {
+		perIP[ip] = n
+	}
+	return s.numConns, perIP
+}
+
+// acquireConn counts a connection from ip, it returns false without counting
+// the connection when a limit is exceeded. The ip is empty when unknown.
+func (s *Server) acquireConn(ip string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.MaxConnections > 0 && s.numConns >= s.MaxConnections {
+		return false
+	}
+	if ip != "" {
+		if s.MaxConnectionsPerIP > 0 && s.ipConns[ip] >= s.MaxConnectionsPerIP {
+			return false
+		}
+		if s.ipConns == nil {
+			s.ipConns = make(map[string]int)
+		}
+		s.ipConns[ip]++
+	}
+	s.numConns++
+	return true
+}
+
+// releaseConn removes a connection counted by acquireConn
+func (s *Server) releaseConn(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.numConns--
+	if ip != "" {
+		if s.ipConns[ip]--; s.ipConns[ip] <= 0 {
+			delete(s.ipConns, ip)
+		}
+	}
+}
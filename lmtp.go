@@ -0,0 +1,53 @@
+package smtpd
+
+// RecipientErrors can be returned by Handler.Message in LMTP mode to give a
+// separate reply for each recipient, in the order of Envelope.Recipients. A
+// nil element accepts the message for the recipient. Recipients without an
+// element are replied with a temporary failure.
+//
+// Any other error returned by Message is replied for all recipients. In SMTP
+// mode, the first non-nil error is replied for the message.
+type RecipientErrors []error
+
+func (e RecipientErrors) Error() string {
+	for _, err := range e {
+		if err != nil {
+			return err.Error()
+		}
+	}
+	return "no recipient errors"
+}
+
+// messageError returns the error to reply after the message data in SMTP
+// mode
+func messageError(err error) error {
+	if errs, ok := err.(RecipientErrors); ok {
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return err
+}
+
+// lmtpReply replies for each recipient after the message data in LMTP mode
+// (RFC 2033)
+func (s *session) lmtpReply(err error) {
+	errs, perRecipient := err.(RecipientErrors)
+	for i, rcpt := range s.Envelope.Recipients {
+		if perRecipient {
+			if i < len(errs) {
+				err = errs[i]
+			} else {
+				err = NewReply(451, "4.3.0", "No status for recipient")
+			}
+		}
+		if err != nil {
+			s.conn.ErrorReply(err)
+		} else {
+			s.conn.Reply("250 2.1.5 <%s> %s", rcpt.Address, s.acceptedReply())
+		}
+	}
+}
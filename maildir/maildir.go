@@ -0,0 +1,167 @@
+/*
+Package maildir delivers messages into maildirs.
+
+A message is written to a unique file in the tmp subdirectory, synced and
+then moved to the new subdirectory, so readers of the maildir never see
+partial messages. File names follow the common maildir++ convention with
+the message size annotated, like "1700000000.M123456P42Q1R1a2b3c.host,S=1234".
+
+Deliver stores a message for several recipients with a single write, the
+file is linked into the maildirs of the other recipients when possible:
+
+	func (h *handler) Message(ctx context.Context, r io.Reader) error {
+		sess := smtpd.SessionFromContext(ctx)
+		var dirs []maildir.Dir
+		for _, rcpt := range sess.Envelope.Recipients {
+			dirs = append(dirs, h.maildirOf(rcpt.Address))
+		}
+		if _, err := maildir.Deliver(r, dirs...); err != nil {
+			return errors.New("451 4.3.0 Delivery failed")
+		}
+		return nil
+	}
+*/
+package maildir
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Dir is the path of a maildir.
+type Dir string
+
+// Create creates the maildir with its cur, new and tmp subdirectories when
+// they are missing.
+func (d Dir) Create() error {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(string(d), sub), 0700); err != nil {
+			return fmt.Errorf("maildir: %v", err)
+		}
+	}
+	return nil
+}
+
+// Deliver delivers the message read from r into d and returns the key of
+// the message, its file name in the new subdirectory.
+func (d Dir) Deliver(r io.Reader) (string, error) {
+	keys, err := Deliver(r, d)
+	if err != nil {
+		return "", err
+	}
+	return keys[0], nil
+}
+
+// Deliver delivers the message read from r into each of dirs, which are
+// created when missing, and returns the keys of the message. Either the
+// message is delivered into all maildirs, or an error is returned and the
+// message is removed from the maildirs it was delivered to.
+func Deliver(r io.Reader, dirs ...Dir) ([]string, error) {
+	if len(dirs) == 0 {
+		return nil, errors.New("maildir: no maildirs")
+	}
+	for _, d := range dirs {
+		if err := d.Create(); err != nil {
+			return nil, err
+		}
+	}
+	name := uniqueName()
+	tmp := filepath.Join(string(dirs[0]), "tmp", name)
+	size, err := writeFile(tmp, r)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("maildir: %v", err)
+	}
+	defer os.Remove(tmp)
+
+	key := fmt.Sprintf("%s,S=%d", name, size)
+	keys := make([]string, 0, len(dirs))
+	for _, d := range dirs {
+		if err := d.add(tmp, key); err != nil {
+			for i, k := range keys {
+				os.Remove(filepath.Join(string(dirs[i]), "new", k))
+			}
+			return nil, fmt.Errorf("maildir: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// add links or copies the message file tmp to the new subdirectory of d
+func (d Dir) add(tmp, key string) error {
+	path := filepath.Join(string(d), "new", key)
+	if err := os.Link(tmp, path); err != nil {
+		// different file system, or the name exists which is unlikely
+		if os.IsExist(err) {
+			return err
+		}
+		f, err := os.Open(tmp)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dup := filepath.Join(string(d), "tmp", key)
+		if _, err := writeFile(dup, f); err != nil {
+			os.Remove(dup)
+			return err
+		}
+		if err := os.Rename(dup, path); err != nil {
+			os.Remove(dup)
+			return err
+		}
+	}
+	return syncDir(filepath.Join(string(d), "new"))
+}
+
+// writeFile writes a new file and syncs it, it returns the size
+func writeFile(path string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return size, err
+}
+
+// syncDir syncs a directory so new entries are persisted
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+var deliveries uint64 // deliveries by this process
+
+// uniqueName returns a unique file name for a message, without size
+func uniqueName() string {
+	now := time.Now()
+	random := make([]byte, 4)
+	rand.Read(random)
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	// '/' and ':' are not allowed in the host part
+	hostname = strings.Replace(hostname, "/", `\057`, -1)
+	hostname = strings.Replace(hostname, ":", `\072`, -1)
+	return fmt.Sprintf("%d.M%dP%dQ%dR%s.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddUint64(&deliveries, 1), hex.EncodeToString(random), hostname)
+}
@@ -0,0 +1,51 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeliver(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	alice, bob := Dir(filepath.Join(dir, "alice")), Dir(filepath.Join(dir, "bob"))
+
+	const msg = "Subject: test\r\n\r\nbody\r\n"
+	keys, err := Deliver(strings.NewReader(msg), alice, bob)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(keys) != 2 || !strings.HasSuffix(keys[0], ",S=23") || strings.Contains(keys[0], "/") {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	for i, d := range []Dir{alice, bob} {
+		data, err := ioutil.ReadFile(filepath.Join(string(d), "new", keys[i]))
+		if err != nil || string(data) != msg {
+			t.Fatalf("unexpected message %q %v", data, err)
+		}
+		if tmp, _ := ioutil.ReadDir(filepath.Join(string(d), "tmp")); len(tmp) != 0 {
+			t.Fatalf("tmp not empty")
+		}
+		if _, err := os.Stat(filepath.Join(string(d), "cur")); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+
+	key, err := alice.Deliver(strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if key == keys[0] {
+		t.Fatalf("key not unique")
+	}
+	if _, err := Deliver(strings.NewReader(msg)); err == nil {
+		t.Fatalf("expected error without maildirs")
+	}
+}
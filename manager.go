@@ -0,0 +1,212 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+)
+
+// TLSMode selects how a listener of a Manager uses TLS.
+type TLSMode int
+
+const (
+	// TLSStartTLS offers STARTTLS when the server has a TLSConfig
+	TLSStartTLS TLSMode = iota
+
+	// TLSRequired offers STARTTLS and refuses MAIL FROM without TLS
+	TLSRequired
+
+	// TLSImplicit starts TLS immediately after connecting (RFC 8314)
+	TLSImplicit
+
+	// TLSDisabled does not offer TLS
+	TLSDisabled
+)
+
+// Profile holds the settings of a listener of a Manager that differ from the
+// base server.
+type Profile struct {
+	// Name of the profile for errors, e.g. "submission"
+	Name string
+
+	// TCP network address to listen on, defaults as for
+	// Server.ListenAndServe
+	Addr string
+
+	// Listener to serve instead of listening on Addr, for example a
+	// listener passed by systemd
+	Listener net.Listener
+
+	TLS TLSMode
+
+	// Set to serve message submission, see Server.Submission
+	Submission bool
+
+	// Set to refuse MAIL FROM from clients that did not authenticate, or to
+	// not offer AUTH at all
+	RequireAuth bool
+	DisableAuth bool
+
+	// Keywords of extensions that are not advertised with EHLO, see
+	// Server.DisabledExtensions
+	DisabledExtensions []string
+
+	// Optional function to change other settings of the server of the
+	// listener
+	Configure func(s *Server)
+}
+
+// Manager runs a server per listener, as MTAs that listen on port 25 for MX
+// traffic, on 465 with implicit TLS and on 587 for submission. Each server
+// is a copy of the base Server, sharing its handler, with the settings of
+// the profile of the listener applied:
+//
+//	m := &smtpd.Manager{
+//		Server: &smtpd.Server{Hostname: "mx.example.com", TLSConfig: config, NewHandler: newHandler},
+//		Profiles: []smtpd.Profile{
+//			{Name: "mx", Addr: ":25", DisableAuth: true},
+//			{Name: "submissions", Addr: ":465", TLS: smtpd.TLSImplicit, Submission: true},
+//			{Name: "submission", Addr: ":587", TLS: smtpd.TLSRequired, Submission: true},
+//		},
+//	}
+//	err := m.ListenAndServe()
+type Manager struct {
+	Server   *Server
+	Profiles []Profile
+
+	mu      sync.Mutex
+	servers []*Server
+}
+
+// Servers returns the servers of the profiles in the same order, for
+// example to get their Stats or Sessions.
+func (m *Manager) Servers() []*Server {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.servers == nil {
+		for _, p := range m.Profiles {
+			m.servers = append(m.servers, p.server(m.Server))
+		}
+	}
+	return append([]*Server(nil), m.servers...)
+}
+
+// ListenAndServe checks the servers of the profiles with Server.Validate,
+// listens on the addresses of the profiles and serves them until a listener
+// fails, see Server.Serve. All servers are closed when one
+// fails. The returned error is ErrServerClosed after Close or Shutdown.
+func (m *Manager) ListenAndServe() error {
+	servers := m.Servers()
+	if len(servers) == 0 {
+		return errors.New("smtpd: Manager has no profiles")
+	}
+	for i, s := range servers {
+		if err := s.Validate(); err != nil {
+			return fmt.Errorf("smtpd: profile %s: %v", m.Profiles[i].Name, err)
+		}
+	}
+	listeners := make([]net.Listener, len(servers))
+	for i, s := range servers {
+		p := m.Profiles[i]
+		if p.Listener != nil {
+			listeners[i] = p.Listener
+			continue
+		}
+		l, err := net.Listen("tcp", s.listenAddr(p.Addr))
+		if err != nil {
+			for _, l := range listeners[:i] {
+				l.Close()
+			}
+			return fmt.Errorf("smtpd: profile %s: %v", p.Name, err)
+		}
+		listeners[i] = l
+	}
+
+	errc := make(chan error, len(servers))
+	for i, s := range servers {
+		go func(s *Server, l net.Listener, name string) {
+			err := s.Serve(l)
+			if err != ErrServerClosed {
+				err = fmt.Errorf("smtpd: profile %s: %v", name, err)
+			}
+			errc <- err
+		}(s, listeners[i], m.Profiles[i].Name)
+	}
+	err := <-errc
+	if err != ErrServerClosed {
+		m.Close()
+	}
+	for range servers[1:] {
+		<-errc
+	}
+	return err
+}
+
+// Close immediately closes the servers of all profiles, see Server.Close.
+func (m *Manager) Close() error {
+	var err error
+	for _, s := range m.Servers() {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Shutdown gracefully shuts down the servers of all profiles in parallel,
+// see Server.Shutdown.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	servers := m.Servers()
+	errc := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *Server) {
+			errc <- s.Shutdown(ctx)
+		}(s)
+	}
+	var err error
+	for range servers {
+		if serr := <-errc; serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// server returns a copy of the base server with the profile applied
+func (p *Profile) server(base *Server) *Server {
+	s := base.clone()
+	switch p.TLS {
+	case TLSRequired:
+		s.RequireTLS = true
+	case TLSImplicit:
+		s.ImplicitTLS = true
+	case TLSDisabled:
+		s.TLSConfig = nil
+	}
+	s.Submission = s.Submission || p.Submission
+	s.RequireAuth = s.RequireAuth || p.RequireAuth
+	s.DisableAuth = s.DisableAuth || p.DisableAuth
+	if p.DisabledExtensions != nil {
+		s.DisabledExtensions = p.DisabledExtensions
+	}
+	if p.Configure != nil {
+		p.Configure(s)
+	}
+	return s
+}
+
+// clone returns a server with the exported fields of s, the state of s is
+// not copied
+func (s *Server) clone() *Server {
+	c := &Server{}
+	src, dst := reflect.ValueOf(s).Elem(), reflect.ValueOf(c).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if src.Type().Field(i).IsExported() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	return c
+}
@@ -0,0 +1,128 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManager(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		return l
+	}
+	mx, submissions, submission := listen(), listen(), listen()
+	m := &Manager{
+		Server: &Server{
+			TLSConfig:  &tls.Config{Certificates: []tls.Certificate{cert}},
+			NewHandler: func() Handler { return testHandler{} },
+		},
+		Profiles: []Profile{
+			{Name: "mx", Listener: mx, DisableAuth: true, DisabledExtensions: []string{"chunking"}},
+			{Name: "submissions", Listener: submissions, TLS: TLSImplicit, Submission: true},
+			{Name: "submission", Listener: submission, TLS: TLSRequired, RequireAuth: true},
+		},
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- m.ListenAndServe()
+	}()
+
+	dial := func(l net.Listener, config *tls.Config) *textproto.Conn {
+		var conn net.Conn
+		var err error
+		if config != nil {
+			conn, err = tls.Dial("tcp", l.Addr().String(), config)
+		} else {
+			conn, err = net.Dial("tcp", l.Addr().String())
+		}
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		c := textproto.NewConn(conn)
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		return c
+	}
+
+	c := dial(mx, nil)
+	msg := cmd(t, c, 250, "EHLO localhost")
+	if !strings.Contains(msg, "STARTTLS") || strings.Contains(msg, "AUTH") || strings.Contains(msg, "CHUNKING") {
+		t.Fatalf("unexpected extensions %q", msg)
+	}
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 221, "QUIT")
+	c.Close()
+
+	c = dial(submissions, &tls.Config{InsecureSkipVerify: true})
+	msg = cmd(t, c, 250, "EHLO localhost")
+	if strings.Contains(msg, "STARTTLS") || !strings.Contains(msg, "AUTH PLAIN") || !strings.Contains(msg, "CHUNKING") {
+		t.Fatalf("unexpected extensions %q", msg)
+	}
+	cmd(t, c, 530, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 221, "QUIT")
+	c.Close()
+
+	c = dial(submission, nil)
+	cmd(t, c, 250, "EHLO localhost")
+	cmd(t, c, 530, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 221, "QUIT")
+	c.Close()
+
+	if m.Server.ImplicitTLS || m.Server.DisableAuth || m.Server.RequireTLS {
+		t.Fatalf("base server changed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestManagerListenError(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer l.Close()
+	m := &Manager{
+		Server:   &Server{NewHandler: func() Handler { return testHandler{} }},
+		Profiles: []Profile{{Name: "mx", Addr: l.Addr().String()}},
+	}
+	if err := m.ListenAndServe(); err == nil || !strings.HasPrefix(err.Error(), "smtpd: profile mx: ") {
+		t.Fatalf("expected listen error, got %v", err)
+	}
+}
+
+func TestManagerValidate(t *testing.T) {
+
+	for _, p := range []Profile{
+		{Name: "submissions", Addr: "127.0.0.1:0", TLS: TLSImplicit},
+		{Name: "submission", Addr: "127.0.0.1:0", TLS: TLSDisabled, Submission: true},
+	} {
+		m := &Manager{
+			Server:   &Server{NewHandler: func() Handler { return testHandler{} }},
+			Profiles: []Profile{p},
+		}
+		if err := m.ListenAndServe(); err == nil || !strings.HasPrefix(err.Error(), "smtpd: profile "+p.Name+": ") {
+			t.Fatalf("expected validation error, got %v", err)
+		}
+	}
+}
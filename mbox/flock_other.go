@@ -0,0 +1,15 @@
+//go:build !unix
+// +build !unix
+
+package mbox
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// flock is not supported
+func flock(f *os.File, deadline time.Time) error {
+	return errors.New("mbox: flock not supported")
+}
@@ -0,0 +1,29 @@
+//go:build unix
+// +build unix
+
+package mbox
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// flock locks f exclusively, waiting until deadline while it is locked. The
+// lock is released when f is closed.
+func flock(f *os.File, deadline time.Time) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			return fmt.Errorf("mbox: flock: %v", err)
+		}
+		if time.Now().After(deadline) {
+			return ErrLockTimeout
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
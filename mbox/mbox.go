@@ -0,0 +1,221 @@
+/*
+Package mbox appends messages to mbox files, for legacy mail readers and
+tools that use them.
+
+Messages are separated by a From_ line with the envelope sender and the
+time of delivery, and line endings are converted to LF. In the mboxrd
+format lines in the message that start with "From ", optionally preceded by
+'>' characters, are escaped with another '>'. In the mboxcl2 format lines
+are not escaped and the length of the body is given in a Content-Length
+header instead.
+
+The mbox file is locked while a message is appended with a dot-lock file,
+flock or both, which must match the locking of the other programs that
+access the file.
+*/
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Format is an mbox format.
+type Format int
+
+const (
+	MboxRD  Format = iota // escape From_ lines reversibly
+	MboxCL2               // add Content-Length, do not escape
+)
+
+// ErrLockTimeout is returned when the mbox file stays locked.
+var ErrLockTimeout = errors.New("mbox: lock timeout")
+
+// staleLock is the age of a dot-lock file after which it is considered left
+// behind by a crashed process
+const staleLock = 5 * time.Minute
+
+// Mailbox is an mbox file.
+type Mailbox struct {
+	Path   string
+	Format Format
+
+	// Lock the file with a dot-lock file, Path with ".lock" appended,
+	// and/or with flock while appending. flock is not available on all
+	// platforms.
+	DotLock bool
+	Flock   bool
+
+	// Maximum time to wait for a lock, 30 seconds if zero
+	LockTimeout time.Duration
+}
+
+// Append appends the message read from r with the envelope sender and the
+// time of delivery. The file is created when missing. When appending
+// fails, the file is truncated to its previous size.
+func (m *Mailbox) Append(sender string, t time.Time, r io.Reader) error {
+	var msg io.Reader = r
+	if m.Format == MboxCL2 {
+		data, err := contentLength(r)
+		if err != nil {
+			return fmt.Errorf("mbox: %v", err)
+		}
+		msg = bytes.NewReader(data)
+	}
+
+	deadline := time.Now().Add(m.lockTimeout())
+	if m.DotLock {
+		if err := dotLock(m.Path+".lock", deadline); err != nil {
+			return err
+		}
+		defer os.Remove(m.Path + ".lock")
+	}
+	f, err := os.OpenFile(m.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("mbox: %v", err)
+	}
+	defer f.Close()
+	if m.Flock {
+		if err := flock(f, deadline); err != nil {
+			return err
+		}
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("mbox: %v", err)
+	}
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "From %s %s\n", fromAddress(sender), t.UTC().Format(time.ANSIC))
+	err = writeLines(w, msg, m.Format == MboxRD)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(size)
+		return fmt.Errorf("mbox: %v", err)
+	}
+	return nil
+}
+
+func (m *Mailbox) lockTimeout() time.Duration {
+	if m.LockTimeout > 0 {
+		return m.LockTimeout
+	}
+	return 30 * time.Second
+}
+
+// fromAddress returns the sender for the From_ line, which must not contain
+// spaces
+func fromAddress(sender string) string {
+	if sender == "" {
+		return "MAILER-DAEMON"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, sender)
+}
+
+// writeLines writes the message with LF line endings, escaping From_ lines
+// when escape is set, followed by an empty line
+func writeLines(w *bufio.Writer, r io.Reader, escape bool) error {
+	br := bufio.NewReader(r)
+	var last []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+			if escape && isFromLine(line) {
+				w.WriteByte('>')
+			}
+			w.Write(line)
+			w.WriteByte('\n')
+			last = line
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if last == nil || len(last) > 0 {
+		w.WriteByte('\n')
+	}
+	return nil
+}
+
+// isFromLine reports whether line matches ">*From "
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
+
+// contentLength reads the message with LF line endings and returns it with
+// a Content-Length header for the body, replacing any existing one
+func contentLength(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := writeLines(w, r, false); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	data := bytes.TrimSuffix(buf.Bytes(), []byte("\n")) // separator
+	header, body := data, []byte(nil)
+	if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+		header, body = data[:i+1], data[i+2:]
+	}
+
+	var out bytes.Buffer
+	skip := false
+	for _, line := range bytes.SplitAfter(header, []byte("\n")) {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if !skip {
+				out.Write(line)
+			}
+			continue
+		}
+		skip = len(line) >= 15 && strings.EqualFold(string(line[:15]), "Content-Length:")
+		if !skip {
+			out.Write(line)
+		}
+	}
+	fmt.Fprintf(&out, "Content-Length: %d\n\n", len(body))
+	out.Write(body)
+	return out.Bytes(), nil
+}
+
+// dotLock creates the lock file path, waiting until deadline while it
+// exists
+func dotLock(path string, deadline time.Time) error {
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return nil
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("mbox: %v", err)
+		}
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > staleLock {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return ErrLockTimeout
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
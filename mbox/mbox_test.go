@@ -0,0 +1,55 @@
+package mbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppend(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	when := time.Date(2024, 3, 1, 9, 5, 0, 0, time.UTC)
+	const msg = "Subject: test\r\nContent-Length: 1\r\n\r\nFrom here\r\n>From there\r\n"
+
+	m := &Mailbox{Path: filepath.Join(dir, "rd"), DotLock: true, Flock: true}
+	if err := m.Append("user@example.com", when, strings.NewReader(msg)); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := m.Append("", when, strings.NewReader("Subject: second\n\nno newline")); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	data, _ := ioutil.ReadFile(m.Path)
+	expected := "From user@example.com Fri Mar  1 09:05:00 2024\nSubject: test\nContent-Length: 1\n\n>From here\n>>From there\n\n" +
+		"From MAILER-DAEMON Fri Mar  1 09:05:00 2024\nSubject: second\n\nno newline\n\n"
+	if string(data) != expected {
+		t.Fatalf("unexpected mbox %q", data)
+	}
+	if _, err := os.Stat(m.Path + ".lock"); !os.IsNotExist(err) {
+		t.Fatalf("lock file not removed")
+	}
+
+	m = &Mailbox{Path: filepath.Join(dir, "cl2"), Format: MboxCL2}
+	if err := m.Append("user@example.com", when, strings.NewReader(msg)); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	data, _ = ioutil.ReadFile(m.Path)
+	expected = "From user@example.com Fri Mar  1 09:05:00 2024\nSubject: test\nContent-Length: 22\n\nFrom here\n>From there\n\n"
+	if string(data) != expected {
+		t.Fatalf("unexpected mbox %q", data)
+	}
+
+	// locked by another process
+	ioutil.WriteFile(m.Path+".lock", nil, 0600)
+	m.DotLock, m.LockTimeout = true, 200*time.Millisecond
+	if err := m.Append("user@example.com", when, strings.NewReader(msg)); err != ErrLockTimeout {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
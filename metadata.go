@@ -0,0 +1,111 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// MetadataVersion is the version of the JSON encoding of Metadata written by
+// this package.
+const MetadataVersion = 1
+
+// Metadata describes a mail transaction and the session it was received in,
+// for storing and exchanging it, for example in spool files, webhook
+// payloads and audit logs. Its JSON encoding is stable: later versions only
+// add members.
+type Metadata struct {
+	Version   int            `json:"version"`
+	Received  time.Time      `json:"received"`
+	SessionID string         `json:"session_id,omitempty"` // see Session.ID
+	Client    ClientMetadata `json:"client"`
+	Envelope  Envelope       `json:"envelope"`
+}
+
+// ClientMetadata describes the client of a session.
+type ClientMetadata struct {
+	IP   string `json:"ip,omitempty"`
+	Port int    `json:"port,omitempty"`
+
+	// Verified reverse DNS hostname, or the hostname forwarded by a proxy
+	Hostname string `json:"hostname,omitempty"`
+
+	Helo     string       `json:"helo,omitempty"`
+	Protocol string       `json:"protocol"` // see Session.Protocol
+	TLS      *TLSMetadata `json:"tls,omitempty"`
+
+	AuthIdentity string `json:"auth_identity,omitempty"`
+	AuthUsername string `json:"auth_username,omitempty"`
+}
+
+// TLSMetadata describes the TLS connection of a session.
+type TLSMetadata struct {
+	Version     string `json:"version"`      // e.g. "TLS 1.3"
+	CipherSuite string `json:"cipher_suite"` // e.g. "TLS_AES_128_GCM_SHA256"
+	ServerName  string `json:"server_name,omitempty"`
+
+	// Subject of the certificate presented by the client, if any
+	ClientCertificate string `json:"client_certificate,omitempty"`
+}
+
+// Metadata returns the metadata of the current mail transaction, received is
+// the time the message was received.
+func (s *Session) Metadata(received time.Time) *Metadata {
+	m := &Metadata{
+		Version:   MetadataVersion,
+		Received:  received,
+		SessionID: s.ID,
+		Client: ClientMetadata{
+			Hostname:     s.RemoteHostname,
+			Helo:         s.Helo,
+			Protocol:     s.Protocol(),
+			AuthIdentity: s.AuthIdentity,
+			AuthUsername: s.AuthUsername,
+		},
+		Envelope: s.Envelope,
+	}
+	if ip := remoteIP(s.RemoteAddr); ip != nil {
+		m.Client.IP = ip.String()
+	}
+	if addr, ok := s.RemoteAddr.(*net.TCPAddr); ok {
+		m.Client.Port = addr.Port
+	}
+	if rdns := s.RDNS(); rdns.Verified() {
+		m.Client.Hostname = rdns.Hostname
+	}
+	if s.TLS != nil {
+		m.Client.TLS = &TLSMetadata{
+			Version:     tls.VersionName(s.TLS.Version),
+			CipherSuite: tls.CipherSuiteName(s.TLS.CipherSuite),
+			ServerName:  s.TLS.ServerName,
+		}
+		if len(s.TLS.PeerCertificates) > 0 {
+			m.Client.TLS.ClientCertificate = s.TLS.PeerCertificates[0].Subject.String()
+		}
+	}
+	return m
+}
+
+// MarshalMetadata returns the JSON encoding of m. The version is set when it
+// is zero.
+func MarshalMetadata(m *Metadata) ([]byte, error) {
+	if m.Version == 0 {
+		m.Version = MetadataVersion
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalMetadata parses the JSON encoding of metadata. Metadata of a
+// later version is parsed as far as it is known.
+func UnmarshalMetadata(data []byte) (*Metadata, error) {
+	m := &Metadata{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("smtpd: invalid metadata: %v", err)
+	}
+	if m.Version <= 0 {
+		return nil, fmt.Errorf("smtpd: invalid metadata version %d", m.Version)
+	}
+	return m, nil
+}
@@ -0,0 +1,74 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+
+	received := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := &Session{
+		RemoteAddr:     &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1025},
+		RemoteHostname: "client.example.com",
+		Helo:           "client",
+		TLS:            &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, ServerName: "mx.example.net"},
+		AuthUsername:   "user",
+		Envelope: Envelope{
+			Sender:     "user@example.com",
+			Recipients: []Recipient{{Address: "a@example.org", Notify: []string{"FAILURE"}, ORcptType: "rfc822", ORcpt: "A@example.org"}},
+			Body:       Body8BitMIME,
+			DeliverBy:  &DeliverBy{Deadline: received.Add(time.Hour), Mode: "R"},
+		},
+		extended: true,
+	}
+	m := s.Metadata(received)
+	if m.Version != MetadataVersion || m.Client.IP != "192.0.2.1" || m.Client.Port != 1025 || m.Client.Protocol != "ESMTPSA" ||
+		m.Client.TLS == nil || m.Client.TLS.Version != "TLS 1.3" {
+		t.Fatalf("unexpected metadata %+v", m)
+	}
+
+	data, err := MarshalMetadata(m)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	for _, field := range []string{
+		`"received":"2024-03-01T12:00:00Z"`,
+		`"client":{"ip":"192.0.2.1","port":1025,"hostname":"client.example.com","helo":"client","protocol":"ESMTPSA",`,
+		`"tls":{"version":"TLS 1.3","cipher_suite":"TLS_AES_128_GCM_SHA256","server_name":"mx.example.net"}`,
+		`"recipients":[{"address":"a@example.org","notify":["FAILURE"],"orcpt_type":"rfc822","orcpt":"A@example.org"}]`,
+		`"deliver_by":{"deadline":"2024-03-01T13:00:00Z","mode":"R"}`,
+	} {
+		if !strings.Contains(string(data), field) {
+			t.Fatalf("%s not found in %s", field, data)
+		}
+	}
+	if strings.Contains(string(data), `"hold_until"`) {
+		t.Fatalf("unexpected hold_until in %s", data)
+	}
+	parsed, err := UnmarshalMetadata(data)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !reflect.DeepEqual(parsed, m) {
+		t.Fatalf("unexpected metadata %+v", parsed)
+	}
+
+	holdUntil := received.Add(2 * time.Hour)
+	s.Envelope.HoldUntil = &holdUntil
+	data, err = MarshalMetadata(s.Metadata(received))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !strings.Contains(string(data), `"hold_until":"2024-03-01T14:00:00Z"`) {
+		t.Fatalf("hold_until not found in %s", data)
+	}
+
+	if _, err := UnmarshalMetadata([]byte(`{"envelope":{}}`)); err == nil {
+		t.Fatalf("expected error for missing version")
+	}
+}
@@ -0,0 +1,39 @@
+package smtpd
+
+import "time"
+
+// Metrics receives measurements of the sessions of a server for monitoring,
+// see package metrics for an implementation exported to Prometheus. The
+// members are called concurrently by the sessions and should not block.
+type Metrics interface {
+	// ConnectionOpened and ConnectionClosed are called when a session
+	// starts and ends
+	ConnectionOpened()
+	ConnectionClosed()
+
+	// Command is called for each command with the verb in upper case and
+	// the status code of the reply. Each chunk of BDAT is a command.
+	Command(verb string, code int)
+
+	// Message is called when the message data of a transaction was
+	// received with DATA or BDAT and replied to, with the number of bytes
+	// received, the time the transfer and the handler took, and the status
+	// code of the reply
+	Message(size int64, duration time.Duration, code int)
+
+	// AuthFailed is called when authentication with a mechanism fails
+	AuthFailed(mechanism string)
+
+	// TLSHandshake is called after a TLS handshake with the negotiated
+	// version, zero when the handshake failed
+	TLSHandshake(version uint16)
+}
+
+// countMessage reports a message replied to with the current reply code
+func (s *session) countMessage(size int64, start time.Time) {
+	s.server.addMessage(size)
+	s.traceMessage(size)
+	if m := s.server.Metrics; m != nil {
+		m.Message(size, time.Since(start), s.conn.code)
+	}
+}
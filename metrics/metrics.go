@@ -0,0 +1,253 @@
+/*
+Package metrics collects the measurements of servers and exports them in the
+Prometheus text exposition format.
+
+A Collector implements smtpd.Metrics and http.Handler:
+
+	c := &metrics.Collector{}
+	server := &smtpd.Server{Metrics: c}
+	http.Handle("/metrics", c)
+
+The following metrics are exported:
+
+	smtpd_connections_total           sessions started
+	smtpd_connections_active          sessions in progress
+	smtpd_commands_total              commands by verb and reply code
+	smtpd_messages_total              messages by reply code
+	smtpd_received_bytes_total        bytes of message data received
+	smtpd_data_duration_seconds       histogram of the message transfer time
+	smtpd_auth_failures_total         failed authentications by mechanism
+	smtpd_tls_handshakes_total        TLS handshakes by version, "failed"
+	                                  for failed handshakes
+
+Verbs of commands that the server does not support are counted as "OTHER",
+to limit the number of time series.
+*/
+package metrics
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds of the buckets of the data duration
+// histogram in seconds.
+var DefaultBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+var verbs = map[string]bool{
+	"HELO": true, "EHLO": true, "LHLO": true, "STARTTLS": true, "AUTH": true,
+	"MAIL": true, "RCPT": true, "DATA": true, "BDAT": true, "RSET": true,
+	"VRFY": true, "EXPN": true, "HELP": true, "NOOP": true, "ETRN": true,
+	"XFORWARD": true, "XCLIENT": true, "QUIT": true,
+}
+
+type command struct {
+	verb string
+	code int
+}
+
+// Collector collects the measurements of one or more servers. The zero
+// value is ready to use.
+type Collector struct {
+	// Upper bounds of the buckets of the data duration histogram in
+	// seconds, DefaultBuckets if nil. Must not be changed after use.
+	Buckets []float64
+
+	mu            sync.Mutex
+	connections   uint64
+	active        int64
+	commands      map[command]uint64
+	messages      map[int]uint64
+	receivedBytes uint64
+	durationCount []uint64 // by bucket, the last for +Inf
+	durationSum   float64
+	authFailures  map[string]uint64
+	handshakes    map[string]uint64
+}
+
+// ConnectionOpened counts a session.
+func (c *Collector) ConnectionOpened() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connections++
+	c.active++
+}
+
+// ConnectionClosed counts the end of a session.
+func (c *Collector) ConnectionClosed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active--
+}
+
+// Command counts a command.
+func (c *Collector) Command(verb string, code int) {
+	if !verbs[verb] {
+		verb = "OTHER"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.commands == nil {
+		c.commands = make(map[command]uint64)
+	}
+	c.commands[command{verb, code}]++
+}
+
+// Message counts a message.
+func (c *Collector) Message(size int64, duration time.Duration, code int) {
+	buckets := c.buckets()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.messages == nil {
+		c.messages = make(map[int]uint64)
+		c.durationCount = make([]uint64, len(buckets)+1)
+	}
+	c.messages[code]++
+	c.receivedBytes += uint64(size)
+	seconds := duration.Seconds()
+	i := sort.SearchFloat64s(buckets, seconds)
+	c.durationCount[i]++
+	c.durationSum += seconds
+}
+
+// AuthFailed counts a failed authentication.
+func (c *Collector) AuthFailed(mechanism string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.authFailures == nil {
+		c.authFailures = make(map[string]uint64)
+	}
+	c.authFailures[mechanism]++
+}
+
+// TLSHandshake counts a TLS handshake.
+func (c *Collector) TLSHandshake(version uint16) {
+	name := "failed"
+	if version != 0 {
+		name = tls.VersionName(version)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handshakes == nil {
+		c.handshakes = make(map[string]uint64)
+	}
+	c.handshakes[name]++
+}
+
+func (c *Collector) buckets() []float64 {
+	if c.Buckets != nil {
+		return c.Buckets
+	}
+	return DefaultBuckets
+}
+
+// ServeHTTP serves the metrics.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the text exposition format to w.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	buckets := c.buckets()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cw := &countWriter{w: bufio.NewWriter(w)}
+
+	header(cw, "smtpd_connections_total", "counter", "Number of SMTP sessions started.")
+	fmt.Fprintf(cw, "smtpd_connections_total %d\n", c.connections)
+	header(cw, "smtpd_connections_active", "gauge", "Number of SMTP sessions in progress.")
+	fmt.Fprintf(cw, "smtpd_connections_active %d\n", c.active)
+
+	header(cw, "smtpd_commands_total", "counter", "Number of commands by verb and reply code.")
+	commands := make([]command, 0, len(c.commands))
+	for cmd := range c.commands {
+		commands = append(commands, cmd)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		if commands[i].verb != commands[j].verb {
+			return commands[i].verb < commands[j].verb
+		}
+		return commands[i].code < commands[j].code
+	})
+	for _, cmd := range commands {
+		fmt.Fprintf(cw, "smtpd_commands_total{verb=%q,code=\"%d\"} %d\n", cmd.verb, cmd.code, c.commands[cmd])
+	}
+
+	header(cw, "smtpd_messages_total", "counter", "Number of messages received by reply code.")
+	codes := make([]int, 0, len(c.messages))
+	for code := range c.messages {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(cw, "smtpd_messages_total{code=\"%d\"} %d\n", code, c.messages[code])
+	}
+	header(cw, "smtpd_received_bytes_total", "counter", "Number of bytes of message data received.")
+	fmt.Fprintf(cw, "smtpd_received_bytes_total %d\n", c.receivedBytes)
+
+	header(cw, "smtpd_data_duration_seconds", "histogram", "Time to receive and handle message data.")
+	var count uint64
+	for i, le := range buckets {
+		if c.durationCount != nil {
+			count += c.durationCount[i]
+		}
+		fmt.Fprintf(cw, "smtpd_data_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), count)
+	}
+	if c.durationCount != nil {
+		count += c.durationCount[len(buckets)]
+	}
+	fmt.Fprintf(cw, "smtpd_data_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(cw, "smtpd_data_duration_seconds_sum %s\n", strconv.FormatFloat(c.durationSum, 'g', -1, 64))
+	fmt.Fprintf(cw, "smtpd_data_duration_seconds_count %d\n", count)
+
+	header(cw, "smtpd_auth_failures_total", "counter", "Number of failed authentications by mechanism.")
+	writeLabeled(cw, "smtpd_auth_failures_total", "mechanism", c.authFailures)
+	header(cw, "smtpd_tls_handshakes_total", "counter", "Number of TLS handshakes by protocol version.")
+	writeLabeled(cw, "smtpd_tls_handshakes_total", "version", c.handshakes)
+
+	err := cw.w.Flush()
+	if cw.err != nil {
+		err = cw.err
+	}
+	return cw.n, err
+}
+
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeLabeled writes the values of a counter with a label, sorted by label
+func writeLabeled(w io.Writer, name, label string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, key, values[key])
+	}
+}
+
+// countWriter counts the bytes written and keeps the first error
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+)
+
+type testHandler struct{}
+
+func (testHandler) Connect(source string) error { return nil }
+func (testHandler) Hello(hostname string) error { return nil }
+func (testHandler) Sender(address string) error { return nil }
+func (testHandler) Recipient(address string) error {
+	if strings.HasPrefix(address, "unknown@") {
+		return errors.New("550 5.1.1 No such user")
+	}
+	return nil
+}
+func (testHandler) AuthUser(identity, username string) (string, error) {
+	return "secret", nil
+}
+func (testHandler) Message(r io.Reader) error {
+	_, err := ioutil.ReadAll(r)
+	return err
+}
+
+func TestCollector(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("../testdata/cert.pem", "../testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	c := &Collector{}
+	server := &smtpd.Server{
+		TLSConfig:  &tls.Config{Certificates: []tls.Certificate{cert}},
+		NewHandler: func() smtpd.Handler { return testHandler{} },
+		Metrics:    c,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	client, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := client.StartTLS(&tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := client.Auth(smtp.PlainAuth("", "user", "wrong", "127.0.0.1")); err == nil {
+		t.Fatalf("expected authentication failure")
+	}
+	// net/smtp cancels the failed authentication with "*", which the
+	// server counts as an unknown command
+	client.Close()
+	time.Sleep(50 * time.Millisecond) // session ends
+
+	if client, err = smtp.Dial(l.Addr().String()); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := client.Mail("sender@example.com"); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	client.Rcpt("a@example.org")
+	client.Rcpt("unknown@example.org")
+	w, err := client.Data()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	io.WriteString(w, "Subject: test\r\n\r\nmeasured\r\n")
+	w.Close()
+	client.Text.PrintfLine("FOO")
+	client.Text.ReadResponse(500)
+	client.Quit()
+	time.Sleep(50 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if _, err := c.WriteTo(&buf); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	for _, line := range []string{
+		"smtpd_connections_total 2\n",
+		"smtpd_connections_active 0\n",
+		"smtpd_commands_total{verb=\"RCPT\",code=\"250\"} 1\n",
+		"smtpd_commands_total{verb=\"RCPT\",code=\"550\"} 1\n",
+		"smtpd_commands_total{verb=\"OTHER\",code=\"500\"} 2\n",
+		"smtpd_messages_total{code=\"250\"} 1\n",
+		"smtpd_received_bytes_total 27\n",
+		"smtpd_data_duration_seconds_bucket{le=\"+Inf\"} 1\n",
+		"smtpd_data_duration_seconds_count 1\n",
+		"smtpd_auth_failures_total{mechanism=\"PLAIN\"} 1\n",
+		"smtpd_tls_handshakes_total{version=\"TLS 1.2\"} 1\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatalf("%q not found in\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	c := &Collector{Buckets: []float64{0.1, 1}}
+	c.Message(1, 50*time.Millisecond, 250)
+	c.Message(1, time.Second, 250)
+	c.Message(1, 2*time.Second, 451)
+	var buf bytes.Buffer
+	c.WriteTo(&buf)
+	expected := "smtpd_data_duration_seconds_bucket{le=\"0.1\"} 1\n" +
+		"smtpd_data_duration_seconds_bucket{le=\"1\"} 2\n" +
+		"smtpd_data_duration_seconds_bucket{le=\"+Inf\"} 3\n" +
+		"smtpd_data_duration_seconds_sum 3.05\n" +
+		"smtpd_data_duration_seconds_count 3\n"
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatalf("unexpected histogram\n%s", buf.String())
+	}
+}
@@ -0,0 +1,72 @@
+package smtpd
+
+import (
+	"context"
+	"net"
+)
+
+// Command is a command received from the client, passed through the
+// Server.Middleware.
+type Command struct {
+	Verb    string // upper case, e.g. "MAIL"
+	Params  string // the rest of the command line
+	Session *Session
+
+	// Status code of the reply, set when the built-in implementation has
+	// processed the command
+	Code int
+}
+
+// CommandHandler processes a command. The built-in CommandHandler replies to
+// the client and calls the Handler. It returns a non-nil error when the
+// session must end, which middleware must return unchanged.
+type CommandHandler func(ctx context.Context, cmd *Command) error
+
+// Middleware wraps the processing of commands, so that cross-cutting
+// concerns such as logging, metrics or policy can be added without changing
+// the Handler. Middleware can refuse a command by returning an error without
+// calling next, the error is replied as for the Handler, e.g.
+//
+//	func noVRFY(next smtpd.CommandHandler) smtpd.CommandHandler {
+//		return func(ctx context.Context, cmd *smtpd.Command) error {
+//			if cmd.Verb == "VRFY" {
+//				return errors.New("502 5.5.1 VRFY disabled")
+//			}
+//			err := next(ctx, cmd)
+//			log.Printf("%s %s: %d", cmd.Session.ID, cmd.Verb, cmd.Code)
+//			return err
+//		}
+//	}
+//
+// The ctx is the context passed to the handler for the command. The chunk of
+// a BDAT command that is refused by middleware is discarded and the mail
+// transaction fails.
+type Middleware func(next CommandHandler) CommandHandler
+
+// endSession is returned by the built-in CommandHandler when the session must
+// end, with the error that ended the session or nil
+type endSession struct {
+	err error
+}
+
+func (e endSession) Error() string {
+	if e.err == nil {
+		return "smtpd: session ended"
+	}
+	return e.err.Error()
+}
+
+// commandHandler returns the built-in CommandHandler of the session wrapped
+// in the Server.Middleware, conn is the connection for STARTTLS
+func (s *session) commandHandler(conn net.Conn) CommandHandler {
+	h := func(ctx context.Context, cmd *Command) error {
+		s.dispatched = true
+		err := s.dispatch(conn, cmd)
+		cmd.Code = s.conn.code
+		return err
+	}
+	for i := len(s.server.Middleware) - 1; i >= 0; i-- {
+		h = s.server.Middleware[i](h)
+	}
+	return h
+}
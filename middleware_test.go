@@ -0,0 +1,90 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+
+	var log []string
+	logging := func(next CommandHandler) CommandHandler {
+		return func(ctx context.Context, cmd *Command) error {
+			err := next(ctx, cmd)
+			log = append(log, fmt.Sprintf("%s %d", cmd.Verb, cmd.Code))
+			return err
+		}
+	}
+	policy := func(next CommandHandler) CommandHandler {
+		return func(ctx context.Context, cmd *Command) error {
+			if cmd.Verb == "VRFY" {
+				return errors.New("502 5.5.1 VRFY disabled")
+			}
+			if cmd.Verb == "MAIL" && cmd.Session.Helo != "localhost" {
+				return errors.New("550 5.7.1 Not allowed")
+			}
+			return next(ctx, cmd)
+		}
+	}
+	server := &Server{Middleware: []Middleware{logging, policy}}
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 502, "VRFY postmaster"); msg != "5.5.1 VRFY disabled" {
+		t.Fatalf("unexpected reply %q", msg)
+	}
+	cmd(t, c, 250, "HELO example.com")
+	cmd(t, c, 550, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "HELO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// refused commands do not reach the built-in implementation
+	expected := []string{"VRFY 0", "HELO 250", "MAIL 0", "HELO 250", "MAIL 250", "QUIT 221"}
+	if !reflect.DeepEqual(log, expected) {
+		t.Fatalf("expected %v, got %v", expected, log)
+	}
+}
+
+func TestMiddlewareRefuseBDAT(t *testing.T) {
+
+	refuse := func(next CommandHandler) CommandHandler {
+		return func(ctx context.Context, cmd *Command) error {
+			if cmd.Verb == "BDAT" {
+				return errors.New("554 5.7.1 Not allowed")
+			}
+			return next(ctx, cmd)
+		}
+	}
+	c, done := dialServer(t, &Server{Middleware: []Middleware{refuse}}, testHandler{})
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+	// the chunk is discarded instead of being read as commands
+	c.PrintfLine("BDAT 10 LAST")
+	c.W.WriteString("QUIT\r\nXXXX")
+	c.W.Flush()
+	if _, _, err := c.ReadResponse(554); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	// the transaction failed
+	cmd(t, c, 503, "DATA")
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
@@ -0,0 +1,285 @@
+/*
+Package mtasts implements SMTP MTA Strict Transport Security (RFC 8461).
+
+A Cache fetches and caches the policies of remote domains for outbound
+delivery, and Policy.CheckDelivery refuses delivery over cleartext or to MX
+hosts that are not covered by an enforced policy. CheckSession validates
+inbound sessions against the policy published for the receiving domain.
+*/
+package mtasts
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+)
+
+// Policy modes
+const (
+	ModeEnforce = "enforce"
+	ModeTesting = "testing"
+	ModeNone    = "none"
+)
+
+// maxPolicySize limits the size of a fetched policy
+const maxPolicySize = 64 << 10
+
+// maxMaxAge is the maximum max_age allowed by RFC 8461
+const maxMaxAge = 31557600 * time.Second
+
+// ErrPolicyViolation is returned when delivery or a session does not comply
+// with an enforced policy.
+var ErrPolicyViolation = errors.New("mtasts: policy violation")
+
+// Policy is an MTA-STS policy.
+type Policy struct {
+	Version string
+	Mode    string
+	MX      []string // MX host patterns, e.g. "mx.example.com" or "*.example.com"
+	MaxAge  time.Duration
+}
+
+// ParsePolicy parses a policy in the format served at
+// https://mta-sts.<domain>/.well-known/mta-sts.txt.
+func ParsePolicy(r io.Reader) (*Policy, error) {
+	p := &Policy{}
+	hasMaxAge := false
+	scanner := bufio.NewScanner(io.LimitReader(r, maxPolicySize))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i == -1 {
+			return nil, fmt.Errorf("mtasts: invalid policy line %q", line)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch key {
+		case "version":
+			p.Version = value
+		case "mode":
+			p.Mode = value
+		case "mx":
+			p.MX = append(p.MX, strings.ToLower(value))
+		case "max_age":
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("mtasts: invalid max_age %q", value)
+			}
+			p.MaxAge = time.Duration(seconds) * time.Second
+			if p.MaxAge > maxMaxAge {
+				p.MaxAge = maxMaxAge
+			}
+			hasMaxAge = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if p.Version != "STSv1" {
+		return nil, fmt.Errorf("mtasts: unsupported policy version %q", p.Version)
+	}
+	switch p.Mode {
+	case ModeEnforce, ModeTesting:
+		if len(p.MX) == 0 {
+			return nil, errors.New("mtasts: policy without mx")
+		}
+	case ModeNone:
+	default:
+		return nil, fmt.Errorf("mtasts: invalid policy mode %q", p.Mode)
+	}
+	if !hasMaxAge {
+		return nil, errors.New("mtasts: policy without max_age")
+	}
+	return p, nil
+}
+
+// Match returns true if host matches one of the MX patterns of the policy. A
+// wildcard pattern matches a single leftmost label.
+func (p *Policy) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		if strings.HasPrefix(pattern, "*.") {
+			if i := strings.IndexByte(host, '.'); i > 0 && host[i+1:] == pattern[2:] {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckDelivery returns ErrPolicyViolation when a message may not be
+// delivered to the MX host mx, because the policy is enforced and the host
+// does not match the policy or the connection does not use TLS with a valid
+// certificate for the host. A nil policy permits any delivery.
+func (p *Policy) CheckDelivery(mx string, tlsVerified bool) error {
+	if p == nil || p.Mode != ModeEnforce {
+		return nil
+	}
+	if !p.Match(mx) {
+		return fmt.Errorf("%w: MX host %s not in policy", ErrPolicyViolation, mx)
+	}
+	if !tlsVerified {
+		return fmt.Errorf("%w: TLS required for %s", ErrPolicyViolation, mx)
+	}
+	return nil
+}
+
+// CheckSession validates an inbound session against the policy published
+// for the receiving domain. An enforced policy requires TLS, and when the
+// client sent a server name it must match the policy. The returned error
+// can be returned from a handler to reject the command.
+func CheckSession(p *Policy, sess *smtpd.Session) error {
+	if p == nil || p.Mode != ModeEnforce {
+		return nil
+	}
+	if sess.TLS == nil {
+		return errors.New("530 5.7.0 Must issue a STARTTLS command first")
+	}
+	if name := sess.TLS.ServerName; name != "" && !p.Match(name) {
+		return fmt.Errorf("550 5.7.0 Server name %s not covered by MTA-STS policy", name)
+	}
+	return nil
+}
+
+// Cache fetches and caches the policies of remote domains.
+type Cache struct {
+	// LookupTXT looks up the TXT records of a name, defaults to
+	// net.DefaultResolver.LookupTXT
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	// Client used to fetch policies, defaults to a client with a timeout of
+	// one minute. Redirects are never followed.
+	Client *http.Client
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	id      string
+	policy  *Policy
+	expires time.Time
+}
+
+// Get returns the policy of domain, or nil if the domain has no policy. A
+// cached policy is used until it expires unless the policy id published in
+// DNS changed. When the policy cannot be refreshed, a cached policy that has
+// not expired is returned.
+func (c *Cache) Get(ctx context.Context, domain string) (*Policy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	c.mu.Lock()
+	entry := c.entries[domain]
+	c.mu.Unlock()
+	valid := entry != nil && time.Now().Before(entry.expires)
+
+	id, err := c.lookupID(ctx, domain)
+	if err != nil {
+		if valid {
+			return entry.policy, nil
+		}
+		return nil, err
+	}
+	if id == "" {
+		if valid {
+			// the record may be removed temporarily, use the cached policy
+			return entry.policy, nil
+		}
+		return nil, nil
+	}
+	if valid && entry.id == id {
+		return entry.policy, nil
+	}
+
+	policy, err := c.fetch(ctx, domain)
+	if err != nil {
+		if valid {
+			return entry.policy, nil
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry)
+	}
+	c.entries[domain] = &cacheEntry{id: id, policy: policy, expires: time.Now().Add(policy.MaxAge)}
+	c.mu.Unlock()
+	return policy, nil
+}
+
+// lookupID returns the policy id of the _mta-sts TXT record of domain, or an
+// empty string if there is no record
+func (c *Cache) lookupID(ctx context.Context, domain string) (string, error) {
+	lookup := c.LookupTXT
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupTXT
+	}
+	records, err := lookup(ctx, "_mta-sts."+domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	var id string
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=STSv1") {
+			continue
+		}
+		if id != "" {
+			return "", nil // multiple records must be treated as no record
+		}
+		for _, field := range strings.Split(record, ";") {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "id=") {
+				id = field[3:]
+			}
+		}
+		if id == "" {
+			return "", nil
+		}
+	}
+	return id, nil
+}
+
+// fetch retrieves the policy of domain over HTTPS
+func (c *Cache) fetch(ctx context.Context, domain string) (*Policy, error) {
+	client := c.Client
+	if client == nil {
+		client = &http.Client{Timeout: time.Minute}
+	}
+	noRedirect := *client
+	noRedirect.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	req, err := http.NewRequest("GET", "https://mta-sts."+domain+"/.well-known/mta-sts.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := noRedirect.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("mtasts: fetching policy of %s: %s", domain, resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/plain" {
+		return nil, fmt.Errorf("mtasts: policy of %s has content type %q", domain, mediaType)
+	}
+	return ParsePolicy(resp.Body)
+}
@@ -0,0 +1,140 @@
+package mtasts
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+)
+
+const testPolicy = "version: STSv1\r\nmode: enforce\r\nmx: mx1.example.com\r\nmx: *.mx.example.com\r\nmax_age: 86400\r\n"
+
+func TestParsePolicy(t *testing.T) {
+
+	p, err := ParsePolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if p.Mode != ModeEnforce || len(p.MX) != 2 || p.MaxAge != 24*time.Hour {
+		t.Fatalf("unexpected policy %+v", p)
+	}
+	for host, match := range map[string]bool{
+		"mx1.example.com":     true,
+		"MX1.example.com.":    true,
+		"a.mx.example.com":    true,
+		"mx.example.com":      false,
+		"a.b.mx.example.com":  false,
+		"mx2.example.com":     false,
+		"mx1.example.com.org": false,
+	} {
+		if p.Match(host) != match {
+			t.Errorf("Match(%q) != %t", host, match)
+		}
+	}
+
+	for _, invalid := range []string{
+		"version: STSv2\nmode: enforce\nmx: mx.example.com\nmax_age: 1\n",
+		"version: STSv1\nmode: strict\nmx: mx.example.com\nmax_age: 1\n",
+		"version: STSv1\nmode: enforce\nmax_age: 1\n",
+		"version: STSv1\nmode: enforce\nmx: mx.example.com\n",
+	} {
+		if _, err := ParsePolicy(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestCheckDelivery(t *testing.T) {
+
+	p, _ := ParsePolicy(strings.NewReader(testPolicy))
+	if err := p.CheckDelivery("mx1.example.com", true); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := p.CheckDelivery("mx1.example.com", false); !errors.Is(err, ErrPolicyViolation) {
+		t.Fatalf("expected policy violation for cleartext, got %v", err)
+	}
+	if err := p.CheckDelivery("mx.other.com", true); !errors.Is(err, ErrPolicyViolation) {
+		t.Fatalf("expected policy violation for MX host, got %v", err)
+	}
+	p.Mode = ModeTesting
+	if err := p.CheckDelivery("mx1.example.com", false); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var none *Policy
+	if err := none.CheckDelivery("mx1.example.com", false); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
+
+func TestCheckSession(t *testing.T) {
+
+	p, _ := ParsePolicy(strings.NewReader(testPolicy))
+	if err := CheckSession(p, &smtpd.Session{}); err == nil || !strings.HasPrefix(err.Error(), "530 ") {
+		t.Fatalf("expected 530 error, got %v", err)
+	}
+	sess := &smtpd.Session{TLS: &tls.ConnectionState{ServerName: "mx1.example.com"}}
+	if err := CheckSession(p, sess); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	sess.TLS.ServerName = "www.example.com"
+	if err := CheckSession(p, sess); err == nil {
+		t.Fatalf("expected error for server name")
+	}
+}
+
+func TestCache(t *testing.T) {
+
+	fetches := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "mta-sts.example.com" || r.URL.Path != "/.well-known/mta-sts.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		fetches++
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, testPolicy)
+	}))
+	defer server.Close()
+
+	id := "20200101"
+	cache := &Cache{
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			if name == "_mta-sts.example.com" {
+				return []string{"v=STSv1; id=" + id}, nil
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		},
+		Client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return net.Dial(network, server.Listener.Addr().String())
+				},
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	p, err := cache.Get(ctx, "example.com")
+	if err != nil || p == nil || p.Mode != ModeEnforce {
+		t.Fatalf("unexpected policy %+v %v", p, err)
+	}
+	if p, _ := cache.Get(ctx, "EXAMPLE.com."); p == nil || fetches != 1 {
+		t.Fatalf("cached policy not used, %d fetches", fetches)
+	}
+	id = "20200102"
+	if p, _ := cache.Get(ctx, "example.com"); p == nil || fetches != 2 {
+		t.Fatalf("policy not refreshed after id change, %d fetches", fetches)
+	}
+	if p, err := cache.Get(ctx, "example.org"); p != nil || err != nil {
+		t.Fatalf("unexpected policy %+v %v", p, err)
+	}
+}
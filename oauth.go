@@ -0,0 +1,190 @@
+package smtpd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// OAuthBearerAuthenticator can optionally be implemented by a Handler or
+// ContextHandler to offer the OAUTHBEARER (RFC 7628) and XOAUTH2 mechanisms
+// over TLS. AuthOAuthBearer validates the bearer token and returns the
+// username. The identity is the authorization identity of OAUTHBEARER or
+// the user of XOAUTH2, it may be empty for OAUTHBEARER. An error is reported
+// to the client with an error challenge, see OAuthError.
+type OAuthBearerAuthenticator interface {
+	AuthOAuthBearer(ctx context.Context, identity, token string) (username string, err error)
+}
+
+// OAuthError can be returned by AuthOAuthBearer to set the fields of the
+// JSON error challenge sent to the client (RFC 7628 section 3.2.2).
+type OAuthError struct {
+	// Status is the error code, e.g. "invalid_token" or
+	// "insufficient_scope", "invalid_token" if empty
+	Status string
+
+	// Scope and OpenIDConfiguration are optional, the scope required to
+	// access the server and the URL of the OpenID Provider Configuration
+	Scope               string
+	OpenIDConfiguration string
+}
+
+// Error returns the reply sent after the error challenge.
+func (e *OAuthError) Error() string {
+	return "535 5.7.8 Authentication credentials invalid"
+}
+
+// oauthMechanism implements OAUTHBEARER and XOAUTH2
+type oauthMechanism struct {
+	auth    OAuthBearerAuthenticator
+	xoauth2 bool
+}
+
+func (m oauthMechanism) Name() string {
+	if m.xoauth2 {
+		return "XOAUTH2"
+	}
+	return "OAUTHBEARER"
+}
+
+func (m oauthMechanism) Start(ctx context.Context) (SASLServer, error) {
+	return &oauthExchange{ctx: ctx, mech: m}, nil
+}
+
+type oauthExchange struct {
+	ctx      context.Context
+	mech     oauthMechanism
+	identity string
+	username string
+	err      error // failure reported with an error challenge
+}
+
+func (e *oauthExchange) Next(response []byte) ([]byte, bool, error) {
+	if e.err != nil {
+		// the client acknowledged the error challenge
+		return nil, false, e.err
+	}
+	if len(response) == 0 {
+		return []byte{}, false, nil
+	}
+	var token string
+	var err error
+	if e.mech.xoauth2 {
+		e.identity, token, err = parseXOAuth2(string(response))
+	} else {
+		e.identity, token, err = parseOAuthBearer(string(response))
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	e.username, err = e.mech.auth.AuthOAuthBearer(e.ctx, e.identity, token)
+	if err != nil {
+		e.err = err
+		return e.errorChallenge(err), false, nil
+	}
+	return nil, true, nil
+}
+
+func (e *oauthExchange) Identity() (string, string) {
+	if e.mech.xoauth2 {
+		// the user of XOAUTH2 is not an authorization identity
+		return "", e.username
+	}
+	return e.identity, e.username
+}
+
+// errorChallenge returns the JSON error challenge for err
+func (e *oauthExchange) errorChallenge(err error) []byte {
+	var oauthErr *OAuthError
+	if !errors.As(err, &oauthErr) {
+		oauthErr = &OAuthError{}
+	}
+	status := oauthErr.Status
+	if status == "" {
+		status = "invalid_token"
+	}
+	var challenge interface{}
+	if e.mech.xoauth2 {
+		// XOAUTH2 uses HTTP status codes
+		switch status {
+		case "invalid_token":
+			status = "401"
+		case "insufficient_scope":
+			status = "403"
+		case "invalid_request":
+			status = "400"
+		}
+		challenge = struct {
+			Status  string `json:"status"`
+			Schemes string `json:"schemes"`
+			Scope   string `json:"scope,omitempty"`
+		}{status, "bearer", oauthErr.Scope}
+	} else {
+		challenge = struct {
+			Status              string `json:"status"`
+			Scope               string `json:"scope,omitempty"`
+			OpenIDConfiguration string `json:"openid-configuration,omitempty"`
+		}{status, oauthErr.Scope, oauthErr.OpenIDConfiguration}
+	}
+	b, _ := json.Marshal(challenge)
+	return b
+}
+
+var errOAuthSyntax = errors.New("501 5.5.2 Invalid OAuth credentials syntax")
+
+// parseOAuthBearer parses the initial response of OAUTHBEARER, e.g.
+// "n,a=user@example.com,\x01host=mx.example.com\x01auth=Bearer token\x01\x01"
+func parseOAuthBearer(resp string) (identity, token string, err error) {
+	i := strings.IndexByte(resp, '\x01')
+	if i == -1 {
+		return "", "", errOAuthSyntax
+	}
+	gs2 := strings.Split(resp[:i], ",")
+	if len(gs2) != 3 || gs2[2] != "" || (gs2[0] != "n" && gs2[0] != "y") {
+		// channel binding is not supported
+		return "", "", errOAuthSyntax
+	}
+	if gs2[1] != "" {
+		if !strings.HasPrefix(gs2[1], "a=") {
+			return "", "", errOAuthSyntax
+		}
+		identity = decodeSASLName(gs2[1][2:])
+	}
+	token, err = bearerToken(resp[i+1:])
+	return identity, token, err
+}
+
+// parseXOAuth2 parses the initial response of XOAUTH2, e.g.
+// "user=user@example.com\x01auth=Bearer token\x01\x01"
+func parseXOAuth2(resp string) (user, token string, err error) {
+	i := strings.IndexByte(resp, '\x01')
+	if i == -1 || !strings.HasPrefix(resp, "user=") {
+		return "", "", errOAuthSyntax
+	}
+	user = resp[5:i]
+	token, err = bearerToken(resp[i+1:])
+	return user, token, err
+}
+
+// bearerToken returns the token of the auth key in the key/value pairs of
+// OAUTHBEARER and XOAUTH2, terminated by \x01\x01
+func bearerToken(kvpairs string) (string, error) {
+	if !strings.HasSuffix(kvpairs, "\x01") {
+		return "", errOAuthSyntax
+	}
+	var token string
+	for _, kv := range strings.Split(strings.TrimSuffix(kvpairs, "\x01"), "\x01") {
+		if len(kv) > 5 && strings.EqualFold(kv[:5], "auth=") {
+			scheme, value := split1(kv[5:])
+			if !strings.EqualFold(scheme, "Bearer") || value == "" {
+				return "", errOAuthSyntax
+			}
+			token = value
+		}
+	}
+	if token == "" {
+		return "", errOAuthSyntax
+	}
+	return token, nil
+}
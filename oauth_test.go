@@ -0,0 +1,107 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+type oauthHandler struct {
+	testHandler
+}
+
+func (h oauthHandler) AuthOAuthBearer(ctx context.Context, identity, token string) (string, error) {
+	if token != "vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==" {
+		return "", &OAuthError{Scope: "mail"}
+	}
+	if identity != "" && identity != "user@example.com" {
+		return "", &OAuthError{Status: "insufficient_scope"}
+	}
+	return "user@example.com", nil
+}
+
+func TestParseOAuthBearer(t *testing.T) {
+
+	tests := []struct {
+		resp     string
+		identity string
+		token    string
+		valid    bool
+	}{
+		{"n,a=user@example.com,\x01host=server.example.com\x01port=587\x01auth=Bearer abc\x01\x01", "user@example.com", "abc", true},
+		{"n,,\x01auth=Bearer abc\x01\x01", "", "abc", true},
+		{"n,a=a=3Db,\x01auth=Bearer abc\x01\x01", "a=b", "abc", true},
+		{"n,,\x01auth=Basic abc\x01\x01", "", "", false},
+		{"n,,\x01host=server.example.com\x01\x01", "", "", false},
+		{"p=tls-unique,,\x01auth=Bearer abc\x01\x01", "", "", false},
+		{"n,,auth=Bearer abc", "", "", false},
+	}
+	for _, test := range tests {
+		identity, token, err := parseOAuthBearer(test.resp)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: unexpected error %v", test.resp, err)
+			continue
+		}
+		if identity != test.identity || token != test.token {
+			t.Errorf("%q: unexpected identity %q and token %q", test.resp, identity, token)
+		}
+	}
+
+	user, token, err := parseXOAuth2("user=someuser@example.com\x01auth=Bearer ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg\x01\x01")
+	if err != nil || user != "someuser@example.com" || token != "ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg" {
+		t.Fatalf("unexpected user %q, token %q, error %v", user, token, err)
+	}
+}
+
+func TestOAuthBearer(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	server := &Server{
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		ImplicitTLS: true,
+	}
+	c, done := dialServerTLS(t, server, oauthHandler{}, &tls.Config{InsecureSkipVerify: true})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 250, "EHLO localhost"); !strings.Contains(msg, "AUTH PLAIN LOGIN OAUTHBEARER XOAUTH2") {
+		t.Fatalf("mechanisms not advertised: %q", msg)
+	}
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	// invalid token
+	msg := cmd(t, c, 334, "AUTH OAUTHBEARER %s", encode("n,,\x01auth=Bearer expired\x01\x01"))
+	if msg != encode(`{"status":"invalid_token","scope":"mail"}`) {
+		t.Fatalf("unexpected error challenge %q", msg)
+	}
+	cmd(t, c, 535, "%s", encode("\x01"))
+	msg = cmd(t, c, 334, "AUTH XOAUTH2 %s", encode("user=user@example.com\x01auth=Bearer expired\x01\x01"))
+	if msg != encode(`{"status":"401","schemes":"bearer","scope":"mail"}`) {
+		t.Fatalf("unexpected error challenge %q", msg)
+	}
+	cmd(t, c, 535, "")
+	cmd(t, c, 501, "AUTH OAUTHBEARER %s", encode("n,,auth=Bearer\x01\x01"))
+
+	cmd(t, c, 235, "AUTH OAUTHBEARER %s", encode("n,a=user@example.com,\x01auth=Bearer vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==\x01\x01"))
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	// not offered without TLS
+	c, done = dialServer(t, &Server{}, oauthHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 250, "EHLO localhost"); strings.Contains(msg, "OAUTHBEARER") {
+		t.Fatalf("OAUTHBEARER advertised without TLS")
+	}
+	cmd(t, c, 502, "AUTH XOAUTH2")
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
@@ -0,0 +1,149 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"time"
+)
+
+// Option configures a Server created with NewServer.
+type Option func(s *Server) error
+
+// NewServer returns a server configured with the options and checks the
+// configuration with Validate. Fields of the returned server can still be
+// set directly before it is started, as with a Server literal:
+//
+//	server, err := smtpd.NewServer(
+//		smtpd.WithHostname("mx.example.com"),
+//		smtpd.WithTLS(config),
+//		smtpd.WithMaxSize(25<<20),
+//		smtpd.WithHandler(newHandler),
+//	)
+func NewServer(opts ...Option) (*Server, error) {
+	s := &Server{}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// WithHostname sets the hostname used in responses.
+func WithHostname(hostname string) Option {
+	return func(s *Server) error {
+		if hostname == "" {
+			return errors.New("smtpd: empty hostname")
+		}
+		s.Hostname = hostname
+		return nil
+	}
+}
+
+// WithTLS enables STARTTLS with the TLS configuration.
+func WithTLS(config *tls.Config) Option {
+	return func(s *Server) error {
+		if config == nil {
+			return errors.New("smtpd: nil TLS config")
+		}
+		s.TLSConfig = config
+		return nil
+	}
+}
+
+// WithImplicitTLS starts TLS with the TLS configuration immediately after
+// connecting, see Server.ImplicitTLS.
+func WithImplicitTLS(config *tls.Config) Option {
+	return func(s *Server) error {
+		if err := WithTLS(config)(s); err != nil {
+			return err
+		}
+		s.ImplicitTLS = true
+		return nil
+	}
+}
+
+// WithMaxSize sets the maximum message size in bytes, see
+// Server.MaxMessageSize.
+func WithMaxSize(size int64) Option {
+	return func(s *Server) error {
+		if size < 0 {
+			return errors.New("smtpd: negative maximum message size")
+		}
+		s.MaxMessageSize = size
+		return nil
+	}
+}
+
+// WithTimeouts sets the maximum time to wait for a command line and for
+// each block of message data, see Server.CommandTimeout and
+// Server.DataTimeout.
+func WithTimeouts(command, data time.Duration) Option {
+	return func(s *Server) error {
+		s.CommandTimeout = command
+		s.DataTimeout = data
+		return nil
+	}
+}
+
+// WithLogger sets the logger for the debug output of the sessions, see
+// Server.DebugLog.
+func WithLogger(logger *log.Logger) Option {
+	return func(s *Server) error {
+		s.DebugLog = logger
+		return nil
+	}
+}
+
+// WithHandler sets the function that creates a Handler for each accepted
+// connection.
+func WithHandler(newHandler func() Handler) Option {
+	return func(s *Server) error {
+		s.NewHandler = newHandler
+		return nil
+	}
+}
+
+// WithContextHandler sets the function that creates a ContextHandler for
+// each accepted connection.
+func WithContextHandler(newHandler func() ContextHandler) Option {
+	return func(s *Server) error {
+		s.NewContextHandler = newHandler
+		return nil
+	}
+}
+
+// Validate returns an error when settings of the server contradict each
+// other or depend on settings that are missing. It is called by NewServer,
+// and can be called before serving a Server literal.
+func (s *Server) Validate() error {
+	switch {
+	case s.ImplicitTLS && s.TLSConfig == nil:
+		return errors.New("smtpd: ImplicitTLS requires TLSConfig")
+	case s.RequireTLS && s.TLSConfig == nil:
+		return errors.New("smtpd: RequireTLS requires TLSConfig")
+	case s.Submission && s.TLSConfig == nil:
+		return errors.New("smtpd: Submission requires TLSConfig")
+	case s.Submission && s.LMTP:
+		return errors.New("smtpd: Submission and LMTP are exclusive")
+	case s.Submission && s.DisableAuth:
+		return errors.New("smtpd: Submission requires AUTH")
+	case s.NewHandler != nil && s.NewContextHandler != nil:
+		return errors.New("smtpd: NewHandler and NewContextHandler are exclusive")
+	case s.MaxMessageSize < 0:
+		return errors.New("smtpd: negative MaxMessageSize")
+	case s.RDNSReject && !s.ReverseDNS:
+		return errors.New("smtpd: RDNSReject requires ReverseDNS")
+	case s.DNSBLReject && s.DNSBL == nil:
+		return errors.New("smtpd: DNSBLReject requires DNSBL")
+	case s.TLSConfig != nil && len(s.TLSConfig.Certificates) == 0 &&
+		s.TLSConfig.GetCertificate == nil && s.TLSConfig.GetConfigForClient == nil &&
+		len(s.VirtualHosts) == 0:
+		return errors.New("smtpd: TLSConfig has no certificate")
+	}
+	return nil
+}
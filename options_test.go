@@ -0,0 +1,78 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestNewServer(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	logger := log.New(ioutil.Discard, "", 0)
+	server, err := NewServer(
+		WithHostname("mx.example.com"),
+		WithImplicitTLS(config),
+		WithMaxSize(1024),
+		WithTimeouts(time.Minute, 2*time.Minute),
+		WithLogger(logger),
+		WithHandler(func() Handler { return testHandler{} }),
+	)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if server.Hostname != "mx.example.com" || server.TLSConfig != config || !server.ImplicitTLS ||
+		server.MaxMessageSize != 1024 || server.CommandTimeout != time.Minute ||
+		server.DataTimeout != 2*time.Minute || server.DebugLog != logger || server.NewHandler == nil {
+		t.Fatalf("unexpected configuration %+v", server)
+	}
+
+	c, done := dialServerTLS(t, server, testHandler{}, &tls.Config{InsecureSkipVerify: true})
+	defer c.Close()
+	if _, msg, err := c.ReadResponse(220); err != nil || msg[:15] != "mx.example.com " {
+		t.Fatalf("unexpected greeting %q: %v", msg, err)
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
+
+func TestNewServerInvalid(t *testing.T) {
+
+	tests := []struct {
+		opts []Option
+		err  string
+	}{
+		{[]Option{WithHostname("")}, "smtpd: empty hostname"},
+		{[]Option{WithTLS(nil)}, "smtpd: nil TLS config"},
+		{[]Option{WithMaxSize(-1)}, "smtpd: negative maximum message size"},
+		{[]Option{WithTLS(&tls.Config{})}, "smtpd: TLSConfig has no certificate"},
+		{[]Option{
+			WithHandler(func() Handler { return testHandler{} }),
+			WithContextHandler(func() ContextHandler { return nil }),
+		}, "smtpd: NewHandler and NewContextHandler are exclusive"},
+		{[]Option{func(s *Server) error {
+			s.Submission = true
+			return nil
+		}}, "smtpd: Submission requires TLSConfig"},
+	}
+	for _, test := range tests {
+		if _, err := NewServer(test.opts...); err == nil || err.Error() != test.err {
+			t.Errorf("expected error %q, got %v", test.err, err)
+		}
+	}
+
+	if err := (&Server{RDNSReject: true}).Validate(); err == nil {
+		t.Fatalf("expected error for RDNSReject without ReverseDNS")
+	}
+	if err := (&Server{}).Validate(); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
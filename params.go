@@ -0,0 +1,174 @@
+package smtpd
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	errNonASCIIAddress = errors.New("553 5.6.7 Non-ASCII address requires SMTPUTF8")
+	errInvalidUTF8     = errors.New("553 5.6.7 Address is not valid UTF-8")
+)
+
+// parsePath splits the argument of MAIL FROM: or RCPT TO: into the address
+// and the ESMTP parameters. The address is returned without angle brackets.
+// Parameter keywords are converted to upper case, keywords without value are
+// mapped to an empty string.
+func parsePath(param string) (addr string, args map[string]string) {
+	param = strings.TrimLeft(param, " ")
+	var rest string
+	if strings.HasPrefix(param, "<") {
+		if i := strings.IndexByte(param, '>'); i != -1 {
+			addr = param[1:i]
+			rest = param[i+1:]
+		} else {
+			addr, rest = split1(param[1:])
+		}
+	} else {
+		addr, rest = split1(param)
+	}
+	return addr, parseArgs(rest)
+}
+
+// parseArgs parses space separated ESMTP parameters of the form keyword[=value]
+func parseArgs(params string) map[string]string {
+	args := make(map[string]string)
+	for _, arg := range strings.Fields(params) {
+		key, value := arg, ""
+		if i := strings.IndexByte(arg, '='); i != -1 {
+			key, value = arg[:i], arg[i+1:]
+		}
+		args[strings.ToUpper(key)] = value
+	}
+	return args
+}
+
+// checkAddress verifies that addr only contains non-ASCII characters when the
+// transaction uses SMTPUTF8, and that these are valid UTF-8
+func checkAddress(addr string, smtputf8 bool) error {
+	for i := 0; i < len(addr); i++ {
+		if addr[i] >= utf8.RuneSelf {
+			if !smtputf8 {
+				return errNonASCIIAddress
+			}
+			if !utf8.ValidString(addr) {
+				return errInvalidUTF8
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// decodeXtext decodes an xtext encoded parameter value (RFC 3461 section 4)
+func decodeXtext(s string) (string, error) {
+	if strings.IndexByte(s, '+') == -1 {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", errors.New("invalid xtext")
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.New("invalid xtext")
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// parseNotify parses the NOTIFY parameter of RCPT TO
+func parseNotify(value string) ([]string, error) {
+	notify := strings.Split(strings.ToUpper(value), ",")
+	for _, n := range notify {
+		switch n {
+		case "NEVER":
+			if len(notify) > 1 {
+				return nil, errors.New("NEVER cannot be combined")
+			}
+		case "SUCCESS", "FAILURE", "DELAY":
+		default:
+			return nil, errors.New("invalid NOTIFY value")
+		}
+	}
+	return notify, nil
+}
+
+// parseDeliverBy parses the BY parameter of MAIL FROM, the by-time is
+// relative to now
+func parseDeliverBy(value string, now time.Time) (*DeliverBy, error) {
+	i := strings.IndexByte(value, ';')
+	if i == -1 {
+		return nil, errors.New("missing by-mode")
+	}
+	seconds, err := strconv.ParseInt(value[:i], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	by := &DeliverBy{
+		Deadline: now.Add(time.Duration(seconds) * time.Second),
+	}
+	mode := strings.ToUpper(value[i+1:])
+	if strings.HasSuffix(mode, "T") {
+		by.Trace = true
+		mode = mode[:len(mode)-1]
+	}
+	switch mode {
+	case "R":
+		// the message must be returned when not delivered in time, so the
+		// by-time must be in the future
+		if seconds <= 0 {
+			return nil, errors.New("invalid by-time for return mode")
+		}
+	case "N":
+	default:
+		return nil, errors.New("invalid by-mode")
+	}
+	by.Mode = mode
+	return by, nil
+}
+
+// parseFutureRelease returns the release time given with the HOLDFOR or
+// HOLDUNTIL parameter of MAIL FROM, or the zero time when neither is given
+func parseFutureRelease(args map[string]string, now time.Time, max time.Duration) (time.Time, error) {
+	holdFor, hasHoldFor := args["HOLDFOR"]
+	holdUntil, hasHoldUntil := args["HOLDUNTIL"]
+	var release time.Time
+	switch {
+	case hasHoldFor && hasHoldUntil:
+		return release, errors.New("HOLDFOR and HOLDUNTIL cannot be combined")
+	case hasHoldFor:
+		seconds, err := strconv.ParseInt(holdFor, 10, 64)
+		if err != nil || seconds < 0 {
+			return release, errors.New("Syntax error in HOLDFOR parameter")
+		}
+		// compared in seconds, as large values overflow a Duration
+		if seconds > int64(max/time.Second) {
+			return release, errors.New("HOLDFOR exceeds maximum hold time")
+		}
+		release = now.Add(time.Duration(seconds) * time.Second)
+	case hasHoldUntil:
+		var err error
+		release, err = time.Parse(time.RFC3339, strings.ToUpper(holdUntil))
+		if err != nil {
+			return release, errors.New("Syntax error in HOLDUNTIL parameter")
+		}
+		if release.Before(now) {
+			return time.Time{}, errors.New("HOLDUNTIL is in the past")
+		}
+		if release.Sub(now) > max {
+			return time.Time{}, errors.New("HOLDUNTIL exceeds maximum hold time")
+		}
+	}
+	return release, nil
+}
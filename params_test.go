@@ -0,0 +1,40 @@
+package smtpd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFutureRelease(t *testing.T) {
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	max := 24 * time.Hour
+
+	tests := []struct {
+		args     map[string]string
+		expected time.Time
+		valid    bool
+	}{
+		{map[string]string{}, time.Time{}, true},
+		{map[string]string{"HOLDFOR": "3600"}, now.Add(time.Hour), true},
+		{map[string]string{"HOLDFOR": "90000"}, time.Time{}, false},
+		{map[string]string{"HOLDFOR": "9223372037"}, time.Time{}, false},
+		{map[string]string{"HOLDFOR": "18446744073"}, time.Time{}, false},
+		{map[string]string{"HOLDFOR": "x"}, time.Time{}, false},
+		{map[string]string{"HOLDUNTIL": "2020-01-02T10:00:00Z"}, now.Add(22 * time.Hour), true},
+		{map[string]string{"HOLDUNTIL": "2020-01-02T10:00:00+01:00"}, now.Add(21 * time.Hour), true},
+		{map[string]string{"HOLDUNTIL": "2019-12-31T10:00:00Z"}, time.Time{}, false},
+		{map[string]string{"HOLDUNTIL": "2020-01-03T10:00:00Z"}, time.Time{}, false},
+		{map[string]string{"HOLDFOR": "60", "HOLDUNTIL": "2020-01-02T10:00:00Z"}, time.Time{}, false},
+	}
+	for _, test := range tests {
+		release, err := parseFutureRelease(test.args, now, max)
+		if (err == nil) != test.valid {
+			t.Errorf("%v: unexpected error %v", test.args, err)
+			continue
+		}
+		if !release.Equal(test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.args, test.expected, release)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyHeader holds the PROXY protocol header sent by a proxy or load
+// balancer before the SMTP session starts.
+type ProxyHeader struct {
+	// Version of the PROXY protocol, 1 (text) or 2 (binary)
+	Version int
+
+	// Addresses of the original client and of the proxy as seen by the
+	// client, nil when the proxy did not provide the addresses, for example
+	// for a health check
+	SourceAddr net.Addr
+	DestAddr   net.Addr
+
+	// Type-length-value fields of a version 2 header
+	TLVs []ProxyTLV
+}
+
+// ProxyTLV is a type-length-value field of a version 2 PROXY protocol header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Types of common TLVs
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02
+	ProxyTLVCRC32C    = 0x03
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20
+	ProxyTLVNetNS     = 0x30
+)
+
+// TLV returns the value of the first TLV of type typ, or nil.
+func (h *ProxyHeader) TLV(typ byte) []byte {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value
+		}
+	}
+	return nil
+}
+
+var (
+	errProxyHeader = errors.New("smtpd: invalid PROXY protocol header")
+
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	// peek no more than needed to tell the versions apart, as the proxy
+	// waits for the greeting after a short header like "PROXY UNKNOWN\r\n"
+	prefix, err := r.Peek(len("PROXY "))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(prefix, []byte("PROXY ")):
+		return readProxyHeaderV1(r)
+	case bytes.HasPrefix(prefix, []byte("\r\n\r\n")):
+		sig, err := r.Peek(len(proxyV2Signature))
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(sig, proxyV2Signature) {
+			return readProxyHeaderV2(r)
+		}
+	}
+	return nil, errProxyHeader
+}
+
+// readProxyHeaderV1 reads the text header, e.g.
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (*ProxyHeader, error) {
+	// the header is at most 107 bytes including CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errProxyHeader
+	}
+	header := &ProxyHeader{Version: 1}
+	switch fields[1] {
+	case "UNKNOWN":
+		return header, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errProxyHeader
+	}
+	if len(fields) != 6 {
+		return nil, errProxyHeader
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	if src == nil || dst == nil || (src.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errProxyHeader
+	}
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if err1 != nil || err2 != nil {
+		return nil, errProxyHeader
+	}
+	header.SourceAddr = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	header.DestAddr = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return header, nil
+}
+
+// readProxyHeaderV2 reads the binary header
+func readProxyHeaderV2(r *bufio.Reader) (*ProxyHeader, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	command := fixed[12] & 0x0f
+	family := fixed[13]
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	header := &ProxyHeader{Version: 2}
+	var n int // length of the address block
+	switch command {
+	case 0x0: // LOCAL, connection established by the proxy itself
+		return header, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errProxyHeader
+	}
+	switch family {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		n = 12
+		if len(body) < n {
+			return nil, errProxyHeader
+		}
+		header.SourceAddr, header.DestAddr = proxyAddrs(family, body[0:4], body[4:8], body[8:10], body[10:12])
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		n = 36
+		if len(body) < n {
+			return nil, errProxyHeader
+		}
+		header.SourceAddr, header.DestAddr = proxyAddrs(family, body[0:16], body[16:32], body[32:34], body[34:36])
+	case 0x31, 0x32: // unix stream or datagram
+		n = 216
+		if len(body) < n {
+			return nil, errProxyHeader
+		}
+		header.SourceAddr = &net.UnixAddr{Name: cstring(body[0:108]), Net: "unix"}
+		header.DestAddr = &net.UnixAddr{Name: cstring(body[108:216]), Net: "unix"}
+	case 0x00: // unspecified
+	default:
+		return nil, errProxyHeader
+	}
+
+	tlvs := body[n:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, errProxyHeader
+		}
+		length := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return nil, errProxyHeader
+		}
+		header.TLVs = append(header.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+length]})
+		tlvs = tlvs[3+length:]
+	}
+	return header, nil
+}
+
+// proxyAddrs returns the source and destination addresses of a version 2
+// header for an IP family
+func proxyAddrs(family byte, src, dst, srcPort, dstPort []byte) (net.Addr, net.Addr) {
+	if family&0x0f == 0x02 {
+		return &net.UDPAddr{IP: net.IP(src), Port: int(binary.BigEndian.Uint16(srcPort))},
+			&net.UDPAddr{IP: net.IP(dst), Port: int(binary.BigEndian.Uint16(dstPort))}
+	}
+	return &net.TCPAddr{IP: net.IP(src), Port: int(binary.BigEndian.Uint16(srcPort))},
+		&net.TCPAddr{IP: net.IP(dst), Port: int(binary.BigEndian.Uint16(dstPort))}
+}
+
+// cstring returns the string up to the first NUL byte
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,111 @@
+package smtpd
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+
+	v2 := "\r\n\r\n\x00\r\nQUIT\n" +
+		"\x21\x11\x00\x14" + // PROXY, TCP over IPv4, 20 bytes
+		"\xc0\x00\x02\x01" + "\xc6\x33\x64\x01" + "\xdc\x04" + "\x00\x19" +
+		"\x05\x00\x05" + "abcde" + // unique id
+		"EHLO"
+
+	tests := []struct {
+		header   string
+		source   string
+		dest     string
+		uniqueID string
+		valid    bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\nEHLO", "192.0.2.1:56324", "198.51.100.1:25", "", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\nEHLO", "[2001:db8::1]:56324", "[2001:db8::2]:25", "", true},
+		{"PROXY UNKNOWN\r\nEHLO", "", "", "", true},
+		{"PROXY TCP4 2001:db8::1 198.51.100.1 56324 25\r\n", "", "", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", "", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\n", "", "", "", false},
+		{"EHLO client.example.com\r\n", "", "", "", false},
+		{v2, "192.0.2.1:56324", "198.51.100.1:25", "abcde", true},
+		{"\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00EHLO", "", "", "", true}, // LOCAL
+		{"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x08\xc0\x00\x02\x01", "", "", "", false},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.header))
+		header, err := readProxyHeader(r)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: unexpected error %v", test.header, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if header.SourceAddr == nil {
+			if test.source != "" {
+				t.Errorf("%q: no source address", test.header)
+			}
+		} else if header.SourceAddr.String() != test.source || header.DestAddr.String() != test.dest {
+			t.Errorf("%q: unexpected addresses %v %v", test.header, header.SourceAddr, header.DestAddr)
+		}
+		if id := string(header.TLV(ProxyTLVUniqueID)); id != test.uniqueID {
+			t.Errorf("%q: unexpected unique id %q", test.header, id)
+		}
+		if rest, _ := r.ReadString('\n'); rest != "EHLO" {
+			t.Errorf("%q: unexpected data after header %q", test.header, rest)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+
+	handler := &sessionHandler{}
+	c, done := dialServerContext(t, &Server{ProxyProtocol: true}, handler)
+	defer c.Close()
+	c.PrintfLine("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25")
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "HELO client.example.com")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	sess := handler.session
+	if sess.Proxy == nil || sess.Proxy.Version != 1 {
+		t.Fatalf("unexpected proxy header %+v", sess.Proxy)
+	}
+	if addr, ok := sess.RemoteAddr.(*net.TCPAddr); !ok || addr.String() != "192.0.2.1:56324" {
+		t.Fatalf("unexpected remote address %v", sess.RemoteAddr)
+	}
+	if sess.LocalAddr.String() != "198.51.100.1:25" {
+		t.Fatalf("unexpected local address %v", sess.LocalAddr)
+	}
+}
+
+func TestProxyProtocolUnknown(t *testing.T) {
+
+	// the proxy waits for the greeting after the short header
+	server := &Server{ProxyProtocol: true, CommandTimeout: 2 * time.Second}
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+	c.PrintfLine("PROXY UNKNOWN")
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
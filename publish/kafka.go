@@ -0,0 +1,90 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// KafkaREST is a Publisher that produces records to Kafka through a REST
+// proxy that implements the v2 API of the Confluent REST Proxy. Key and
+// value are produced as binary data.
+type KafkaREST struct {
+	// Base URL of the proxy, e.g. "http://localhost:8082"
+	URL string
+
+	// Additional request headers, for example for authorization
+	Header http.Header
+
+	// Client used for requests, defaults to a client with a timeout of 30
+	// seconds
+	Client *http.Client
+}
+
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaRecord struct {
+	Key   []byte `json:"key,omitempty"`
+	Value []byte `json:"value"`
+}
+
+type kafkaOffsets struct {
+	Offsets []struct {
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+// Publish produces a record to a topic.
+func (k *KafkaREST) Publish(ctx context.Context, topic string, key, value []byte) error {
+	body, err := json.Marshal(&kafkaRecords{Records: []kafkaRecord{{Key: key, Value: value}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(k.URL, "/")+"/topics/"+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range k.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.binary.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	client := k.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kafka: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var offsets kafkaOffsets
+	if err := json.Unmarshal(data, &offsets); err != nil {
+		return fmt.Errorf("kafka: invalid response: %v", err)
+	}
+	if len(offsets.Offsets) != 1 {
+		return fmt.Errorf("kafka: %d offsets in response", len(offsets.Offsets))
+	}
+	if o := offsets.Offsets[0]; o.ErrorCode != nil || o.Error != "" {
+		return fmt.Errorf("kafka: %s", o.Error)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package publish
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATS is a Publisher that publishes to a NATS server. A message is
+// published when the server confirmed that it received it, which does not
+// imply that a consumer or JetStream stream stored it. The key is sent in the
+// Nats-Msg-Id header for deduplication by JetStream when the server supports
+// headers. The connection is kept open for later messages, a NATS can be
+// shared by sessions.
+type NATS struct {
+	// Address of the server, "localhost:4222" if empty
+	Address string
+
+	// Credentials, a username and password or a token, if required by the
+	// server
+	Username string
+	Password string
+	Token    string
+
+	// Configuration for TLS, which is used when set or when the server
+	// requires it
+	TLSConfig *tls.Config
+
+	// Timeout of the connection and of a message, 10 seconds if zero
+	Timeout time.Duration
+
+	// Dial connects to the server, defaults to net.Dialer.DialContext
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	mu      sync.Mutex
+	conn    net.Conn
+	r       *bufio.Reader
+	headers bool // server supports headers
+}
+
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	Headers     bool `json:"headers"`
+}
+
+// Publish publishes a message to a subject.
+func (n *NATS) Publish(ctx context.Context, subject string, key, value []byte) error {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return fmt.Errorf("nats: invalid subject %q", subject)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, n.timeout())
+	defer cancel()
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return err
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	n.conn.SetDeadline(deadline)
+	var err error
+	if len(key) > 0 && n.headers && !strings.ContainsAny(string(key), "\r\n") {
+		header := "NATS/1.0\r\nNats-Msg-Id: " + string(key) + "\r\n\r\n"
+		_, err = fmt.Fprintf(n.conn, "HPUB %s %d %d\r\n%s%s\r\nPING\r\n", subject, len(header), len(header)+len(value), header, value)
+	} else {
+		_, err = fmt.Fprintf(n.conn, "PUB %s %d\r\n%s\r\nPING\r\n", subject, len(value), value)
+	}
+	if err == nil {
+		err = n.pong()
+	}
+	if err != nil {
+		n.conn.Close()
+		n.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the server.
+func (n *NATS) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.Close()
+	n.conn = nil
+	return err
+}
+
+// connect connects to the server and authenticates
+func (n *NATS) connect(ctx context.Context) error {
+	address := n.Address
+	if address == "" {
+		address = "localhost:4222"
+	}
+	dial := n.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("nats: unexpected greeting %q", strings.TrimSpace(line))
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(line[5:]), &info); err != nil {
+		conn.Close()
+		return fmt.Errorf("nats: invalid INFO: %v", err)
+	}
+	if n.TLSConfig != nil || info.TLSRequired {
+		config := &tls.Config{}
+		if n.TLSConfig != nil {
+			config = n.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn, r = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	options, _ := json.Marshal(map[string]interface{}{
+		"verbose":    false,
+		"pedantic":   false,
+		"lang":       "go",
+		"name":       "smtpd",
+		"protocol":   1,
+		"headers":    true,
+		"user":       n.Username,
+		"pass":       n.Password,
+		"auth_token": n.Token,
+	})
+	n.conn, n.r, n.headers = conn, r, info.Headers
+	if _, err = fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", options); err == nil {
+		err = n.pong()
+	}
+	if err != nil {
+		conn.Close()
+		n.conn = nil
+		return err
+	}
+	return nil
+}
+
+// pong waits for the reply to a PING
+func (n *NATS) pong() error {
+	for {
+		line, err := n.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats: " + strings.Trim(strings.TrimSpace(line[4:]), "'"))
+		}
+	}
+}
+
+func (n *NATS) timeout() time.Duration {
+	if n.Timeout > 0 {
+		return n.Timeout
+	}
+	return 10 * time.Second
+}
@@ -0,0 +1,116 @@
+/*
+Package publish publishes accepted messages as events to a message broker,
+so that downstream consumers can process mail asynchronously.
+
+A Sink publishes an Event with the metadata of the mail transaction and the
+message, or, when a spool is set, the ID of the spool entry the message was
+written to, for messages too large to pass through the broker. Brokers are
+plugged in by implementing Publisher, NATS publishes to a NATS server and
+KafkaREST to Kafka through a REST proxy.
+*/
+package publish
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+	"github.com/emailfabric/smtpd/spool"
+)
+
+// Publisher publishes messages to a topic of a broker, the subject of NATS.
+// The key identifies the message, for example for partitioning or
+// deduplication.
+type Publisher interface {
+	Publish(ctx context.Context, topic string, key, value []byte) error
+}
+
+var errPublish = errors.New("451 4.3.0 Message could not be processed, try again later")
+
+// Event is the JSON document published for a message, with the envelope
+// and the client in the embedded Metadata.
+type Event struct {
+	// Random identifier of the message, also the key of the published
+	// message
+	ID string `json:"id"`
+	smtpd.Metadata
+	Size int64 `json:"size"`
+
+	// The message, encoded in base64 in JSON, or the ID of the spool entry
+	// the message was written to
+	Message []byte `json:"message,omitempty"`
+	SpoolID string `json:"spool_id,omitempty"`
+}
+
+// Sink is a handler that publishes messages. The members other than Message
+// are handled by the embedded ContextHandler, which decides which clients,
+// senders and recipients are accepted. A Sink can be shared by sessions.
+type Sink struct {
+	smtpd.ContextHandler
+
+	Publisher Publisher
+	Topic     string
+
+	// Spool the messages are written to when set, the events then refer to
+	// the spool entries instead of including the messages
+	Spool *spool.Spool
+
+	// Optional hook called with publishing errors
+	OnError func(err error)
+}
+
+// Message publishes the message, the client gets a temporary error reply when
+// publishing fails.
+func (s *Sink) Message(ctx context.Context, r io.Reader) error {
+	if _, err := s.Publish(ctx, smtpd.SessionFromContext(ctx), r); err != nil {
+		if s.OnError != nil {
+			s.OnError(err)
+		}
+		return errPublish
+	}
+	return nil
+}
+
+// Publish publishes the message read from r with the envelope of the
+// current transaction of sess. When a spool is set, the spool entry is
+// removed again if publishing fails.
+func (s *Sink) Publish(ctx context.Context, sess *smtpd.Session, r io.Reader) (*Event, error) {
+	e := &Event{ID: randomID()}
+	if s.Spool != nil {
+		entry, err := s.Spool.Write(sess, r)
+		if err != nil {
+			return nil, err
+		}
+		e.Metadata, e.Size, e.SpoolID = entry.Metadata, entry.Size, entry.ID
+	} else {
+		msg, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		e.Metadata, e.Size, e.Message = *sess.Metadata(time.Now()), int64(len(msg)), msg
+	}
+	value, err := json.Marshal(e)
+	if err == nil {
+		err = s.Publisher.Publish(ctx, s.Topic, []byte(e.ID), value)
+	}
+	if err != nil {
+		if e.SpoolID != "" {
+			s.Spool.Remove(e.SpoolID)
+		}
+		return nil, err
+	}
+	return e, nil
+}
+
+// randomID returns a random identifier in hex
+func randomID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,187 @@
+package publish
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emailfabric/smtpd"
+	"github.com/emailfabric/smtpd/spool"
+)
+
+type testPublisher struct {
+	topic      string
+	key, value []byte
+	err        error
+}
+
+func (p *testPublisher) Publish(ctx context.Context, topic string, key, value []byte) error {
+	p.topic, p.key, p.value = topic, key, value
+	return p.err
+}
+
+func TestSink(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "publish")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	pub := &testPublisher{}
+	sink := &Sink{Publisher: pub, Topic: "mail"}
+	sess := &smtpd.Session{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+		Envelope:   smtpd.Envelope{Sender: "sender@example.com", Recipients: []smtpd.Recipient{{Address: "rcpt@example.org"}}},
+	}
+	const msg = "Subject: test\r\n\r\npublished\r\n"
+	e, err := sink.Publish(context.Background(), sess, strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var published Event
+	if err := json.Unmarshal(pub.value, &published); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if pub.topic != "mail" || string(pub.key) != e.ID || published.ID != e.ID || string(published.Message) != msg ||
+		published.Size != int64(len(msg)) || published.Envelope.Sender != "sender@example.com" || published.Client.IP != "192.0.2.1" {
+		t.Fatalf("unexpected event %+v", published)
+	}
+
+	// with spool
+	sink.Spool = &spool.Spool{Dir: dir}
+	e, err = sink.Publish(context.Background(), sess, strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if e.Message != nil || e.SpoolID == "" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if _, err := sink.Spool.Get(e.SpoolID); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	pub.err = errors.New("unavailable")
+	if _, err = sink.Publish(context.Background(), sess, strings.NewReader(msg)); err == nil {
+		t.Fatalf("expected error")
+	}
+	if entries, _ := sink.Spool.List(); len(entries) != 1 {
+		t.Fatalf("spool entry not removed")
+	}
+}
+
+// natsServer serves a NATS connection, messages published to the subject
+// "reject" are refused
+func natsServer(l net.Listener, published chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "INFO {\"server_id\":\"test\",\"headers\":true,\"max_payload\":1048576}\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "CONNECT":
+			if !strings.Contains(line, `"user":"user"`) {
+				io.WriteString(conn, "-ERR 'Authorization Violation'\r\n")
+				return
+			}
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case "PUB", "HPUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, size+2)
+			io.ReadFull(r, data)
+			if fields[1] == "reject" {
+				io.WriteString(conn, "-ERR 'Permissions Violation for Publish to reject'\r\n")
+				return
+			}
+			published <- fields[1] + " " + string(data[:size])
+		}
+	}
+}
+
+func TestNATS(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer l.Close()
+	published := make(chan string, 2)
+	go natsServer(l, published)
+
+	n := &NATS{Address: l.Addr().String(), Username: "user", Password: "secret"}
+	defer n.Close()
+	for i := 0; i < 2; i++ {
+		if err := n.Publish(context.Background(), "mail.in", []byte("id1"), []byte("event")); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if msg := <-published; msg != "mail.in NATS/1.0\r\nNats-Msg-Id: id1\r\n\r\nevent" {
+			t.Fatalf("unexpected message %q", msg)
+		}
+	}
+	err = n.Publish(context.Background(), "reject", nil, []byte("event"))
+	if err == nil || !strings.Contains(err.Error(), "Permissions Violation") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// reconnects after an error
+	go natsServer(l, published)
+	if err := n.Publish(context.Background(), "mail.in", []byte("id2"), []byte("event")); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	<-published
+
+	if err := n.Publish(context.Background(), "mail in", nil, nil); err == nil {
+		t.Fatalf("expected error for invalid subject")
+	}
+}
+
+func TestKafkaREST(t *testing.T) {
+
+	var records kafkaRecords
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/mail" || r.Header.Get("Content-Type") != "application/vnd.kafka.binary.v2+json" {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"error_code":40401,"message":"Topic not found."}`)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&records)
+		if string(records.Records[0].Key) == "fail" {
+			io.WriteString(w, `{"offsets":[{"partition":null,"offset":null,"error_code":50003,"error":"Leader not available"}]}`)
+			return
+		}
+		io.WriteString(w, `{"key_schema_id":null,"value_schema_id":null,"offsets":[{"partition":0,"offset":1,"error_code":null,"error":null}]}`)
+	}))
+	defer server.Close()
+
+	k := &KafkaREST{URL: server.URL}
+	if err := k.Publish(context.Background(), "mail", []byte("id1"), []byte("event")); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(records.Records) != 1 || string(records.Records[0].Key) != "id1" || string(records.Records[0].Value) != "event" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	if err := k.Publish(context.Background(), "mail", []byte("fail"), []byte("event")); err == nil || !strings.Contains(err.Error(), "Leader") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := k.Publish(context.Background(), "other", nil, []byte("event")); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
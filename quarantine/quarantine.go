@@ -0,0 +1,212 @@
+/*
+Package quarantine stores messages that were rejected or held for review,
+like messages that failed DKIM verification, contained malware or were
+refused by policy, with their envelope and the reason.
+
+Quarantined items can be listed, released to be injected again, for example
+into the queue of a relay, or purged. A Store keeps each item in two files
+in a directory, the message and its metadata in JSON.
+*/
+package quarantine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+	"github.com/emailfabric/smtpd/internal/filestore"
+)
+
+// ErrNotFound is returned for unknown items.
+var ErrNotFound = errors.New("quarantine: item not found")
+
+const (
+	dataExt = ".eml"
+	metaExt = ".json"
+)
+
+// Item is a quarantined message.
+type Item struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Reason     string    `json:"reason"`
+	Sender     string    `json:"sender"`
+	Recipients []string  `json:"recipients"`
+	ClientIP   string    `json:"client_ip,omitempty"`
+	Helo       string    `json:"helo,omitempty"`
+	Size       int64     `json:"size"`
+}
+
+// Store is a quarantine in a directory. A Store can be shared by servers.
+type Store struct {
+	// Directory of the quarantined items, created when missing
+	Dir string
+
+	// Inject delivers a released message, usually by handing it to the
+	// queue of the server. Release fails when not set.
+	Inject func(ctx context.Context, item *Item, msg io.Reader) error
+}
+
+// Put quarantines the message read from r with the envelope of the current
+// transaction of sess.
+func (s *Store) Put(sess *smtpd.Session, reason string, r io.Reader) (*Item, error) {
+	item := &Item{Reason: reason, Sender: sess.Envelope.Sender, Helo: sess.Helo}
+	for _, rcpt := range sess.Envelope.Recipients {
+		item.Recipients = append(item.Recipients, rcpt.Address)
+	}
+	switch addr := sess.RemoteAddr.(type) {
+	case *net.TCPAddr:
+		item.ClientIP = addr.IP.String()
+	default:
+		if addr != nil {
+			host, _, _ := net.SplitHostPort(addr.String())
+			item.ClientIP = host
+		}
+	}
+	if err := s.Add(item, r); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// Add quarantines the message read from r with the envelope and reason of
+// item. The ID, Time and Size of item are set.
+func (s *Store) Add(item *Item, r io.Reader) error {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return fmt.Errorf("quarantine: %v", err)
+	}
+	item.ID = filestore.NewID()
+	if item.Time.IsZero() {
+		item.Time = time.Now()
+	}
+	// the message is written first, items without metadata are not listed
+	err := s.store().Add(item.ID, r, func(size int64) interface{} {
+		item.Size = size
+		return item
+	})
+	if err != nil {
+		return fmt.Errorf("quarantine: %v", err)
+	}
+	return nil
+}
+
+// List returns the quarantined items, oldest first.
+func (s *Store) List() ([]*Item, error) {
+	ids, err := s.store().IDs()
+	if err != nil {
+		return nil, fmt.Errorf("quarantine: %v", err)
+	}
+	items := make([]*Item, 0, len(ids))
+	for _, id := range ids {
+		item, err := s.Get(id)
+		if err == ErrNotFound {
+			continue // purged meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Time.Before(items[j].Time)
+	})
+	return items, nil
+}
+
+// Get returns the quarantined item with the given ID.
+func (s *Store) Get(id string) (*Item, error) {
+	if !filestore.ValidID(id) {
+		return nil, ErrNotFound
+	}
+	item := &Item{}
+	err := s.store().ReadMeta(id, item)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("quarantine: %s: %v", id, err)
+	}
+	return item, nil
+}
+
+// Open returns the message of the quarantined item with the given ID.
+func (s *Store) Open(id string) (io.ReadCloser, error) {
+	if !filestore.ValidID(id) {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(s.store().Path(id, dataExt))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("quarantine: %v", err)
+	}
+	return f, nil
+}
+
+// Release injects the quarantined item with the given ID with Inject and
+// purges it when that succeeds.
+func (s *Store) Release(ctx context.Context, id string) error {
+	if s.Inject == nil {
+		return errors.New("quarantine: no Inject function")
+	}
+	item, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	msg, err := s.Open(id)
+	if err != nil {
+		return err
+	}
+	err = s.Inject(ctx, item, msg)
+	msg.Close()
+	if err != nil {
+		return fmt.Errorf("quarantine: inject %s: %v", id, err)
+	}
+	return s.Purge(id)
+}
+
+// Purge removes the quarantined item with the given ID.
+func (s *Store) Purge(id string) error {
+	if !filestore.ValidID(id) {
+		return ErrNotFound
+	}
+	err := s.store().Remove(id)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("quarantine: %v", err)
+	}
+	return nil
+}
+
+// PurgeBefore removes the items quarantined before t and returns the number
+// of removed items.
+func (s *Store) PurgeBefore(t time.Time) (int, error) {
+	items, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, item := range items {
+		if !item.Time.Before(t) {
+			break
+		}
+		if err := s.Purge(item.ID); err != nil && err != ErrNotFound {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (s *Store) store() *filestore.Store {
+	return &filestore.Store{Dir: s.Dir, DataExt: dataExt, MetaExt: metaExt}
+}
@@ -0,0 +1,87 @@
+package quarantine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+)
+
+func TestStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	var injected []string
+	s := &Store{
+		Dir: dir + "/q",
+		Inject: func(ctx context.Context, item *Item, msg io.Reader) error {
+			data, _ := ioutil.ReadAll(msg)
+			if item.Sender == "fail@example.com" {
+				return errors.New("queue full")
+			}
+			injected = append(injected, item.Reason+": "+string(data))
+			return nil
+		},
+	}
+	sess := &smtpd.Session{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+		Helo:       "mail.example.com",
+		Envelope: smtpd.Envelope{
+			Sender:     "user@example.com",
+			Recipients: []smtpd.Recipient{{Address: "a@example.org"}, {Address: "b@example.org"}},
+		},
+	}
+	virus, err := s.Put(sess, "virus found", strings.NewReader("Subject: virus\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if virus.ClientIP != "192.0.2.1" || virus.Size != 18 || len(virus.Recipients) != 2 {
+		t.Fatalf("unexpected item %+v", virus)
+	}
+	old := &Item{Reason: "dkim fail", Sender: "fail@example.com", Time: time.Now().Add(-48 * time.Hour)}
+	if err := s.Add(old, strings.NewReader("Subject: dkim\r\n\r\n")); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	items, err := s.List()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(items) != 2 || items[0].ID != old.ID || items[1].Reason != "virus found" || items[1].Helo != "mail.example.com" {
+		t.Fatalf("unexpected items %+v", items)
+	}
+
+	if err := s.Release(context.Background(), old.ID); err == nil {
+		t.Fatalf("expected inject error")
+	}
+	if err := s.Release(context.Background(), virus.ID); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(injected) != 1 || injected[0] != "virus found: Subject: virus\r\n\r\n" {
+		t.Fatalf("unexpected injected %q", injected)
+	}
+	if _, err := s.Get(virus.ID); err != ErrNotFound {
+		t.Fatalf("released item not purged: %v", err)
+	}
+
+	if n, err := s.PurgeBefore(time.Now().Add(-time.Hour)); n != 1 || err != nil {
+		t.Fatalf("unexpected purge %d %v", n, err)
+	}
+	if items, _ = s.List(); len(items) != 0 {
+		t.Fatalf("unexpected items %+v", items)
+	}
+	if _, err := s.Open("../../etc/passwd"); err != ErrNotFound {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,360 @@
+/*
+Package queue delivers the messages in a spool with retries.
+
+A Queue periodically passes the due entries of a spool.Spool to a Deliverer,
+one call for the recipients of each domain. Recipients are removed from the
+entry when delivery succeeds or fails permanently with a 5xx error. Other
+errors defer delivery to a later attempt, with an interval that doubles
+after each attempt, until the entry is older than the maximum lifetime and
+the remaining recipients fail. The hooks report the outcome for each
+recipient, for example for logging, metrics or bounce messages.
+*/
+package queue
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+	"github.com/emailfabric/smtpd/spool"
+)
+
+// Deliverer delivers a message to recipients of a domain. It returns an
+// error for each recipient, nil when the message was delivered to the
+// recipient. Errors with a 5xx reply code, like an *smtpd.Reply or an error
+// text starting with the code, are permanent.
+type Deliverer interface {
+	Deliver(ctx context.Context, e *spool.Entry, domain string, rcpts []smtpd.Recipient, msg io.Reader) []error
+}
+
+// DelivererFunc is a function that implements Deliverer.
+type DelivererFunc func(ctx context.Context, e *spool.Entry, domain string, rcpts []smtpd.Recipient, msg io.Reader) []error
+
+// Deliver calls f.
+func (f DelivererFunc) Deliver(ctx context.Context, e *spool.Entry, domain string, rcpts []smtpd.Recipient, msg io.Reader) []error {
+	return f(ctx, e, domain, rcpts, msg)
+}
+
+// Queue delivers the entries of a spool.
+type Queue struct {
+	Spool     *spool.Spool
+	Deliverer Deliverer
+
+	// Time until the first retry, 5 minutes if zero. The interval doubles
+	// after each attempt up to MaxRetryInterval, 4 hours if zero.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+
+	// Time after which recipients that could not be delivered fail, 5 days
+	// if zero
+	MaxLifetime time.Duration
+
+	// Maximum number of concurrent deliveries to a domain, 5 if zero
+	MaxPerDomain int
+
+	// Interval at which Run looks for due entries, 1 minute if zero
+	ScanInterval time.Duration
+
+	// Optional hooks called with the outcome of a delivery attempt for a
+	// recipient, and with spool errors. OnDeferred is not called for
+	// attempts interrupted by the cancellation of the context of Run.
+	OnDelivered func(e *spool.Entry, rcpt smtpd.Recipient)
+	OnDeferred  func(e *spool.Entry, rcpt smtpd.Recipient, err error)
+	OnFailed    func(e *spool.Entry, rcpt smtpd.Recipient, err error)
+	OnError     func(err error)
+
+	mu      sync.Mutex
+	domains map[string]chan struct{} // semaphores limiting deliveries
+	active  map[string]bool          // IDs of the entries being delivered
+	wake    chan struct{}
+}
+
+// Enqueue spools the message read from r for the current transaction of
+// sess and wakes up Run to deliver it.
+func (q *Queue) Enqueue(sess *smtpd.Session, r io.Reader) (*spool.Entry, error) {
+	e, err := q.Spool.Write(sess, r)
+	if err != nil {
+		return nil, err
+	}
+	q.Wake()
+	return e, nil
+}
+
+// Wake makes Run look for due entries without waiting for the scan interval.
+func (q *Queue) Wake() {
+	select {
+	case q.wakeChan() <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) wakeChan() chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.wake == nil {
+		q.wake = make(chan struct{}, 1)
+	}
+	return q.wake
+}
+
+// Run delivers due entries until ctx is canceled. Each entry is delivered
+// independently, so a slow delivery does not hold up the others. Run returns
+// when the running deliveries are done after ctx is canceled.
+func (q *Queue) Run(ctx context.Context) error {
+	interval := q.ScanInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	wake := q.wakeChan()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		if err := q.dispatch(ctx, &wg); err != nil {
+			q.error(err)
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// RunOnce makes a delivery attempt for each due entry that is not being
+// delivered already, and returns when these attempts are done.
+func (q *Queue) RunOnce(ctx context.Context) error {
+	var wg sync.WaitGroup
+	err := q.dispatch(ctx, &wg)
+	wg.Wait()
+	return err
+}
+
+// dispatch starts a delivery attempt for each due entry that is not being
+// delivered already, wg is done when the attempts are done
+func (q *Queue) dispatch(ctx context.Context, wg *sync.WaitGroup) error {
+	entries, err := q.Spool.List()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if e.NextAttempt.After(now) || !q.claim(e.ID) {
+			continue
+		}
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			defer q.release(id)
+			// read again, the listed entry may precede an attempt that
+			// completed meanwhile
+			e, err := q.Spool.Get(id)
+			if err == spool.ErrNotFound {
+				return
+			}
+			if err != nil {
+				q.error(err)
+				return
+			}
+			if e.NextAttempt.After(time.Now()) {
+				return
+			}
+			q.deliver(ctx, e)
+		}(e.ID)
+	}
+	return nil
+}
+
+// claim marks an entry as being delivered, it returns false if it already is
+func (q *Queue) claim(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.active[id] {
+		return false
+	}
+	if q.active == nil {
+		q.active = make(map[string]bool)
+	}
+	q.active[id] = true
+	return true
+}
+
+func (q *Queue) release(id string) {
+	q.mu.Lock()
+	delete(q.active, id)
+	q.mu.Unlock()
+}
+
+// deliver makes a delivery attempt for an entry and updates it
+func (q *Queue) deliver(ctx context.Context, e *spool.Entry) {
+	rcpts := e.Envelope.Recipients
+	byDomain := make(map[string][]int)
+	for i, rcpt := range rcpts {
+		domain := domainOf(rcpt.Address)
+		byDomain[domain] = append(byDomain[domain], i)
+	}
+	errs := make([]error, len(rcpts))
+	var wg sync.WaitGroup
+	for domain, indexes := range byDomain {
+		wg.Add(1)
+		go func(domain string, indexes []int) {
+			defer wg.Done()
+			results := q.deliverDomain(ctx, e, domain, indexes)
+			for i, index := range indexes {
+				errs[index] = results[i]
+			}
+		}(domain, indexes)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	interrupted := ctx.Err() != nil
+	expired := now.Sub(e.Received) >= q.maxLifetime()
+	var remaining []smtpd.Recipient
+	for i, rcpt := range rcpts {
+		err := errs[i]
+		switch {
+		case err == nil:
+			if q.OnDelivered != nil {
+				q.OnDelivered(e, rcpt)
+			}
+		case permanent(err):
+			q.fail(e, rcpt, err)
+		case interrupted:
+			remaining = append(remaining, rcpt)
+		case expired:
+			q.fail(e, rcpt, fmt.Errorf("554 5.4.7 Delivery time expired: %v", err))
+		default:
+			if q.OnDeferred != nil {
+				q.OnDeferred(e, rcpt, err)
+			}
+			remaining = append(remaining, rcpt)
+		}
+	}
+	if len(remaining) == 0 {
+		if err := q.Spool.Remove(e.ID); err != nil {
+			q.error(err)
+		}
+		return
+	}
+	e.Envelope.Recipients = remaining
+	if !interrupted {
+		e.Attempts++
+		e.NextAttempt = now.Add(q.backoff(e.Attempts))
+	}
+	if err := q.Spool.Update(e); err != nil {
+		q.error(err)
+	}
+}
+
+// deliverDomain delivers to the recipients of a domain with the given
+// indexes, waiting for a free delivery slot of the domain
+func (q *Queue) deliverDomain(ctx context.Context, e *spool.Entry, domain string, indexes []int) []error {
+	errs := make([]error, len(indexes))
+	setAll := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	sem := q.semaphore(domain)
+	select {
+	case sem <- struct{}{}:
+		defer func() { <-sem }()
+	case <-ctx.Done():
+		return setAll(ctx.Err())
+	}
+	msg, err := q.Spool.Open(e.ID)
+	if err != nil {
+		return setAll(err)
+	}
+	defer msg.Close()
+	rcpts := make([]smtpd.Recipient, len(indexes))
+	for i, index := range indexes {
+		rcpts[i] = e.Envelope.Recipients[index]
+	}
+	results := q.Deliverer.Deliver(ctx, e, domain, rcpts, msg)
+	if len(results) != len(rcpts) {
+		return setAll(fmt.Errorf("queue: deliverer returned %d results for %d recipients", len(results), len(rcpts)))
+	}
+	return results
+}
+
+// semaphore returns the channel that limits the deliveries to a domain
+func (q *Queue) semaphore(domain string) chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.domains == nil {
+		q.domains = make(map[string]chan struct{})
+	}
+	sem := q.domains[domain]
+	if sem == nil {
+		max := q.MaxPerDomain
+		if max <= 0 {
+			max = 5
+		}
+		sem = make(chan struct{}, max)
+		q.domains[domain] = sem
+	}
+	return sem
+}
+
+func (q *Queue) fail(e *spool.Entry, rcpt smtpd.Recipient, err error) {
+	if q.OnFailed != nil {
+		q.OnFailed(e, rcpt, err)
+	}
+}
+
+func (q *Queue) error(err error) {
+	if q.OnError != nil {
+		q.OnError(err)
+	}
+}
+
+// backoff returns the time until the next attempt after the given number of
+// attempts
+func (q *Queue) backoff(attempts int) time.Duration {
+	interval, max := q.RetryInterval, q.MaxRetryInterval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	if max <= 0 {
+		max = 4 * time.Hour
+	}
+	for i := 1; i < attempts && interval < max; i++ {
+		interval *= 2
+	}
+	if interval > max {
+		interval = max
+	}
+	return interval
+}
+
+func (q *Queue) maxLifetime() time.Duration {
+	if q.MaxLifetime > 0 {
+		return q.MaxLifetime
+	}
+	return 5 * 24 * time.Hour
+}
+
+// permanent returns true if err has a 5xx reply code
+func permanent(err error) bool {
+	if reply, ok := err.(*smtpd.Reply); ok {
+		return reply.Code >= 500 && reply.Code < 600
+	}
+	msg := err.Error()
+	return len(msg) >= 3 && msg[0] == '5' && msg[1] >= '0' && msg[1] <= '9' && msg[2] >= '0' && msg[2] <= '9'
+}
+
+// domainOf returns the lowercase domain of an address
+func domainOf(address string) string {
+	i := strings.LastIndexByte(address, '@')
+	return strings.ToLower(address[i+1:])
+}
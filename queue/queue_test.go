@@ -0,0 +1,186 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+	"github.com/emailfabric/smtpd/spool"
+)
+
+func TestQueue(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var outcomes []string
+	record := func(outcome string) {
+		mu.Lock()
+		outcomes = append(outcomes, outcome)
+		mu.Unlock()
+	}
+	active, maxActive := 0, 0
+	q := &Queue{
+		Spool:         &spool.Spool{Dir: dir},
+		RetryInterval: time.Minute,
+		MaxPerDomain:  1,
+		Deliverer: DelivererFunc(func(ctx context.Context, e *spool.Entry, domain string, rcpts []smtpd.Recipient, msg io.Reader) []error {
+			if domain == "ok.example" {
+				mu.Lock()
+				if active++; active > maxActive {
+					maxActive = active
+				}
+				mu.Unlock()
+				defer func() {
+					mu.Lock()
+					active--
+					mu.Unlock()
+				}()
+			}
+			if data, _ := ioutil.ReadAll(msg); string(data) != "Subject: test\r\n\r\n" {
+				t.Errorf("unexpected message %q", data)
+			}
+			time.Sleep(10 * time.Millisecond)
+			errs := make([]error, len(rcpts))
+			for i := range rcpts {
+				switch domain {
+				case "temp.example":
+					errs[i] = errors.New("451 4.4.1 Try again later")
+				case "perm.example":
+					errs[i] = smtpd.NewReply(550, "5.1.1", "No such user")
+				}
+			}
+			return errs
+		}),
+		OnDelivered: func(e *spool.Entry, rcpt smtpd.Recipient) { record("delivered " + rcpt.Address) },
+		OnDeferred:  func(e *spool.Entry, rcpt smtpd.Recipient, err error) { record("deferred " + rcpt.Address) },
+		OnFailed: func(e *spool.Entry, rcpt smtpd.Recipient, err error) {
+			record("failed " + rcpt.Address + ": " + err.Error())
+		},
+		OnError: func(err error) { t.Errorf("%s", err.Error()) },
+	}
+
+	sess := &smtpd.Session{Envelope: smtpd.Envelope{
+		Sender:     "sender@example.com",
+		Recipients: []smtpd.Recipient{{Address: "a@ok.example"}, {Address: "b@temp.example"}, {Address: "c@Perm.Example"}},
+	}}
+	e, err := q.Enqueue(sess, strings.NewReader("Subject: test\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	sess.Envelope.Recipients = []smtpd.Recipient{{Address: "d@ok.example"}}
+	q.Enqueue(sess, strings.NewReader("Subject: test\r\n\r\n"))
+
+	ctx := context.Background()
+	if err := q.RunOnce(ctx); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(outcomes) != 4 || maxActive != 1 {
+		t.Fatalf("unexpected outcomes %q, %d concurrent", outcomes, maxActive)
+	}
+	e, err = q.Spool.Get(e.ID)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(e.Envelope.Recipients) != 1 || e.Attempts != 1 || time.Until(e.NextAttempt) < 50*time.Second {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	// not due
+	outcomes = nil
+	q.RunOnce(ctx)
+	if len(outcomes) != 0 {
+		t.Fatalf("unexpected outcomes %q", outcomes)
+	}
+
+	// expired
+	e.NextAttempt = time.Time{}
+	q.Spool.Update(e)
+	q.MaxLifetime = time.Nanosecond
+	q.RunOnce(ctx)
+	if len(outcomes) != 1 || outcomes[0] != "failed b@temp.example: 554 5.4.7 Delivery time expired: 451 4.4.1 Try again later" {
+		t.Fatalf("unexpected outcomes %q", outcomes)
+	}
+	if entries, _ := q.Spool.List(); len(entries) != 0 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	for attempts, expected := range map[int]time.Duration{1: time.Minute, 3: 4 * time.Minute, 20: 4 * time.Hour} {
+		if d := q.backoff(attempts); d != expected {
+			t.Errorf("unexpected backoff %v after %d attempts", d, attempts)
+		}
+	}
+}
+
+func TestRunIndependent(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	release := make(chan struct{})
+	delivered := make(chan string, 10)
+	q := &Queue{
+		Spool:        &spool.Spool{Dir: dir},
+		ScanInterval: 10 * time.Millisecond,
+		Deliverer: DelivererFunc(func(ctx context.Context, e *spool.Entry, domain string, rcpts []smtpd.Recipient, msg io.Reader) []error {
+			if domain == "slow.example" {
+				<-release
+			}
+			delivered <- rcpts[0].Address
+			return make([]error, len(rcpts))
+		}),
+		OnError: func(err error) { t.Errorf("%s", err.Error()) },
+	}
+	sess := &smtpd.Session{Envelope: smtpd.Envelope{
+		Sender:     "sender@example.com",
+		Recipients: []smtpd.Recipient{{Address: "a@slow.example"}},
+	}}
+	q.Enqueue(sess, strings.NewReader("Subject: test\r\n\r\n"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Run(ctx)
+	}()
+
+	// delivered while the slow entry is still being delivered
+	sess.Envelope.Recipients = []smtpd.Recipient{{Address: "b@fast.example"}}
+	q.Enqueue(sess, strings.NewReader("Subject: test\r\n\r\n"))
+	select {
+	case rcpt := <-delivered:
+		if rcpt != "b@fast.example" {
+			t.Fatalf("unexpected delivery to %s", rcpt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("delivery blocked by the slow entry")
+	}
+
+	// the slow entry is not delivered again by later scans
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if rcpt := <-delivered; rcpt != "a@slow.example" {
+		t.Fatalf("unexpected delivery to %s", rcpt)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(delivered) != 0 {
+		t.Fatalf("unexpected delivery to %s", <-delivered)
+	}
+}
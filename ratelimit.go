@@ -0,0 +1,126 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate of connections and commands. It is consulted
+// with the event "CONNECT" for new connections, and with "AUTH", "MAIL"
+// and "RCPT" for these commands. The key is "ip:" followed by the client IP
+// address, or for MAIL and RCPT also "helo:" followed by the lower case
+// HELO name, and "user:" followed by the username of an authenticated
+// client. An event is refused when any of its keys is not allowed.
+type RateLimiter interface {
+	// Allow reports whether an event for the key is allowed now, and
+	// counts the event when it is.
+	Allow(ctx context.Context, event, key string) bool
+}
+
+var (
+	errRateLimited       = errors.New("450 4.7.1 Rate limit exceeded, try again later")
+	errRateLimitedClosed = errors.New("421 4.7.0 Rate limit exceeded, closing connection")
+)
+
+// Rate is the rate of a TokenBucketLimiter. The bucket holds up to Burst
+// tokens and is refilled with Limit tokens per second.
+type Rate struct {
+	Limit float64
+	Burst int
+}
+
+// TokenBucketLimiter is a RateLimiter with a token bucket for each event and
+// key. Each event takes one token, and is refused when the bucket is empty.
+// Events without a rate are always allowed. A TokenBucketLimiter can be
+// shared by servers.
+type TokenBucketLimiter struct {
+	// Rates by event, for example "CONNECT"
+	Rates map[string]Rate
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	pruneAt int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   Rate
+}
+
+// fill adds the tokens for the time since the last event
+func (b *tokenBucket) fill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate.Limit
+	if max := float64(b.rate.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// Allow implements RateLimiter.
+func (l *TokenBucketLimiter) Allow(ctx context.Context, event, key string) bool {
+	rate, ok := l.Rates[event]
+	if !ok {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	if len(l.buckets) >= l.pruneAt {
+		l.prune(now)
+	}
+	key = event + " " + key
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(rate.Burst), last: now, rate: rate}
+		l.buckets[key] = b
+	} else {
+		b.fill(now)
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune removes full buckets
+func (l *TokenBucketLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.fill(now); b.tokens >= float64(b.rate.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.pruneAt = 2 * len(l.buckets)
+	if l.pruneAt < 1024 {
+		l.pruneAt = 1024
+	}
+}
+
+// rateLimited returns true if an event of the session exceeds the rate
+// limit for its IP address, HELO name or user
+func (s *session) rateLimited(event string) bool {
+	l := s.server.RateLimiter
+	if l == nil || s.exempt {
+		return false
+	}
+	if ip := remoteIP(s.RemoteAddr); ip != nil && !l.Allow(s.ctx, event, "ip:"+ip.String()) {
+		return true
+	}
+	if event != "MAIL" && event != "RCPT" {
+		return false
+	}
+	if s.Helo != "" && !l.Allow(s.ctx, event, "helo:"+strings.ToLower(s.Helo)) {
+		return true
+	}
+	if s.AuthUsername != "" && !l.Allow(s.ctx, event, "user:"+s.AuthUsername) {
+		return true
+	}
+	return false
+}
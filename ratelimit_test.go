@@ -0,0 +1,61 @@
+package smtpd
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+
+	limiter := &TokenBucketLimiter{Rates: map[string]Rate{"MAIL": {Limit: 1, Burst: 2}}}
+	ctx := context.Background()
+
+	for i, expected := range []bool{true, true, false} {
+		if limiter.Allow(ctx, "MAIL", "ip:192.0.2.1") != expected {
+			t.Fatalf("event %d: expected %t", i+1, expected)
+		}
+	}
+	if !limiter.Allow(ctx, "MAIL", "ip:192.0.2.2") {
+		t.Fatalf("other key not allowed")
+	}
+	if !limiter.Allow(ctx, "RCPT", "ip:192.0.2.1") {
+		t.Fatalf("event without rate not allowed")
+	}
+
+	// bucket is refilled
+	limiter.buckets["MAIL ip:192.0.2.1"].last = time.Now().Add(-time.Second)
+	if !limiter.Allow(ctx, "MAIL", "ip:192.0.2.1") {
+		t.Fatalf("bucket not refilled")
+	}
+
+	// full buckets are pruned
+	limiter.buckets["MAIL ip:192.0.2.2"].last = time.Now().Add(-time.Hour)
+	limiter.prune(time.Now())
+	if _, ok := limiter.buckets["MAIL ip:192.0.2.2"]; ok || len(limiter.buckets) != 1 {
+		t.Fatalf("unexpected buckets %v", limiter.buckets)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+
+	limiter := &TokenBucketLimiter{Rates: map[string]Rate{
+		"MAIL": {Limit: 0.001, Burst: 1},
+		"AUTH": {Limit: 0.001, Burst: 1},
+	}}
+	server := &Server{RateLimiter: limiter}
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "HELO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RSET")
+	cmd(t, c, 450, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 502, "AUTH UNKNOWN")
+	cmd(t, c, 421, "AUTH UNKNOWN")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
@@ -0,0 +1,163 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// RDNS is the result of the reverse DNS lookup of a client IP address.
+type RDNS struct {
+	// Names of the PTR records of the address
+	Names []string
+
+	// First name that resolves back to the address (forward-confirmed
+	// reverse DNS), empty if there is none
+	Hostname string
+
+	// Error of a lookup that failed temporarily, nil when the address has
+	// no PTR records
+	Err error
+}
+
+// Verified returns true if the client has a forward-confirmed hostname.
+func (r *RDNS) Verified() bool {
+	return r != nil && r.Hostname != ""
+}
+
+const (
+	rdnsTimeout  = 10 * time.Second
+	rdnsCacheTTL = 5 * time.Minute
+)
+
+var (
+	errRDNSFailed    = errors.New("550 5.7.25 Reverse DNS validation failed")
+	errRDNSTemporary = errors.New("450 4.7.25 Reverse DNS lookup failed, try again later")
+)
+
+// rdnsLookup is a lookup in progress
+type rdnsLookup struct {
+	done   chan struct{}
+	result *RDNS
+}
+
+type rdnsEntry struct {
+	result  *RDNS
+	expires time.Time
+}
+
+// RDNS returns the result of the reverse DNS lookup of the client that was
+// started at connection time when Server.ReverseDNS is set, waiting for the
+// lookup to complete. It returns nil when no lookup was made.
+func (s *Session) RDNS() *RDNS {
+	if s.rdns == nil {
+		return nil
+	}
+	<-s.rdns.done
+	return s.rdns.result
+}
+
+// startRDNS starts the reverse DNS lookup of the client in the background
+func (s *session) startRDNS() {
+	ip := remoteIP(s.RemoteAddr)
+	if !s.server.ReverseDNS || ip == nil {
+		s.Session.rdns = nil
+		return
+	}
+	l := &rdnsLookup{done: make(chan struct{})}
+	s.Session.rdns = l
+	ctx := s.ctx
+	go func() {
+		l.result = s.server.lookupRDNS(ctx, ip)
+		close(l.done)
+	}()
+}
+
+// checkRDNS returns an error when the client must be refused because it has
+// no forward-confirmed hostname
+func (s *session) checkRDNS() error {
+	if !s.server.RDNSReject || s.rdns == nil || s.exempt {
+		return nil
+	}
+	result := s.RDNS()
+	if result.Verified() {
+		return nil
+	}
+	if result.Err != nil {
+		return errRDNSTemporary
+	}
+	return errRDNSFailed
+}
+
+// lookupRDNS returns the cached or new result of the lookup of ip
+func (srv *Server) lookupRDNS(ctx context.Context, ip net.IP) *RDNS {
+	key := ip.String()
+	now := time.Now()
+	srv.mu.Lock()
+	if e := srv.rdnsCache[key]; e != nil && now.Before(e.expires) {
+		srv.mu.Unlock()
+		return e.result
+	}
+	srv.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, rdnsTimeout)
+	defer cancel()
+	result := verifyRDNS(ctx, srv.resolver(), ip)
+	if result.Err != nil {
+		return result // not cached
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.rdnsCache == nil {
+		srv.rdnsCache = make(map[string]*rdnsEntry)
+	}
+	if len(srv.rdnsCache) >= srv.rdnsPruneAt {
+		for k, e := range srv.rdnsCache {
+			if !now.Before(e.expires) {
+				delete(srv.rdnsCache, k)
+			}
+		}
+		srv.rdnsPruneAt = 2 * len(srv.rdnsCache)
+		if srv.rdnsPruneAt < 1024 {
+			srv.rdnsPruneAt = 1024
+		}
+	}
+	srv.rdnsCache[key] = &rdnsEntry{result: result, expires: now.Add(rdnsCacheTTL)}
+	return result
+}
+
+// verifyRDNS looks up the PTR records of ip and the addresses of each name
+func verifyRDNS(ctx context.Context, r Resolver, ip net.IP) *RDNS {
+	names, err := r.LookupAddr(ctx, ip.String())
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return &RDNS{}
+		}
+		return &RDNS{Err: err}
+	}
+	result := &RDNS{}
+	for _, name := range names {
+		result.Names = append(result.Names, strings.TrimSuffix(name, "."))
+	}
+	var lookupErr error
+	for _, name := range result.Names {
+		addrs, err := r.LookupIPAddr(ctx, name)
+		if err != nil {
+			if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+				lookupErr = err
+			}
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				result.Hostname = name
+				return result
+			}
+		}
+	}
+	result.Err = lookupErr
+	return result
+}
@@ -0,0 +1,108 @@
+package smtpd
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestReverseDNS(t *testing.T) {
+
+	// loopback address is confirmed with the hosts file
+	server := &Server{ReverseDNS: true, RDNSReject: true, Resolver: &net.Resolver{PreferGo: true}}
+	result := server.lookupRDNS(context.Background(), net.ParseIP("127.0.0.1"))
+	if !result.Verified() || result.Err != nil {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if server.rdnsCache["127.0.0.1"].result != result {
+		t.Fatalf("result not cached")
+	}
+
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	var r *RDNS
+	if r.Verified() {
+		t.Fatalf("nil result verified")
+	}
+	sess := &session{server: &Server{RDNSReject: true}}
+	sess.rdns = &rdnsLookup{done: make(chan struct{}), result: &RDNS{Names: []string{"forged.example.com"}}}
+	close(sess.rdns.done)
+	if err := sess.checkRDNS(); err != errRDNSFailed {
+		t.Fatalf("expected %v, got %v", errRDNSFailed, err)
+	}
+	sess.rdns.result.Err = &net.DNSError{Err: "timeout", IsTimeout: true}
+	if err := sess.checkRDNS(); err != errRDNSTemporary {
+		t.Fatalf("expected %v, got %v", errRDNSTemporary, err)
+	}
+}
+
+// testResolver is a Resolver with static PTR and address records
+type testResolver struct {
+	ptr   map[string][]string
+	addrs map[string][]string
+}
+
+func (r testResolver) notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r testResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := r.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, r.notFound(addr)
+}
+
+func (r testResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r.addrs[host]; ok {
+		return addrs, nil
+	}
+	return nil, r.notFound(host)
+}
+
+func (r testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := r.LookupHost(ctx, host)
+	var ips []net.IPAddr
+	for _, addr := range addrs {
+		ips = append(ips, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return ips, err
+}
+
+func (r testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, r.notFound(name)
+}
+
+func (r testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, r.notFound(name)
+}
+
+func TestVerifyRDNS(t *testing.T) {
+
+	resolver := testResolver{
+		ptr: map[string][]string{
+			"192.0.2.1": {"mail.example.com."},
+			"192.0.2.2": {"forged.example.com.", "other.example.com."},
+		},
+		addrs: map[string][]string{
+			"mail.example.com":   {"192.0.2.1"},
+			"forged.example.com": {"198.51.100.1"},
+		},
+	}
+	ctx := context.Background()
+	if r := verifyRDNS(ctx, resolver, net.ParseIP("192.0.2.1")); r.Hostname != "mail.example.com" || r.Err != nil {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	if r := verifyRDNS(ctx, resolver, net.ParseIP("192.0.2.2")); r.Verified() || len(r.Names) != 2 || r.Err != nil {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	if r := verifyRDNS(ctx, resolver, net.ParseIP("192.0.2.3")); r.Verified() || len(r.Names) != 0 || r.Err != nil {
+		t.Fatalf("unexpected result %+v", r)
+	}
+}
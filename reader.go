@@ -2,13 +2,16 @@ package smtpd
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"io"
 )
 
 // textproto.Reader#DotReader() rewrites standard CRLF line endings to LF which
 // causes issues when mails are signed or forwarded
 // this replacement preserves line endings and also implements io.WriterTo which
-// is more efficient when io.Copy is used on the reader
+// is more efficient when io.Copy is used on the reader, the message reader of
+// the session passes it through timeoutReader
 
 const (
 	stateBeginLine = iota // beginning of line; initial state; must be zero
@@ -21,6 +24,88 @@ const (
 type dotReader struct {
 	r     *bufio.Reader
 	state int
+	wire  bool  // count escape dots as received on the wire
+	size  int64 // number of message bytes consumed
+	max   int64 // fail with ErrMessageTooLarge when size exceeds max, if set
+
+	// fail with the first invalid data found when maxLine or rejectNUL is
+	// set or bare LF is rejected, maxLine is the maximum line length
+	// including CRLF
+	maxLine   int
+	rejectNUL bool
+	lineLen   int   // length of the current line on the wire
+	invalid   error // first invalid data found
+	discard   bool  // only record invalid data while discarding the message
+
+	bareLF  BareLFMode
+	cr      bool   // last byte read was CR
+	lfLine  bool   // current line follows a bare LF
+	pending []byte // data that did not fit in the last Read
+}
+
+// Errors for invalid message data
+var (
+	ErrMessageLineTooLong = errors.New("500 5.5.2 Line too long")
+	ErrMessageNUL         = errors.New("554 5.6.0 Message contains NUL characters")
+	ErrBareLF             = errors.New("500 5.5.2 Bare LF line endings not allowed")
+)
+
+// BareLFMode selects how message data lines ending with LF instead of CRLF
+// are handled. Unless bare LF is accepted the end of data must be
+// <CRLF>.<CRLF>, so a client can not end a message with bare LF and smuggle
+// the remaining data past a server that handles it differently.
+type BareLFMode int
+
+const (
+	// BareLFAccept passes lines ending with bare LF unchanged and accepts
+	// a line with a single dot ending with bare LF as the end of data
+	BareLFAccept BareLFMode = iota
+
+	// BareLFReject refuses messages containing bare LF with ErrBareLF
+	// after the end of data, as required by RFC 5321
+	BareLFReject
+
+	// BareLFNormalize replaces bare LF with CRLF
+	BareLFNormalize
+)
+
+// checkByte checks a byte of message data as received on the wire
+func (d *dotReader) checkByte(c byte) {
+	d.lineLen++
+	if d.invalid == nil {
+		if d.maxLine > 0 && d.lineLen > d.maxLine {
+			d.invalid = ErrMessageLineTooLong
+		} else if d.rejectNUL && c == 0 {
+			d.invalid = ErrMessageNUL
+		}
+	}
+	if c == '\n' {
+		d.lineLen = 0
+	}
+}
+
+// checkLine checks a line of message data as received on the wire
+func (d *dotReader) checkLine(line []byte) {
+	if d.invalid != nil {
+		return
+	}
+	if d.maxLine > 0 && len(line) > d.maxLine {
+		d.invalid = ErrMessageLineTooLong
+	} else if d.rejectNUL && bytes.IndexByte(line, 0) != -1 {
+		d.invalid = ErrMessageNUL
+	}
+}
+
+// failInvalid returns true if reads fail with invalid data
+func (d *dotReader) failInvalid() bool {
+	return d.invalid != nil && !d.discard
+}
+
+// Size returns the number of message bytes consumed so far. Escape dots removed
+// by dot unstuffing are only counted when wire is set. The final ".\r\n" is
+// never counted.
+func (d *dotReader) Size() int64 {
+	return d.size
 }
 
 // Read chunk of message data.
@@ -30,7 +115,16 @@ type dotReader struct {
 func (d *dotReader) Read(b []byte) (n int, err error) {
 	br := d.r
 	state := d.state
-	for n < len(b) && state != stateEOF {
+	for n < len(b) {
+		if len(d.pending) > 0 {
+			k := copy(b[n:], d.pending)
+			d.pending = d.pending[k:]
+			n += k
+			continue
+		}
+		if state == stateEOF {
+			break
+		}
 		var c byte
 		c, err = br.ReadByte()
 		if err != nil {
@@ -39,6 +133,28 @@ func (d *dotReader) Read(b []byte) (n int, err error) {
 			}
 			break
 		}
+		if d.maxLine > 0 || d.rejectNUL {
+			d.checkByte(c)
+		}
+		cr := d.cr
+		d.cr = c == '\r'
+
+		if c == '\n' && !cr && d.bareLF != BareLFAccept {
+			if state == stateDot {
+				n = d.put(b, n, '.') // not the end of data
+			}
+			if d.bareLF == BareLFReject && d.invalid == nil {
+				d.invalid = ErrBareLF
+			}
+			if d.bareLF == BareLFNormalize {
+				n = d.put(b, n, '\r', '\n')
+			} else {
+				n = d.put(b, n, '\n')
+			}
+			d.lfLine = true
+			state = stateBeginLine
+			continue
+		}
 
 		switch state {
 		case stateBeginLine:
@@ -58,18 +174,32 @@ func (d *dotReader) Read(b []byte) (n int, err error) {
 				state = stateEOF // exit loop
 				continue
 			}
+			d.countDot()
 			state = stateData
 		case stateDotCR:
 			if c == '\n' {
+				if d.lfLine && d.bareLF != BareLFAccept {
+					// dot line after bare LF is not the end of data
+					n = d.put(b, n, '.', '\r', '\n')
+					d.lfLine = false
+					state = stateBeginLine
+					continue
+				}
 				state = stateEOF // exit loop
 				continue
 			}
 			// .CR not followed by LF, should not occur
 			c = '\r'
 			br.UnreadByte()
+			if d.lineLen > 0 {
+				d.lineLen-- // checked again
+			}
+			d.cr = true
+			d.countDot()
 			state = stateData
 		case stateData:
 			if c == '\n' {
+				d.lfLine = false
 				state = stateBeginLine
 			}
 		}
@@ -77,33 +207,82 @@ func (d *dotReader) Read(b []byte) (n int, err error) {
 		b[n] = c
 		n++
 	}
+	d.size += int64(n)
+	if err == nil && d.failInvalid() {
+		err = d.invalid
+	}
 	if err == nil && state == stateEOF {
 		err = io.EOF
 	}
+	if err == nil && d.max > 0 && d.size > d.max {
+		err = ErrMessageTooLarge
+	}
 	d.state = state
 	return
 }
 
+// put writes p to b at n and keeps the bytes that do not fit for the next
+// Read, it returns the new n
+func (d *dotReader) put(b []byte, n int, p ...byte) int {
+	k := copy(b[n:], p)
+	d.pending = append(d.pending, p[k:]...)
+	return n + k
+}
+
+// countDot counts a discarded escape dot in on-wire mode
+func (d *dotReader) countDot() {
+	if d.wire {
+		d.size++
+	}
+}
+
 // WriteTo implements WriterTo which can be used in io.Copy.
 // It is more efficient than Read() because it loops on lines instead of bytes.
 func (d *dotReader) WriteTo(w io.Writer) (n int64, err error) {
 	if d.state == stateEOF {
-		return 0, io.EOF
+		return 0, nil
+	}
+	if d.bareLF != BareLFAccept || d.state != stateBeginLine || len(d.pending) > 0 {
+		// bare LF and partially read lines are handled by Read
+		return io.Copy(w, struct{ io.Reader }{d})
 	}
 	for {
 		line, err := d.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// line longer than the buffer, the rest is handled by Read
+			d.lineLen = len(line)
+			if d.maxLine > 0 || d.rejectNUL {
+				d.checkLine(line)
+			}
+			if line[0] == '.' {
+				line = line[1:]
+				d.countDot()
+			}
+			written, err := w.Write(line)
+			n += int64(written)
+			d.size += int64(written)
+			if err != nil {
+				return n, err
+			}
+			d.state, d.cr = stateData, line[len(line)-1] == '\r'
+			m, err := io.Copy(w, struct{ io.Reader }{d})
+			return n + m, err
+		}
 		if err != nil {
-			// ErrBufferFull should not occur as lines must be 1000 bytes or less
 			// a partial line may be returned after error (often io.EOF)
 			if line != nil {
 				written, _ := w.Write(line)
 				n += int64(written)
+				d.size += int64(written)
 			}
 			if err == io.EOF {
 				err = io.ErrUnexpectedEOF
 			}
 			return n, err
 		}
+		if d.maxLine > 0 || d.rejectNUL {
+			d.checkLine(line)
+		}
 		// line starts with dot?
 		if len(line) >= 2 && line[0] == '.' {
 			// followed by CRLF or LF?
@@ -113,12 +292,20 @@ func (d *dotReader) WriteTo(w io.Writer) (n int64, err error) {
 			}
 			// followed by other character, remove dot
 			line = line[1:]
+			d.countDot()
 		}
 		// copy line including (CR)LF
 		written, err := w.Write(line)
 		n += int64(written)
+		d.size += int64(written)
 		if err != nil {
 			return n, err
 		}
+		if d.max > 0 && d.size > d.max {
+			return n, ErrMessageTooLarge
+		}
+		if d.failInvalid() {
+			return n, d.invalid
+		}
 	}
 }
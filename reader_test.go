@@ -0,0 +1,164 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const stuffedMessage = "Subject: test\r\n\r\n..leading dot\r\n.\r\nQUIT\r\n"
+
+const unstuffedMessage = "Subject: test\r\n\r\n.leading dot\r\n"
+
+func TestDotReaderSize(t *testing.T) {
+
+	for _, wire := range []bool{false, true} {
+		expected := int64(len(unstuffedMessage))
+		if wire {
+			expected++ // escape dot
+		}
+
+		// Read
+		d := &dotReader{r: bufio.NewReader(strings.NewReader(stuffedMessage)), wire: wire}
+		data, err := ioutil.ReadAll(d)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if string(data) != unstuffedMessage {
+			t.Fatalf("unexpected data %q", data)
+		}
+		if d.Size() != expected {
+			t.Fatalf("Read: expected size %d, got %d (wire %t)", expected, d.Size(), wire)
+		}
+
+		// WriteTo
+		d = &dotReader{r: bufio.NewReader(strings.NewReader(stuffedMessage)), wire: wire}
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, d); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if buf.String() != unstuffedMessage {
+			t.Fatalf("unexpected data %q", buf.String())
+		}
+		if d.Size() != expected {
+			t.Fatalf("WriteTo: expected size %d, got %d (wire %t)", expected, d.Size(), wire)
+		}
+	}
+}
+
+func TestDotReaderInvalid(t *testing.T) {
+	tests := []struct {
+		msg       string
+		maxLine   int
+		rejectNUL bool
+		err       error
+	}{
+		{"short\r\n.\r\n", 8, false, nil},
+		{"exactly\r\n.\r\n", 9, false, nil},
+		{"too long\r\n.\r\n", 9, false, ErrMessageLineTooLong},
+		{"..dotted\r\n.\r\n", 9, false, ErrMessageLineTooLong},
+		{"nul\x00\r\n.\r\n", 0, false, nil},
+		{"nul\x00\r\n.\r\n", 0, true, ErrMessageNUL},
+	}
+	for i, test := range tests {
+		// Read
+		d := &dotReader{r: bufio.NewReader(strings.NewReader(test.msg + "QUIT\r\n")), maxLine: test.maxLine, rejectNUL: test.rejectNUL}
+		_, err := ioutil.ReadAll(d)
+		if err != test.err {
+			t.Errorf("%d: Read: expected error %v, got %v", i, test.err, err)
+		}
+		// remaining data is discarded up to the final dot
+		d.discard = true
+		if _, err := ioutil.ReadAll(d); err != nil {
+			t.Errorf("%d: discard: %v", i, err)
+		}
+		if d.invalid != test.err {
+			t.Errorf("%d: expected invalid %v, got %v", i, test.err, d.invalid)
+		}
+		if rest, _ := d.r.ReadString('\n'); rest != "QUIT\r\n" {
+			t.Errorf("%d: unexpected data after message %q", i, rest)
+		}
+
+		// WriteTo
+		d = &dotReader{r: bufio.NewReader(strings.NewReader(test.msg)), maxLine: test.maxLine, rejectNUL: test.rejectNUL}
+		if _, err := io.Copy(ioutil.Discard, d); err != test.err {
+			t.Errorf("%d: WriteTo: expected error %v, got %v", i, test.err, err)
+		}
+	}
+}
+
+func TestDotReaderBareLF(t *testing.T) {
+	const msg = "a\r\nb\nc\r\n.\nd\n.\r\n..e\r\n.\r\nQUIT\r\n"
+	tests := []struct {
+		mode BareLFMode
+		data string
+		err  error
+	}{
+		{BareLFAccept, "a\r\nb\nc\r\n", nil},
+		{BareLFReject, "a\r\nb\nc\r\n.\nd\n.\r\n.e\r\n", ErrBareLF},
+		{BareLFNormalize, "a\r\nb\r\nc\r\n.\r\nd\r\n.\r\n.e\r\n", nil},
+	}
+	for _, test := range tests {
+		for _, size := range []int{1, 512} {
+			d := &dotReader{r: bufio.NewReader(strings.NewReader(msg)), bareLF: test.mode, discard: true}
+			var buf bytes.Buffer
+			p := make([]byte, size)
+			for {
+				n, err := d.Read(p)
+				buf.Write(p[:n])
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("%s", err.Error())
+				}
+			}
+			if buf.String() != test.data {
+				t.Errorf("mode %d, size %d: unexpected data %q", test.mode, size, buf.String())
+			}
+			if d.invalid != test.err {
+				t.Errorf("mode %d: expected %v, got %v", test.mode, test.err, d.invalid)
+			}
+			if int64(buf.Len()) != d.Size() {
+				t.Errorf("mode %d: size %d, read %d", test.mode, d.Size(), buf.Len())
+			}
+		}
+	}
+}
+
+func TestDotReaderWriteTo(t *testing.T) {
+
+	long := strings.Repeat("x", 40)
+	msg := "..dot\r\n." + long + "\r\n" + long + "\r\n.\r\nQUIT\r\n"
+	expected := ".dot\r\n" + long + "\r\n" + long + "\r\n"
+
+	// lines longer than the buffer
+	d := &dotReader{r: bufio.NewReaderSize(strings.NewReader(msg), 16)}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, d); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if buf.String() != expected || d.Size() != int64(len(expected)) {
+		t.Fatalf("unexpected data %q (size %d)", buf.String(), d.Size())
+	}
+
+	// after a partial Read
+	d = &dotReader{r: bufio.NewReader(strings.NewReader(msg))}
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(d, b); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	buf.Reset()
+	if _, err := io.Copy(&buf, d); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if string(b)+buf.String() != expected {
+		t.Fatalf("unexpected data %q", string(b)+buf.String())
+	}
+	if n, err := d.WriteTo(&buf); n != 0 || err != nil {
+		t.Fatalf("expected nothing after the end of data, got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,84 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+)
+
+// Protocol returns the protocol of the session for the with clause of a
+// Received header (RFC 3848 and RFC 6531), for example "ESMTPSA" for ESMTP
+// with TLS and authentication.
+func (s *Session) Protocol() string {
+	var proto string
+	switch {
+	case s.lmtp:
+		proto = "LMTP"
+	case s.extended:
+		proto = "ESMTP"
+	default:
+		return "SMTP"
+	}
+	if s.Envelope.SMTPUTF8 {
+		proto = "UTF8" + strings.TrimPrefix(proto, "E")
+	}
+	if s.TLS != nil {
+		proto += "S"
+	}
+	if s.AuthUsername != "" {
+		proto += "A"
+	}
+	return proto
+}
+
+// Received returns the Received header field (RFC 5321 section 4.4) for
+// the current mail transaction, including CRLF. by is the hostname of the
+// server. The client is identified by its HELO hostname, verified reverse
+// DNS hostname and IP address. The TLS parameters and authenticated user
+// are added as comments, and the recipient when there is only one.
+func (s *Session) Received(by string, now time.Time) string {
+	var b strings.Builder
+	b.WriteString("Received: from ")
+	if s.Helo != "" {
+		b.WriteString(sanitizeTrace(s.Helo))
+	} else {
+		b.WriteString("unknown")
+	}
+	host := s.RemoteHostname
+	if rdns := s.RDNS(); rdns.Verified() {
+		host = rdns.Hostname
+	}
+	if ip := remoteIP(s.RemoteAddr); ip != nil {
+		if host == "" {
+			host = "unknown"
+		}
+		literal := ip.String()
+		if ip.To4() == nil {
+			literal = "IPv6:" + literal
+		}
+		b.WriteString(" (" + sanitizeTrace(host) + " [" + literal + "])")
+	}
+	if s.TLS != nil {
+		b.WriteString("\r\n\t(using " + tls.VersionName(s.TLS.Version) + " with cipher " + tls.CipherSuiteName(s.TLS.CipherSuite) + ")")
+	}
+	if s.AuthUsername != "" {
+		b.WriteString("\r\n\t(authenticated sender: " + sanitizeTrace(s.AuthUsername) + ")")
+	}
+	b.WriteString("\r\n\tby " + by + " with " + s.Protocol())
+	if len(s.Envelope.Recipients) == 1 {
+		b.WriteString("\r\n\tfor <" + sanitizeTrace(s.Envelope.Recipients[0].Address) + ">")
+	}
+	b.WriteString("; " + now.Format(time.RFC1123Z) + "\r\n")
+	return b.String()
+}
+
+// sanitizeTrace replaces characters given by the client that could break
+// the syntax of a Received header
+func sanitizeTrace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f || r == '(' || r == ')' || r == '\\' || r == '<' || r == '>' || r == ';' {
+			return '?'
+		}
+		return r
+	}, s)
+}
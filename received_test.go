@@ -0,0 +1,73 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReceived(t *testing.T) {
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := &Session{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1025},
+		Helo:       "client (evil)",
+		Envelope:   Envelope{Recipients: []Recipient{{Address: "rcpt@example.org"}}},
+		extended:   true,
+		rdns:       &rdnsLookup{done: make(chan struct{}), result: &RDNS{Hostname: "client.example.com"}},
+	}
+	close(s.rdns.done)
+	expected := "Received: from client ?evil? (client.example.com [IPv6:2001:db8::1])\r\n" +
+		"\tby mx.example.net with ESMTP\r\n\tfor <rcpt@example.org>; Fri, 01 Mar 2024 12:00:00 +0000\r\n"
+	if h := s.Received("mx.example.net", now); h != expected {
+		t.Fatalf("unexpected header %q", h)
+	}
+
+	s.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256}
+	s.AuthUsername = "user@example.org"
+	s.Envelope.Recipients = append(s.Envelope.Recipients, Recipient{Address: "other@example.org"})
+	expected = "Received: from client ?evil? (client.example.com [IPv6:2001:db8::1])\r\n" +
+		"\t(using TLS 1.3 with cipher TLS_AES_128_GCM_SHA256)\r\n\t(authenticated sender: user@example.org)\r\n" +
+		"\tby mx.example.net with ESMTPSA; Fri, 01 Mar 2024 12:00:00 +0000\r\n"
+	if h := s.Received("mx.example.net", now); h != expected {
+		t.Fatalf("unexpected header %q", h)
+	}
+
+	for proto, s := range map[string]*Session{
+		"SMTP":      {},
+		"LMTPS":     {lmtp: true, extended: true, TLS: &tls.ConnectionState{}},
+		"UTF8SMTPA": {extended: true, AuthUsername: "user", Envelope: Envelope{SMTPUTF8: true}},
+	} {
+		if p := s.Protocol(); p != proto {
+			t.Errorf("unexpected protocol %s, expected %s", p, proto)
+		}
+	}
+}
+
+func TestAddReceived(t *testing.T) {
+
+	handler := &dataHandler{}
+	c, done := dialServer(t, &Server{Hostname: "mx.example.net", AddReceived: true}, handler)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "HELO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	data := handler.data[0]
+	if !strings.HasPrefix(data, "Received: from localhost (unknown [127.0.0.1])\r\n\tby mx.example.net with SMTP\r\n\tfor <rcpt@example.com>; ") ||
+		!strings.HasSuffix(data, "\r\nSubject: test\r\n\r\nThis is a test.\r\n") {
+		t.Fatalf("unexpected message %q", data)
+	}
+}
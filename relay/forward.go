@@ -0,0 +1,143 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+	"github.com/emailfabric/smtpd/queue"
+	"github.com/emailfabric/smtpd/spool"
+)
+
+// forwardHold is the time after which the queue delivers a spooled message
+// whose forwarding was interrupted, e.g. by a crash. It exceeds the duration
+// of a forwarding attempt.
+const forwardHold = time.Hour
+
+var (
+	errNoSmarthost = errors.New("451 4.3.5 No smarthost configured")
+	errSpool       = errors.New("451 4.3.0 Message could not be stored")
+)
+
+// Forwarder is a handler that forwards the messages accepted by a server to
+// the smarthost of Client, which must be set. The members other than
+// Message are handled by the embedded ContextHandler, which decides which
+// clients, senders and recipients are accepted:
+//
+//	fwd := &relay.Forwarder{
+//		ContextHandler: policy,
+//		Client: &relay.Client{
+//			Smarthost: "smtp.example.net:587",
+//			Username:  "user",
+//			Password:  "secret",
+//		},
+//	}
+//	server := &smtpd.Server{
+//		NewContextHandler: func() smtpd.ContextHandler { return fwd },
+//	}
+//
+// Without Queue the message is streamed to the smarthost and its reply is
+// returned to the client when no recipient was accepted, a temporary reply
+// when there is one. Recipients the smarthost refused after it accepted
+// others are dropped.
+type Forwarder struct {
+	smtpd.ContextHandler
+
+	Client *Client
+
+	// Queue for recipients that can not be forwarded immediately, its
+	// Deliverer is usually Client. When set, messages are spooled before
+	// they are forwarded and accepted when at least one recipient is
+	// accepted or deferred. Deferred recipients are retried by the queue,
+	// and the OnFailed hook of the queue is called for recipients that the
+	// smarthost refused when the message was accepted.
+	Queue *queue.Queue
+}
+
+// Message forwards the message.
+func (f *Forwarder) Message(ctx context.Context, r io.Reader) error {
+	if f.Client == nil || f.Client.Smarthost == "" {
+		return errNoSmarthost
+	}
+	sess := smtpd.SessionFromContext(ctx)
+	if f.Queue == nil {
+		results := f.Client.Send(ctx, "", &sess.Envelope, sess.Envelope.Recipients, r)
+		accepted := false
+		var err error
+		for _, result := range results {
+			switch {
+			case result.Err == nil:
+				accepted = true
+			case err == nil || !permanent(result.Err):
+				err = result.Err
+			}
+		}
+		if accepted {
+			return nil
+		}
+		return err
+	}
+
+	// the entry is not due while it is forwarded, so that a running queue
+	// does not deliver it too
+	e := &spool.Entry{
+		Metadata:    *sess.Metadata(time.Now()),
+		NextAttempt: time.Now().Add(forwardHold),
+	}
+	if err := f.Queue.Spool.Add(e, r); err != nil {
+		return errSpool
+	}
+	msg, err := f.Queue.Spool.Open(e.ID)
+	if err != nil {
+		return errSpool
+	}
+	results := f.Client.Send(ctx, "", &e.Envelope, e.Envelope.Recipients, msg)
+	msg.Close()
+
+	var delivered int
+	var deferred, failed []smtpd.Recipient
+	var failedErrs []error
+	for i, result := range results {
+		rcpt := e.Envelope.Recipients[i]
+		switch {
+		case result.Err == nil:
+			delivered++
+		case permanent(result.Err):
+			failed = append(failed, rcpt)
+			failedErrs = append(failedErrs, result.Err)
+		default:
+			deferred = append(deferred, rcpt)
+		}
+	}
+	if len(deferred) == 0 {
+		f.Queue.Spool.Remove(e.ID)
+		if delivered == 0 && len(failedErrs) > 0 {
+			return failedErrs[0] // refused, the client bounces the message
+		}
+	}
+	if f.Queue.OnFailed != nil {
+		for i, rcpt := range failed {
+			f.Queue.OnFailed(e, rcpt, failedErrs[i])
+		}
+	}
+	if len(deferred) > 0 {
+		e.Envelope.Recipients = deferred
+		e.NextAttempt = time.Time{} // due
+		if err := f.Queue.Spool.Update(e); err != nil {
+			return errSpool
+		}
+		f.Queue.Wake()
+	}
+	return nil
+}
+
+// permanent returns true if err has a 5xx reply code
+func permanent(err error) bool {
+	if reply, ok := err.(*smtpd.Reply); ok {
+		return reply.Code >= 500 && reply.Code < 600
+	}
+	msg := err.Error()
+	return len(msg) >= 3 && msg[0] == '5' && msg[1] >= '0' && msg[1] <= '9' && msg[2] >= '0' && msg[2] <= '9'
+}
@@ -0,0 +1,163 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+	"github.com/emailfabric/smtpd/queue"
+	"github.com/emailfabric/smtpd/spool"
+)
+
+type upstreamHandler struct {
+	relayHandler
+	onRecipient func() // optional hook called for each recipient
+}
+
+func (h *upstreamHandler) AuthUser(identity, username string) (string, error) {
+	if username == "user" {
+		return "secret", nil
+	}
+	return "", errors.New("535 5.7.8 Authentication failed")
+}
+
+func (h *upstreamHandler) Recipient(address string) error {
+	if h.onRecipient != nil {
+		h.onRecipient()
+	}
+	if strings.HasPrefix(address, "later@") {
+		return errors.New("451 4.3.0 Try again later")
+	}
+	return h.relayHandler.Recipient(address)
+}
+
+type acceptHandler struct{}
+
+func (acceptHandler) Connect(ctx context.Context, source string) error    { return nil }
+func (acceptHandler) Hello(ctx context.Context, hostname string) error    { return nil }
+func (acceptHandler) Sender(ctx context.Context, address string) error    { return nil }
+func (acceptHandler) Recipient(ctx context.Context, address string) error { return nil }
+func (acceptHandler) AuthUser(ctx context.Context, identity, username string) (string, error) {
+	return "", errors.New("535 5.7.8 Authentication failed")
+}
+func (acceptHandler) Message(ctx context.Context, r io.Reader) error { return nil }
+
+// listen serves server on a new listener and returns its address
+func listen(t *testing.T, server *smtpd.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	go server.Serve(l)
+	return l.Addr().String()
+}
+
+func TestForwarder(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("../testdata/cert.pem", "../testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	upstream := &upstreamHandler{}
+	upstreamServer := &smtpd.Server{
+		RequireAuth: true,
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		NewHandler:  func() smtpd.Handler { return upstream },
+	}
+	upstreamAddr := listen(t, upstreamServer)
+	defer upstreamServer.Close()
+
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	var failed []string
+	fwd := &Forwarder{
+		ContextHandler: acceptHandler{},
+		Client:         &Client{Smarthost: upstreamAddr, Username: "user", Password: "secret"},
+	}
+	frontServer := &smtpd.Server{NewContextHandler: func() smtpd.ContextHandler { return fwd }}
+	frontAddr := listen(t, frontServer)
+	defer frontServer.Close()
+
+	c := &Client{Smarthost: frontAddr}
+	env := &smtpd.Envelope{Sender: "sender@example.com"}
+	const msg = "Subject: test\r\n\r\nforwarded\r\n"
+	send := func(addresses ...string) []*Result {
+		var rcpts []smtpd.Recipient
+		for _, address := range addresses {
+			rcpts = append(rcpts, smtpd.Recipient{Address: address})
+		}
+		return c.Send(context.Background(), "", env, rcpts, strings.NewReader(msg))
+	}
+
+	// a refused recipient is dropped when another is accepted
+	results := send("a@example.org", "unknown@example.org")
+	if results[0].Err != nil || results[1].Err != nil {
+		t.Fatalf("unexpected results %v %v", results[0].Err, results[1].Err)
+	}
+	if len(upstream.messages) != 1 || upstream.messages[0] != msg || len(upstream.rcpts) != 1 {
+		t.Fatalf("unexpected forwarded messages %q %q", upstream.messages, upstream.rcpts)
+	}
+	results = send("unknown@example.org", "later@example.org")
+	if reply, ok := results[0].Err.(*smtpd.Reply); !ok || reply.Code != 451 {
+		t.Fatalf("unexpected result %v", results[0].Err)
+	}
+
+	// authentication failure is temporary
+	fwd.Client.Password = "wrong"
+	results = send("a@example.org")
+	if reply, ok := results[0].Err.(*smtpd.Reply); !ok || reply.Code != 451 || !strings.Contains(reply.Message, "Authentication") {
+		t.Fatalf("unexpected result %v", results[0].Err)
+	}
+	fwd.Client.Password = "secret"
+
+	// with queue
+	fwd.Queue = &queue.Queue{
+		Spool:     &spool.Spool{Dir: dir},
+		Deliverer: fwd.Client,
+		OnFailed: func(e *spool.Entry, rcpt smtpd.Recipient, err error) {
+			failed = append(failed, rcpt.Address)
+		},
+	}
+	// the spooled message is not due for the queue while it is forwarded
+	var due bool
+	upstream.onRecipient = func() {
+		entries, _ := fwd.Queue.Spool.List()
+		for _, e := range entries {
+			due = due || !e.NextAttempt.After(time.Now())
+		}
+	}
+	results = send("b@example.org", "later@example.org", "unknown@example.org")
+	upstream.onRecipient = nil
+	if due {
+		t.Fatalf("message due while forwarded")
+	}
+	if results[0].Err != nil || results[1].Err != nil || results[2].Err != nil {
+		t.Fatalf("unexpected results %v %v %v", results[0].Err, results[1].Err, results[2].Err)
+	}
+	entries, _ := fwd.Queue.Spool.List()
+	if len(entries) != 1 || len(entries[0].Envelope.Recipients) != 1 || entries[0].Envelope.Recipients[0].Address != "later@example.org" ||
+		entries[0].NextAttempt.After(time.Now()) {
+		t.Fatalf("unexpected queue %+v", entries)
+	}
+	if len(failed) != 1 || failed[0] != "unknown@example.org" {
+		t.Fatalf("unexpected failed %q", failed)
+	}
+	results = send("unknown@example.org")
+	if reply, ok := results[0].Err.(*smtpd.Reply); !ok || reply.Code != 550 {
+		t.Fatalf("unexpected result %v", results[0].Err)
+	}
+	if entries, _ = fwd.Queue.Spool.List(); len(entries) != 1 {
+		t.Fatalf("refused message not removed")
+	}
+}
@@ -0,0 +1,750 @@
+/*
+Package relay delivers messages to the mail servers of recipient domains,
+which together with the spool and queue packages turns a server into a
+store-and-forward MTA.
+
+A Client looks up the MX hosts of a domain, or the address of the domain
+itself when it has no MX records, and tries the addresses of the hosts in
+order of preference until a host accepts or permanently refuses the
+message. STARTTLS is used when offered, and can be required per domain.
+Client.CheckMX can restrict the MX hosts of a domain, e.g. to the hosts of
+its MTA-STS policy.
+PIPELINING, SIZE, 8BITMIME, SMTPUTF8 and DSN are used when supported by the
+host. The result is reported for each recipient. Client implements
+queue.Deliverer:
+
+	q := &queue.Queue{
+		Spool:     &spool.Spool{Dir: "/var/spool/smtpd"},
+		Deliverer: &relay.Client{Hostname: "mx.example.com"},
+	}
+	go q.Run(ctx)
+
+With Client.Smarthost set all messages are sent to a single relay host,
+optionally with authentication. A Forwarder is a handler that forwards the
+messages accepted by a server to the smarthost.
+*/
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+	"github.com/emailfabric/smtpd/spool"
+)
+
+// TLSPolicy selects the use of STARTTLS for a domain.
+type TLSPolicy int
+
+const (
+	// TLSOpportunistic uses STARTTLS when offered without verifying the
+	// certificate, and delivers without TLS when the handshake fails
+	TLSOpportunistic TLSPolicy = iota
+
+	// TLSRequired only delivers to hosts that offer STARTTLS with a valid
+	// certificate for the MX hostname
+	TLSRequired
+
+	// TLSDisabled never uses STARTTLS
+	TLSDisabled
+)
+
+// Result is the result of a delivery to a recipient.
+type Result struct {
+	// Hostname of the server that gave the final reply, empty when no
+	// server was reached
+	Host string
+
+	// Error when the message was not delivered, usually an *smtpd.Reply
+	// with the reply of the server. Errors with a 5xx code are permanent.
+	Err error
+}
+
+// Client delivers messages to remote servers. A Client can be shared.
+type Client struct {
+	// Hostname sent with EHLO, defaults to the hostname of the system
+	Hostname string
+
+	// Resolver for MX and address lookups, defaults to net.DefaultResolver
+	Resolver smtpd.Resolver
+
+	// Port of the servers, "25" if empty
+	Port string
+
+	// Dial connects to a server, defaults to net.Dialer.DialContext
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// TLS configuration used for STARTTLS, the ServerName is set to the MX
+	// hostname. Defaults to an empty configuration.
+	TLSConfig *tls.Config
+
+	// Policy returns the TLS policy of a domain, for example from MTA-STS
+	// or DANE. All domains use opportunistic TLS when not set.
+	Policy func(ctx context.Context, domain string) TLSPolicy
+
+	// CheckMX is called with each MX host of a domain before it is tried,
+	// the host is skipped when it returns an error. Together with a Policy
+	// of TLSRequired it enforces an MTA-STS policy:
+	//
+	//	CheckMX: func(ctx context.Context, domain, host string) error {
+	//		p, err := cache.Get(ctx, domain)
+	//		if err != nil {
+	//			return err
+	//		}
+	//		return p.CheckDelivery(host, true)
+	//	},
+	CheckMX func(ctx context.Context, domain, host string) error
+
+	// Maximum number of MX hosts that are tried, 5 if zero
+	MaxHosts int
+
+	// Host, or host and port, to which all messages are sent instead of the
+	// MX hosts of the recipient domains
+	Smarthost string
+
+	// Credentials for AUTH with the smarthost, only sent after STARTTLS
+	Username string
+	Password string
+
+	// Timeouts to connect, for replies to commands and for the reply after
+	// the message data. Zero values use 30 seconds, 5 minutes and 10
+	// minutes as recommended by RFC 5321.
+	ConnectTimeout time.Duration
+	CommandTimeout time.Duration
+	DataTimeout    time.Duration
+}
+
+// Deliver implements queue.Deliverer.
+func (c *Client) Deliver(ctx context.Context, e *spool.Entry, domain string, rcpts []smtpd.Recipient, msg io.Reader) []error {
+	results := c.Send(ctx, domain, &e.Envelope, rcpts, msg)
+	errs := make([]error, len(results))
+	for i, r := range results {
+		errs[i] = r.Err
+	}
+	return errs
+}
+
+// Send delivers the message read from msg with envelope env to recipients
+// of domain and returns the result for each recipient. The sender and
+// parameters are taken from env, its recipients are ignored. msg is read
+// again for each attempt when it implements io.Seeker. Otherwise it is
+// streamed to the first host that accepts a recipient, and the other hosts
+// are not tried when that fails.
+func (c *Client) Send(ctx context.Context, domain string, env *smtpd.Envelope, rcpts []smtpd.Recipient, msg io.Reader) []*Result {
+	all := func(host string, err error) []*Result {
+		results := make([]*Result, len(rcpts))
+		for i := range results {
+			results[i] = &Result{Host: host, Err: err}
+		}
+		return results
+	}
+	data, err := newMessage(msg, env)
+	if err != nil {
+		return all("", err)
+	}
+	port := c.Port
+	if port == "" {
+		port = "25"
+	}
+	var hosts []string
+	if c.Smarthost != "" {
+		host := c.Smarthost
+		if h, p, err := net.SplitHostPort(c.Smarthost); err == nil {
+			host, port = h, p
+		}
+		hosts = []string{host}
+	} else if hosts, err = c.lookupMX(ctx, domain); err != nil {
+		return all("", err)
+	}
+	policy := TLSOpportunistic
+	if c.Policy != nil {
+		policy = c.Policy(ctx, domain)
+	}
+	t := &transaction{c: c, env: env, rcpts: rcpts, msg: data, port: port, policy: policy}
+
+	lastErr := error(smtpd.NewReply(451, "4.4.4", "No usable MX host for "+domain))
+	lastHost := ""
+	for _, host := range hosts {
+		if c.CheckMX != nil && c.Smarthost == "" {
+			if err := c.CheckMX(ctx, domain, host); err != nil {
+				lastErr = smtpd.NewReply(451, "4.7.0", fmt.Sprintf("MX host %s refused by policy: %v", host, err))
+				continue
+			}
+		}
+		addrs, err := c.resolver().LookupIPAddr(ctx, host)
+		if err != nil {
+			lastErr = smtpd.NewReply(451, "4.4.3", fmt.Sprintf("Lookup of %s failed: %v", host, err))
+			continue
+		}
+		sortAddrs(addrs)
+		for _, addr := range addrs {
+			results, err := t.send(ctx, host, addr.IP, true)
+			if err == errTLSFailed {
+				results, err = t.send(ctx, host, addr.IP, false)
+			}
+			if err == nil {
+				return results
+			}
+			if ce, ok := err.(*connError); ok {
+				err = ce.Reply
+			}
+			lastErr, lastHost = err, host
+			if ctx.Err() != nil || data.consumed {
+				return all(lastHost, lastErr)
+			}
+		}
+	}
+	return all(lastHost, lastErr)
+}
+
+func (c *Client) resolver() smtpd.Resolver {
+	if c.Resolver != nil {
+		return c.Resolver
+	}
+	return net.DefaultResolver
+}
+
+func (c *Client) hostname() string {
+	if c.Hostname != "" {
+		return c.Hostname
+	}
+	if hostname, err := os.Hostname(); err == nil && strings.Contains(hostname, ".") {
+		return hostname
+	}
+	return "localhost"
+}
+
+func timeout(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+// lookupMX returns the hosts to try for a domain in order of preference
+func (c *Client) lookupMX(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := c.resolver().LookupMX(ctx, domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			mxs = nil // implicit MX
+		} else {
+			return nil, smtpd.NewReply(451, "4.4.3", fmt.Sprintf("MX lookup of %s failed: %v", domain, err))
+		}
+	}
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		// null MX, RFC 7505
+		return nil, smtpd.NewReply(556, "5.1.10", "Domain "+domain+" does not accept mail")
+	}
+	if len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	max := c.MaxHosts
+	if max <= 0 {
+		max = 5
+	}
+	var hosts []string
+	for _, mx := range mxs {
+		if len(hosts) == max {
+			break
+		}
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, nil
+}
+
+// sortAddrs orders IPv6 addresses before IPv4 addresses, keeping the order
+// of the resolver otherwise
+func sortAddrs(addrs []net.IPAddr) {
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return addrs[i].IP.To4() == nil && addrs[j].IP.To4() != nil
+	})
+}
+
+// message is a message that can be read again for each attempt when it is
+// seekable
+type message struct {
+	r        io.Reader
+	start    int64
+	size     int64 // -1 when not known
+	consumed bool  // a reader that is not seekable was read
+}
+
+func newMessage(r io.Reader, env *smtpd.Envelope) (*message, error) {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		size := env.Size
+		if size <= 0 {
+			size = -1
+		}
+		return &message{r: r, size: size}, nil
+	}
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return &message{r: rs, start: start, size: end - start}, nil
+}
+
+// reader returns a reader from the start of the message
+func (m *message) reader() (io.Reader, error) {
+	rs, ok := m.r.(io.ReadSeeker)
+	if !ok {
+		if m.consumed {
+			return nil, errors.New("message can not be read again")
+		}
+		m.consumed = true
+		return m.r, nil
+	}
+	if _, err := rs.Seek(m.start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// transaction is the delivery of a message to the recipients of a domain
+type transaction struct {
+	c      *Client
+	env    *smtpd.Envelope
+	rcpts  []smtpd.Recipient
+	msg    *message
+	port   string
+	policy TLSPolicy
+}
+
+// errTLSFailed is returned when an opportunistic TLS handshake fails, the
+// delivery is attempted again without TLS
+var errTLSFailed = errors.New("relay: TLS handshake failed")
+
+// send delivers to the host at ip. It returns an error when the delivery
+// should be attempted with another host.
+func (t *transaction) send(ctx context.Context, host string, ip net.IP, useTLS bool) ([]*Result, error) {
+	c := t.c
+	dial := c.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, timeout(c.ConnectTimeout, 30*time.Second))
+	conn, err := dial(dialCtx, "tcp", net.JoinHostPort(ip.String(), t.port))
+	cancel()
+	if err != nil {
+		return nil, smtpd.NewReply(451, "4.4.1", fmt.Sprintf("Connection to %s failed: %v", host, err))
+	}
+	// close the connection when ctx is canceled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	s := &session{t: t, host: host, conn: conn, text: textproto.NewConn(conn)}
+	defer s.text.Close()
+	return s.run(useTLS)
+}
+
+// session is a connection to a host
+type session struct {
+	t    *transaction
+	host string
+	conn net.Conn
+	text *textproto.Conn
+	ext  map[string]string // EHLO keywords and parameters
+	tls  bool
+}
+
+func (s *session) run(useTLS bool) ([]*Result, error) {
+	c := s.t.c
+	if _, err := s.reply(220); err != nil {
+		return nil, err
+	}
+	if err := s.hello(); err != nil {
+		return nil, err
+	}
+	if _, ok := s.ext["STARTTLS"]; ok && useTLS && s.t.policy != TLSDisabled {
+		if err := s.cmd(220, "STARTTLS"); err != nil {
+			if s.t.policy == TLSRequired {
+				return nil, err
+			}
+			return nil, errTLSFailed
+		}
+		config := &tls.Config{}
+		if c.TLSConfig != nil {
+			config = c.TLSConfig.Clone()
+		}
+		config.ServerName = s.host
+		config.InsecureSkipVerify = s.t.policy != TLSRequired
+		tlsConn := tls.Client(s.conn, config)
+		tlsConn.SetDeadline(time.Now().Add(timeout(c.CommandTimeout, 5*time.Minute)))
+		if err := tlsConn.Handshake(); err != nil {
+			if s.t.policy == TLSRequired {
+				return nil, smtpd.NewReply(451, "4.7.5", fmt.Sprintf("TLS handshake with %s failed: %v", s.host, err))
+			}
+			return nil, errTLSFailed
+		}
+		s.conn, s.text, s.tls = tlsConn, textproto.NewConn(tlsConn), true
+		if err := s.hello(); err != nil {
+			return nil, err
+		}
+	}
+	if s.t.policy == TLSRequired && !s.tls {
+		return nil, smtpd.NewReply(451, "4.7.10", "TLS is required but not offered by "+s.host)
+	}
+	if c.Username != "" {
+		if err := s.auth(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.check(); err != nil {
+		return s.all(err), nil
+	}
+	results, err := s.transfer()
+	if err == nil {
+		s.cmd(221, "QUIT")
+	}
+	return results, err
+}
+
+// all returns the same result for each recipient
+func (s *session) all(err error) []*Result {
+	results := make([]*Result, len(s.t.rcpts))
+	for i := range results {
+		results[i] = &Result{Host: s.host, Err: err}
+	}
+	return results
+}
+
+// hello sends EHLO, or HELO when EHLO is not supported
+func (s *session) hello() error {
+	s.ext = make(map[string]string)
+	lines, err := s.cmdLines(250, "EHLO %s", s.t.c.hostname())
+	if err != nil {
+		if reply, ok := err.(*smtpd.Reply); ok && reply.Code >= 500 && !s.tls {
+			return s.cmd(250, "HELO %s", s.t.c.hostname())
+		}
+		return err
+	}
+	for _, line := range lines[1:] {
+		keyword, param := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			keyword, param = line[:i], line[i+1:]
+		}
+		s.ext[strings.ToUpper(keyword)] = param
+	}
+	return nil
+}
+
+// auth authenticates with PLAIN or LOGIN, failures are temporary so the
+// messages are kept until the credentials are fixed
+func (s *session) auth() error {
+	c := s.t.c
+	if !s.tls {
+		return smtpd.NewReply(451, "4.7.0", "Not authenticating with "+s.host+" without TLS")
+	}
+	mechs := strings.Fields(strings.ToUpper(s.ext["AUTH"]))
+	var err error
+	switch {
+	case contains(mechs, "PLAIN"):
+		resp := base64.StdEncoding.EncodeToString([]byte("\x00" + c.Username + "\x00" + c.Password))
+		err = s.cmd(235, "AUTH PLAIN %s", resp)
+	case contains(mechs, "LOGIN"):
+		if err = s.cmd(334, "AUTH LOGIN"); err == nil {
+			if err = s.cmd(334, "%s", base64.StdEncoding.EncodeToString([]byte(c.Username))); err == nil {
+				err = s.cmd(235, "%s", base64.StdEncoding.EncodeToString([]byte(c.Password)))
+			}
+		}
+	default:
+		return smtpd.NewReply(451, "4.7.0", s.host+" does not offer AUTH PLAIN or LOGIN")
+	}
+	if err != nil {
+		if isConnError(err) {
+			return err
+		}
+		return smtpd.NewReply(451, "4.7.0", fmt.Sprintf("Authentication with %s failed: %v", s.host, err))
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error when the host does not support the extensions
+// the message requires
+func (s *session) check() error {
+	env := s.t.env
+	if env.SMTPUTF8 && !s.has("SMTPUTF8") {
+		return smtpd.NewReply(553, "5.6.7", s.host+" does not support SMTPUTF8")
+	}
+	switch env.Body {
+	case smtpd.Body8BitMIME:
+		if !s.has("8BITMIME") {
+			return smtpd.NewReply(554, "5.6.3", s.host+" does not support 8BITMIME")
+		}
+	case smtpd.BodyBinaryMIME:
+		return smtpd.NewReply(554, "5.6.3", "BINARYMIME is not supported for relaying")
+	}
+	if size, ok := s.ext["SIZE"]; ok {
+		if max, err := strconv.ParseInt(size, 10, 64); err == nil && max > 0 && s.t.msg.size > max {
+			return smtpd.NewReply(552, "5.3.4", fmt.Sprintf("Message size exceeds the limit of %s", s.host))
+		}
+	}
+	return nil
+}
+
+func (s *session) has(keyword string) bool {
+	_, ok := s.ext[keyword]
+	return ok
+}
+
+// transfer sends the mail transaction
+func (s *session) transfer() ([]*Result, error) {
+	env := s.t.env
+	mail := "MAIL FROM:<" + env.Sender + ">"
+	if s.has("SIZE") && s.t.msg.size >= 0 {
+		mail += " SIZE=" + strconv.FormatInt(s.t.msg.size, 10)
+	}
+	if env.Body == smtpd.Body8BitMIME {
+		mail += " BODY=8BITMIME"
+	}
+	if env.SMTPUTF8 {
+		mail += " SMTPUTF8"
+	}
+	dsn := s.has("DSN")
+	if dsn && env.Ret != "" {
+		mail += " RET=" + env.Ret
+	}
+	if dsn && env.EnvID != "" {
+		mail += " ENVID=" + encodeXtext(env.EnvID)
+	}
+	cmds := []string{mail}
+	for _, rcpt := range s.t.rcpts {
+		cmd := "RCPT TO:<" + rcpt.Address + ">"
+		if dsn && len(rcpt.Notify) > 0 {
+			cmd += " NOTIFY=" + strings.Join(rcpt.Notify, ",")
+		}
+		if dsn && rcpt.ORcpt != "" {
+			cmd += " ORCPT=" + rcpt.ORcptType + ";" + encodeXtext(rcpt.ORcpt)
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	results := make([]*Result, len(s.t.rcpts))
+	accepted := 0
+	var mailErr, dataErr error
+	if s.has("PIPELINING") {
+		// send MAIL, RCPT and DATA together and read the replies
+		for _, cmd := range append(cmds, "DATA") {
+			s.text.W.WriteString(cmd + "\r\n")
+		}
+		s.setDeadline(s.t.c.CommandTimeout, 5*time.Minute)
+		if err := s.text.W.Flush(); err != nil {
+			return nil, s.connError(err)
+		}
+		if _, mailErr = s.reply(250); isConnError(mailErr) {
+			return nil, mailErr
+		}
+		for i := range s.t.rcpts {
+			_, err := s.reply(250)
+			if isConnError(err) {
+				return nil, err
+			}
+			results[i] = &Result{Host: s.host, Err: err}
+			if err == nil {
+				accepted++
+			}
+		}
+		if _, dataErr = s.reply(354); isConnError(dataErr) {
+			return nil, dataErr
+		}
+		if mailErr == nil && accepted > 0 && dataErr != nil {
+			// DATA refused, the accepted recipients failed
+			for _, r := range results {
+				if r.Err == nil {
+					r.Err = dataErr
+				}
+			}
+			accepted = 0
+		}
+	} else {
+		if mailErr = s.cmd(250, "%s", cmds[0]); isConnError(mailErr) {
+			return nil, mailErr
+		}
+		for i := range s.t.rcpts {
+			if mailErr != nil {
+				break
+			}
+			err := s.cmd(250, "%s", cmds[i+1])
+			if isConnError(err) {
+				return nil, err
+			}
+			results[i] = &Result{Host: s.host, Err: err}
+			if err == nil {
+				accepted++
+			}
+		}
+		if mailErr == nil && accepted > 0 {
+			if dataErr = s.cmd(354, "DATA"); isConnError(dataErr) {
+				return nil, dataErr
+			}
+			if dataErr != nil {
+				for _, r := range results {
+					if r.Err == nil {
+						r.Err = dataErr
+					}
+				}
+				accepted = 0
+			}
+		}
+	}
+	if mailErr != nil {
+		return s.all(mailErr), nil
+	}
+	if accepted == 0 {
+		if dataErr == nil {
+			// DATA accepted by a pipelining server without recipients
+			s.text.W.WriteString(".\r\n")
+			s.text.W.Flush()
+			s.reply(250)
+		} else {
+			s.cmd(250, "RSET")
+		}
+		return results, nil
+	}
+
+	// message data
+	r, err := s.t.msg.reader()
+	if err != nil {
+		return nil, err
+	}
+	s.setDeadline(s.t.c.DataTimeout, 10*time.Minute)
+	w := smtpd.NewDotWriter(s.text.W)
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, s.connError(err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, s.connError(err)
+	}
+	if err := s.text.W.Flush(); err != nil {
+		return nil, s.connError(err)
+	}
+	_, err = s.reply(250)
+	if isConnError(err) {
+		return nil, err
+	}
+	for _, r := range results {
+		if r.Err == nil {
+			r.Err = err
+		}
+	}
+	return results, nil
+}
+
+func (s *session) setDeadline(d, def time.Duration) {
+	s.conn.SetDeadline(time.Now().Add(timeout(d, def)))
+}
+
+// cmd sends a command and reads the reply
+func (s *session) cmd(expectCode int, format string, args ...interface{}) error {
+	_, err := s.cmdLines(expectCode, format, args...)
+	return err
+}
+
+// cmdLines sends a command and returns the lines of the reply
+func (s *session) cmdLines(expectCode int, format string, args ...interface{}) ([]string, error) {
+	s.setDeadline(s.t.c.CommandTimeout, 5*time.Minute)
+	if err := s.text.PrintfLine(format, args...); err != nil {
+		return nil, s.connError(err)
+	}
+	return s.reply(expectCode)
+}
+
+// reply reads a reply, it returns an *smtpd.Reply for an unexpected reply
+func (s *session) reply(expectCode int) ([]string, error) {
+	s.setDeadline(s.t.c.CommandTimeout, 5*time.Minute)
+	code, msg, err := s.text.ReadResponse(expectCode)
+	lines := strings.Split(msg, "\n")
+	if err == nil {
+		return lines, nil
+	}
+	if _, ok := err.(*textproto.Error); !ok {
+		return nil, s.connError(err)
+	}
+	return nil, parseReply(code, lines)
+}
+
+// connError returns the error for a failed connection, which is temporary
+func (s *session) connError(err error) error {
+	return &connError{smtpd.NewReply(451, "4.4.2", fmt.Sprintf("Connection to %s failed: %v", s.host, err))}
+}
+
+// connError is a network error or a 421 reply, after which the delivery is
+// attempted with another host
+type connError struct {
+	*smtpd.Reply
+}
+
+func isConnError(err error) bool {
+	if _, ok := err.(*connError); ok {
+		return true
+	}
+	reply, ok := err.(*smtpd.Reply)
+	return ok && reply.Code == 421
+}
+
+var reEnhancedCode = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3}) `)
+
+// parseReply returns the Reply for a reply with the code and lines of text
+func parseReply(code int, lines []string) *smtpd.Reply {
+	reply := &smtpd.Reply{Code: code}
+	for i, line := range lines {
+		if m := reEnhancedCode.FindStringSubmatch(line); m != nil {
+			if i == 0 {
+				reply.EnhancedCode = m[1]
+			}
+			line = line[len(m[0]):]
+		}
+		if reply.Message != "" {
+			reply.Message += " "
+		}
+		reply.Message += line
+	}
+	return reply
+}
+
+// encodeXtext encodes a parameter value as xtext (RFC 3461 section 4)
+func encodeXtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
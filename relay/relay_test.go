@@ -0,0 +1,159 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emailfabric/smtpd"
+)
+
+type testResolver struct {
+	mx map[string][]*net.MX
+}
+
+func (r *testResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r *testResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r *testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if strings.HasPrefix(host, "down.") {
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.2")}}, nil
+	}
+	return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+}
+
+func (r *testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+
+type relayHandler struct {
+	mu       sync.Mutex
+	messages []string
+	rcpts    []string
+}
+
+func (h *relayHandler) Connect(source string) error { return nil }
+func (h *relayHandler) Hello(hostname string) error { return nil }
+func (h *relayHandler) AuthUser(identity, username string) (string, error) {
+	return "", errors.New("535 not supported")
+}
+func (h *relayHandler) Sender(address string) error { return nil }
+func (h *relayHandler) Recipient(address string) error {
+	if strings.HasPrefix(address, "unknown@") {
+		return errors.New("550 5.1.1 No such user")
+	}
+	if strings.HasPrefix(address, "full@") {
+		return errors.New("452 4.2.2 Mailbox full")
+	}
+	h.mu.Lock()
+	h.rcpts = append(h.rcpts, address)
+	h.mu.Unlock()
+	return nil
+}
+func (h *relayHandler) Message(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	h.mu.Lock()
+	h.messages = append(h.messages, string(data))
+	h.mu.Unlock()
+	return err
+}
+
+func TestSend(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("../testdata/cert.pem", "../testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	for _, pipelining := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		handler := &relayHandler{}
+		server := &smtpd.Server{
+			Hostname:   "mx.example.org",
+			Pipelining: pipelining,
+			TLSConfig:  &tls.Config{Certificates: []tls.Certificate{cert}},
+			NewHandler: func() smtpd.Handler { return handler },
+		}
+		go server.Serve(l)
+
+		c := &Client{
+			Hostname: "relay.example.com",
+			Port:     port,
+			Resolver: &testResolver{mx: map[string][]*net.MX{
+				"example.org":  {{Host: "mx.example.org.", Pref: 20}, {Host: "down.example.org.", Pref: 10}},
+				"null.example": {{Host: ".", Pref: 0}},
+			}},
+		}
+		env := &smtpd.Envelope{Sender: "sender@example.com", Body: smtpd.Body8BitMIME}
+		const msg = "Subject: test\r\n\r\n.leading dot\r\n"
+		rcpts := []smtpd.Recipient{{Address: "a@example.org"}, {Address: "unknown@example.org"}, {Address: "full@example.org"}, {Address: "b@example.org"}}
+		results := c.Send(context.Background(), "example.org", env, rcpts, strings.NewReader(msg))
+		if len(results) != 4 || results[0].Err != nil || results[3].Err != nil || results[0].Host != "mx.example.org" {
+			t.Fatalf("unexpected results %+v", results)
+		}
+		if reply, ok := results[1].Err.(*smtpd.Reply); !ok || reply.Code != 550 || reply.EnhancedCode != "5.1.1" || reply.Message != "No such user" {
+			t.Fatalf("unexpected result %+v", results[1].Err)
+		}
+		if reply, ok := results[2].Err.(*smtpd.Reply); !ok || reply.Code != 452 {
+			t.Fatalf("unexpected result %+v", results[2].Err)
+		}
+		if len(handler.messages) != 1 || handler.messages[0] != msg || len(handler.rcpts) != 2 {
+			t.Fatalf("unexpected delivery %q %q", handler.messages, handler.rcpts)
+		}
+
+		// TLS required, the certificate is not valid for mx.example.org
+		c.Policy = func(ctx context.Context, domain string) TLSPolicy { return TLSRequired }
+		results = c.Send(context.Background(), "example.org", env, rcpts[:1], strings.NewReader(msg))
+		if reply, ok := results[0].Err.(*smtpd.Reply); !ok || reply.Code != 451 || reply.EnhancedCode != "4.7.5" {
+			t.Fatalf("unexpected result %+v", results[0].Err)
+		}
+
+		// MX hosts refused by CheckMX are skipped
+		c.Policy = nil
+		var checked []string
+		c.CheckMX = func(ctx context.Context, domain, host string) error {
+			checked = append(checked, host)
+			if host == "down.example.org" {
+				return errors.New("not in policy")
+			}
+			return nil
+		}
+		results = c.Send(context.Background(), "example.org", env, rcpts[:1], strings.NewReader(msg))
+		if results[0].Err != nil || len(checked) != 2 || checked[0] != "down.example.org" {
+			t.Fatalf("unexpected result %+v, checked %q", results[0].Err, checked)
+		}
+		c.CheckMX = func(ctx context.Context, domain, host string) error { return errors.New("not in policy") }
+		results = c.Send(context.Background(), "example.org", env, rcpts[:1], strings.NewReader(msg))
+		if reply, ok := results[0].Err.(*smtpd.Reply); !ok || reply.Code != 451 || reply.EnhancedCode != "4.7.0" {
+			t.Fatalf("unexpected result %+v", results[0].Err)
+		}
+		c.CheckMX = nil
+
+		results = c.Send(context.Background(), "null.example", env, rcpts[:1], strings.NewReader(msg))
+		if reply, ok := results[0].Err.(*smtpd.Reply); !ok || reply.Code != 556 {
+			t.Fatalf("unexpected result %+v", results[0].Err)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,56 @@
+package smtpd
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Reply is an SMTP reply with an enhanced status code (RFC 3463). A Reply can
+// be returned as error by the Handler members to reject a command with a
+// specific reply.
+type Reply struct {
+	Code         int    // basic status code, e.g. 550
+	EnhancedCode string // enhanced status code, e.g. "5.1.1"
+	Message      string
+}
+
+// NewReply returns a Reply with the basic status code, the enhanced status
+// code and the reply text. If the enhanced status code is empty, a generic
+// code based on the class of the basic status code is used.
+func NewReply(code int, enhancedCode, message string) *Reply {
+	return &Reply{
+		Code:         code,
+		EnhancedCode: enhancedCode,
+		Message:      message,
+	}
+}
+
+// Error returns the reply as it is sent to the client.
+func (r *Reply) Error() string {
+	enhancedCode := r.EnhancedCode
+	if enhancedCode == "" {
+		enhancedCode = fmt.Sprintf("%d.0.0", r.Code/100)
+	}
+	return fmt.Sprintf("%d %s %s", r.Code, enhancedCode, r.Message)
+}
+
+var reEnhancedCode = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}( |$)`)
+
+// withEnhancedCode inserts a generic enhanced status code in a reply starting
+// with a 2xx, 4xx or 5xx status code if it does not include one
+func withEnhancedCode(msg string) string {
+	if len(msg) < 3 || (msg[0] != '2' && msg[0] != '4' && msg[0] != '5') {
+		return msg
+	}
+	text := msg[3:]
+	if len(text) > 0 && (text[0] == ' ' || text[0] == '-') {
+		text = text[1:]
+	}
+	if reEnhancedCode.MatchString(text) {
+		return msg
+	}
+	if text == "" {
+		return fmt.Sprintf("%s %c.0.0", msg[:3], msg[0])
+	}
+	return fmt.Sprintf("%s %c.0.0 %s", msg[:3], msg[0], text)
+}
@@ -0,0 +1,25 @@
+package smtpd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEnhancedCodes(t *testing.T) {
+
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{NewReply(550, "5.1.1", "No such user"), "550 5.1.1 No such user"},
+		{NewReply(452, "", "Try again later"), "452 4.0.0 Try again later"},
+		{fmt.Errorf("550 5.7.1 Relaying denied"), "550 5.7.1 Relaying denied"},
+		{fmt.Errorf("550 Unauthorized"), "550 5.0.0 Unauthorized"},
+		{fmt.Errorf("421"), "421 4.0.0"},
+	}
+	for _, test := range tests {
+		if reply := withEnhancedCode(test.err.Error()); reply != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, reply)
+		}
+	}
+}
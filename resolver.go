@@ -0,0 +1,26 @@
+package smtpd
+
+import (
+	"context"
+	"net"
+)
+
+// Resolver performs DNS lookups. It is implemented by *net.Resolver, and
+// can be replaced by a caching resolver, a resolver using DNS over TLS or
+// HTTPS, or a mock for tests. The lookup functions of the subpackages can
+// be set to its methods, for example dnsbl.Checker.LookupHost.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// resolver returns the resolver of the server
+func (s *Server) resolver() Resolver {
+	if s.Resolver != nil {
+		return s.Resolver
+	}
+	return net.DefaultResolver
+}
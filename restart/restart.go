@@ -0,0 +1,188 @@
+/*
+Package restart upgrades the executable of a daemon without dropping
+connections or refusing mail. The running process starts a new process with
+its listening sockets as inherited file descriptors, waits until the new
+process is ready, and then drains its own sessions:
+
+	// in the running process, for example on SIGHUP
+	err := restart.Upgrade(ctx, server, nil, listeners)
+
+	// at startup
+	listeners, err := restart.Listeners()
+	if listeners == nil {
+		// first start, listen normally
+	}
+	for _, l := range listeners {
+		go server.Serve(l)
+	}
+	restart.Ready()
+
+The listeners are passed in the environment variable SMTPD_LISTEN_FDS as with
+systemd socket activation, starting at file descriptor 3.
+*/
+package restart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/emailfabric/smtpd"
+)
+
+// Environment variables passed to the new process
+const (
+	EnvListenFDs = "SMTPD_LISTEN_FDS" // number of listeners
+	EnvReadyFD   = "SMTPD_READY_FD"   // descriptor to signal readiness
+)
+
+// listenFdsStart is the descriptor of the first listener
+const listenFdsStart = 3
+
+// filer is implemented by the listeners of package net
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Start starts the new process with the listeners and waits until it calls
+// Ready. The process is the command cmd, or the current executable with the
+// same arguments and environment if cmd is nil. The process is killed when it
+// does not become ready before ctx is done.
+//
+// Unix listeners are changed to not remove their socket file when closed, so
+// that they can be closed by the running process.
+func Start(ctx context.Context, cmd *exec.Cmd, listeners []net.Listener) (*os.Process, error) {
+	if cmd == nil {
+		path, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("restart: %v", err)
+		}
+		cmd = exec.Command(path, os.Args[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.(filer)
+		if !ok {
+			return nil, fmt.Errorf("restart: cannot pass listener %s", l.Addr())
+		}
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, fmt.Errorf("restart: %v", err)
+		}
+		files = append(files, f)
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("restart: %v", err)
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env,
+		EnvListenFDs+"="+strconv.Itoa(len(listeners)),
+		EnvReadyFD+"="+strconv.Itoa(listenFdsStart+len(listeners)))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("restart: %v", err)
+	}
+	readyW.Close() // the new process holds the write end
+
+	done := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := ready.Read(b[:])
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if err == io.EOF {
+			err = errors.New("exited before it was ready")
+		}
+		return nil, fmt.Errorf("restart: new process: %v", err)
+	}
+	go cmd.Wait() // release the resources when the process exits
+	return cmd.Process, nil
+}
+
+// Upgrade starts the new process with Start and then gracefully shuts down
+// server, see smtpd.Server.Shutdown. The listeners of the server are closed
+// after the new process accepts connections on them.
+func Upgrade(ctx context.Context, server *smtpd.Server, cmd *exec.Cmd, listeners []net.Listener) error {
+	if _, err := Start(ctx, cmd, listeners); err != nil {
+		return err
+	}
+	return server.Shutdown(ctx)
+}
+
+// Listeners returns the listeners passed by the previous process, nil when
+// the process was not started by Start. The environment variable is unset, so
+// that the listeners are not passed to child processes.
+func Listeners() ([]net.Listener, error) {
+	fds := os.Getenv(EnvListenFDs)
+	os.Unsetenv(EnvListenFDs)
+	if fds == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("restart: invalid %s %q", EnvListenFDs, fds)
+	}
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(listenFdsStart+i), "listener")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("restart: %v", err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// Ready tells the previous process that the new process is serving, so that
+// it can shut down. It does nothing when the process was not started by
+// Start.
+func Ready() error {
+	fd := os.Getenv(EnvReadyFD)
+	os.Unsetenv(EnvReadyFD)
+	if fd == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(fd)
+	if err != nil || n < listenFdsStart {
+		return fmt.Errorf("restart: invalid %s %q", EnvReadyFD, fd)
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		return fmt.Errorf("restart: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package restart
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestNewProcess is run as the new process by TestStart
+func TestNewProcess(t *testing.T) {
+	if os.Getenv("RESTART_TEST_PROCESS") == "" {
+		t.Skip("not started by TestStart")
+	}
+	listeners, err := Listeners()
+	if err != nil || len(listeners) != 1 {
+		t.Fatalf("expected 1 listener, got %d: %v", len(listeners), err)
+	}
+	if os.Getenv(EnvListenFDs) != "" {
+		t.Fatalf("expected %s to be unset", EnvListenFDs)
+	}
+	if os.Getenv("RESTART_TEST_PROCESS") == "fail" {
+		os.Exit(1)
+	}
+	if err := Ready(); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	conn, err := listeners[0].Accept()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	conn.Write([]byte("new process\n"))
+	conn.Close()
+}
+
+func newProcess(mode string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestNewProcess$")
+	cmd.Env = append(os.Environ(), "RESTART_TEST_PROCESS="+mode)
+	return cmd
+}
+
+func TestStart(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := newProcess("serve")
+	process, err := Start(ctx, cmd, []net.Listener{l})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer process.Kill()
+	l.Close()
+
+	// the new process accepts the connection on the same address
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "new process\n" {
+		t.Fatalf("expected reply from the new process, got %q: %v", line, err)
+	}
+}
+
+func TestStartFailed(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer l.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := Start(ctx, newProcess("fail"), []net.Listener{l}); err == nil {
+		t.Fatalf("expected error when the new process exits")
+	}
+	// the listener of the running process still works
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	conn.Close()
+}
+
+func TestNotRestarted(t *testing.T) {
+	if os.Getenv("RESTART_TEST_PROCESS") != "" {
+		t.Skip("started by TestStart")
+	}
+	listeners, err := Listeners()
+	if err != nil || listeners != nil {
+		t.Fatalf("expected no listeners, got %v: %v", listeners, err)
+	}
+	if err := Ready(); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
@@ -0,0 +1,55 @@
+package smtpd
+
+import (
+	"context"
+	"net"
+	"runtime"
+)
+
+// ListenReusePort opens n TCP listeners on the same address addr with
+// SO_REUSEPORT, so that the kernel distributes the incoming connections over
+// the listeners instead of serializing the accepts on one listener. If n is
+// zero runtime.NumCPU() listeners are opened. With port 0 all listeners use
+// the port assigned to the first. SO_REUSEPORT is only supported on Linux.
+func ListenReusePort(addr string, n int) ([]net.Listener, error) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	lc := net.ListenConfig{Control: reusePort}
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		addr = l.Addr().String()
+	}
+	return listeners, nil
+}
+
+// ListenAndServeReusePort is like ListenAndServe, but opens n listeners with
+// ListenReusePort and calls Serve for each in its own goroutine. It returns
+// after all listeners are closed, with the first error of Serve.
+func (s *Server) ListenAndServeReusePort(addr string, n int) error {
+	listeners, err := ListenReusePort(s.listenAddr(addr), n)
+	if err != nil {
+		return err
+	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- s.Serve(l)
+		}(l)
+	}
+	err = nil
+	for range listeners {
+		if serr := <-errs; err == nil || err == ErrServerClosed {
+			err = serr
+		}
+	}
+	return err
+}
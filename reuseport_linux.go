@@ -0,0 +1,20 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package smtpd
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, which is missing in package syscall
+const soReusePort = 0xf
+
+// reusePort sets SO_REUSEPORT on a socket before it is bound
+func reusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+// +build !linux mips mipsle mips64 mips64le
+
+package smtpd
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePort fails, SO_REUSEPORT is not supported on this platform
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("smtpd: SO_REUSEPORT is not supported")
+}
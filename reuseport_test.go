@@ -0,0 +1,52 @@
+package smtpd
+
+import (
+	"net"
+	"net/textproto"
+	"runtime"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on Linux")
+	}
+	listeners, err := ListenReusePort("127.0.0.1:0", 4)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(listeners) != 4 {
+		t.Fatalf("expected 4 listeners, got %d", len(listeners))
+	}
+	addr := listeners[0].Addr().String()
+	server := &Server{NewHandler: func() Handler { return testHandler{} }}
+	for _, l := range listeners {
+		if l.Addr().String() != addr {
+			t.Fatalf("expected address %s, got %s", addr, l.Addr())
+		}
+		go server.Serve(l)
+	}
+	defer server.Close()
+
+	for i := 0; i < 8; i++ {
+		c, err := textproto.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		c.Close()
+	}
+
+	// a port in use without SO_REUSEPORT
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer l.Close()
+	if err := server.ListenAndServeReusePort(l.Addr().String(), 2); err == nil {
+		t.Fatalf("expected error for address in use")
+	}
+}
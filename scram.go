@@ -0,0 +1,253 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// SCRAMCredentials holds the salted verifier of a password for
+// SCRAM-SHA-256 (RFC 7677). The password itself is not needed by the server.
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSCRAMCredentials derives the SCRAM-SHA-256 credentials for a password
+// with a salt and an iteration count of at least 4096.
+func NewSCRAMCredentials(password string, salt []byte, iterations int) SCRAMCredentials {
+	salted := pbkdf2SHA256([]byte(password), salt, iterations)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	return SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(salted, []byte("Server Key")),
+	}
+}
+
+// SCRAMAuthenticator can optionally be implemented by a Handler or
+// ContextHandler to offer SCRAM-SHA-256, and SCRAM-SHA-256-PLUS with channel
+// binding over TLS. SCRAMCredentials returns the stored credentials of
+// username, see NewSCRAMCredentials.
+type SCRAMAuthenticator interface {
+	SCRAMCredentials(ctx context.Context, username string) (SCRAMCredentials, error)
+}
+
+// scramMechanism implements SCRAM-SHA-256 and SCRAM-SHA-256-PLUS
+type scramMechanism struct {
+	auth SCRAMAuthenticator
+	plus bool
+}
+
+func (m scramMechanism) Name() string {
+	if m.plus {
+		return "SCRAM-SHA-256-PLUS"
+	}
+	return "SCRAM-SHA-256"
+}
+
+func (m scramMechanism) Start(ctx context.Context) (SASLServer, error) {
+	sess := SessionFromContext(ctx)
+	if m.plus && (sess == nil || sess.TLS == nil) {
+		return nil, errors.New("504 5.5.4 SCRAM-SHA-256-PLUS requires TLS")
+	}
+	e := &scramExchange{ctx: ctx, auth: m.auth, plus: m.plus}
+	if sess != nil {
+		e.tls = sess.TLS
+	}
+	return e, nil
+}
+
+type scramExchange struct {
+	ctx  context.Context
+	auth SCRAMAuthenticator
+	plus bool
+	tls  *tls.ConnectionState
+
+	gs2Header       string
+	cbindType       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	creds           SCRAMCredentials
+	identity        string
+	username        string
+}
+
+func (e *scramExchange) Next(response []byte) ([]byte, bool, error) {
+	if e.serverFirst == "" {
+		if len(response) == 0 {
+			// ask for the client-first-message
+			return []byte{}, false, nil
+		}
+		return e.clientFirst(string(response))
+	}
+	return e.clientFinal(string(response))
+}
+
+// clientFirst processes the client-first-message and returns the
+// server-first-message
+func (e *scramExchange) clientFirst(msg string) ([]byte, bool, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, false, errInvalidCredentials
+	}
+	switch cbind := parts[0]; {
+	case cbind == "n":
+		if e.plus {
+			return nil, false, errInvalidCredentials
+		}
+	case cbind == "y":
+		// the client supports channel binding but thinks the server does
+		// not, which indicates a downgrade when PLUS is offered over TLS
+		if e.plus || e.tls != nil {
+			return nil, false, errInvalidCredentials
+		}
+	case strings.HasPrefix(cbind, "p="):
+		if !e.plus {
+			return nil, false, errInvalidCredentials
+		}
+		e.cbindType = cbind[2:]
+		if e.cbindType != "tls-exporter" && e.cbindType != "tls-unique" {
+			return nil, false, errors.New("535 5.7.8 Unsupported channel binding type")
+		}
+	default:
+		return nil, false, errInvalidCredentials
+	}
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, false, errInvalidCredentials
+		}
+		e.identity = decodeSASLName(parts[1][2:])
+	}
+	e.gs2Header = parts[0] + "," + parts[1] + ","
+	e.clientFirstBare = parts[2]
+
+	attrs := strings.Split(e.clientFirstBare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") || len(attrs[1]) == 2 {
+		return nil, false, errInvalidCredentials
+	}
+	e.username = decodeSASLName(attrs[0][2:])
+	creds, err := e.auth.SCRAMCredentials(e.ctx, e.username)
+	if err != nil {
+		return nil, false, err
+	}
+	e.creds = creds
+
+	b := make([]byte, 18)
+	rand.Read(b)
+	e.nonce = attrs[1][2:] + base64.RawStdEncoding.EncodeToString(b)
+	e.serverFirst = "r=" + e.nonce + ",s=" + base64.StdEncoding.EncodeToString(creds.Salt) +
+		",i=" + strconv.Itoa(creds.Iterations)
+	return []byte(e.serverFirst), false, nil
+}
+
+// clientFinal verifies the client-final-message and returns the
+// server-final-message
+func (e *scramExchange) clientFinal(msg string) ([]byte, bool, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i == -1 {
+		return nil, false, errInvalidCredentials
+	}
+	withoutProof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil {
+		return nil, false, errInvalidCredentials
+	}
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || attrs[1] != "r="+e.nonce {
+		return nil, false, errInvalidCredentials
+	}
+	cbind, err := base64.StdEncoding.DecodeString(attrs[0][2:])
+	if err != nil {
+		return nil, false, errInvalidCredentials
+	}
+	expected := []byte(e.gs2Header)
+	if e.cbindType != "" {
+		data, err := channelBinding(e.tls, e.cbindType)
+		if err != nil {
+			return nil, false, err
+		}
+		expected = append(expected, data...)
+	}
+	if subtle.ConstantTimeCompare(cbind, expected) != 1 {
+		return nil, false, errInvalidCredentials
+	}
+
+	authMessage := []byte(e.clientFirstBare + "," + e.serverFirst + "," + withoutProof)
+	signature := hmacSHA256(e.creds.StoredKey, authMessage)
+	if len(proof) != len(signature) {
+		return nil, false, errInvalidCredentials
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ signature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], e.creds.StoredKey) != 1 {
+		return nil, false, errInvalidCredentials
+	}
+	serverSignature := hmacSHA256(e.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), true, nil
+}
+
+func (e *scramExchange) Identity() (string, string) {
+	return e.identity, e.username
+}
+
+// channelBinding returns the channel binding data of the TLS connection
+func channelBinding(state *tls.ConnectionState, cbindType string) ([]byte, error) {
+	switch cbindType {
+	case "tls-exporter":
+		if state.Version < tls.VersionTLS13 {
+			break
+		}
+		return state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	case "tls-unique":
+		if len(state.TLSUnique) > 0 {
+			return state.TLSUnique, nil
+		}
+	}
+	return nil, errors.New("535 5.7.8 Channel binding type not available")
+}
+
+// decodeSASLName decodes a username or identity in a SCRAM message
+func decodeSASLName(name string) string {
+	name = strings.Replace(name, "=2C", ",", -1)
+	return strings.Replace(name, "=3D", "=", -1)
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// pbkdf2SHA256 derives a key of the hash size with PBKDF2 (RFC 8018)
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for n := 1; n < iterations; n++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for i := range key {
+			key[i] ^= u[i]
+		}
+	}
+	return key
+}
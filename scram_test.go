@@ -0,0 +1,151 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type scramHandler struct {
+	sessionHandler
+}
+
+func (h *scramHandler) SCRAMCredentials(ctx context.Context, username string) (SCRAMCredentials, error) {
+	if username != "user@example.com" {
+		return SCRAMCredentials{}, errors.New("535 5.7.8 Authentication credentials invalid")
+	}
+	return NewSCRAMCredentials("pencil", []byte("salt"), 4096), nil
+}
+
+// scramClient computes the client-final-message for a server-first-message
+// and returns it with the expected server-final-message
+func scramClient(t *testing.T, gs2Header, clientFirstBare, serverFirst, password string, cbind []byte) (string, string) {
+	var nonce, salt string
+	for _, attr := range strings.Split(serverFirst, ",") {
+		switch {
+		case strings.HasPrefix(attr, "r="):
+			nonce = attr[2:]
+		case strings.HasPrefix(attr, "s="):
+			salt = attr[2:]
+		}
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	salted := pbkdf2SHA256([]byte(password), saltBytes, 4096)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(append([]byte(gs2Header), cbind...)) + ",r=" + nonce
+	authMessage := []byte(clientFirstBare + "," + serverFirst + "," + withoutProof)
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	serverSignature := hmacSHA256(hmacSHA256(salted, []byte("Server Key")), authMessage)
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof),
+		"v=" + base64.StdEncoding.EncodeToString(serverSignature)
+}
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914 section 11
+	key := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1)
+	if got := hex.EncodeToString(key[:16]); got != "55ac046e56e3089fec1691c22544b605" {
+		t.Fatalf("unexpected key %s", got)
+	}
+}
+
+func TestSCRAM(t *testing.T) {
+
+	handler := &scramHandler{}
+	c, done := dialServerContext(t, &Server{}, handler)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 250, "EHLO localhost"); !strings.Contains(msg, "AUTH CRAM-MD5 SCRAM-SHA-256\n") {
+		t.Fatalf("mechanism not advertised: %q", msg)
+	}
+	cmd(t, c, 504, "AUTH SCRAM-SHA-256-PLUS")
+
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	decode := func(s string) string {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		return string(b)
+	}
+
+	// wrong password
+	clientFirstBare := "n=user@example.com,r=fyko+d2lbbFgONRv9qkxdawL"
+	serverFirst := decode(cmd(t, c, 334, "AUTH SCRAM-SHA-256 %s", encode("n,,"+clientFirstBare)))
+	if !strings.HasPrefix(serverFirst, "r=fyko+d2lbbFgONRv9qkxdawL") {
+		t.Fatalf("unexpected server-first-message %q", serverFirst)
+	}
+	clientFinal, _ := scramClient(t, "n,,", clientFirstBare, serverFirst, "wrong", nil)
+	cmd(t, c, 535, "%s", encode(clientFinal))
+
+	// without initial response
+	if msg := cmd(t, c, 334, "AUTH SCRAM-SHA-256"); msg != "" {
+		t.Fatalf("unexpected challenge %q", msg)
+	}
+	serverFirst = decode(cmd(t, c, 334, "%s", encode("n,,"+clientFirstBare)))
+	clientFinal, serverFinal := scramClient(t, "n,,", clientFirstBare, serverFirst, "pencil", nil)
+	if msg := decode(cmd(t, c, 334, "%s", encode(clientFinal))); msg != serverFinal {
+		t.Fatalf("unexpected server-final-message %q", msg)
+	}
+	cmd(t, c, 235, "")
+	cmd(t, c, 250, "MAIL FROM:<user@example.com>")
+	cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+	if handler.session.AuthUsername != "user@example.com" {
+		t.Fatalf("unexpected username %q", handler.session.AuthUsername)
+	}
+}
+
+func TestSCRAMChannelBinding(t *testing.T) {
+
+	state := &tls.ConnectionState{Version: tls.VersionTLS12, TLSUnique: []byte("finished")}
+	newExchange := func(plus bool) *scramExchange {
+		return &scramExchange{ctx: context.Background(), auth: &scramHandler{}, plus: plus, tls: state}
+	}
+	clientFirstBare := "n=user@example.com,r=nonce"
+
+	tests := []struct {
+		plus      bool
+		gs2Header string
+		cbind     []byte
+		valid     bool
+	}{
+		{true, "p=tls-unique,,", []byte("finished"), true},
+		{true, "p=tls-unique,a=admin,", []byte("finished"), true},
+		{true, "p=tls-unique,,", []byte("other"), false},
+		{true, "p=tls-exporter,,", nil, false},
+		{true, "n,,", nil, false},
+		{false, "y,,", nil, false}, // downgrade
+		{false, "p=tls-unique,,", []byte("finished"), false},
+	}
+	for _, test := range tests {
+		e := newExchange(test.plus)
+		serverFirst, _, err := e.Next([]byte(test.gs2Header + clientFirstBare))
+		if err == nil {
+			clientFinal, _ := scramClient(t, test.gs2Header, clientFirstBare, string(serverFirst), "pencil", test.cbind)
+			_, _, err = e.Next([]byte(clientFinal))
+		}
+		if (err == nil) != test.valid {
+			t.Errorf("%s: unexpected error %v", test.gs2Header, err)
+		}
+	}
+}
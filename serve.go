@@ -0,0 +1,278 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve, ListenAndServe and ServeSMTP after a
+// call to Close or Shutdown.
+var ErrServerClosed = errors.New("smtpd: Server closed")
+
+// ListenAndServe listens on the TCP network address addr and then calls Serve
+// to handle incoming connections. If addr is empty ":smtp" is used, or ":465"
+// with ImplicitTLS, or ":587" for Submission.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", s.listenAddr(addr))
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// listenAddr returns addr or the default address when it is empty
+func (s *Server) listenAddr(addr string) string {
+	if addr != "" {
+		return addr
+	}
+	switch {
+	case s.ImplicitTLS:
+		return ":465"
+	case s.Submission:
+		return ":587"
+	}
+	return ":smtp"
+}
+
+// Serve accepts incoming connections on the listener l and serves each
+// connection in a new goroutine with a Handler created by NewHandler, or a
+// ContextHandler created by NewContextHandler. The
+// connection is closed when the session ends. A panic in a session is
+// recovered and logged, and only closes the affected connection.
+//
+// Serve always returns a non-nil error and closes l. After Close or Shutdown
+// the returned error is ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+
+	if s.NewHandler == nil && s.NewContextHandler == nil {
+		return errors.New("smtpd: Server.NewHandler is not set")
+	}
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Printf("smtpd: Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn runs a session on an accepted connection
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		if err := recover(); err != nil {
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("smtpd: panic serving %s: %v\n%s", conn.RemoteAddr(), err, buf)
+		}
+		conn.Close()
+	}()
+
+	var err error
+	if s.NewContextHandler != nil {
+		err = s.ServeSMTPContext(context.Background(), conn, s.NewContextHandler())
+	} else {
+		err = s.ServeSMTP(conn, s.NewHandler())
+	}
+	if l := s.debugLog(); err != nil && l != nil {
+		l.Printf("Connection from %s closed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// Close immediately closes all listeners and the connections of all active
+// sessions.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.closeListeners()
+	for sess := range s.sessions {
+		sess.cancel()
+		sess.netConn.Close()
+	}
+	return err
+}
+
+// shutdownPollInterval is how often Shutdown checks for idle sessions
+const shutdownPollInterval = 100 * time.Millisecond
+
+// Shutdown gracefully shuts down the server. It closes all listeners, then
+// ends sessions that are waiting for a command with a 421 reply. Sessions
+// that are processing a command, for example receiving message data, are
+// ended after the command completes. Shutdown returns when all sessions have
+// ended, or closes the remaining connections and returns the context's error
+// when the context expires first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	err := s.closeListeners()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.wakeIdleSessions() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeListeners stops accepting connections, s.mu must be held
+func (s *Server) closeListeners() error {
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// wakeIdleSessions interrupts sessions that are waiting for a command so
+// they notice the shutdown, it returns the number of remaining sessions
+func (s *Server) wakeIdleSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sess := range s.sessions {
+		if atomic.LoadInt32(&sess.active) == 0 {
+			sess.netConn.SetReadDeadline(time.Now())
+		}
+	}
+	return len(s.sessions)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// trackListener adds or removes a listener, it returns false when the server
+// is closed
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+// trackSession adds or removes a session, it returns false when the server
+// is closed
+func (s *Server) trackSession(sess *session, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.closed {
+			return false
+		}
+		if s.sessions == nil {
+			s.sessions = make(map[*session]struct{})
+		}
+		s.sessions[sess] = struct{}{}
+	} else {
+		delete(s.sessions, sess)
+	}
+	return true
+}
+
+// SessionInfo describes an active session, see Server.Sessions.
+type SessionInfo struct {
+	ID           string
+	RemoteAddr   net.Addr
+	Start        time.Time // start of the session
+	Helo         string
+	AuthUsername string
+	TLS          bool
+	Transaction  bool // a mail transaction is in progress
+	Commands     int  // number of commands received
+}
+
+// Sessions returns the active sessions as of their last command.
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]SessionInfo, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess.info)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Start.Before(sessions[j].Start)
+	})
+	return sessions
+}
+
+// KillSession closes the connection of the session with the ID, it returns
+// false when there is no such session.
+func (s *Server) KillSession(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sess := range s.sessions {
+		if sess.ID == id {
+			sess.cancel()
+			sess.netConn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// updateInfo updates the description of the session for Server.Sessions
+func (s *session) updateInfo() {
+	info := SessionInfo{
+		ID:           s.ID,
+		RemoteAddr:   s.RemoteAddr,
+		Start:        s.start,
+		Helo:         s.Helo,
+		AuthUsername: s.AuthUsername,
+		TLS:          s.tls,
+		Transaction:  s.hasSender,
+		Commands:     s.numCommands,
+	}
+	s.server.mu.Lock()
+	defer s.server.mu.Unlock()
+	s.info = info
+}
@@ -5,22 +5,33 @@ package smtpd
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net"
 	"os"
-	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrMessageTooLarge is returned by the reader passed to Handler.Message when
+// the message data exceeds Server.MaxMessageSize. The remaining data is
+// discarded and the message is rejected with this error.
+var ErrMessageTooLarge = errors.New("552 5.3.4 Message size exceeds fixed maximum message size")
+
 // DefaultHostname is used in the banner greeting when Server#hostname is empty.
 var DefaultHostname, _ = os.Hostname()
 
@@ -33,8 +44,334 @@ type Server struct {
 	// must include at least one certificate or else set GetCertificate
 	TLSConfig *tls.Config
 
+	// Minimum TLS version and cipher suites, replacing those of TLSConfig
+	// when set. See DefaultTLSConfig for modern defaults.
+	TLSMinVersion   uint16
+	TLSCipherSuites []uint16
+
+	// Set to accept TLS 1.0 and 1.1 and CBC cipher suites from legacy
+	// clients. With opportunistic STARTTLS these clients would otherwise
+	// send in cleartext.
+	AllowLegacyTLS bool
+
+	// Maximum time for the TLS handshake, zero means CommandTimeout. The
+	// connection is closed when the handshake fails.
+	TLSHandshakeTimeout time.Duration
+
+	// Set to refuse MAIL FROM on connections without TLS
+	RequireTLS bool
+
+	// Set to refuse MAIL FROM from clients that did not authenticate, see
+	// also AuthRequirer
+	RequireAuth bool
+
+	// Set to start TLS immediately after connecting instead of with STARTTLS,
+	// to serve the submissions port (RFC 8314). Requires TLSConfig.
+	ImplicitTLS bool
+
+	// Set to serve LMTP (RFC 2033) instead of SMTP. The client must greet
+	// with LHLO, and after the message data a reply is given for each
+	// recipient, see RecipientErrors.
+	LMTP bool
+
+	// Set to serve message submission (RFC 6409). Clients must greet with
+	// EHLO, use TLS and authenticate before MAIL FROM. With SubmissionFixups
+	// the Date and Message-ID headers are added to messages without them,
+	// and a missing or empty From header is set to the envelope sender.
+	Submission       bool
+	SubmissionFixups bool
+
+	// Set to prepend a Received header to the message passed to
+	// Handler.Message, see Session.Received
+	AddReceived bool
+
 	// Set to enable PIPELINING
 	Pipelining bool
+
+	// Maximum time to wait for the next command outside of a mail
+	// transaction, CommandTimeout if zero
+	IdleTimeout time.Duration
+
+	// Maximum duration of a session, zero means no limit
+	MaxSessionDuration time.Duration
+
+	// Maximum length of a command line including CRLF, 512 if zero,
+	// negative means no limit. Longer lines are refused with 500 5.5.2.
+	// AUTH lines may be up to 12288 octets.
+	MaxLineLength int
+
+	// Maximum length of a line of message data received with DATA including
+	// CRLF, zero means no limit. RFC 5321 limits lines to 1000 octets.
+	// Messages with longer lines are refused with ErrMessageLineTooLong.
+	MaxDataLineLength int
+
+	// Set to refuse messages received with DATA that contain NUL bytes
+	// with ErrMessageNUL
+	RejectNUL bool
+
+	// Handling of message data lines received with DATA that end with LF
+	// instead of CRLF, bare LF is accepted by default
+	BareLF BareLFMode
+
+	// Maximum number of recipients of a message, further recipients are
+	// refused with 452 4.5.3, zero means no limit
+	MaxRecipients int
+
+	// Maximum number of messages per connection, and of commands other than
+	// QUIT per connection, zero means no limit. The connection is closed
+	// with 421 when a limit is exceeded.
+	MaxMessagesPerConnection int
+	MaxCommands              int
+
+	// Maximum number of open connections, and of open connections from the
+	// same remote IP address, zero means no limit. Connections over a limit
+	// are greeted with 421 4.3.2 and closed. See ConnectionCounts.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+
+	// RateLimiter limits the rate of connections and of AUTH, MAIL and
+	// RCPT commands, see TokenBucketLimiter. Connections and AUTH commands
+	// over the limit are refused with 421 and closed, MAIL and RCPT
+	// commands with 450.
+	RateLimiter RateLimiter
+
+	// Time to wait before sending the greeting, clients that send data
+	// before the greeting are refused with 554 and disconnected, zero means
+	// no delay
+	GreetDelay time.Duration
+
+	// Number of replies to invalid commands (500, 501 and 503) after which
+	// the connection is closed, zero means no limit
+	MaxErrors int
+
+	// Delay before a reply to an invalid command, multiplied by the number
+	// of such replies so far, zero means no delay
+	ErrorDelay time.Duration
+
+	// Maximum time to wait for a command line, 5 minutes if zero as in RFC
+	// 5321 section 4.5.3.2.7, negative means no timeout
+	CommandTimeout time.Duration
+
+	// Maximum time to wait for each block of message data sent with DATA or
+	// BDAT, 3 minutes if zero, negative means no timeout
+	DataTimeout time.Duration
+
+	// Maximum time to send a reply, 5 minutes if zero, negative means no
+	// timeout
+	WriteTimeout time.Duration
+
+	// Maximum message size in bytes advertised with the SIZE extension,
+	// zero means no limit
+	MaxMessageSize int64
+
+	// Set to count the escape dots of DATA removed by dot unstuffing in
+	// the message size checked against MaxMessageSize, i.e. to count the
+	// data as received on the wire
+	WireSize bool
+
+	// Set to enable MT-PRIORITY (RFC 6710), optionally with the name of the
+	// priority assignment policy to advertise, e.g. "MIXER". Otherwise the
+	// MT-PRIORITY parameter is refused with 555.
+	MTPriority       bool
+	MTPriorityPolicy string
+
+	// Maximum priority accepted from clients that are not authenticated,
+	// higher priorities are lowered to this value
+	MaxUnauthPriority int
+
+	// Set to enable DELIVERBY (RFC 2852), optionally with the minimum
+	// by-time to advertise. A BY parameter in return mode with a shorter
+	// by-time is rejected. Otherwise the BY parameter is refused with 555.
+	DeliverBy    bool
+	MinDeliverBy time.Duration
+
+	// Maximum hold time advertised with the FUTURERELEASE extension (RFC
+	// 4865), zero disables FUTURERELEASE and refuses the HOLDFOR and
+	// HOLDUNTIL parameters with 555
+	MaxFutureRelease time.Duration
+
+	// Keywords of extensions that are not advertised with EHLO, e.g.
+	// "CHUNKING" or "SMTPUTF8". Their commands are refused with 502 and
+	// their MAIL and RCPT parameters with 555. Disabling CHUNKING disables
+	// BINARYMIME as well.
+	DisabledExtensions []string
+
+	// Reply to VRFY when the handler does not implement Verifier, defaults
+	// to DefaultVerifyReply
+	VerifyReply string
+
+	// Help text returned by HELP for each topic, keyed by the upper case
+	// topic. Lines are separated by "\n". The empty topic replaces the
+	// default list of supported commands.
+	HelpTopics map[string]string
+
+	// Set to expect a PROXY protocol header (version 1 or 2) from a proxy or
+	// load balancer before the session starts. The addresses in the header
+	// replace the addresses of the connection. Connections without a valid
+	// header are closed, so only set this when all connections are made
+	// through the proxy. Set ImplicitTLS instead of passing a TLS connection
+	// to ServeSMTP, as the header precedes the TLS handshake.
+	ProxyProtocol bool
+
+	// Networks of proxies that are allowed to forward the attributes of the
+	// original client with XCLIENT and XFORWARD
+	TrustedProxies []*net.IPNet
+
+	// Set to look up the hostname of clients with forward-confirmed reverse
+	// DNS in the background at connection time, see Session.RDNS. Clients
+	// without a confirmed hostname are refused at connect when RDNSReject
+	// is set, with 450 when the lookup failed temporarily and 550
+	// otherwise.
+	ReverseDNS bool
+	RDNSReject bool
+
+	// Resolver for DNS lookups, defaults to net.DefaultResolver
+	Resolver Resolver
+
+	// DNSBL checks connecting clients against DNS blocklists, the result is
+	// available to the handler in the Session. Blocked clients are refused
+	// with 554 5.7.1 at connect when DNSBLReject is set.
+	DNSBL       DNSBL
+	DNSBLReject bool
+
+	// Access lists of client networks, see ParseNetworks. Clients in
+	// DeniedNetworks are refused with 554 when they connect. Clients in
+	// RelayNetworks are always allowed to relay, they do not need to
+	// authenticate for RequireAuth and have Session.Relay set for the
+	// handler. Clients in ExemptNetworks are exempt from the RateLimiter
+	// and DNSBL.
+	DeniedNetworks Networks
+	RelayNetworks  Networks
+	ExemptNetworks Networks
+
+	// NewHandler is called by Serve to create a Handler for each accepted
+	// connection
+	NewHandler func() Handler
+
+	// NewContextHandler can be set instead of NewHandler to serve accepted
+	// connections with a ContextHandler
+	NewContextHandler func() ContextHandler
+
+	// Additional SASL mechanisms offered with AUTH. A mechanism with the
+	// name of a built-in mechanism replaces the built-in mechanism.
+	SASLMechanisms []SASLMechanism
+
+	// Names of the AUTH mechanisms in the order they are offered, nil for
+	// PLAIN, LOGIN and EXTERNAL with TLS, CRAM-MD5 without TLS, and the
+	// mechanisms supported by the handler and SASLMechanisms. Mechanisms
+	// that are not listed are refused.
+	AuthMechanisms []string
+
+	// Names of the AUTH mechanisms that are only offered with TLS, nil for
+	// PLAIN, LOGIN, OAUTHBEARER and XOAUTH2
+	AuthTLSMechanisms []string
+
+	// Set to not offer AUTH at all, e.g. on an MX server
+	DisableAuth bool
+
+	// Source of the random CRAM-MD5 challenges, crypto/rand.Reader if nil.
+	// Can be set to a deterministic source for testing.
+	Rand io.Reader
+
+	// AuthThrottle slows down and locks out clients after failed AUTH
+	// attempts
+	AuthThrottle *AuthThrottle
+
+	// Credentials verifies the passwords of PLAIN and LOGIN instead of the
+	// handler, see StaticCredentials and HashedCredentials
+	Credentials CredentialStore
+
+	// Configurations of virtual hosts by lower case TLS server name
+	VirtualHosts map[string]*VirtualHost
+
+	// Metrics receives measurements of the sessions, for example to export
+	// them to a monitoring system
+	Metrics Metrics
+
+	// Tracer creates spans for the sessions, transactions and commands,
+	// for example with OpenTelemetry
+	Tracer Tracer
+
+	// Include the session ID in the reply to accepted message data, e.g.
+	// "250 2.0.0 OK 5f3a9c0e12b4d687 accepted"
+	SessionIDInReply bool
+
+	// Logger for the debug output of the sessions, including the commands
+	// and replies, each line preceded by the session ID. Nil disables the
+	// output unless the global Debug is set.
+	DebugLog *log.Logger
+
+	// Transcripts records the commands and replies of sessions for
+	// troubleshooting
+	Transcripts *Transcripts
+
+	// Middleware wraps the processing of each command, the first is the
+	// outermost
+	Middleware []Middleware
+
+	mu          sync.Mutex
+	tlsOnce     sync.Once
+	tlsConf     *tls.Config
+	tlsVersions map[uint16]uint64 // successful handshakes by version
+	closed      bool
+	listeners   map[net.Listener]struct{}
+	sessions    map[*session]struct{}
+	numConns    int            // connections counted for MaxConnections
+	ipConns     map[string]int // connections by remote IP
+	rdnsCache   map[string]*rdnsEntry
+	rdnsPruneAt int
+	stats       serverStats
+}
+
+// protocol returns the protocol name for the greeting
+func (s *Server) protocol() string {
+	if s.LMTP {
+		return "LMTP"
+	}
+	return "ESMTP"
+}
+
+// maxAuthLine is the maximum length of AUTH command and response lines,
+// RFC 4954 section 4
+const maxAuthLine = 12288
+
+// maxLineLength returns the maximum length of a command line including CRLF
+func (s *Server) maxLineLength() int {
+	switch {
+	case s.MaxLineLength < 0:
+		return 0
+	case s.MaxLineLength == 0:
+		return 512 // RFC 5321 section 4.5.3.1.4
+	}
+	return s.MaxLineLength
+}
+
+// validLineLength returns false if a command line other than AUTH is too long
+func (s *Server) validLineLength(line string) bool {
+	max := s.maxLineLength()
+	if max <= 0 || len(line)+2 <= max {
+		return true
+	}
+	verb, _ := split1(strings.TrimSpace(line))
+	return strings.EqualFold(verb, "AUTH")
+}
+
+// readLimit returns the maximum length of lines read from the connection,
+// which allows longer AUTH lines
+func (s *Server) readLimit() int {
+	max := s.maxLineLength()
+	if max > 0 && max < maxAuthLine {
+		max = maxAuthLine
+	}
+	return max
+}
+
+// random returns Server.Rand or the cryptographically secure source
+func (s *Server) random() io.Reader {
+	if s.Rand != nil {
+		return s.Rand
+	}
+	return rand.Reader
 }
 
 func (s *Server) hostname() string {
@@ -44,26 +381,46 @@ func (s *Server) hostname() string {
 	return DefaultHostname
 }
 
-// Debug can be set to true to print SMTP traces to the default Logger in package log.
+// Debug can be set to true to print SMTP traces of the servers without
+// Server.DebugLog to the default Logger in package log.
+//
+// Deprecated: Debug affects all servers of the process, set Server.DebugLog.
 var Debug = false
 
+// debugLog returns the logger for debug output, nil when disabled
+func (s *Server) debugLog() *log.Logger {
+	if s.DebugLog != nil {
+		return s.DebugLog
+	}
+	if Debug {
+		return log.Default()
+	}
+	return nil
+}
+
 // Handler should be implemented by the application for handling SMTP command
 // parameters and message data on a connection.
 //
 // Each member can return an error to reject the command or to indicate
 // processing failure. If the error text starts with a three digit status code,
-// then the error text is returned as-is in the SMTP reply. If the error does
-// not start with three digits, then "451 Requested action aborted: " is
+// then the error text is returned as-is in the SMTP reply, with a generic
+// enhanced status code inserted when the text does not include one. A Reply
+// can be used to return a specific enhanced status code. If the error does
+// not start with three digits, then "451 4.3.0 Requested action aborted: " is
 // returned in the SMTP reply with the error text appended.
 type Handler interface {
-	// Connect is called after connecting
+	// Connect is called after connecting. The source is the remote address
+	// of the client, or for a unix socket "unix:" followed by the socket
+	// path and the peer credentials when available. After XCLIENT the
+	// source is "unknown" when the proxy does not know the address.
 	Connect(source string) error
 
 	// Hello is called after EHLO/HELO
 	Hello(hostname string) error
 
-	// Authenticate is called after AUTH
-	//Authenticate(identity, username, password_or_response string) error
+	// AuthUser is called after AUTH to get the password of a user. When
+	// the handler implements PasswordAuthenticator, AuthUser is only used
+	// for CRAM-MD5.
 	AuthUser(identity, username string) (password string, err error)
 
 	// Sender is called after MAIL FROM
@@ -74,19 +431,105 @@ type Handler interface {
 
 	// Message is called after DATA. The reader returns the message data
 	// after dot unstuffing. The final ".\r\n" is not included in the data.
+	// With CHUNKING, Message is called after the first BDAT command and the
+	// reader returns the data of all chunks as a single stream.
 	// When the complete message is consumed io.EOF is returned. It's not
 	// required to consume all data. Any remaining data will be discarded
 	// after Message() returns and the reader will become invalid.
 	Message(reader io.Reader) error
 }
 
+// ContextHandler is like Handler, but each member receives a context that is
+// tied to the lifetime of the connection. The context is canceled when the
+// session ends, when the client disconnects while a member runs, and when
+// the server is closed, which includes the expiry of the context passed to
+// Server.Shutdown. A graceful Shutdown lets running members complete.
+//
+// Disconnects are noticed while Message runs once it has read all message
+// data.
+//
+// Errors returned by the members are handled the same as for Handler.
+type ContextHandler interface {
+	// Connect is called after connecting
+	Connect(ctx context.Context, source string) error
+
+	// Hello is called after EHLO/HELO
+	Hello(ctx context.Context, hostname string) error
+
+	// AuthUser is called after AUTH
+	AuthUser(ctx context.Context, identity, username string) (password string, err error)
+
+	// Sender is called after MAIL FROM
+	Sender(ctx context.Context, address string) error
+
+	// Recipient is called after RCPT TO
+	Recipient(ctx context.Context, address string) error
+
+	// Message is called after DATA or BDAT, see Handler for details on the
+	// reader.
+	Message(ctx context.Context, reader io.Reader) error
+}
+
+// DisconnectHandler can optionally be implemented by a Handler or
+// ContextHandler to be notified when the session ends. Disconnect receives the
+// outcome of the commands given during the session in the order they were
+// received. Only the most recent outcomes are kept when a session runs many
+// commands.
+type DisconnectHandler interface {
+	Disconnect(outcomes []Outcome)
+}
+
+// HandshakeHandler can optionally be implemented by a Handler or
+// ContextHandler to be notified of the result of the TLS handshake, for
+// example to collect TLS reports. After a successful handshake the
+// connection state is available in Session.TLS. The connection is closed
+// after a failed handshake.
+type HandshakeHandler interface {
+	Handshake(ctx context.Context, err error)
+}
+
+// Outcome records the reply given to a command.
+type Outcome struct {
+	Command string // command verb in upper case
+	Code    int    // reply status code
+}
+
+// Accepted returns true if the command was accepted with a 2xx or 3xx reply.
+func (o Outcome) Accepted() bool {
+	return o.Code >= 200 && o.Code < 400
+}
+
+// maxOutcomes limits the number of outcomes recorded per session, older
+// outcomes are dropped when the limit is exceeded
+const maxOutcomes = 100
+
 type session struct {
+	Session
 	server    *Server
+	netConn   net.Conn // connection passed to ServeSMTP
 	conn      *conn
-	handler   Handler
-	tls       bool // using tls
-	hasSender bool // mail given
-	hasRcpt   bool // rcpt given
+	active    int32 // processing a command, accessed atomically
+	ctx       context.Context
+	cancel    context.CancelFunc
+	handler   ContextHandler
+	impl      interface{} // handler provided by the application
+	tls       bool        // using tls
+	hasSender bool        // mail given
+	hasRcpt   bool        // rcpt given
+	outcomes  []Outcome
+	pending   *string // command line to process before reading the next
+
+	forwardedHelo string // HELO of the original client given with XCLIENT
+	vhost         *VirtualHost
+	numCommands   int         // number of commands received
+	numMessages   int         // number of messages passed to the handler
+	exempt        bool        // client in Server.ExemptNetworks
+	authMech      string      // mechanism of the last AUTH command
+	dispatched    bool        // the last command reached the built-in implementation
+	trace         trace       // spans when Server.Tracer is set
+	transcript    *transcript // recorded when Server.Transcripts is set
+	start         time.Time   // start of the session
+	info          SessionInfo // see Server.Sessions, guarded by Server.mu
 }
 
 // ServeSMTP should be called by the application for each incoming connection.
@@ -96,20 +539,127 @@ type session struct {
 //
 // The application should close the connection after ServeSMTP returns.
 func (s *Server) ServeSMTP(conn net.Conn, handler Handler) error {
+	return s.serve(context.Background(), conn, contextHandler{handler}, handler)
+}
 
-	if Debug {
-	    log.Printf("Connection from %s to %s", conn.RemoteAddr(), conn.LocalAddr())
-    }
+// ServeSMTPContext is like ServeSMTP, but uses a ContextHandler. The context
+// passed to the handler is derived from ctx.
+func (s *Server) ServeSMTPContext(ctx context.Context, conn net.Conn, handler ContextHandler) error {
+	return s.serve(ctx, conn, handler, handler)
+}
+
+func (s *Server) serve(ctx context.Context, conn net.Conn, handler ContextHandler, impl interface{}) (err error) {
+
+	id := s.newSessionID()
+	if l := s.debugLog(); l != nil {
+		l.Printf("%s: Connection from %s to %s", id, conn.RemoteAddr(), conn.LocalAddr())
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var deadline time.Time // end of the session
+	if s.MaxSessionDuration > 0 {
+		deadline = time.Now().Add(s.MaxSessionDuration)
+	}
 	sess := &session{
-		server: s,
-		conn:   newConn(conn),
+		server:  s,
+		netConn: conn,
 		//state: state_init,
+		cancel:  cancel,
 		handler: handler,
+		impl:    impl,
+	}
+	if _, ok := impl.(ContextHandler); ok {
+		// only a ContextHandler can notice the cancellation
+		handler = watchedHandler{handler, sess}
+		sess.handler = handler
+	}
+	sess.ID = id
+	sess.start = time.Now()
+	sess.startTranscript()
+	defer func() {
+		sess.endTranscript(err)
+	}()
+	sess.conn = sess.newConn(conn, deadline)
+	sess.RemoteAddr = conn.RemoteAddr()
+	sess.LocalAddr = conn.LocalAddr()
+	sess.lmtp = s.LMTP
+	sess.ctx = context.WithValue(ctx, sessionKey{}, &sess.Session)
+	sess.updateInfo()
+	if h, ok := impl.(SessionSetter); ok {
+		h.SetSession(&sess.Session)
+	}
+
+	if !s.trackSession(sess, true) {
+		sess.conn.Reply("421 4.3.2 Service shutting down")
+		return ErrServerClosed
+	}
+	defer s.trackSession(sess, false)
+	if s.Metrics != nil {
+		s.Metrics.ConnectionOpened()
+		defer s.Metrics.ConnectionClosed()
 	}
-	
+
+	// send any replies still buffered when the session ends
+	defer func() {
+		sess.conn.Flush()
+	}()
+
+	if s.ProxyProtocol {
+		sess.conn.SetReadTimeout(s.commandTimeout(true))
+		header, err := readProxyHeader(sess.conn.r.R)
+		if err != nil {
+			return err
+		}
+		sess.conn.SetReadTimeout(0)
+		sess.Proxy = header
+		if header.SourceAddr != nil {
+			sess.RemoteAddr = header.SourceAddr
+			sess.LocalAddr = header.DestAddr
+		}
+	}
+	sess.startSession()
+	defer sess.endSession()
+
+	var ip string
+	if addr := remoteIP(sess.RemoteAddr); addr != nil {
+		ip = addr.String()
+	}
+	if !s.acquireConn(ip) {
+		if !s.ImplicitTLS {
+			sess.conn.ErrorReply(errTooManyConnections)
+		}
+		return nil
+	}
+	defer s.releaseConn(ip)
+	if !sess.checkAccess() {
+		if !s.ImplicitTLS {
+			sess.conn.ErrorReply(errAccessDenied)
+		}
+		return nil
+	}
+	if sess.rateLimited("CONNECT") {
+		if !s.ImplicitTLS {
+			sess.conn.ErrorReply(errRateLimitedClosed)
+		}
+		return nil
+	}
+	sess.updateInfo() // address given by a proxy
+	sess.startRDNS()
+
+	if s.ImplicitTLS {
+		if s.TLSConfig == nil {
+			return errors.New("smtpd: Server.TLSConfig is not set")
+		}
+		// data buffered after the PROXY header belongs to the handshake
+		conn = tls.Server(&bufferedConn{Conn: conn, r: sess.conn.r.R}, s.tlsConfig())
+		sess.conn = sess.newConn(conn, deadline)
+	}
+
 	// connection already encrypted (SMTPS)?
-	if _, ok := conn.(*tls.Conn); ok {
-	    sess.tls = true
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := sess.handshake(tlsConn); err != nil {
+			return err
+		}
 	}
 
 	/*
@@ -123,47 +673,226 @@ func (s *Server) ServeSMTP(conn net.Conn, handler Handler) error {
 			}
 	*/
 
-	err := handler.Connect(conn.RemoteAddr().String())
+	if h, ok := impl.(DisconnectHandler); ok {
+		defer func() {
+			h.Disconnect(sess.outcomes)
+		}()
+	}
+
+	source := sess.RemoteAddr.String()
+	if unixConn, ok := conn.(*net.UnixConn); ok && sess.Proxy == nil {
+		sess.PeerCred, _ = peerCred(unixConn)
+		source = unixSource(unixConn, sess.PeerCred)
+	}
+	if err := sess.checkDNSBL(); err != nil {
+		sess.conn.ErrorReply(err)
+		return nil
+	}
+	if err := sess.checkRDNS(); err != nil {
+		sess.conn.ErrorReply(err)
+		return nil
+	}
+	err = handler.Connect(sess.ctx, source)
 	if err != nil {
 		sess.conn.ErrorReply(err)
 		return nil
 	}
-	sess.conn.Reply("220 %s ESMTP %s", s.hostname(), time.Now().Format(time.RFC1123Z))
+	if s.GreetDelay > 0 {
+		if err := sess.greetDelay(); err == ErrEarlyTalker {
+			sess.conn.ErrorReply(err)
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	sess.conn.Reply("220 %s %s %s", sess.hostname(), s.protocol(), time.Now().Format(time.RFC1123Z))
 
+	handleCommand := sess.commandHandler(conn)
 	for {
-		line, err := sess.conn.ReadLine()
+		atomic.StoreInt32(&sess.active, 0)
+		if s.isClosed() {
+			sess.conn.Reply("421 4.3.2 Service shutting down")
+			return ErrServerClosed
+		}
+		if s.MaxErrors > 0 && sess.conn.errors >= s.MaxErrors {
+			sess.conn.Reply("421 4.7.0 Too many errors, closing connection")
+			sess.conn.Flush()
+			return nil
+		}
+		line, err := sess.readCommand()
+		if err == nil && !s.validLineLength(line) {
+			err = errLineTooLong
+		}
+		if err == errLineTooLong {
+			verb, _ := split1(strings.TrimSpace(line))
+			sess.conn.ErrorReply(err)
+			sess.record(strings.ToUpper(verb))
+			continue
+		}
 		if err != nil {
+			if s.isClosed() {
+				sess.conn.Reply("421 4.3.2 Service shutting down")
+				return ErrServerClosed
+			}
+			if isTimeout(err) {
+				sess.timeout(ErrIdleTimeout)
+			}
 			return err
 		}
+		atomic.StoreInt32(&sess.active, 1)
 		// trim space by adjusting slice
 		line = strings.TrimSpace(line)
 		// split at first space
 		verb, params := split1(line)
+		verb = strings.ToUpper(verb)
+		sess.startCommand(verb)
 
-		switch strings.ToUpper(verb) {
-		case "HELO":
-			sess.helo(params)
-		case "EHLO":
-			sess.ehlo(params)
-		case "STARTTLS":
-			sess.starttls(conn)
-		case "AUTH":
-			sess.auth(params)
-		case "MAIL":
-			sess.mail(params)
-		case "RCPT":
-			sess.rcpt(params)
-		case "DATA":
-			sess.data()
-		case "RSET":
-			sess.rset()
-		case "QUIT":
-			sess.conn.Reply("221 %s closing connection", s.hostname())
-			return nil // disconnect
-		default:
-			sess.conn.Reply("500 unrecognized command: %+q", verb)
+		if verb != "QUIT" {
+			sess.numCommands++
+			if s.MaxCommands > 0 && sess.numCommands > s.MaxCommands {
+				sess.conn.Reply("421 4.7.0 Too many commands, closing connection")
+				sess.conn.Flush()
+				sess.record(verb)
+				return nil
+			}
+		}
+		if verb == "MAIL" && s.MaxMessagesPerConnection > 0 && sess.numMessages >= s.MaxMessagesPerConnection {
+			sess.conn.Reply("421 4.7.0 Too many messages, closing connection")
+			sess.conn.Flush()
+			sess.record(verb)
+			return nil
+		}
+
+		c := &Command{Verb: verb, Params: params, Session: &sess.Session}
+		sess.dispatched = false
+		err = handleCommand(sess.ctx, c)
+		if end, ok := err.(endSession); ok {
+			sess.record(verb)
+			return end.err
+		}
+		if verb == "BDAT" && !sess.dispatched {
+			// the chunk must not be read as commands
+			if err := sess.discardBDAT(params); err != nil {
+				sess.record(verb)
+				return err
+			}
+		}
+		if err != nil {
+			sess.conn.ErrorReply(err)
+		}
+		sess.record(verb)
+	}
+}
+
+// dispatch processes a command with the built-in implementation, conn is the
+// connection for STARTTLS. It returns an endSession error when the session
+// must end.
+func (s *session) dispatch(conn net.Conn, cmd *Command) error {
+	if ext, ok := commandExtensions[cmd.Verb]; ok && s.server.disabled(ext) {
+		if cmd.Verb == "BDAT" {
+			// the chunk is sent anyway and must be consumed
+			if err := s.discardBDAT(cmd.Params); err != nil {
+				return endSession{err}
+			}
+		}
+		s.conn.Reply("502 5.5.1 %s not supported", cmd.Verb)
+		return nil
+	}
+	switch verb := cmd.Verb; verb {
+	case "HELO", "EHLO":
+		if s.server.LMTP {
+			s.conn.Reply("500 5.5.1 Use LHLO in LMTP mode")
+		} else if verb == "HELO" {
+			s.helo(cmd.Params)
+		} else {
+			s.ehlo(cmd.Params)
+		}
+	case "LHLO":
+		if s.server.LMTP {
+			s.ehlo(cmd.Params)
+		} else {
+			s.conn.Reply("500 5.5.2 unrecognized command: %+q", verb)
+		}
+	case "STARTTLS":
+		if err := s.starttls(conn); err != nil {
+			return endSession{err}
+		}
+	case "AUTH":
+		if s.AuthUsername == "" && s.rateLimited(verb) {
+			s.conn.ErrorReply(errRateLimitedClosed)
+			s.conn.Flush()
+			return endSession{nil}
+		}
+		s.auth(cmd.Params)
+	case "MAIL":
+		s.mail(cmd.Params)
+	case "RCPT":
+		s.rcpt(cmd.Params)
+	case "DATA", "BDAT":
+		var err error
+		if verb == "DATA" {
+			err = s.data()
+		} else {
+			err = s.bdat(cmd.Params)
+		}
+		if err != nil {
+			return endSession{s.timeout(err)}
+		}
+	case "RSET":
+		s.rset()
+	case "VRFY":
+		s.vrfy(cmd.Params)
+	case "EXPN":
+		s.expn(cmd.Params)
+	case "HELP":
+		s.help(cmd.Params)
+	case "NOOP":
+		s.noop()
+	case "ETRN":
+		s.etrn(cmd.Params)
+	case "XFORWARD":
+		s.xforward(cmd.Params)
+	case "XCLIENT":
+		if !s.xclient(cmd.Params) {
+			return endSession{nil}
 		}
+	case "QUIT":
+		s.conn.Reply("221 2.0.0 %s closing connection", s.hostname())
+		s.conn.Flush()
+		return endSession{nil} // disconnect
+	default:
+		s.conn.Reply("500 5.5.2 unrecognized command: %+q", verb)
+	}
+	return nil
+}
+
+// readCommand reads the next command line within the command timeout
+func (s *session) readCommand() (string, error) {
+	if s.pending != nil {
+		line := *s.pending
+		s.pending = nil
+		return line, nil
+	}
+	s.conn.SetReadTimeout(s.server.commandTimeout(!s.hasSender))
+	defer s.conn.SetReadTimeout(0)
+	line, err := s.conn.ReadLine()
+	s.recordCommand(line, err)
+	return line, err
+}
+
+// record adds the outcome of the last command to the session
+func (s *session) record(verb string) {
+	if len(s.outcomes) == maxOutcomes {
+		copy(s.outcomes, s.outcomes[1:])
+		s.outcomes = s.outcomes[:maxOutcomes-1]
+	}
+	s.outcomes = append(s.outcomes, Outcome{Command: verb, Code: s.conn.code})
+	s.server.countReply(s.conn.code)
+	s.updateInfo()
+	if m := s.server.Metrics; m != nil {
+		m.Command(verb, s.conn.code)
 	}
+	s.endCommand()
 }
 
 func (s *session) helo(params string) {
@@ -171,13 +900,19 @@ func (s *session) helo(params string) {
 		s.conn.Reply("501 Syntax: HELO hostname")
 		return
 	}
+	if s.forwardedHelo != "" {
+		// keep the hostname of the original client given with XCLIENT
+		params = s.forwardedHelo
+	}
 	// save client hostname
-	err := s.handler.Hello(params)
+	err := s.handler.Hello(s.ctx, params)
 	if err != nil {
 		s.conn.ErrorReply(err)
 		return
 	}
-	s.conn.Reply("250 %s", s.server.hostname())
+	s.Helo = params
+	s.extended = false
+	s.conn.Reply("250 %s", s.hostname())
 }
 
 func (s *session) ehlo(params string) {
@@ -185,77 +920,274 @@ func (s *session) ehlo(params string) {
 		s.conn.Reply("501 Syntax: EHLO hostname")
 		return
 	}
+	if s.forwardedHelo != "" {
+		// keep the hostname of the original client given with XCLIENT
+		params = s.forwardedHelo
+	}
 	// save client hostname
-	err := s.handler.Hello(params)
+	err := s.handler.Hello(s.ctx, params)
 	if err != nil {
 		s.conn.ErrorReply(err)
 		return
 	}
+	s.Helo = params
+	s.extended = true
 
-	lines := []string{s.server.Hostname}
+	lines := []string{s.hostname()}
 	if s.server.TLSConfig != nil && s.tls == false {
 		lines = append(lines, "STARTTLS")
 	}
-	if s.tls {
-		lines = append(lines, "AUTH PLAIN LOGIN")
-	} else {
-		lines = append(lines, "AUTH CRAM-MD5")
+	if mechs := s.authMechanisms(); len(mechs) > 0 {
+		lines = append(lines, "AUTH "+strings.Join(mechs, " "))
 	}
 	if s.server.Pipelining {
 		lines = append(lines, "PIPELINING")
 	}
-	// 8BITMIME
-	// SIZE
-	s.conn.MultiLineReply(250, lines...)
+	if s.server.MaxMessageSize > 0 {
+		lines = append(lines, fmt.Sprintf("SIZE %d", s.server.MaxMessageSize))
+	}
+	lines = append(lines, "8BITMIME")
+	lines = append(lines, "SMTPUTF8")
+	lines = append(lines, "DSN")
+	lines = append(lines, "CHUNKING")
+	lines = append(lines, "BINARYMIME")
+	lines = append(lines, "ENHANCEDSTATUSCODES")
+	if s.server.DeliverBy {
+		if s.server.MinDeliverBy > 0 {
+			lines = append(lines, fmt.Sprintf("DELIVERBY %d", int64(s.server.MinDeliverBy/time.Second)))
+		} else {
+			lines = append(lines, "DELIVERBY")
+		}
+	}
+	if s.server.MaxFutureRelease > 0 {
+		lines = append(lines, fmt.Sprintf("FUTURERELEASE %d %s",
+			int64(s.server.MaxFutureRelease/time.Second),
+			time.Now().Add(s.server.MaxFutureRelease).UTC().Format(time.RFC3339)))
+	}
+	if _, ok := s.impl.(QueueFlusher); ok {
+		lines = append(lines, "ETRN")
+	}
+	if s.server.trusted(s.netConn.RemoteAddr()) {
+		lines = append(lines, "XCLIENT "+xclientAttrs)
+		lines = append(lines, "XFORWARD "+xforwardAttrs)
+	}
+	if s.server.MTPriority {
+		if s.server.MTPriorityPolicy != "" {
+			lines = append(lines, "MT-PRIORITY "+s.server.MTPriorityPolicy)
+		} else {
+			lines = append(lines, "MT-PRIORITY")
+		}
+	}
+	s.conn.MultiLineReply(250, s.server.advertised(lines)...)
+}
+
+// advertised removes the DisabledExtensions from the lines of the EHLO reply
+func (s *Server) advertised(lines []string) []string {
+	if len(s.DisabledExtensions) == 0 {
+		return lines
+	}
+	out := lines[:1:1]
+	for _, line := range lines[1:] {
+		keyword, _ := split1(line)
+		if !s.disabled(keyword) {
+			out = append(out, line)
+		}
+	}
+	return out
 }
 
-func (s *session) starttls(conn net.Conn) {
+// disabled reports whether the extension is in DisabledExtensions. BINARYMIME
+// is disabled with CHUNKING, as it requires BDAT (RFC 3030 section 3).
+func (s *Server) disabled(keyword string) bool {
+	for _, ext := range s.DisabledExtensions {
+		if strings.EqualFold(keyword, ext) ||
+			strings.EqualFold(keyword, "BINARYMIME") && strings.EqualFold(ext, "CHUNKING") {
+			return true
+		}
+	}
+	return false
+}
+
+// commandExtensions maps commands to the extension that defines them
+var commandExtensions = map[string]string{
+	"STARTTLS": "STARTTLS",
+	"AUTH":     "AUTH",
+	"BDAT":     "CHUNKING",
+	"ETRN":     "ETRN",
+	"XCLIENT":  "XCLIENT",
+	"XFORWARD": "XFORWARD",
+}
+
+// paramExtensions maps MAIL and RCPT parameters to the extension that
+// defines them, the extension of BODY depends on its value
+var paramExtensions = map[string]string{
+	"AUTH":        "AUTH",
+	"SIZE":        "SIZE",
+	"SMTPUTF8":    "SMTPUTF8",
+	"RET":         "DSN",
+	"ENVID":       "DSN",
+	"NOTIFY":      "DSN",
+	"ORCPT":       "DSN",
+	"MT-PRIORITY": "MT-PRIORITY",
+	"BY":          "DELIVERBY",
+	"HOLDFOR":     "FUTURERELEASE",
+	"HOLDUNTIL":   "FUTURERELEASE",
+}
+
+// enabled reports whether an extension that must be enabled explicitly is
+func (s *Server) enabled(keyword string) bool {
+	switch keyword {
+	case "MT-PRIORITY":
+		return s.MTPriority
+	case "DELIVERBY":
+		return s.DeliverBy
+	case "FUTURERELEASE":
+		return s.MaxFutureRelease > 0
+	}
+	return true
+}
+
+// unsupportedParam returns the first parameter in args, in the order of
+// names, whose extension is disabled or not enabled
+func (s *Server) unsupportedParam(args map[string]string, names ...string) string {
+	for _, name := range names {
+		value, ok := args[name]
+		if !ok {
+			continue
+		}
+		ext := paramExtensions[name]
+		if name == "BODY" {
+			ext = strings.ToUpper(value) // 8BITMIME or BINARYMIME
+		}
+		if ext != "" && (s.disabled(ext) || !s.enabled(ext)) {
+			return name
+		}
+	}
+	return ""
+}
+
+func (s *session) starttls(conn net.Conn) error {
 	if s.server.TLSConfig == nil {
-		s.conn.Reply("500 STARTTLS not supported")
-		return
+		s.conn.Reply("500 5.5.1 STARTTLS not supported")
+		return nil
 	}
 	// check if already running tls
 	if s.tls {
-		s.conn.Reply("500 TLS already in use")
-		return
+		s.conn.Reply("500 5.5.1 TLS already in use")
+		return nil
 	}
 	s.conn.Reply("220 2.0.0 ready to start TLS")
-	tlsConn := tls.Server(conn, s.server.TLSConfig)
+	s.conn.Flush()
+	// commands pipelined after STARTTLS are discarded with the buffered
+	// reader of the cleartext connection
+	tlsConn := tls.Server(conn, s.server.tlsConfig())
+	if err := s.handshake(tlsConn); err != nil {
+		// the state of the connection is unknown, no reply can be sent
+		return err
+	}
+
+	code := s.conn.code
+	errors := s.conn.errors
+	s.conn = s.newConn(tlsConn, s.conn.deadline)
+	s.conn.errors = errors
+	s.conn.code = code
+	return nil
+}
 
+// handshake runs the TLS handshake within the handshake timeout
+func (s *session) handshake(tlsConn *tls.Conn) error {
+	timeout := s.server.TLSHandshakeTimeout
+	if timeout == 0 {
+		timeout = s.server.commandTimeout(true)
+	}
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
 	err := tlsConn.Handshake()
-	if err != nil {
-		s.conn.Reply("550 %s", err.Error())  // EOF when aborted?
-		return
+	if h, ok := s.impl.(HandshakeHandler); ok && err != nil {
+		h.Handshake(s.ctx, err)
 	}
-	if Debug {
-    	state := tlsConn.ConnectionState()
-    	log.Printf("tls %t, version %x, cipher %x\n", state.HandshakeComplete, state.Version, state.CipherSuite)
+	if err != nil {
+		if m := s.server.Metrics; m != nil {
+			m.TLSHandshake(0)
+		}
+		s.logf("TLS handshake with %s failed: %v", s.RemoteAddr, err)
+		return fmt.Errorf("smtpd: TLS handshake failed: %v", err)
 	}
-
-	s.conn = newConn(tlsConn)
-
+	tlsConn.SetDeadline(time.Time{})
+	state := tlsConn.ConnectionState()
+	s.logf("tls %t, version %x, cipher %x", state.HandshakeComplete, state.Version, state.CipherSuite)
+	s.TLS = &state
 	s.tls = true
+	s.vhost = s.server.virtualHost(state.ServerName)
+	s.server.countTLSVersion(state.Version)
+	if m := s.server.Metrics; m != nil {
+		m.TLSHandshake(state.Version)
+	}
+	if h, ok := s.impl.(HandshakeHandler); ok {
+		h.Handshake(s.ctx, nil)
+	}
+	return nil
 }
 
 func (s *session) auth(params string) {
+	if s.server.DisableAuth {
+		s.conn.Reply("502 5.5.1 AUTH not supported")
+		return
+	}
+	if s.AuthUsername != "" {
+		s.conn.Reply("503 5.5.1 Already authenticated")
+		return
+	}
+	if s.hasSender {
+		s.conn.Reply("503 5.5.1 AUTH not permitted during a mail transaction")
+		return
+	}
+	if t := s.server.AuthThrottle; t != nil && t.locked(remoteIP(s.RemoteAddr)) {
+		s.conn.ErrorReply(errAuthLocked)
+		return
+	}
 	mech, cred := split1(params)
-	switch strings.ToUpper(mech) {
+	mech = strings.ToUpper(mech)
+	s.authMech = mech
+	if s.server.AuthMechanisms != nil && !containsFold(s.server.AuthMechanisms, mech) {
+		s.conn.Reply("502 5.5.4 Unknown authentication mechanism")
+		return
+	}
+	m := s.server.saslMechanism(mech)
+	if !s.tls && s.server.authRequiresTLS(mech, m != nil) {
+		s.conn.Reply("502 5.5.1 AUTH %s not allowed, use STARTTLS first", mech)
+		return
+	}
+	if m != nil {
+		s.authSASL(m, cred)
+		return
+	}
+	switch mech {
 	case "PLAIN":
-    	if s.tls == false {
-    		s.conn.Reply("502 AUTH PLAIN not allowed, use STARTTLS first")
-    		break
-    	}
-	    s.authPlain(cred)
+		s.authPlain(cred)
 	case "LOGIN":
-    	if s.tls == false {
-    		s.conn.Reply("502 AUTH LOGIN not allowed, use STARTTLS first")
-    		break
-    	}
-    	s.authLogin()
+		s.authLogin()
 	case "CRAM-MD5":
-	    s.authCramMD5()
+		s.authCramMD5()
+	case "EXTERNAL":
+		s.authExternal(cred)
+	case "SCRAM-SHA-256", "SCRAM-SHA-256-PLUS":
+		a, ok := s.impl.(SCRAMAuthenticator)
+		if !ok {
+			s.conn.Reply("502 5.5.4 Unknown authentication mechanism")
+			break
+		}
+		s.authSASL(scramMechanism{auth: a, plus: mech == "SCRAM-SHA-256-PLUS"}, cred)
+	case "OAUTHBEARER", "XOAUTH2":
+		a, ok := s.impl.(OAuthBearerAuthenticator)
+		if !ok {
+			s.conn.Reply("502 5.5.4 Unknown authentication mechanism")
+			break
+		}
+		s.authSASL(oauthMechanism{auth: a, xoauth2: mech == "XOAUTH2"}, cred)
 	default:
-		s.conn.Reply("502 Unknown authentication mechanism")
+		s.conn.Reply("502 5.5.4 Unknown authentication mechanism")
 	}
 }
 
@@ -266,16 +1198,16 @@ func (s *session) authPlain(cred string) {
 	if cred == "" {
 		s.conn.Reply("334 Give me your credentials")
 		data, err = s.readAuthResp()
-    	if err != nil {
-    		s.conn.ErrorReply(err)
-    		return
-    	}
+		if err != nil {
+			s.conn.ErrorReply(err)
+			return
+		}
 	} else {
-    	data, err = base64.StdEncoding.DecodeString(cred)
-    	if err != nil {
-    		s.conn.Reply("502 Couldn't decode your credentials")
-    		return
-    	}
+		data, err = base64.StdEncoding.DecodeString(cred)
+		if err != nil {
+			s.conn.Reply("502 5.5.2 Couldn't decode your credentials")
+			return
+		}
 	}
 	// The client sends the authorization identity (identity to login as),
 	// followed by a US-ASCII NULL character, followed by the authentication
@@ -285,37 +1217,37 @@ func (s *session) authPlain(cred string) {
 	// as the authentication identity.
 	parts := bytes.Split(data, []byte{0})
 	if len(parts) != 3 {
-		s.conn.Reply("502 Couldn't decode your credentials")
+		s.conn.Reply("502 5.5.2 Couldn't decode your credentials")
 		return
 	}
 	identity := string(parts[0])
 	username := string(parts[1])
 	password := string(parts[2])
 	// ? check if username or password is empty
-	
-	// check credentials
-	expected, err := s.handler.AuthUser(identity, username)
-	if err != nil {
-		s.conn.ErrorReply(err)
+
+	if s.userLocked(username) {
+		s.authFailed(username, errInvalidCredentials)
 		return
 	}
-	if expected == "" || password != expected {
-    	s.conn.Reply("502 invalid credentials")
-    	return
+
+	// check credentials
+	if err := s.checkPassword(identity, username, password); err != nil {
+		s.authFailed(username, err)
+		return
 	}
-	s.conn.Reply("235 OK, you are now authenticated")
+	s.authSucceeded(identity, username)
 }
 
 func (s *session) authLogin() {
-    // ask for username
-    s.conn.Reply("334 VXNlcm5hbWU6") // "Username:" in Base64
+	// ask for username
+	s.conn.Reply("334 VXNlcm5hbWU6") // "Username:" in Base64
 	data, err := s.readAuthResp()
 	if err != nil {
 		s.conn.ErrorReply(err)
 		return
 	}
 	username := string(data)
-	
+
 	// ask for password
 	s.conn.Reply("334 UGFzc3dvcmQ6") // "Password:" in Base64
 	data, err = s.readAuthResp()
@@ -325,95 +1257,229 @@ func (s *session) authLogin() {
 	}
 	password := string(data)
 
-    // check credentials
-	expected, err := s.handler.AuthUser("", username)
-	if err != nil {
-		s.conn.ErrorReply(err)
+	if s.userLocked(username) {
+		s.authFailed(username, errInvalidCredentials)
 		return
 	}
-	if expected == "" || password != expected {
-    	s.conn.Reply("502 invalid credentials")
-    	return
+
+	// check credentials
+	if err := s.checkPassword("", username, password); err != nil {
+		s.authFailed(username, err)
+		return
 	}
-	s.conn.Reply("235 OK, you are now authenticated")
+	s.authSucceeded("", username)
 }
 
 func (s *session) authCramMD5() {
-    
-    // send challenge
-    challenge := []byte(fmt.Sprintf("<%d-%d@%s>", rand.Int63(), time.Now().Unix(), s.server.Hostname))
-    s.conn.Reply("334 " + base64.StdEncoding.EncodeToString(challenge))
-    
-    // get response, should be challenge hashed with password
+
+	// send challenge
+	var b [8]byte
+	if _, err := io.ReadFull(s.server.random(), b[:]); err != nil {
+		s.conn.ErrorReply(errAuthTemporary)
+		return
+	}
+	challenge := []byte(fmt.Sprintf("<%d-%d@%s>", binary.BigEndian.Uint64(b[:]), time.Now().Unix(), s.hostname()))
+	s.conn.Reply("334 %s", base64.StdEncoding.EncodeToString(challenge))
+
+	// get response, should be challenge hashed with password
 	data, err := s.readAuthResp()
 	if err != nil {
 		s.conn.ErrorReply(err)
 		return
 	}
 	username, hashed := split1(string(data))
-    
-    // lookup expected password
-    expected, err := s.handler.AuthUser("", username)
+
+	if s.userLocked(username) {
+		s.authFailed(username, errInvalidCredentials)
+		return
+	}
+
+	// lookup expected password
+	expected, err := s.authUser("", username)
 	if err != nil {
-		s.conn.ErrorReply(err)
+		s.authFailed(username, err)
 		return
 	}
-	
-    // calculate expected response and compare
-    d := hmac.New(md5.New, []byte(expected))
+
+	// calculate expected response and compare
+	d := hmac.New(md5.New, []byte(expected))
 	d.Write(challenge)
 	h := fmt.Sprintf("%x", d.Sum(make([]byte, 0, d.Size())))
-	if hashed != h {
-    	s.conn.Reply("502 invalid credentials")
-    	return
+	if expected == "" || subtle.ConstantTimeCompare([]byte(hashed), []byte(h)) != 1 {
+		s.authFailed(username, errInvalidCredentials)
+		return
 	}
-    s.conn.Reply("235 OK, you are now authenticated")
+	s.authSucceeded("", username)
 }
 
 func (s *session) readAuthResp() (data []byte, err error) {
-    line, err := s.conn.ReadLine()
+	s.conn.SetReadTimeout(s.server.commandTimeout(false))
+	line, err := s.conn.ReadLine()
+	s.conn.SetReadTimeout(0)
 	if err != nil {
 		return
 	}
+	s.recordAuthResp(line)
 	if line == "*" {
-	    err = fmt.Errorf("501 Authentication cancelled")
+		err = errAuthCancelled
 		return
-	} 
+	}
 	data, err = base64.StdEncoding.DecodeString(line)
 	if err != nil {
-	    err = fmt.Errorf("501 Invalid base64 encoding: %v", err)
+		err = fmt.Errorf("501 5.5.2 Invalid base64 encoding: %v", err)
 		return
 	}
-    return
+	return
 }
 
 func (s *session) mail(params string) {
 
-    // valid sender address already provided?
+	// valid sender address already provided?
 	if s.hasSender {
-		s.conn.Reply("503 Sender already given")
+		s.conn.Reply("503 5.5.1 Sender already given")
+		return
+	}
+
+	if s.server.RequireTLS && !s.tls {
+		s.conn.ErrorReply(errTLSRequired)
+		return
+	}
+	if s.AuthUsername == "" && s.requireAuth() {
+		s.conn.ErrorReply(errAuthRequired)
+		return
+	}
+	if err := s.checkSubmission(); err != nil {
+		s.conn.ErrorReply(err)
+		return
+	}
+	if s.rateLimited("MAIL") {
+		s.conn.ErrorReply(errRateLimited)
 		return
 	}
 
 	if len(params) < 5 || strings.EqualFold(params[0:5], "FROM:") == false {
-		s.conn.Reply("501 Syntax: MAIL FROM:<address>")
+		s.conn.Reply("501 5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+
+	addr, args := parsePath(params[5:]) // could be empty for remote bounces
+	if name := s.server.unsupportedParam(args, "AUTH", "SIZE", "BODY", "SMTPUTF8",
+		"RET", "ENVID", "MT-PRIORITY", "BY", "HOLDFOR", "HOLDUNTIL"); name != "" {
+		s.conn.Reply("555 5.5.4 %s parameter not supported", name)
+		return
+	}
+	env := Envelope{Sender: addr}
+	if value, ok := args["AUTH"]; ok {
+		mailbox, err := decodeXtext(value)
+		if err != nil || mailbox == "" {
+			s.conn.Reply("501 5.5.4 Syntax error in AUTH parameter")
+			return
+		}
+		// only accepted from authenticated clients (RFC 4954 section 5)
+		if s.AuthUsername != "" {
+			env.Auth = mailbox
+		}
+	}
+	if value, ok := args["SIZE"]; ok {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			s.conn.Reply("501 5.5.4 Syntax error in SIZE parameter")
+			return
+		}
+		if s.server.MaxMessageSize > 0 && size > s.server.MaxMessageSize {
+			s.conn.ErrorReply(ErrMessageTooLarge)
+			return
+		}
+		env.Size = size
+	}
+	if value, ok := args["BODY"]; ok {
+		switch body := BodyType(strings.ToUpper(value)); body {
+		case Body7Bit, Body8BitMIME, BodyBinaryMIME:
+			env.Body = body
+		default:
+			s.conn.Reply("501 5.5.4 Syntax error in BODY parameter")
+			return
+		}
+	}
+	if value, ok := args["SMTPUTF8"]; ok {
+		if value != "" {
+			s.conn.Reply("501 5.5.4 SMTPUTF8 parameter does not take a value")
+			return
+		}
+		env.SMTPUTF8 = true
+	}
+	if err := checkAddress(addr, env.SMTPUTF8); err != nil {
+		s.conn.ErrorReply(err)
 		return
 	}
+	if value, ok := args["RET"]; ok {
+		env.Ret = strings.ToUpper(value)
+		if env.Ret != "FULL" && env.Ret != "HDRS" {
+			s.conn.Reply("501 5.5.4 Syntax error in RET parameter")
+			return
+		}
+	}
+	if value, ok := args["ENVID"]; ok {
+		envid, err := decodeXtext(value)
+		if err != nil || envid == "" || len(value) > 100 {
+			s.conn.Reply("501 5.5.4 Syntax error in ENVID parameter")
+			return
+		}
+		env.EnvID = envid
+	}
+
+	if value, ok := args["MT-PRIORITY"]; ok {
+		priority, err := strconv.Atoi(value)
+		if err != nil || priority < -9 || priority > 9 {
+			s.conn.Reply("501 5.5.4 Syntax error in MT-PRIORITY parameter")
+			return
+		}
+		if s.AuthUsername == "" && priority > s.server.MaxUnauthPriority {
+			priority = s.server.MaxUnauthPriority
+		}
+		env.Priority = priority
+	}
+
+	if value, ok := args["BY"]; ok {
+		by, err := parseDeliverBy(value, time.Now())
+		if err != nil {
+			s.conn.Reply("501 5.5.4 Syntax error in BY parameter")
+			return
+		}
+		if by.Mode == "R" && time.Until(by.Deadline) < s.server.MinDeliverBy {
+			s.conn.Reply("553 5.5.4 BY time is less than the minimum of %d seconds", int64(s.server.MinDeliverBy/time.Second))
+			return
+		}
+		env.DeliverBy = by
+	}
+
+	if s.server.MaxFutureRelease > 0 {
+		holdUntil, err := parseFutureRelease(args, time.Now(), s.server.MaxFutureRelease)
+		if err != nil {
+			s.conn.Reply("501 5.5.4 %s", err.Error())
+			return
+		}
+		if !holdUntil.IsZero() {
+			env.HoldUntil = &holdUntil
+		}
+	}
 
-	addr := address(params[5:]) // could be empty for remote bounces
-	// BODY=, SIZE=, AUTH=, ENVID=, RET=
-	err := s.handler.Sender(addr)
+	// envelope is available to the handler through the session
+	s.Envelope = env
+	err := s.handler.Sender(s.ctx, addr)
 	if err != nil {
+		s.Envelope = Envelope{}
 		s.conn.ErrorReply(err)
 		return
 	}
 	s.hasSender = true
-	s.conn.Reply("250 OK")
+	s.traceSender(addr)
+	s.conn.Reply("250 2.1.0 OK")
 }
 
 func (s *session) rcpt(params string) {
 	if s.hasSender == false {
-		s.conn.Reply("503 RCPT TO without MAIL FROM") // No sender given
+		s.conn.Reply("503 5.5.1 RCPT TO without MAIL FROM") // No sender given
 		return
 	}
 
@@ -422,42 +1488,162 @@ func (s *session) rcpt(params string) {
 		return
 	}
 
-	// TODO: return 452 too many recipients when too many recipients (RFC 5321 section 4.5.3.1.10)
-	addr := address(params[3:])
-	// ORCPT=, NOTIFY=
-	err := s.handler.Recipient(addr)
+	if s.server.MaxRecipients > 0 && len(s.Envelope.Recipients) >= s.server.MaxRecipients {
+		// RFC 5321 section 4.5.3.1.10
+		s.conn.Reply("452 4.5.3 Too many recipients")
+		return
+	}
+	if s.rateLimited("RCPT") {
+		s.conn.ErrorReply(errRateLimited)
+		return
+	}
+	addr, args := parsePath(params[3:])
+	if name := s.server.unsupportedParam(args, "NOTIFY", "ORCPT"); name != "" {
+		s.conn.Reply("555 5.5.4 %s parameter not supported", name)
+		return
+	}
+	if err := checkAddress(addr, s.Envelope.SMTPUTF8); err != nil {
+		s.conn.ErrorReply(err)
+		return
+	}
+	rcpt := Recipient{Address: addr}
+	if value, ok := args["NOTIFY"]; ok {
+		notify, err := parseNotify(value)
+		if err != nil {
+			s.conn.Reply("501 5.5.4 Syntax error in NOTIFY parameter")
+			return
+		}
+		rcpt.Notify = notify
+	}
+	if value, ok := args["ORCPT"]; ok {
+		addrType, orcpt := "", ""
+		i := strings.IndexByte(value, ';')
+		if i > 0 {
+			addrType = value[:i]
+			orcpt, _ = decodeXtext(value[i+1:])
+		}
+		if orcpt == "" {
+			s.conn.Reply("501 5.5.4 Syntax error in ORCPT parameter")
+			return
+		}
+		rcpt.ORcptType = addrType
+		rcpt.ORcpt = orcpt
+	}
+
+	// recipient is available to the handler through the session
+	s.Envelope.Recipients = append(s.Envelope.Recipients, rcpt)
+	err := s.handler.Recipient(s.ctx, addr)
 	if err != nil {
+		s.Envelope.Recipients = s.Envelope.Recipients[:len(s.Envelope.Recipients)-1]
 		s.conn.ErrorReply(err)
 		return
 	}
 	s.hasRcpt = true
-	s.conn.Reply("250 OK")
+	s.conn.Reply("250 2.1.5 OK")
 }
 
-func (s *session) data() {
+// data receives the message data, it returns an error when the session
+// must end
+func (s *session) data() error {
 	if s.hasRcpt == false {
-		s.conn.Reply("503 DATA without RCPT TO")
-		return
+		s.conn.Reply("503 5.5.1 DATA without RCPT TO")
+		return nil
+	}
+	if s.Envelope.Body == BodyBinaryMIME {
+		s.conn.Reply("503 5.5.1 BINARYMIME requires BDAT")
+		return nil
 	}
 	s.conn.Reply("354 End data with <CR><LF>.<CR><LF>")
+	s.conn.Flush()
+	start := time.Now()
+	s.server.countTransfer(1)
+	defer s.server.countTransfer(-1)
 	reader := &dotReader{
-		r: s.conn.r.R,
+		r:         s.conn.r.R,
+		wire:      s.server.WireSize,
+		max:       s.server.MaxMessageSize,
+		maxLine:   s.server.MaxDataLineLength,
+		rejectNUL: s.server.RejectNUL,
+		bareLF:    s.server.BareLF,
 	}
-	err := s.handler.Message(reader)
-	io.Copy(ioutil.Discard, reader) // discard any remaining data
-	if err != nil {
+	tr := &timeoutReader{r: s.recordData(reader), conn: s.conn, timeout: s.server.dataTimeout()}
+	err := s.handler.Message(s.ctx, s.messageReader(tr))
+	s.numMessages++
+	reader.max, reader.discard = 0, true
+	io.Copy(ioutil.Discard, tr) // discard any remaining data
+	s.conn.SetReadTimeout(0)
+	if tr.timedOut {
+		return ErrDataTimeout
+	}
+	if s.server.MaxMessageSize > 0 && reader.Size() > s.server.MaxMessageSize {
+		err = ErrMessageTooLarge
+	}
+	if reader.invalid != nil {
+		err = reader.invalid
+	}
+	if s.server.LMTP {
+		s.lmtpReply(err)
+		s.countMessage(reader.Size(), start)
+		s.reset()
+		return nil
+	}
+	if err = messageError(err); err != nil {
 		s.conn.ErrorReply(err)
-		return
+		s.countMessage(reader.Size(), start)
+		return nil
 	}
-	s.hasSender = false
-	s.hasRcpt = false
-	s.conn.Reply("250 OK")
+	s.reset()
+	s.conn.Reply("250 2.0.0 %s", s.acceptedReply())
+	s.countMessage(reader.Size(), start)
+	return nil
 }
 
 func (s *session) rset() {
+	s.reset()
+	s.conn.Reply("250 2.0.0 OK")
+}
+
+// reset aborts the current mail transaction
+func (s *session) reset() {
 	s.hasSender = false
 	s.hasRcpt = false
-	s.conn.Reply("250 OK")
+	s.Envelope = Envelope{}
+	s.Forwarded = nil
+}
+
+// isTimeout returns true if err is caused by an expired deadline
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// contextHandler adapts a Handler to the ContextHandler interface
+type contextHandler struct {
+	Handler
+}
+
+func (h contextHandler) Connect(ctx context.Context, source string) error {
+	return h.Handler.Connect(source)
+}
+
+func (h contextHandler) Hello(ctx context.Context, hostname string) error {
+	return h.Handler.Hello(hostname)
+}
+
+func (h contextHandler) AuthUser(ctx context.Context, identity, username string) (string, error) {
+	return h.Handler.AuthUser(identity, username)
+}
+
+func (h contextHandler) Sender(ctx context.Context, address string) error {
+	return h.Handler.Sender(address)
+}
+
+func (h contextHandler) Recipient(ctx context.Context, address string) error {
+	return h.Handler.Recipient(address)
+}
+
+func (h contextHandler) Message(ctx context.Context, reader io.Reader) error {
+	return h.Handler.Message(reader)
 }
 
 // split at first space
@@ -471,12 +1657,3 @@ func split1(str string) (elem, rest string) {
 	}
 	return
 }
-
-var reAddress = regexp.MustCompile(` ?<?([^>\s]+)`)
-
-func address(param string) (addr string) {
-	if m := reAddress.FindStringSubmatch(param); m != nil {
-		addr = m[1]
-	}
-	return
-}
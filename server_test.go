@@ -1,12 +1,29 @@
 package smtpd
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
 	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var testMessage = []byte(`From: sender@example.com
@@ -41,91 +58,2280 @@ func (h testHandler) Message(reader io.Reader) error { return nil }
 
 func TestSendMail(t *testing.T) {
 
-	Debug = true
+	done := runServer(t, &Server{DebugLog: log.Default()}, testHandler{})
 
-	runServer(t, &Server{}, testHandler{})
+	err := sendMail("127.0.0.1:10025", nil, "sender@example.com", []string{"recipient@example.com"}, testMessage)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
+
+func TestSendMailWithPlainAuth(t *testing.T) {
+
+	// openssl genrsa 2048 > test/key.pem
+	// openssl req -x509 -new -key key.pem > test/cert.pem
+	//
+	// Country Name (2 letter code) [AU]:.
+	// State or Province Name (full name) [Some-State]:.
+	// Locality Name (eg, city) []:
+	// Organization Name (eg, company) [Internet Widgits Pty Ltd]:.
+	// Organizational Unit Name (eg, section) []:
+	// Common Name (e.g. server FQDN or YOUR name) []:127.0.0.1
+	// Email Address []:
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		//ClientAuth:   tls.VerifyClientCertIfGiven,
+		//ServerName:   "localhost",
+	}
+
+	server := &Server{
+		TLSConfig: tlsConfig,
+		DebugLog:  log.Default(),
+	}
+
+	done := runServer(t, server, testHandler{})
+
+	auth := smtp.PlainAuth("", "user@example.com", "password", "127.0.0.1")
+	err = sendMail("127.0.0.1:10025", auth, "sender@example.com", []string{"recipient@example.com"}, testMessage)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	server := &Server{
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{cert}},
+		ImplicitTLS:   true,
+		ProxyProtocol: true,
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer listener.Close()
+	done := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		done <- server.ServeSMTP(conn, testHandler{})
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	// send the PROXY header and the TLS client hello at once
+	conn.Write([]byte("PROXY UNKNOWN\r\n"))
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	c := textproto.NewConn(tlsConn)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	msg := cmd(t, c, 250, "EHLO localhost")
+	if strings.Contains(msg, "STARTTLS") || !strings.Contains(msg, "AUTH PLAIN") {
+		t.Fatalf("unexpected extensions %q", msg)
+	}
+	cmd(t, c, 500, "STARTTLS")
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
+
+type handshakeHandler struct {
+	testHandler
+	errs chan error
+}
+
+func (h handshakeHandler) Handshake(ctx context.Context, err error) {
+	h.errs <- err
+}
+
+func TestStartTLSFailure(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	server := &Server{
+		TLSConfig:           &tls.Config{Certificates: []tls.Certificate{cert}},
+		TLSHandshakeTimeout: 50 * time.Millisecond,
+	}
+
+	// no handshake within the timeout
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	cmd(t, c, 220, "STARTTLS")
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "TLS handshake failed") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("handshake did not time out")
+	}
+
+	// invalid handshake
+	handler := handshakeHandler{errs: make(chan error, 1)}
+	c, done = dialServer(t, server, handler)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 220, "STARTTLS")
+	c.PrintfLine("EHLO localhost")
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "TLS handshake failed") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := c.ReadLine(); err == nil {
+		t.Fatalf("expected connection to be closed")
+	}
+	if err := <-handler.errs; err == nil {
+		t.Fatalf("handshake failure not reported")
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	server := &Server{
+		TLSConfig:  &tls.Config{Certificates: []tls.Certificate{cert}},
+		RequireTLS: true,
+	}
+
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	if msg := cmd(t, c, 530, "MAIL FROM:<sender@example.com>"); msg != "5.7.0 Must issue a STARTTLS command first" {
+		t.Fatalf("unexpected reply %q", msg)
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	server.ImplicitTLS = true
+	c, done = dialServerTLS(t, server, testHandler{}, &tls.Config{InsecureSkipVerify: true})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
+
+type localHandler struct {
+	testHandler
+}
+
+func (h localHandler) RequireAuth(ctx context.Context) bool {
+	addr := SessionFromContext(ctx).RemoteAddr.(*net.TCPAddr)
+	return !addr.IP.IsLoopback()
+}
+
+func TestRequireAuth(t *testing.T) {
+
+	server := &Server{RequireAuth: true}
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	if msg := cmd(t, c, 530, "MAIL FROM:<sender@example.com>"); msg != "5.7.0 Authentication required" {
+		t.Fatalf("unexpected reply %q", msg)
+	}
+	challenge, err := base64.StdEncoding.DecodeString(cmd(t, c, 334, "AUTH CRAM-MD5"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	d := hmac.New(md5.New, []byte("password"))
+	d.Write(challenge)
+	cmd(t, c, 235, "%s", base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("user@example.com %x", d.Sum(nil)))))
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	// the handler decides
+	c, done = dialServer(t, server, localHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
+
+func TestSubmission(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	// cleartext
+	c, done := dialServer(t, &Server{Submission: true, TLSConfig: tlsConfig}, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	cmd(t, c, 530, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	server := &Server{
+		Hostname:         "mail.example.com",
+		TLSConfig:        tlsConfig,
+		ImplicitTLS:      true,
+		Submission:       true,
+		SubmissionFixups: true,
+	}
+	handler := &dataHandler{}
+	c, done = dialServerTLS(t, server, handler, &tls.Config{InsecureSkipVerify: true})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "HELO localhost")
+	cmd(t, c, 503, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "EHLO localhost")
+	cmd(t, c, 530, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 235, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00password")))
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\nmessage-id: <1@example.com>\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	data := handler.data[0]
+	if !strings.HasPrefix(data, "Date: ") || strings.Count(strings.ToLower(data), "message-id:") != 1 {
+		t.Fatalf("unexpected fix-ups %q", data)
+	}
+	if !strings.HasSuffix(data, "\r\nSubject: test\r\nmessage-id: <1@example.com>\r\n\r\nThis is a test.\r\n") {
+		t.Fatalf("unexpected message %q", data)
+	}
+}
+
+func TestFixupHeaders(t *testing.T) {
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		from, message, expected string
+	}{
+		{"", "Subject: test\r\n\r\nbody\r\n", "Date: Fri, 01 Mar 2024 12:00:00 +0000\r\nMessage-ID: <*@mx.example.net>\r\nSubject: test\r\n\r\nbody\r\n"},
+		{"user@example.com", "Date: x\r\nMessage-ID: <1@x>\r\nSubject: test\r\n\r\nbody\r\n", "From: <user@example.com>\r\nDate: x\r\nMessage-ID: <1@x>\r\nSubject: test\r\n\r\nbody\r\n"},
+		{"user@example.com", "Date: x\r\nMessage-ID: <1@x>\r\nFrom: <>\r\n \r\nTo: a@x\r\n\r\nbody\r\n", "From: <user@example.com>\r\nDate: x\r\nMessage-ID: <1@x>\r\nTo: a@x\r\n\r\nbody\r\n"},
+		{"user@example.com", "Date: x\r\nMessage-ID: <1@x>\r\nFrom:\r\n Alice <alice@x>\r\n\r\n", "Date: x\r\nMessage-ID: <1@x>\r\nFrom:\r\n Alice <alice@x>\r\n\r\n"},
+	} {
+		data, _ := ioutil.ReadAll(fixupHeaders(strings.NewReader(test.message), "mx.example.net", test.from, now))
+		prefix, suffix := test.expected, ""
+		if i := strings.IndexByte(test.expected, '*'); i >= 0 {
+			prefix, suffix = test.expected[:i], test.expected[i+1:]
+		}
+		if !strings.HasPrefix(string(data), prefix) || !strings.HasSuffix(string(data), suffix) {
+			t.Errorf("unexpected fix-ups %q, expected %q", data, test.expected)
+		}
+	}
+}
+
+func TestFixupHeadersLarge(t *testing.T) {
+
+	// a header over the limit is passed unchanged, Date at its end is not
+	// duplicated
+	long := "X-Long: " + strings.Repeat("x", 998) + "\r\n"
+	message := strings.Repeat(long, 70) + "Date: x\r\nMessage-ID: <1@x>\r\n\r\nbody\r\n"
+	data, err := ioutil.ReadAll(fixupHeaders(strings.NewReader(message), "mx.example.net", "user@example.com", time.Now()))
+	if err != nil || string(data) != message {
+		t.Fatalf("unexpected fix-ups of large header: %v", err)
+	}
+
+	// a line without LF is not buffered past the limit
+	message = "Subject: " + strings.Repeat("x", 1<<20)
+	counter := &countReader{r: strings.NewReader(message)}
+	r := fixupHeaders(counter, "mx.example.net", "user@example.com", time.Now())
+	if counter.n > maxFixupHeader+4096 {
+		t.Fatalf("read %d bytes of the header", counter.n)
+	}
+	data, err = ioutil.ReadAll(r)
+	if err != nil || string(data) != message {
+		t.Fatalf("unexpected fix-ups of long line: %v", err)
+	}
+}
+
+// countReader counts the bytes read from r
+type countReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+type externalHandler struct {
+	testHandler
+}
+
+func (h externalHandler) AuthExternal(ctx context.Context, identity string, cert *x509.Certificate) (string, error) {
+	if identity != "" && identity != "user@example.com" {
+		return "", NewReply(535, "5.7.8", "Not authorized")
+	}
+	return "user@example.com", nil
+}
+
+func TestAuthExternal(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	server := &Server{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    pool,
+		},
+		ImplicitTLS: true,
+	}
+
+	// without client certificate
+	c, done := dialServerTLS(t, server, externalHandler{}, &tls.Config{InsecureSkipVerify: true})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 250, "EHLO localhost"); strings.Contains(msg, "EXTERNAL") {
+		t.Fatalf("EXTERNAL advertised without client certificate")
+	}
+	cmd(t, c, 504, "AUTH EXTERNAL =")
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	config := &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}}
+	c, done = dialServerTLS(t, server, externalHandler{}, config)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 250, "EHLO localhost"); !strings.Contains(msg, "AUTH PLAIN LOGIN EXTERNAL") {
+		t.Fatalf("EXTERNAL not advertised")
+	}
+	cmd(t, c, 535, "AUTH EXTERNAL %s", base64.StdEncoding.EncodeToString([]byte("other@example.com")))
+	cmd(t, c, 334, "AUTH EXTERNAL")
+	cmd(t, c, 235, "")
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
+
+func TestAuthMechanisms(t *testing.T) {
+
+	server := &Server{
+		AuthMechanisms:    []string{"cram-md5", "PLAIN"},
+		AuthTLSMechanisms: []string{},
+	}
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 250, "EHLO localhost"); !strings.Contains(msg, "\nAUTH CRAM-MD5 PLAIN\n") {
+		t.Fatalf("unexpected mechanisms %q", msg)
+	}
+	cmd(t, c, 502, "AUTH LOGIN")
+	cmd(t, c, 235, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00password")))
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	server = &Server{DisableAuth: true}
+	c, done = dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 250, "EHLO localhost"); strings.Contains(msg, "AUTH") {
+		t.Fatalf("AUTH advertised %q", msg)
+	}
+	cmd(t, c, 502, "AUTH CRAM-MD5")
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
+
+type passwordHandler struct {
+	testHandler
+}
+
+func (h passwordHandler) AuthUser(identity, username string) (string, error) {
+	return "", errors.New("unexpected call")
+}
+
+func (h passwordHandler) Authenticate(ctx context.Context, identity, username, password string) error {
+	if username != "user@example.com" || password != "secret" {
+		return NewReply(535, "5.7.8", "Authentication credentials invalid")
+	}
+	return nil
+}
+
+func TestAuthenticate(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	server := &Server{
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		ImplicitTLS: true,
+	}
+	c, done := dialServerTLS(t, server, passwordHandler{}, &tls.Config{InsecureSkipVerify: true})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	cmd(t, c, 250, "EHLO localhost")
+	cmd(t, c, 535, "AUTH PLAIN %s", encode("\x00user@example.com\x00password"))
+	cmd(t, c, 334, "AUTH LOGIN")
+	cmd(t, c, 334, "%s", encode("user@example.com"))
+	cmd(t, c, 235, "%s", encode("secret"))
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	server.Credentials = StaticCredentials{"user@example.com": "letmein"}
+	c, done = dialServerTLS(t, server, testHandler{}, &tls.Config{InsecureSkipVerify: true})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	cmd(t, c, 535, "AUTH PLAIN %s", encode("\x00user@example.com\x00password"))
+	cmd(t, c, 235, "AUTH PLAIN %s", encode("\x00user@example.com\x00letmein"))
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
+
+type unavailableHandler struct {
+	testHandler
+}
+
+func (h unavailableHandler) AuthUser(identity, username string) (string, error) {
+	return "", fmt.Errorf("421 backend unavailable")
+}
+
+func TestAuthFailureReplies(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	server := &Server{
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		ImplicitTLS: true,
+	}
+	c, done := dialServerTLS(t, server, testHandler{}, &tls.Config{InsecureSkipVerify: true})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	cmd(t, c, 250, "EHLO localhost")
+	// unknown users can not be told from wrong passwords
+	unknown := cmd(t, c, 535, "AUTH PLAIN %s", encode("\x00unknown@example.com\x00password"))
+	wrong := cmd(t, c, 535, "AUTH PLAIN %s", encode("\x00user@example.com\x00wrong"))
+	if unknown != wrong || unknown != "5.7.8 Authentication credentials invalid" {
+		t.Fatalf("unexpected replies %q and %q", unknown, wrong)
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	c, done = dialServerTLS(t, server, unavailableHandler{}, &tls.Config{InsecureSkipVerify: true})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	if msg := cmd(t, c, 454, "AUTH PLAIN %s", encode("\x00user@example.com\x00password")); msg != "4.7.0 Temporary authentication failure" {
+		t.Fatalf("unexpected reply %q", msg)
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
+
+func TestVirtualHosts(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	server := &Server{
+		Hostname:    "mail.example.com",
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		ImplicitTLS: true,
+		VirtualHosts: map[string]*VirtualHost{
+			"mail.example.org": {
+				Hostname:     "mail.example.org",
+				Certificates: []tls.Certificate{cert},
+				AuthUser: func(ctx context.Context, identity, username string) (string, error) {
+					return "secret", nil
+				},
+			},
+		},
+	}
+	plain := func(password string) string {
+		return base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00" + password))
+	}
+
+	config := &tls.Config{InsecureSkipVerify: true, ServerName: "MAIL.example.org"}
+	c, done := dialServerTLS(t, server, testHandler{}, config)
+	defer c.Close()
+	if _, msg, err := c.ReadResponse(220); err != nil || !strings.HasPrefix(msg, "mail.example.org ") {
+		t.Fatalf("unexpected greeting %q %v", msg, err)
+	}
+	if msg := cmd(t, c, 250, "EHLO localhost"); !strings.HasPrefix(msg, "mail.example.org\n") {
+		t.Fatalf("unexpected reply %q", msg)
+	}
+	cmd(t, c, 535, "AUTH PLAIN %s", plain("password"))
+	cmd(t, c, 235, "AUTH PLAIN %s", plain("secret"))
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	// default host
+	config = &tls.Config{InsecureSkipVerify: true, ServerName: "other.example.org"}
+	c, done = dialServerTLS(t, server, testHandler{}, config)
+	defer c.Close()
+	if _, msg, err := c.ReadResponse(220); err != nil || !strings.HasPrefix(msg, "mail.example.com ") {
+		t.Fatalf("unexpected greeting %q %v", msg, err)
+	}
+	cmd(t, c, 235, "AUTH PLAIN %s", plain("password"))
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
+
+// testMechanism asks for a username and confirms it with additional data
+type testMechanism struct{}
+
+func (m testMechanism) Name() string { return "X-TEST" }
+
+func (m testMechanism) Start(ctx context.Context) (SASLServer, error) {
+	return &testExchange{}, nil
+}
+
+type testExchange struct {
+	username string
+}
+
+func (e *testExchange) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte("who?"), false, nil
+	}
+	if string(response) != "user@example.com" {
+		return nil, false, NewReply(535, "5.7.8", "Authentication credentials invalid")
+	}
+	e.username = string(response)
+	return []byte("welcome"), true, nil
+}
+
+func (e *testExchange) Identity() (string, string) { return "", e.username }
+
+func TestSASLMechanism(t *testing.T) {
+
+	handler := &sessionHandler{}
+	c, done := dialServerContext(t, &Server{SASLMechanisms: []SASLMechanism{testMechanism{}}}, handler)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 250, "EHLO localhost"); !strings.Contains(msg, "AUTH CRAM-MD5 X-TEST\n") {
+		t.Fatalf("mechanism not advertised: %q", msg)
+	}
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	cmd(t, c, 535, "AUTH x-test %s", encode("other@example.com"))
+	if msg := cmd(t, c, 334, "AUTH X-TEST"); msg != encode("who?") {
+		t.Fatalf("unexpected challenge %q", msg)
+	}
+	cmd(t, c, 501, "*")
+	cmd(t, c, 334, "AUTH X-TEST")
+	if msg := cmd(t, c, 334, "%s", encode("user@example.com")); msg != encode("welcome") {
+		t.Fatalf("unexpected additional data %q", msg)
+	}
+	cmd(t, c, 235, "")
+	cmd(t, c, 250, "MAIL FROM:<user@example.com>")
+	cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+	if handler.session.AuthUsername != "user@example.com" {
+		t.Fatalf("unexpected username %q", handler.session.AuthUsername)
+	}
+}
+
+func TestAuthParameter(t *testing.T) {
+
+	handler := &sessionHandler{}
+	c, done := dialServerContext(t, &Server{SASLMechanisms: []SASLMechanism{testMechanism{}}}, handler)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com> AUTH=<>")
+	cmd(t, c, 503, "AUTH X-TEST")
+	cmd(t, c, 250, "RSET")
+	cmd(t, c, 334, "AUTH X-TEST %s", base64.StdEncoding.EncodeToString([]byte("user@example.com")))
+	cmd(t, c, 235, "")
+	cmd(t, c, 503, "AUTH X-TEST")
+	cmd(t, c, 501, "MAIL FROM:<sender@example.com> AUTH=")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com> AUTH=e+3Dmc2@example.com")
+	cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+	if auth := handler.session.Envelope.Auth; auth != "e=mc2@example.com" {
+		t.Fatalf("unexpected AUTH parameter %q", auth)
+	}
+}
+
+func TestSendMailWithCramMD5Auth(t *testing.T) {
+
+	server := &Server{DebugLog: log.Default()}
+
+	done := runServer(t, server, testHandler{})
+
+	auth := smtp.CRAMMD5Auth("user@example.com", "password")
+	err := sendMail("127.0.0.1:10025", auth, "sender@example.com", []string{"recipient@example.com"}, testMessage)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
+
+func TestCramMD5Challenge(t *testing.T) {
+
+	random := bytes.NewReader([]byte{0, 0, 0, 0, 0, 0, 0, 42})
+	c, done := dialServer(t, &Server{Hostname: "mail.example.com", Rand: random}, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	challenge, err := base64.StdEncoding.DecodeString(cmd(t, c, 334, "AUTH CRAM-MD5"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !strings.HasPrefix(string(challenge), "<42-") || !strings.HasSuffix(string(challenge), "@mail.example.com>") {
+		t.Fatalf("unexpected challenge %q", challenge)
+	}
+	cmd(t, c, 501, "*")
+	cmd(t, c, 454, "AUTH CRAM-MD5") // source exhausted
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
+
+type outcomeHandler struct {
+	testHandler
+	outcomes []Outcome
+}
+
+func (h *outcomeHandler) Recipient(address string) error {
+	if address == "unknown@example.com" {
+		return fmt.Errorf("550 5.1.1 No such user")
+	}
+	return nil
+}
+
+func (h *outcomeHandler) Disconnect(outcomes []Outcome) {
+	h.outcomes = outcomes
+}
+
+func TestDisconnectOutcomes(t *testing.T) {
+
+	handler := &outcomeHandler{}
+	c, done := dialServer(t, &Server{}, handler)
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "HELO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 550, "RCPT TO:<unknown@example.com>")
+	cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+	cmd(t, c, 221, "QUIT")
+
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	expected := []Outcome{
+		{"HELO", 250},
+		{"MAIL", 250},
+		{"RCPT", 550},
+		{"RCPT", 250},
+		{"QUIT", 221},
+	}
+	if !reflect.DeepEqual(handler.outcomes, expected) {
+		t.Fatalf("expected outcomes %v, got %v", expected, handler.outcomes)
+	}
+	if handler.outcomes[2].Accepted() || !handler.outcomes[3].Accepted() {
+		t.Fatalf("expected rejected RCPT followed by accepted RCPT")
+	}
+}
+
+func TestTimeoutWaitingForCommand(t *testing.T) {
+
+	server := &Server{
+		IdleTimeout: 100 * time.Millisecond,
+	}
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	// stay silent
+	_, msg, err := c.ReadResponse(421)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !strings.Contains(msg, "Timeout waiting for command") {
+		t.Fatalf("unexpected reply: %s", msg)
+	}
+	if err := <-done; !isTimeout(err) {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+}
+
+func TestDataTimeout(t *testing.T) {
+
+	server := &Server{
+		CommandTimeout: time.Second,
+		DataTimeout:    100 * time.Millisecond,
+	}
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "HELO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+	cmd(t, c, 354, "DATA")
+	// each block must arrive within the timeout
+	for i := 0; i < 3; i++ {
+		c.PrintfLine("line %d", i)
+		time.Sleep(50 * time.Millisecond)
+	}
+	// stall
+	_, msg, err := c.ReadResponse(421)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !strings.Contains(msg, "Timeout while receiving data") {
+		t.Fatalf("unexpected reply: %s", msg)
+	}
+	if err := <-done; err != ErrDataTimeout {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+}
+
+type timeoutHandler struct {
+	testHandler
+	err error
+}
+
+func (h *timeoutHandler) Timeout(ctx context.Context, err error) {
+	h.err = err
+}
+
+func TestSessionTimeouts(t *testing.T) {
+
+	// idle between transactions
+	server := &Server{IdleTimeout: 100 * time.Millisecond}
+	handler := &timeoutHandler{}
+	c, done := dialServer(t, server, handler)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "HELO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	time.Sleep(200 * time.Millisecond) // not idle during a transaction
+	cmd(t, c, 250, "RSET")
+	if _, msg, err := c.ReadResponse(421); err != nil || msg != "4.4.2 Idle timeout, closing connection" {
+		t.Fatalf("unexpected reply %q, %v", msg, err)
+	}
+	<-done
+	if handler.err != ErrIdleTimeout {
+		t.Fatalf("unexpected notification %v", handler.err)
+	}
+
+	// session time limit
+	server = &Server{MaxSessionDuration: 300 * time.Millisecond}
+	handler = &timeoutHandler{}
+	c, done = dialServer(t, server, handler)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	for i := 0; i < 4; i++ {
+		cmd(t, c, 250, "NOOP")
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, msg, err := c.ReadResponse(421); err != nil || msg != "4.4.2 Session time limit exceeded, closing connection" {
+		t.Fatalf("unexpected reply %q, %v", msg, err)
+	}
+	<-done
+	if handler.err != ErrSessionTimeout {
+		t.Fatalf("unexpected notification %v", handler.err)
+	}
+}
+
+func TestMaxErrors(t *testing.T) {
+
+	server := &Server{MaxErrors: 3, ErrorDelay: 20 * time.Millisecond}
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	start := time.Now()
+	cmd(t, c, 500, "BOGUS")
+	cmd(t, c, 250, "HELO localhost")
+	cmd(t, c, 503, "RCPT TO:<rcpt@example.com>")
+	cmd(t, c, 501, "MAIL TO:<sender@example.com>")
+	if _, msg, err := c.ReadResponse(421); err != nil || msg != "4.7.0 Too many errors, closing connection" {
+		t.Fatalf("unexpected reply %q, %v", msg, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	// delays of 1, 2 and 3 times the error delay
+	if elapsed := time.Since(start); elapsed < 120*time.Millisecond {
+		t.Fatalf("error replies not delayed, took %v", elapsed)
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+
+	server := &Server{MaxRecipients: 2, MaxMessagesPerConnection: 1}
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "HELO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<rcpt1@example.com>")
+	cmd(t, c, 250, "RCPT TO:<rcpt2@example.com>")
+	cmd(t, c, 452, "RCPT TO:<rcpt3@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 421, "MAIL FROM:<sender@example.com>")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	server = &Server{MaxCommands: 2}
+	c, done = dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "HELO localhost")
+	cmd(t, c, 250, "NOOP")
+	cmd(t, c, 421, "NOOP")
+	<-done
+}
+
+func TestMaxLineLength(t *testing.T) {
+
+	server := &Server{SASLMechanisms: []SASLMechanism{testMechanism{}}}
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "HELO localhost")
+	if msg := cmd(t, c, 500, "NOOP %s", strings.Repeat("x", 600)); msg != "5.5.2 Line too long" {
+		t.Fatalf("unexpected reply %q", msg)
+	}
+	cmd(t, c, 500, "NOOP %s", strings.Repeat("x", 20000))
+	// longer AUTH lines are allowed
+	cmd(t, c, 535, "AUTH X-TEST %s", strings.Repeat("x", 4000))
+	cmd(t, c, 250, "NOOP")
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
+
+func TestInvalidMessageData(t *testing.T) {
+
+	server := &Server{MaxDataLineLength: 1000, RejectNUL: true, BareLF: BareLFReject}
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "HELO localhost")
+	for _, test := range []struct {
+		line string
+		code int
+		msg  string
+	}{
+		{strings.Repeat("x", 998), 250, ""},
+		{strings.Repeat("x", 999), 500, "5.5.2 Line too long"},
+		{"nul \x00 byte", 554, "5.6.0 Message contains NUL characters"},
+		{"bare\n.\nlf", 500, "5.5.2 Bare LF line endings not allowed"},
+	} {
+		cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+		cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+		cmd(t, c, 354, "DATA")
+		// the message is refused after the final dot
+		c.PrintfLine("Subject: test\r\n\r\n%s\r\nmore data\r\n.", test.line)
+		_, msg, err := c.ReadResponse(test.code)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if test.msg != "" && msg != test.msg {
+			t.Fatalf("unexpected reply %q", msg)
+		}
+		cmd(t, c, 250, "RSET")
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
+
+func TestGreetDelay(t *testing.T) {
+
+	server := &Server{GreetDelay: 50 * time.Millisecond}
+
+	// client waits for the greeting
+	c, done := dialServer(t, server, testHandler{})
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	c.Close()
+
+	// early talker is refused
+	c, done = dialServer(t, server, testHandler{})
+	defer c.Close()
+	c.PrintfLine("EHLO localhost")
+	if _, msg, err := c.ReadResponse(554); err != nil {
+		t.Fatalf("%s", err.Error())
+	} else if !strings.Contains(msg, "before greeting") {
+		t.Fatalf("unexpected reply %q", msg)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
+
+type panicHandler struct {
+	testHandler
+}
+
+func (h panicHandler) Hello(hostname string) error {
+	if hostname == "panic" {
+		panic("hello")
+	}
+	return nil
+}
+
+func TestServe(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	server := &Server{
+		NewHandler: func() Handler { return panicHandler{} },
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+	addr := listener.Addr().String()
+
+	// panic in session only closes the connection
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	c.PrintfLine("HELO panic")
+	if _, _, err := c.ReadResponse(250); err == nil {
+		t.Fatalf("expected connection to be closed")
+	}
+	c.Close()
+
+	err = sendMail(addr, nil, "sender@example.com", []string{"recipient@example.com"}, testMessage)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	server.Close()
+	if err := <-done; err != ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	server := &Server{
+		NewHandler:          func() Handler { return testHandler{} },
+		MaxConnectionsPerIP: 1,
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+	addr := listener.Addr().String()
+
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if total, perIP := server.ConnectionCounts(); total != 1 || perIP["127.0.0.1"] != 1 {
+		t.Fatalf("unexpected counts %d %v", total, perIP)
+	}
+
+	// second connection from the same address is refused
+	c2, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if _, msg, err := c2.ReadResponse(421); err != nil {
+		t.Fatalf("%s", err.Error())
+	} else if !strings.Contains(msg, "Too many connections") {
+		t.Fatalf("unexpected reply %q", msg)
+	}
+	c2.Close()
+
+	cmd(t, c, 221, "QUIT")
+	c.Close()
+	for i := 0; i < 100; i++ {
+		if total, _ := server.ConnectionCounts(); total == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if total, perIP := server.ConnectionCounts(); total != 0 || len(perIP) != 0 {
+		t.Fatalf("unexpected counts %d %v", total, perIP)
+	}
+
+	server.Close()
+	if err := <-done; err != ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+type sourceHandler struct {
+	testHandler
+	source chan string
+}
+
+func (h sourceHandler) Connect(source string) error {
+	h.source <- source
+	return nil
+}
+
+func TestListenAndServeUnix(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "smtpd")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lmtp.sock")
+
+	handler := sourceHandler{source: make(chan string, 1)}
+	server := &Server{
+		LMTP:       true,
+		NewHandler: func() Handler { return handler },
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServeUnix(path, 0660)
+	}()
+	var c *textproto.Conn
+	for i := 0; i < 50; i++ {
+		if c, err = textproto.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer c.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+		t.Fatalf("unexpected socket permissions %v %v", fi.Mode(), err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	source := <-handler.source
+	if runtime.GOOS == "linux" {
+		expected := fmt.Sprintf("unix:%s pid=%d uid=%d", path, os.Getpid(), os.Getuid())
+		if !strings.HasPrefix(source, expected) {
+			t.Fatalf("expected source %q, got %q", expected, source)
+		}
+	}
+	cmd(t, c, 250, "LHLO localhost")
+	cmd(t, c, 221, "QUIT")
+
+	if _, err := ListenUnix(path, 0660); err == nil {
+		t.Fatalf("expected error for socket in use")
+	}
+	server.Close()
+	if err := <-done; err != ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file not removed: %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	server := &Server{
+		NewHandler: func() Handler { return testHandler{} },
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+	addr := listener.Addr().String()
+
+	// session receiving message data
+	busy, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer busy.Close()
+	if _, _, err := busy.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, busy, 250, "HELO localhost")
+	cmd(t, busy, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, busy, 250, "RCPT TO:<recipient@example.com>")
+	cmd(t, busy, 354, "DATA")
+	busy.PrintfLine("Subject: test")
+
+	// idle session
+	idle, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer idle.Close()
+	if _, _, err := idle.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+
+	if _, _, err := idle.ReadResponse(421); err != nil {
+		t.Fatalf("idle session: %s", err.Error())
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before DATA completed: %v", err)
+	case <-time.After(2 * shutdownPollInterval):
+	}
+
+	busy.PrintfLine("")
+	busy.PrintfLine("This is a test.")
+	busy.PrintfLine(".")
+	if _, _, err := busy.ReadResponse(250); err != nil {
+		t.Fatalf("busy session: %s", err.Error())
+	}
+	if _, _, err := busy.ReadResponse(421); err != nil {
+		t.Fatalf("busy session: %s", err.Error())
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+type ctxHandler struct {
+	ctx context.Context
+}
+
+func (h *ctxHandler) Connect(ctx context.Context, source string) error {
+	h.ctx = ctx
+	return nil
+}
+
+func (h *ctxHandler) Hello(ctx context.Context, hostname string) error { return ctx.Err() }
+
+func (h *ctxHandler) AuthUser(ctx context.Context, identity, username string) (string, error) {
+	return "", fmt.Errorf("550 Unauthorized")
+}
+
+func (h *ctxHandler) Sender(ctx context.Context, address string) error { return ctx.Err() }
+
+func (h *ctxHandler) Recipient(ctx context.Context, address string) error { return ctx.Err() }
+
+func (h *ctxHandler) Message(ctx context.Context, reader io.Reader) error { return ctx.Err() }
+
+func TestContextHandler(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	handler := &ctxHandler{}
+	server := &Server{
+		NewContextHandler: func() ContextHandler { return handler },
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	err = sendMail(listener.Addr().String(), nil, "sender@example.com", []string{"recipient@example.com"}, testMessage)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	server.Shutdown(context.Background())
+	if handler.ctx.Err() != context.Canceled {
+		t.Fatalf("expected context to be canceled after session, got %v", handler.ctx.Err())
+	}
+}
+
+type sessionHandler struct {
+	ctxHandler
+	session Session
+}
+
+func (h *sessionHandler) Message(ctx context.Context, reader io.Reader) error {
+	h.session = *SessionFromContext(ctx)
+	return nil
+}
+
+func TestSessionFromContext(t *testing.T) {
+
+	handler := &sessionHandler{}
+	c, done := dialServerContext(t, &Server{}, handler)
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	msg := cmd(t, c, 250, "EHLO client.example.com")
+	if !strings.Contains(msg, "\n8BITMIME") {
+		t.Fatalf("8BITMIME not advertised: %s", msg)
+	}
+	if !strings.Contains(msg, "\nENHANCEDSTATUSCODES") {
+		t.Fatalf("ENHANCEDSTATUSCODES not advertised: %s", msg)
+	}
+	cmd(t, c, 501, "MAIL FROM:<sender@example.com> BODY=9BIT")
+	if msg := cmd(t, c, 250, "MAIL FROM:<sender@example.com> BODY=8bitmime RET=HDRS ENVID=QQ+2B314"); msg != "2.1.0 OK" {
+		t.Fatalf("unexpected reply %q", msg)
+	}
+	cmd(t, c, 250, "RCPT TO:<one@example.com>")
+	cmd(t, c, 501, "RCPT TO:<two@example.com> NOTIFY=NEVER,DELAY")
+	cmd(t, c, 250, "RCPT TO:<two@example.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;two+2Bx@example.com")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	sess := handler.session
+	if sess.Helo != "client.example.com" {
+		t.Fatalf("unexpected helo %q", sess.Helo)
+	}
+	if sess.RemoteAddr == nil || sess.TLS != nil {
+		t.Fatalf("unexpected connection state %v %v", sess.RemoteAddr, sess.TLS)
+	}
+	expected := Envelope{
+		Sender: "sender@example.com",
+		Recipients: []Recipient{
+			{Address: "one@example.com"},
+			{
+				Address:   "two@example.com",
+				Notify:    []string{"SUCCESS", "FAILURE"},
+				ORcptType: "rfc822",
+				ORcpt:     "two+x@example.com",
+			},
+		},
+		Body:  Body8BitMIME,
+		Ret:   "HDRS",
+		EnvID: "QQ+314",
+	}
+	if !reflect.DeepEqual(sess.Envelope, expected) {
+		t.Fatalf("expected envelope %v, got %v", expected, sess.Envelope)
+	}
+}
+
+// setterHandler is a Handler that gets the Session with SetSession
+type setterHandler struct {
+	testHandler
+	session *Session
+	helo    string
+	sender  string
+}
+
+func (h *setterHandler) SetSession(sess *Session) { h.session = sess }
+
+func (h *setterHandler) Recipient(address string) error {
+	h.helo, h.sender = h.session.Helo, h.session.Envelope.Sender
+	return nil
+}
+
+func TestSessionSetter(t *testing.T) {
+
+	handler := &setterHandler{}
+	c, done := dialServer(t, &Server{}, handler)
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO client.example.com")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if handler.helo != "client.example.com" || handler.sender != "sender@example.com" {
+		t.Fatalf("unexpected session %q %q", handler.helo, handler.sender)
+	}
+}
+
+func TestSessionID(t *testing.T) {
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		handler := &sessionHandler{}
+		c, done := dialServerContext(t, &Server{SessionIDInReply: true}, handler)
+		defer c.Close()
+
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		cmd(t, c, 250, "EHLO client.example.com")
+		cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+		cmd(t, c, 250, "RCPT TO:<one@example.com>")
+		cmd(t, c, 354, "DATA")
+		msg := cmd(t, c, 250, "Subject: test\r\n\r\nThis is a test.\r\n.")
+		cmd(t, c, 221, "QUIT")
+		if err := <-done; err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+
+		id := handler.session.ID
+		if len(id) != 16 {
+			t.Fatalf("unexpected session ID %q", id)
+		}
+		if expected := "2.0.0 OK " + id + " accepted"; msg != expected {
+			t.Fatalf("expected reply %q, got %q", expected, msg)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] == ids[1] {
+		t.Fatalf("expected distinct session IDs, got %v", ids)
+	}
+}
+
+func TestDebugLog(t *testing.T) {
+
+	var out bytes.Buffer
+	handler := &sessionHandler{}
+	c, done := dialServerContext(t, &Server{DebugLog: log.New(&out, "", 0)}, handler)
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO client.example.com")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<one@example.com>")
+	cmd(t, c, 354, "DATA")
+	cmd(t, c, 250, "Subject: test\r\n\r\nThis is a test.\r\n.")
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	id := handler.session.ID
+	for _, line := range []string{
+		id + ": -> EHLO client.example.com\n",
+		id + ": <- 250 2.0.0 OK\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Fatalf("%q not found in\n%s", line, out.String())
+		}
+	}
+}
+
+type readHandler struct {
+	testHandler
+}
+
+func (h readHandler) Message(reader io.Reader) error {
+	_, err := ioutil.ReadAll(reader)
+	return err
+}
+
+func TestMaxMessageSize(t *testing.T) {
+
+	server := &Server{
+		MaxMessageSize: 20,
+	}
+	c, done := dialServer(t, server, readHandler{})
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	msg := cmd(t, c, 250, "EHLO localhost")
+	if !strings.Contains(msg, "\nSIZE 20") {
+		t.Fatalf("SIZE not advertised: %s", msg)
+	}
+	cmd(t, c, 552, "MAIL FROM:<sender@example.com> SIZE=21")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com> SIZE=20")
+	cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis message is too large.\r\n.")
+	if _, _, err := c.ReadResponse(552); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	// transaction is still open
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: x\r\n\r\nHi\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// escape dots count with WireSize, the message has 20 bytes unstuffed
+	for _, wire := range []bool{false, true} {
+		c, done := dialServer(t, &Server{MaxMessageSize: 20, WireSize: wire}, readHandler{})
+		defer c.Close()
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		cmd(t, c, 250, "EHLO localhost")
+		cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+		cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+		cmd(t, c, 354, "DATA")
+		code := 250
+		if wire {
+			code = 552
+		}
+		cmd(t, c, code, "Subject: x\r\n\r\n..Hi!\r\n.")
+		cmd(t, c, 221, "QUIT")
+		if err := <-done; err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+}
+
+func TestSMTPUTF8(t *testing.T) {
+
+	handler := &sessionHandler{}
+	c, done := dialServerContext(t, &Server{}, handler)
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	msg := cmd(t, c, 250, "EHLO localhost")
+	if !strings.Contains(msg, "\nSMTPUTF8") {
+		t.Fatalf("SMTPUTF8 not advertised: %s", msg)
+	}
+	cmd(t, c, 553, "MAIL FROM:<josé@example.com>")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 553, "RCPT TO:<josé@example.com>")
+	cmd(t, c, 250, "RSET")
+	cmd(t, c, 250, "MAIL FROM:<josé@example.com> SMTPUTF8")
+	cmd(t, c, 553, "RCPT TO:<bad\xff@example.com>")
+	cmd(t, c, 250, "RCPT TO:<用户@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	env := handler.session.Envelope
+	if !env.SMTPUTF8 || env.Sender != "josé@example.com" || env.Recipients[0].Address != "用户@example.com" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+}
+
+type dataHandler struct {
+	testHandler
+	data []string
+	err  error
+}
+
+func (h *dataHandler) Message(reader io.Reader) error {
+	data, err := ioutil.ReadAll(reader)
+	h.data = append(h.data, string(data))
+	h.err = err
+	return err
+}
+
+func TestChunking(t *testing.T) {
+
+	handler := &dataHandler{}
+	c, done := dialServer(t, &Server{}, handler)
+	defer c.Close()
 
-	err := sendMail("127.0.0.1:10025", nil, "sender@example.com", []string{"recipient@example.com"}, testMessage)
-	if err != nil {
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	msg := cmd(t, c, 250, "EHLO localhost")
+	if !strings.Contains(msg, "\nCHUNKING") {
+		t.Fatalf("CHUNKING not advertised: %s", msg)
+	}
+
+	// chunks are passed as a single message
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+	// each chunk ends with the CRLF sent after the command
+	cmd(t, c, 250, "BDAT 15\r\nSubject: test")
+	cmd(t, c, 250, "BDAT 0")
+	cmd(t, c, 250, "BDAT 9 LAST\r\n\r\n.test")
+	if len(handler.data) != 1 || handler.data[0] != "Subject: test\r\n\r\n.test\r\n" {
+		t.Fatalf("unexpected message data %q", handler.data)
+	}
+
+	// chunk after last
+	cmd(t, c, 503, "BDAT 6 LAST\r\ntest")
+
+	// binary data is not unstuffed
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com> BODY=BINARYMIME")
+	cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+	cmd(t, c, 503, "DATA")
+	cmd(t, c, 250, "BDAT 7 LAST\r\n\x00\r\n.\xff")
+	if len(handler.data) != 2 || handler.data[1] != "\x00\r\n.\xff\r\n" {
+		t.Fatalf("unexpected message data %q", handler.data)
+	}
+
+	// aborted transfer
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+	cmd(t, c, 250, "BDAT 6\r\ntest")
+	cmd(t, c, 250, "RSET")
+	if handler.err != errBDATAborted {
+		t.Fatalf("expected aborted transfer, got %v", handler.err)
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
 		t.Fatalf("%s", err.Error())
 	}
 }
 
-func TestSendMailWithPlainAuth(t *testing.T) {
+func TestDisabledExtensions(t *testing.T) {
 
-	Debug = true
+	server := &Server{DisabledExtensions: []string{"chunking", "DSN", "SIZE"}}
+	c, done := dialServer(t, server, &dataHandler{})
+	defer c.Close()
 
-	// openssl genrsa 2048 > test/key.pem
-	// openssl req -x509 -new -key key.pem > test/cert.pem
-	//
-	// Country Name (2 letter code) [AU]:.
-	// State or Province Name (full name) [Some-State]:.
-	// Locality Name (eg, city) []:
-	// Organization Name (eg, company) [Internet Widgits Pty Ltd]:.
-	// Organizational Unit Name (eg, section) []:
-	// Common Name (e.g. server FQDN or YOUR name) []:127.0.0.1
-	// Email Address []:
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	msg := cmd(t, c, 250, "EHLO localhost")
+	for _, ext := range []string{"CHUNKING", "BINARYMIME", "DSN", "SIZE"} {
+		if strings.Contains(msg, "\n"+ext) {
+			t.Fatalf("%s advertised: %s", ext, msg)
+		}
+	}
+	if msg := cmd(t, c, 214, "HELP"); strings.Contains(msg, "BDAT") {
+		t.Fatalf("BDAT listed: %s", msg)
+	}
 
-	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
-	if err != nil {
+	cmd(t, c, 555, "MAIL FROM:<sender@example.com> SIZE=100")
+	cmd(t, c, 555, "MAIL FROM:<sender@example.com> BODY=BINARYMIME")
+	cmd(t, c, 555, "MAIL FROM:<sender@example.com> RET=HDRS")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com> BODY=8BITMIME")
+	cmd(t, c, 555, "RCPT TO:<recipient@example.com> NOTIFY=NEVER")
+	cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+	// the chunk is consumed and the transaction is aborted
+	cmd(t, c, 502, "BDAT 6 LAST\r\nQUIT")
+	cmd(t, c, 503, "DATA")
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
+
+// countingConn counts the writes to a connection
+type countingConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestPipelining(t *testing.T) {
+
+	server := &Server{
+		Pipelining: true,
+	}
+	var counting *countingConn
+	c, done := dialSession(t, func(conn net.Conn) error {
+		counting = &countingConn{Conn: conn}
+		return server.ServeSMTP(counting, testHandler{})
+	})
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
 		t.Fatalf("%s", err.Error())
 	}
+	cmd(t, c, 250, "EHLO localhost")
+	writes := atomic.LoadInt32(&counting.writes)
 
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		//ClientAuth:   tls.VerifyClientCertIfGiven,
-		//ServerName:   "localhost",
+	// send a batch of commands in a single write
+	c.W.WriteString("MAIL FROM:<sender@example.com>\r\n" +
+		"RCPT TO:<one@example.com>\r\n" +
+		"RCPT TO:<two@example.com>\r\n" +
+		"DATA\r\n")
+	c.W.Flush()
+	for _, code := range []int{250, 250, 250, 354} {
+		if _, _, err := c.ReadResponse(code); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+	if n := atomic.LoadInt32(&counting.writes) - writes; n != 1 {
+		t.Fatalf("expected replies in a single write, got %d writes", n)
+	}
+
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
 	}
+}
+
+func TestMTPriority(t *testing.T) {
 
 	server := &Server{
-		TLSConfig: tlsConfig,
+		MTPriority:        true,
+		MTPriorityPolicy:  "MIXER",
+		MaxUnauthPriority: 3,
+	}
+	handler := &sessionHandler{}
+	c, done := dialServerContext(t, server, handler)
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	msg := cmd(t, c, 250, "EHLO localhost")
+	if !strings.Contains(msg, "\nMT-PRIORITY MIXER") {
+		t.Fatalf("MT-PRIORITY not advertised: %s", msg)
 	}
+	cmd(t, c, 501, "MAIL FROM:<sender@example.com> MT-PRIORITY=10")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com> MT-PRIORITY=6")
+	cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if p := handler.session.Envelope.Priority; p != 3 {
+		t.Fatalf("expected priority lowered to 3, got %d", p)
+	}
+
+	// parameters of extensions that are not enabled
+	c, done = dialServer(t, &Server{}, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	for _, param := range []string{"MT-PRIORITY=1", "BY=120;R", "HOLDFOR=60", "HOLDUNTIL=2030-01-01T00:00:00Z"} {
+		cmd(t, c, 555, "MAIL FROM:<sender@example.com> %s", param)
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
 
-	runServer(t, server, testHandler{})
+func TestDeliverBy(t *testing.T) {
 
-	auth := smtp.PlainAuth("", "user@example.com", "password", "127.0.0.1")
-	err = sendMail("127.0.0.1:10025", auth, "sender@example.com", []string{"recipient@example.com"}, testMessage)
-	if err != nil {
+	server := &Server{
+		DeliverBy:    true,
+		MinDeliverBy: time.Hour,
+	}
+	handler := &sessionHandler{}
+	c, done := dialServerContext(t, server, handler)
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	msg := cmd(t, c, 250, "EHLO localhost")
+	if !strings.Contains(msg, "\nDELIVERBY 3600") {
+		t.Fatalf("DELIVERBY not advertised: %s", msg)
+	}
+	cmd(t, c, 501, "MAIL FROM:<sender@example.com> BY=3600")
+	cmd(t, c, 501, "MAIL FROM:<sender@example.com> BY=-60;R")
+	cmd(t, c, 553, "MAIL FROM:<sender@example.com> BY=60;R")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com> BY=7200;RT")
+	cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
 		t.Fatalf("%s", err.Error())
 	}
+	by := handler.session.Envelope.DeliverBy
+	if by == nil || by.Mode != "R" || !by.Trace || time.Until(by.Deadline) < time.Hour {
+		t.Fatalf("unexpected BY parameter %+v", by)
+	}
 }
 
-func TestSendMailWithCramMD5Auth(t *testing.T) {
+type verifyHandler struct {
+	testHandler
+}
+
+func (h verifyHandler) Verify(ctx context.Context, address string) (string, error) {
+	if address == "user@example.com" {
+		return "Some User <user@example.com>", nil
+	}
+	return "", NewReply(550, "5.1.1", "No such user")
+}
+
+func (h verifyHandler) Expand(ctx context.Context, list string) ([]string, error) {
+	if list == "staff" {
+		return []string{"One <one@example.com>", "two@example.com"}, nil
+	}
+	return nil, NewReply(550, "5.1.1", "No such list")
+}
 
-	Debug = true
+func TestVerify(t *testing.T) {
+
+	// default reply
+	c, done := dialServer(t, &Server{}, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 252, "VRFY user@example.com")
+	cmd(t, c, 502, "EXPN staff")
+	cmd(t, c, 221, "QUIT")
+	<-done
 
-	server := &Server{}
+	// handler
+	c, done = dialServer(t, &Server{}, verifyHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 501, "VRFY")
+	if msg := cmd(t, c, 250, "VRFY user@example.com"); msg != "2.1.5 Some User <user@example.com>" {
+		t.Fatalf("unexpected reply %q", msg)
+	}
+	cmd(t, c, 550, "VRFY <unknown@example.com>")
+	if msg := cmd(t, c, 250, "EXPN staff"); msg != "2.1.5 One <one@example.com>\n2.1.5 two@example.com" {
+		t.Fatalf("unexpected reply %q", msg)
+	}
+	cmd(t, c, 550, "EXPN unknown")
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
 
-	runServer(t, server, testHandler{})
+type noopHandler struct {
+	testHandler
+	count *int
+}
 
-	auth := smtp.CRAMMD5Auth("user@example.com", "password")
-	err := sendMail("127.0.0.1:10025", auth, "sender@example.com", []string{"recipient@example.com"}, testMessage)
-	if err != nil {
+func (h noopHandler) Noop(ctx context.Context) error {
+	*h.count++
+	return nil
+}
+
+func TestNoop(t *testing.T) {
+
+	count := 0
+	c, done := dialServer(t, &Server{}, noopHandler{count: &count})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "NOOP")
+	cmd(t, c, 250, "NOOP ignored argument")
+	cmd(t, c, 221, "QUIT")
+	<-done
+	if count != 2 {
+		t.Fatalf("Noop called %d times, expected 2", count)
+	}
+}
+
+type etrnHandler struct {
+	testHandler
+}
+
+func (h etrnHandler) FlushQueue(ctx context.Context, node string) error {
+	switch node {
+	case "example.com", "@example.com", "#queue":
+		return nil
+	case "empty.example.com":
+		return NewReply(251, "2.0.0", "No messages waiting for node empty.example.com")
+	}
+	return NewReply(459, "4.0.0", "Node "+node+" not allowed")
+}
+
+func TestETRN(t *testing.T) {
+
+	c, done := dialServer(t, &Server{}, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 250, "EHLO localhost"); strings.Contains(msg, "ETRN") {
+		t.Fatalf("ETRN advertised without QueueFlusher")
+	}
+	cmd(t, c, 502, "ETRN example.com")
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	c, done = dialServer(t, &Server{}, etrnHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 250, "EHLO localhost"); !strings.Contains(msg, "ETRN") {
+		t.Fatalf("ETRN not advertised")
+	}
+	cmd(t, c, 501, "ETRN")
+	cmd(t, c, 501, "ETRN bad..example.com")
+	cmd(t, c, 250, "ETRN example.com")
+	cmd(t, c, 250, "ETRN @example.com")
+	cmd(t, c, 250, "ETRN #queue")
+	cmd(t, c, 251, "ETRN empty.example.com")
+	cmd(t, c, 459, "ETRN other.example.com")
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
+
+func TestXClient(t *testing.T) {
+
+	// untrusted
+	c, done := dialServer(t, &Server{}, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 250, "EHLO proxy.example.com"); strings.Contains(msg, "XCLIENT") {
+		t.Fatalf("XCLIENT advertised to untrusted client")
+	}
+	cmd(t, c, 550, "XCLIENT ADDR=192.0.2.1")
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	server := &Server{TrustedProxies: []*net.IPNet{loopback}}
+	handler := &sessionHandler{}
+	c, done = dialServerContext(t, server, handler)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 250, "EHLO proxy.example.com"); !strings.Contains(msg, "XCLIENT NAME ADDR") {
+		t.Fatalf("XCLIENT not advertised")
+	}
+	cmd(t, c, 501, "XCLIENT ADDR=bad")
+	cmd(t, c, 501, "XCLIENT FOO=bar")
+	cmd(t, c, 220, "XCLIENT NAME=client.example.com ADDR=IPV6:2001:db8::1 PORT=4321 HELO=client")
+	cmd(t, c, 220, "XCLIENT LOGIN=user PROTO=ESMTP")
+	cmd(t, c, 250, "EHLO proxy.example.com")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 503, "XCLIENT NAME=[UNAVAILABLE]")
+	cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	sess := handler.session
+	if sess.RemoteAddr.String() != "[2001:db8::1]:4321" || sess.RemoteHostname != "client.example.com" {
+		t.Fatalf("unexpected client %v %q", sess.RemoteAddr, sess.RemoteHostname)
+	}
+	if sess.Helo != "client" || sess.AuthUsername != "user" {
+		t.Fatalf("unexpected helo %q or login %q", sess.Helo, sess.AuthUsername)
+	}
+
+	// address not available
+	sources := sourceHandler{source: make(chan string, 2)}
+	c, done = dialServer(t, server, sources)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	<-sources.source
+	cmd(t, c, 220, "XCLIENT ADDR=[UNAVAILABLE] PORT=[UNAVAILABLE]")
+	if source := <-sources.source; source != "unknown" {
+		t.Fatalf("expected unknown source, got %q", source)
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
+
+func TestXForward(t *testing.T) {
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	server := &Server{TrustedProxies: []*net.IPNet{loopback}}
+	handler := &sessionHandler{}
+	c, done := dialServerContext(t, server, handler)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if msg := cmd(t, c, 250, "EHLO proxy.example.com"); !strings.Contains(msg, "XFORWARD NAME ADDR") {
+		t.Fatalf("XFORWARD not advertised")
+	}
+	cmd(t, c, 501, "XFORWARD SOURCE=ELSEWHERE")
+	cmd(t, c, 250, "XFORWARD NAME=client.example.com ADDR=192.0.2.1 PORT=4321")
+	cmd(t, c, 250, "XFORWARD HELO=client PROTO=esmtp IDENT=123+2B4 SOURCE=REMOTE")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 503, "XFORWARD NAME=[UNAVAILABLE]")
+	cmd(t, c, 250, "RCPT TO:<rcpt@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	expected := &ForwardedClient{
+		IP:     net.ParseIP("192.0.2.1"),
+		Port:   4321,
+		Name:   "client.example.com",
+		Helo:   "client",
+		Proto:  "ESMTP",
+		Ident:  "123+4",
+		Source: "REMOTE",
+	}
+	if !reflect.DeepEqual(handler.session.Forwarded, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, handler.session.Forwarded)
+	}
+	if handler.session.Helo != "proxy.example.com" {
+		t.Fatalf("unexpected helo %q", handler.session.Helo)
+	}
+}
+
+type lmtpHandler struct {
+	testHandler
+}
+
+func (h lmtpHandler) Message(reader io.Reader) error {
+	return RecipientErrors{nil, NewReply(552, "5.2.2", "Mailbox full")}
+}
+
+func TestLMTP(t *testing.T) {
+
+	c, done := dialServer(t, &Server{LMTP: true}, lmtpHandler{})
+	defer c.Close()
+	if _, msg, err := c.ReadResponse(220); err != nil || !strings.Contains(msg, " LMTP ") {
+		t.Fatalf("unexpected greeting %q %v", msg, err)
+	}
+	cmd(t, c, 500, "EHLO localhost")
+	cmd(t, c, 250, "LHLO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<one@example.com>")
+	cmd(t, c, 250, "RCPT TO:<two@example.com>")
+	cmd(t, c, 250, "RCPT TO:<three@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	for _, code := range []int{250, 552, 451} {
+		if _, _, err := c.ReadResponse(code); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+
+	// with BDAT
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<one@example.com>")
+	cmd(t, c, 250, "RCPT TO:<two@example.com>")
+	c.PrintfLine("BDAT 6 LAST\r\nTest")
+	for _, code := range []int{250, 552} {
+		if _, _, err := c.ReadResponse(code); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+
+	// per-recipient errors in SMTP mode
+	c, done = dialServer(t, &Server{}, lmtpHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 500, "LHLO localhost")
+	cmd(t, c, 250, "EHLO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<one@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	if _, _, err := c.ReadResponse(552); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
+
+func TestHelp(t *testing.T) {
+
+	server := &Server{HelpTopics: map[string]string{"MAIL": "MAIL FROM:<address>\nSee RFC 5321"}}
+	c, done := dialServer(t, server, verifyHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
 		t.Fatalf("%s", err.Error())
 	}
+	msg := cmd(t, c, 214, "HELP")
+	if !strings.Contains(msg, " EXPN ") || strings.Contains(msg, "STARTTLS") {
+		t.Fatalf("unexpected reply %q", msg)
+	}
+	if msg := cmd(t, c, 214, "HELP mail"); msg != "2.0.0 MAIL FROM:<address>\n2.0.0 See RFC 5321" {
+		t.Fatalf("unexpected reply %q", msg)
+	}
+	cmd(t, c, 504, "HELP FOO")
+	cmd(t, c, 221, "QUIT")
+	<-done
 }
 
-func runServer(t *testing.T, server *Server, handler Handler) {
+// runServer runs a single session on port 10025, the channel receives the
+// result of ServeSMTP
+func runServer(t *testing.T, server *Server, handler Handler) <-chan error {
 
 	listener, err := net.Listen("tcp", "127.0.0.1:10025")
 	if err != nil {
 		t.Fatalf("%s", err.Error())
 	}
 
+	done := make(chan error, 1)
 	go func() {
 		defer listener.Close()
 
 		conn, err := listener.Accept()
 		if err != nil {
-			t.Fatalf("%s", err.Error())
+			done <- err
+			return
 		}
 
-		err = server.ServeSMTP(conn, handler)
+		done <- server.ServeSMTP(conn, handler)
+	}()
+	return done
+}
+
+// dialServer runs a single session on a loopback connection and returns the
+// client side of the connection. The channel receives the result of ServeSMTP.
+func dialServer(t *testing.T, server *Server, handler Handler) (*textproto.Conn, <-chan error) {
+	return dialSession(t, func(conn net.Conn) error {
+		return server.ServeSMTP(conn, handler)
+	})
+}
+
+// dialServerTLS is like dialServer for a server with ImplicitTLS, config is
+// the TLS configuration of the client
+func dialServerTLS(t *testing.T, server *Server, handler Handler, config *tls.Config) (*textproto.Conn, <-chan error) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer listener.Close()
+
+		conn, err := listener.Accept()
 		if err != nil {
-			t.Fatalf("%s", err.Error())
+			done <- err
+			return
+		}
+		defer conn.Close()
+
+		done <- server.ServeSMTP(conn, handler)
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	return textproto.NewConn(conn), done
+}
+
+// dialServerContext is like dialServer for a ContextHandler
+func dialServerContext(t *testing.T, server *Server, handler ContextHandler) (*textproto.Conn, <-chan error) {
+	return dialSession(t, func(conn net.Conn) error {
+		return server.ServeSMTPContext(context.Background(), conn, handler)
+	})
+}
+
+// dialSession runs serve for a single loopback connection and returns the
+// client side of the connection
+func dialSession(t *testing.T, serve func(conn net.Conn) error) (*textproto.Conn, <-chan error) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer listener.Close()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
 		}
+		defer conn.Close()
+
+		done <- serve(conn)
 	}()
-	// close listener to abort
+
+	client, err := textproto.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	return client, done
+}
+
+// cmd sends a command and checks the reply status code
+func cmd(t *testing.T, c *textproto.Conn, code int, format string, args ...interface{}) string {
+	t.Helper()
+	id, err := c.Cmd(format, args...)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+	_, msg, err := c.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("%s: %s", fmt.Sprintf(format, args...), err.Error())
+	}
+	return msg
 }
 
 // sendMail does the same as smtp.SendMail, but without verifying TLS certificate
@@ -183,4 +2389,3 @@ func sendMail(addr string, a smtp.Auth, from string, to []string, msg []byte) er
 	// => tls: received record with version 3231 when expecting version 303
 	return nil
 }
-
@@ -0,0 +1,180 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// Session holds information about an SMTP session for use by the handler.
+// The Session of a connection can be retrieved with SessionFromContext from
+// the context passed to the ContextHandler members. It is updated by the
+// server as the session progresses and must not be modified by the handler.
+type Session struct {
+	// Random identifier of the session assigned at connect, included in
+	// the debug log, e.g. to correlate the logs with reports of clients
+	ID string
+
+	// RemoteAddr and LocalAddr of the connection, or of the original client
+	// connection as given by a trusted proxy. The IP of RemoteAddr is nil
+	// when XCLIENT gives the address as unavailable.
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+
+	// Credentials of the client process connected to a unix socket, nil for
+	// other connections or when not supported by the platform
+	PeerCred *PeerCred
+
+	// PROXY protocol header received before the session, nil unless
+	// Server.ProxyProtocol is set
+	Proxy *ProxyHeader
+
+	// Hostname of the client as forwarded by a trusted proxy with XCLIENT,
+	// empty when not known
+	RemoteHostname string
+
+	// Hostname given with the accepted HELO/EHLO command
+	Helo string
+
+	// State of the TLS connection, nil when TLS is not used
+	TLS *tls.ConnectionState
+
+	// Authorization identity and username after successful AUTH, for
+	// example for relay decisions in later handler calls. The identity is
+	// empty unless it was provided by the client.
+	AuthIdentity string
+	AuthUsername string
+
+	// Blocklists of Server.DNSBL that list the client IP address, and
+	// whether the listings are sufficient to block the client
+	DNSBLListed  []string
+	DNSBLBlocked bool
+
+	// Set when the client is in Server.RelayNetworks and is always allowed
+	// to relay
+	Relay bool
+
+	// Envelope of the current mail transaction
+	Envelope Envelope
+
+	// Attributes of the original client forwarded by a trusted proxy with
+	// XFORWARD for the current mail transaction, nil when not forwarded
+	Forwarded *ForwardedClient
+
+	rdns     *rdnsLookup // reverse DNS lookup of the client, see RDNS
+	extended bool        // greeted with EHLO or LHLO
+	lmtp     bool        // served with Server.LMTP
+}
+
+// ForwardedClient holds the attributes of the original client given with
+// XFORWARD. Attributes that were not given or are unavailable are empty.
+type ForwardedClient struct {
+	IP    net.IP
+	Port  int
+	Name  string // hostname of the client
+	Helo  string // hostname given with HELO/EHLO
+	Proto string // "SMTP" or "ESMTP", or another protocol name
+	Ident string // identifier of the transaction assigned by the proxy
+	// Source is "LOCAL" when the message was submitted locally, or "REMOTE"
+	Source string
+}
+
+// Envelope holds the sender and recipients of a mail transaction.
+type Envelope struct {
+	// Sender address given with the accepted MAIL FROM command, empty for a
+	// null reverse-path
+	Sender string `json:"sender"`
+
+	// Recipients given with accepted RCPT TO commands. During a call to
+	// Handler.Recipient the last element is the recipient being checked.
+	Recipients []Recipient `json:"recipients"`
+
+	// Message size declared with the SIZE parameter of MAIL FROM, zero when
+	// not declared
+	Size int64 `json:"size,omitempty"`
+
+	// Body type declared with the BODY parameter of MAIL FROM, empty when not
+	// declared
+	Body BodyType `json:"body,omitempty"`
+
+	// Set when the client requested SMTPUTF8 with MAIL FROM, the envelope
+	// addresses and message headers may contain UTF-8 and the message must
+	// be relayed using SMTPUTF8
+	SMTPUTF8 bool `json:"smtputf8,omitempty"`
+
+	// DSN parameters of MAIL FROM (RFC 3461). Ret is "FULL" or "HDRS", or
+	// empty when not given. EnvID is the decoded envelope identifier.
+	Ret   string `json:"ret,omitempty"`
+	EnvID string `json:"envid,omitempty"`
+
+	// Priority given with the MT-PRIORITY parameter of MAIL FROM (RFC 6710),
+	// from -9 to 9 with 0 as the default. Priorities from clients that are
+	// not authenticated are limited to Server.MaxUnauthPriority.
+	Priority int `json:"priority,omitempty"`
+
+	// Mailbox of the original submitter given with the AUTH parameter of
+	// MAIL FROM (RFC 4954), "<>" when the submitter is unknown. Empty when
+	// not given or when the client did not authenticate.
+	Auth string `json:"auth,omitempty"`
+
+	// Delivery deadline given with the BY parameter of MAIL FROM, nil when
+	// not given
+	DeliverBy *DeliverBy `json:"deliver_by,omitempty"`
+
+	// Time until which delivery should be postponed as requested with the
+	// HOLDFOR or HOLDUNTIL parameter of MAIL FROM, nil when not requested
+	HoldUntil *time.Time `json:"hold_until,omitempty"`
+}
+
+// DeliverBy holds the BY parameter of MAIL FROM (RFC 2852).
+type DeliverBy struct {
+	// Time by which the message should be delivered
+	Deadline time.Time `json:"deadline"`
+
+	// Mode is "R" to return the message when it cannot be delivered before
+	// the deadline, or "N" to only notify the sender
+	Mode string `json:"mode"`
+
+	// Trace is set to request a delivery status notification for each relay
+	Trace bool `json:"trace,omitempty"`
+}
+
+// Recipient holds a recipient address and its parameters.
+type Recipient struct {
+	Address string `json:"address"`
+
+	// DSN parameters of RCPT TO (RFC 3461). Notify contains "NEVER" or any
+	// of "SUCCESS", "FAILURE" and "DELAY", or is nil when not given. ORcpt
+	// is the decoded original recipient address of type ORcptType, usually
+	// "rfc822".
+	Notify    []string `json:"notify,omitempty"`
+	ORcptType string   `json:"orcpt_type,omitempty"`
+	ORcpt     string   `json:"orcpt,omitempty"`
+}
+
+// BodyType is the body type of a message declared by the client.
+type BodyType string
+
+const (
+	Body7Bit       BodyType = "7BIT"
+	Body8BitMIME   BodyType = "8BITMIME"   // RFC 6152
+	BodyBinaryMIME BodyType = "BINARYMIME" // RFC 3030, requires BDAT
+)
+
+type sessionKey struct{}
+
+// SessionSetter can optionally be implemented by a Handler to access the
+// Session, as its members get no context for SessionFromContext. SetSession
+// is called before Connect. The Session is updated while the session runs,
+// and must not be used by other goroutines or after the session ended.
+type SessionSetter interface {
+	SetSession(sess *Session)
+}
+
+// SessionFromContext returns the Session associated with a context passed to
+// a ContextHandler member, or nil.
+func SessionFromContext(ctx context.Context) *Session {
+	sess, _ := ctx.Value(sessionKey{}).(*Session)
+	return sess
+}
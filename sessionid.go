@@ -0,0 +1,30 @@
+package smtpd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// newSessionID returns a random identifier for a session, Server.Rand is
+// left to the challenges of authentication
+func (s *Server) newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logf writes debug output of the session preceded with the session ID
+func (s *session) logf(format string, args ...interface{}) {
+	if l := s.server.debugLog(); l != nil {
+		l.Printf("%s: "+format, append([]interface{}{s.ID}, args...)...)
+	}
+}
+
+// acceptedReply returns the text of the reply to accepted message data,
+// with the session ID if Server.SessionIDInReply is set
+func (s *session) acceptedReply() string {
+	if s.server.SessionIDInReply {
+		return "OK " + s.ID + " accepted"
+	}
+	return "OK"
+}
@@ -0,0 +1,226 @@
+/*
+Package spamd scores messages with SpamAssassin's spamd over the SPAMC/1.5
+protocol, so a handler can reject or tag spam during the DATA phase without
+running spamc.
+
+A Client sends a message with the SYMBOLS command and returns whether spamd
+considers it spam, the score and the names of the matched rules. Messages
+larger than MaxSize are not scanned, like spamc does.
+*/
+package spamd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrSpam can be returned by a handler to reject a message as spam.
+var ErrSpam = errors.New("550 5.7.1 Message rejected as spam")
+
+// Result is the result of scanning a message.
+type Result struct {
+	Spam      bool
+	Score     float64
+	Threshold float64
+	Symbols   []string // names of the matched rules
+	Skipped   bool     // the message was larger than Client.MaxSize
+}
+
+// Header returns an X-Spam-Status header field with the result, including
+// CRLF, for tagging the message.
+func (r *Result) Header() string {
+	status := "No"
+	if r.Spam {
+		status = "Yes"
+	}
+	if r.Skipped {
+		return "X-Spam-Status: " + status + ", skipped\r\n"
+	}
+	return fmt.Sprintf("X-Spam-Status: %s, score=%.1f required=%.1f tests=%s\r\n",
+		status, r.Score, r.Threshold, strings.Join(r.Symbols, ","))
+}
+
+// Client is a spamd client. A Client can be shared by sessions, each check
+// uses a new connection.
+type Client struct {
+	// Network and address of spamd, "tcp" and "localhost:783" if empty.
+	// The network can be "unix" with the path of a socket as address.
+	Network string
+	Address string
+
+	// User whose preferences spamd applies, if set
+	User string
+
+	// Maximum size of scanned messages, 512 KiB if zero
+	MaxSize int
+
+	// Maximum time to connect and scan a message, 30 seconds if zero
+	Timeout time.Duration
+
+	// Dial connects to spamd, defaults to net.Dialer.DialContext
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Check scans a message, msg is the complete message with CRLF line endings.
+func (c *Client) Check(ctx context.Context, msg []byte) (*Result, error) {
+	maxSize := c.MaxSize
+	if maxSize <= 0 {
+		maxSize = 512 << 10
+	}
+	if len(msg) > maxSize {
+		return &Result{Skipped: true}, nil
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	network, address := c.Network, c.Address
+	if network == "" {
+		network = "tcp"
+	}
+	if address == "" {
+		address = "localhost:783"
+	}
+	dial := c.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("spamd: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "SYMBOLS SPAMC/1.5\r\nContent-length: %d\r\n", len(msg))
+	if c.User != "" {
+		fmt.Fprintf(w, "User: %s\r\n", c.User)
+	}
+	w.WriteString("\r\n")
+	w.Write(msg)
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("spamd: %v", err)
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	result, err := readResponse(bufio.NewReader(conn))
+	if err != nil {
+		return nil, fmt.Errorf("spamd: %v", err)
+	}
+	return result, nil
+}
+
+// readResponse reads the response to a SYMBOLS request
+func readResponse(r *bufio.Reader) (*Result, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	// SPAMD/1.1 0 EX_OK
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "SPAMD/") {
+		return nil, fmt.Errorf("invalid response %q", line)
+	}
+	if fields[1] != "0" {
+		return nil, fmt.Errorf("error response %q", line)
+	}
+
+	result := &Result{}
+	hasSpam := false
+	length := -1
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid header %q", line)
+		}
+		value := strings.TrimSpace(line[i+1:])
+		switch strings.ToLower(line[:i]) {
+		case "content-length":
+			if length, err = strconv.Atoi(value); err != nil || length < 0 {
+				return nil, fmt.Errorf("invalid header %q", line)
+			}
+		case "spam":
+			// True ; 15.0 / 5.0
+			if err := parseSpam(value, result); err != nil {
+				return nil, fmt.Errorf("invalid header %q", line)
+			}
+			hasSpam = true
+		}
+	}
+	if !hasSpam {
+		return nil, errors.New("missing Spam header")
+	}
+
+	var body []byte
+	if length >= 0 {
+		body = make([]byte, length)
+		_, err = io.ReadFull(r, body)
+	} else {
+		body, err = ioutil.ReadAll(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, symbol := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		if symbol = strings.TrimSpace(symbol); symbol != "" {
+			result.Symbols = append(result.Symbols, symbol)
+		}
+	}
+	return result, nil
+}
+
+// parseSpam parses the value of a Spam header like "True ; 15.0 / 5.0"
+func parseSpam(value string, result *Result) error {
+	i := strings.IndexByte(value, ';')
+	j := strings.IndexByte(value, '/')
+	if i < 0 || j < i {
+		return errors.New("invalid value")
+	}
+	switch strings.ToLower(strings.TrimSpace(value[:i])) {
+	case "true", "yes":
+		result.Spam = true
+	case "false", "no":
+	default:
+		return errors.New("invalid value")
+	}
+	var err error
+	if result.Score, err = strconv.ParseFloat(strings.TrimSpace(value[i+1:j]), 64); err != nil {
+		return err
+	}
+	result.Threshold, err = strconv.ParseFloat(strings.TrimSpace(value[j+1:]), 64)
+	return err
+}
+
+// readLine reads a line without CRLF
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
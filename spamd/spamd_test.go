@@ -0,0 +1,95 @@
+package spamd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serveSpamd answers one request on l with response, and returns the
+// received request line, headers and message
+func serveSpamd(t *testing.T, l net.Listener, response string) <-chan string {
+	ch := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			ch <- err.Error()
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var request strings.Builder
+		length := 0
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				ch <- err.Error()
+				return
+			}
+			request.WriteString(line)
+			if line == "\r\n" {
+				break
+			}
+			if strings.HasPrefix(line, "Content-length: ") {
+				length, _ = strconv.Atoi(strings.TrimSpace(line[16:]))
+			}
+		}
+		msg := make([]byte, length)
+		io.ReadFull(r, msg)
+		request.Write(msg)
+		io.WriteString(conn, response)
+		ch <- request.String()
+	}()
+	return ch
+}
+
+func TestCheck(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer l.Close()
+	c := &Client{Address: l.Addr().String(), User: "alice", MaxSize: 100}
+	const msg = "Subject: test\r\n\r\nBuy now!\r\n"
+	ctx := context.Background()
+
+	const symbols = "BAYES_99,HTML_MESSAGE"
+	requests := serveSpamd(t, l, fmt.Sprintf("SPAMD/1.1 0 EX_OK\r\nContent-length: %d\r\nSpam: True ; 15.2 / 5.0\r\n\r\n%s\r\n", len(symbols)+2, symbols))
+	result, err := c.Check(ctx, []byte(msg))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if request := <-requests; request != "SYMBOLS SPAMC/1.5\r\nContent-length: 27\r\nUser: alice\r\n\r\n"+msg {
+		t.Fatalf("unexpected request %q", request)
+	}
+	if !result.Spam || result.Score != 15.2 || result.Threshold != 5 || len(result.Symbols) != 2 || result.Symbols[1] != "HTML_MESSAGE" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if h := result.Header(); h != "X-Spam-Status: Yes, score=15.2 required=5.0 tests=BAYES_99,HTML_MESSAGE\r\n" {
+		t.Fatalf("unexpected header %q", h)
+	}
+
+	requests = serveSpamd(t, l, "SPAMD/1.1 0 EX_OK\r\nSpam: False ; -0.5 / 5.0\r\n\r\n")
+	if result, err = c.Check(ctx, []byte(msg)); err != nil || result.Spam || result.Score != -0.5 || len(result.Symbols) != 0 {
+		t.Fatalf("unexpected result %+v %v", result, err)
+	}
+	<-requests
+
+	requests = serveSpamd(t, l, "SPAMD/1.0 76 Bad header line: (Content-Length mismatch)\r\n")
+	if _, err = c.Check(ctx, []byte(msg)); err == nil {
+		t.Fatalf("expected error")
+	}
+	<-requests
+
+	// too large messages are not scanned
+	result, err = c.Check(ctx, []byte(msg+strings.Repeat("x", 100)))
+	if err != nil || !result.Skipped {
+		t.Fatalf("unexpected result %+v %v", result, err)
+	}
+}
@@ -0,0 +1,176 @@
+package spf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidMacro = errors.New("invalid macro")
+
+// expand expands the macros of a domain-spec, or of an explanation string
+// when exp is set (RFC 7208 section 7)
+func (e *evaluator) expand(s, domain string, exp bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", errInvalidMacro
+		}
+		i++
+		switch s[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			j := strings.IndexByte(s[i:], '}')
+			if j == -1 {
+				return "", errInvalidMacro
+			}
+			value, err := e.macro(s[i+1:i+j], domain, exp)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += j
+		default:
+			return "", errInvalidMacro
+		}
+	}
+	result := b.String()
+	if !exp {
+		// truncate to 253 characters by removing leftmost labels
+		for len(result) > 253 {
+			i := strings.IndexByte(result, '.')
+			if i == -1 {
+				return "", errInvalidMacro
+			}
+			result = result[i+1:]
+		}
+	}
+	return result, nil
+}
+
+// macro expands a macro-letter with its transformers and delimiters
+func (e *evaluator) macro(m, domain string, exp bool) (string, error) {
+	if m == "" {
+		return "", errInvalidMacro
+	}
+	letter := m[0]
+	escape := letter >= 'A' && letter <= 'Z'
+	if escape {
+		letter += 'a' - 'A'
+	}
+
+	sender := e.o.Sender
+	at := strings.LastIndexByte(sender, '@')
+	var value string
+	switch letter {
+	case 's':
+		value = sender
+	case 'l':
+		value = sender[:at]
+	case 'o':
+		value = sender[at+1:]
+	case 'd':
+		value = domain
+	case 'i':
+		value = dottedIP(e.o.IP)
+	case 'p':
+		value = "unknown" // validation is expensive and discouraged
+	case 'v':
+		if e.o.IP.To4() != nil {
+			value = "in-addr"
+		} else {
+			value = "ip6"
+		}
+	case 'h':
+		value = e.o.Helo
+	case 'c', 'r', 't':
+		if !exp {
+			return "", errInvalidMacro
+		}
+		switch letter {
+		case 'c':
+			value = e.o.IP.String()
+		case 'r':
+			value = e.o.Receiver
+		case 't':
+			value = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+	default:
+		return "", errInvalidMacro
+	}
+
+	// transformers: digits and "r", then delimiters
+	rest := m[1:]
+	digits := 0
+	for len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+		digits = digits*10 + int(rest[0]-'0')
+		rest = rest[1:]
+		if digits > 128 {
+			return "", errInvalidMacro
+		}
+	}
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse = true
+		rest = rest[1:]
+	}
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", errInvalidMacro
+		}
+		delimiters = rest
+	}
+	if len(m) > 1 && m[1] == '0' {
+		return "", errInvalidMacro
+	}
+
+	if digits > 0 || reverse || delimiters != "." {
+		parts := strings.FieldsFunc(value, func(r rune) bool {
+			return strings.ContainsRune(delimiters, r)
+		})
+		if reverse {
+			for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+				parts[i], parts[j] = parts[j], parts[i]
+			}
+		}
+		if digits > 0 && digits < len(parts) {
+			parts = parts[len(parts)-digits:]
+		}
+		value = strings.Join(parts, ".")
+	}
+	if escape {
+		value = strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+	}
+	return value, nil
+}
+
+// dottedIP returns the IP address for the "i" macro, with the nibbles of an
+// IPv6 address separated by dots
+func dottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	var b strings.Builder
+	for i, x := range ip.To16() {
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		fmt.Fprintf(&b, "%x.%x", x>>4, x&0xf)
+	}
+	return b.String()
+}
@@ -0,0 +1,631 @@
+/*
+Package spf evaluates the Sender Policy Framework (RFC 7208) for the client
+of an SMTP session.
+
+A Checker evaluates the MAIL FROM identity, or the HELO identity for a null
+sender, and returns an Outcome with the result and the value of the
+Received-SPF header. Verify also returns an error that a handler can return
+from Sender to refuse the sender when the result is one of Checker.Reject.
+
+	func (h *handler) Sender(ctx context.Context, address string) error {
+		outcome, err := h.spf.Verify(ctx, smtpd.SessionFromContext(ctx))
+		h.receivedSPF = outcome.ReceivedSPF()
+		return err
+	}
+*/
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+)
+
+// Result is the result of an SPF evaluation.
+type Result string
+
+// Results defined by RFC 7208 section 2.6
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Limits of RFC 7208 section 4.6.4
+const (
+	maxLookups     = 10 // terms that cause DNS lookups
+	maxVoidLookups = 2  // lookups without records
+	maxNames       = 10 // MX or PTR names
+)
+
+// Resolver performs the DNS lookups of a Checker. It is implemented by
+// *net.Resolver and smtpd.Resolver.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Checker evaluates SPF policies. A Checker can be shared by sessions.
+type Checker struct {
+	// Resolver for DNS lookups, defaults to net.DefaultResolver
+	Resolver Resolver
+
+	// Hostname of the receiving server for the Received-SPF header and
+	// explanations, defaults to "localhost"
+	Hostname string
+
+	// Results for which Verify returns an error to refuse the sender, for
+	// example Fail, SoftFail and TempError
+	Reject []Result
+
+	// Maximum time for the evaluation, 20 seconds if zero
+	Timeout time.Duration
+}
+
+// Outcome is the outcome of an SPF evaluation.
+type Outcome struct {
+	Result   Result
+	Identity string // "mailfrom" or "helo"
+	IP       net.IP
+	Sender   string // MAIL FROM address, or postmaster@ the HELO name
+	Helo     string
+	Receiver string
+
+	// Explanation of a fail result provided by the domain, if any
+	Explanation string
+
+	// Reason of a temperror or permerror
+	Err error
+}
+
+// Check evaluates the MAIL FROM identity of a session, or the HELO identity
+// when the sender is null. The result is None when there is no identity to
+// check.
+func (c *Checker) Check(ctx context.Context, sess *smtpd.Session) *Outcome {
+	var ip net.IP
+	switch addr := sess.RemoteAddr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		if addr != nil {
+			host, _, _ := net.SplitHostPort(addr.String())
+			ip = net.ParseIP(host)
+		}
+	}
+	return c.CheckHost(ctx, ip, sess.Envelope.Sender, sess.Helo)
+}
+
+// CheckHost evaluates the MAIL FROM identity sender, or the HELO identity
+// when the sender is empty, for the client IP address ip.
+func (c *Checker) CheckHost(ctx context.Context, ip net.IP, sender, helo string) *Outcome {
+	o := &Outcome{Result: None, Identity: "mailfrom", IP: ip, Sender: sender, Helo: helo, Receiver: c.receiver()}
+	if sender == "" {
+		o.Identity = "helo"
+		o.Sender = "postmaster@" + helo
+	}
+	if ip == nil {
+		return o
+	}
+	i := strings.LastIndexByte(o.Sender, '@')
+	domain := o.Sender[i+1:]
+	if i == 0 {
+		o.Sender = "postmaster" + o.Sender
+	} else if i == -1 {
+		o.Sender = "postmaster@" + o.Sender
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 20 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	e := &evaluator{ctx: ctx, r: c.resolver(), o: o}
+	o.Result, o.Err = e.checkHost(domain, 0)
+	return o
+}
+
+// Verify evaluates the session like Check, and returns an error to refuse
+// the sender when the result is one of c.Reject.
+func (c *Checker) Verify(ctx context.Context, sess *smtpd.Session) (*Outcome, error) {
+	o := c.Check(ctx, sess)
+	for _, result := range c.Reject {
+		if result == o.Result {
+			return o, o.error()
+		}
+	}
+	return o, nil
+}
+
+func (c *Checker) resolver() Resolver {
+	if c.Resolver != nil {
+		return c.Resolver
+	}
+	return net.DefaultResolver
+}
+
+func (c *Checker) receiver() string {
+	if c.Hostname != "" {
+		return c.Hostname
+	}
+	return "localhost"
+}
+
+// error returns the reply to refuse the sender for the outcome, with the
+// enhanced status codes of RFC 7372
+func (o *Outcome) error() error {
+	domain := o.Sender[strings.LastIndexByte(o.Sender, '@')+1:]
+	switch o.Result {
+	case TempError:
+		return fmt.Errorf("451 4.7.24 SPF validation error for %s", domain)
+	case PermError:
+		return fmt.Errorf("550 5.7.24 SPF validation error for %s", domain)
+	case Fail, SoftFail:
+		if o.Explanation != "" {
+			return fmt.Errorf("550 5.7.23 %s", o.Explanation)
+		}
+		return fmt.Errorf("550 5.7.23 SPF validation failed for %s", domain)
+	}
+	return fmt.Errorf("550 5.7.23 SPF result %s for %s", o.Result, domain)
+}
+
+// ReceivedSPF returns the value of the Received-SPF header for the outcome
+// (RFC 7208 section 9.1).
+func (o *Outcome) ReceivedSPF() string {
+	var comment string
+	switch o.Result {
+	case Pass:
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender", o.Sender, o.IP)
+	case Fail:
+		comment = fmt.Sprintf("domain of %s does not designate %s as permitted sender", o.Sender, o.IP)
+	case SoftFail:
+		comment = fmt.Sprintf("domain of transitioning %s does not designate %s as permitted sender", o.Sender, o.IP)
+	case Neutral:
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", o.IP, o.Sender)
+	case None:
+		comment = fmt.Sprintf("domain of %s does not provide an SPF record", o.Sender)
+	default:
+		comment = fmt.Sprintf("error in processing during lookup of %s", o.Sender)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (%s: %s)", o.Result, o.Receiver, comment)
+	fmt.Fprintf(&b, " client-ip=%s;", o.IP)
+	if o.Identity == "mailfrom" {
+		fmt.Fprintf(&b, " envelope-from=%q;", o.Sender)
+	}
+	if o.Helo != "" {
+		fmt.Fprintf(&b, " helo=%s;", o.Helo)
+	}
+	fmt.Fprintf(&b, " receiver=%s; identity=%s;", o.Receiver, o.Identity)
+	return b.String()
+}
+
+// errors that result in permerror
+var (
+	errTooManyLookups     = errors.New("too many DNS lookups")
+	errTooManyVoidLookups = errors.New("too many void DNS lookups")
+	errMultipleRecords    = errors.New("multiple SPF records")
+	errNoRecord           = errors.New("no SPF record")
+)
+
+// evaluator evaluates the check_host() function of RFC 7208 section 4
+type evaluator struct {
+	ctx     context.Context
+	r       Resolver
+	o       *Outcome
+	lookups int
+	voids   int
+}
+
+// tempError is a DNS error that results in temperror
+type tempError struct{ error }
+
+// checkHost evaluates the policy of domain
+func (e *evaluator) checkHost(domain string, depth int) (Result, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if !validDomain(domain) {
+		return None, nil
+	}
+	record, err := e.record(domain)
+	if err != nil {
+		return resultOf(err), err
+	}
+	if record == "" {
+		return None, nil
+	}
+	terms := strings.Fields(record)[1:]
+
+	// modifiers apply regardless of their position
+	var redirect, exp string
+	directives := terms[:0:0]
+	for _, term := range terms {
+		i := strings.IndexByte(term, '=')
+		if i <= 0 || !isName(term[:i]) {
+			directives = append(directives, term)
+			continue
+		}
+		switch strings.ToLower(term[:i]) {
+		case "redirect":
+			if redirect != "" {
+				return PermError, errors.New("multiple redirect modifiers")
+			}
+			redirect = term[i+1:]
+		case "exp":
+			if exp != "" {
+				return PermError, errors.New("multiple exp modifiers")
+			}
+			exp = term[i+1:]
+		}
+	}
+
+	for _, term := range directives {
+		result, match, err := e.directive(term, domain, depth)
+		if err != nil {
+			return resultOf(err), err
+		}
+		if match {
+			if result == Fail && exp != "" && depth == 0 {
+				e.o.Explanation = e.explanation(exp, domain)
+			}
+			return result, nil
+		}
+	}
+	if redirect != "" {
+		if err := e.count(); err != nil {
+			return PermError, err
+		}
+		target, err := e.expand(redirect, domain, false)
+		if err != nil {
+			return PermError, err
+		}
+		result, err := e.checkHost(target, depth+1)
+		if result == None {
+			return PermError, errNoRecord
+		}
+		return result, err
+	}
+	return Neutral, nil
+}
+
+// record returns the SPF record of domain, or an empty string
+func (e *evaluator) record(domain string) (string, error) {
+	txts, err := e.r.LookupTXT(e.ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", tempError{err}
+	}
+	var record string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || len(txt) > 7 && strings.EqualFold(txt[:7], "v=spf1 ") {
+			if record != "" {
+				return "", errMultipleRecords
+			}
+			record = txt
+		}
+	}
+	return record, nil
+}
+
+// directive evaluates a directive, it returns the result of the qualifier
+// when the mechanism matches
+func (e *evaluator) directive(term, domain string, depth int) (Result, bool, error) {
+	result := Pass
+	switch term[0] {
+	case '+':
+		term = term[1:]
+	case '-':
+		result, term = Fail, term[1:]
+	case '~':
+		result, term = SoftFail, term[1:]
+	case '?':
+		result, term = Neutral, term[1:]
+	}
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i != -1 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+
+	var match bool
+	var err error
+	switch name {
+	case "all":
+		if arg != "" {
+			return PermError, false, fmt.Errorf("invalid term %q", term)
+		}
+		match = true
+	case "include":
+		match, err = e.include(arg, domain, depth)
+	case "a", "mx":
+		match, err = e.addresses(name, arg, domain)
+	case "ptr":
+		match, err = e.ptr(arg, domain)
+	case "ip4", "ip6":
+		match, err = e.network(name, arg)
+	case "exists":
+		match, err = e.exists(arg, domain)
+	default:
+		return PermError, false, fmt.Errorf("unknown mechanism %q", term)
+	}
+	return result, match, err
+}
+
+// domainArg returns the domain-spec of ":domain" in arg, or domain when arg
+// does not start with a colon, and the remaining CIDR lengths
+func (e *evaluator) domainArg(arg, domain string, required bool) (string, string, error) {
+	if !strings.HasPrefix(arg, ":") {
+		if required {
+			return "", "", errors.New("missing domain-spec")
+		}
+		return domain, arg, nil
+	}
+	spec, cidr := arg[1:], ""
+	if i := strings.IndexByte(spec, '/'); i != -1 {
+		spec, cidr = spec[:i], spec[i:]
+	}
+	target, err := e.expand(spec, domain, false)
+	return target, cidr, err
+}
+
+func (e *evaluator) include(arg, domain string, depth int) (bool, error) {
+	if err := e.count(); err != nil {
+		return false, err
+	}
+	target, cidr, err := e.domainArg(arg, domain, true)
+	if err != nil || cidr != "" {
+		return false, errors.New("invalid include")
+	}
+	if depth >= maxLookups {
+		return false, errTooManyLookups
+	}
+	result, err := e.checkHost(target, depth+1)
+	switch result {
+	case Pass:
+		return true, nil
+	case TempError, PermError:
+		return false, err
+	case None:
+		return false, errNoRecord
+	}
+	return false, nil
+}
+
+// addresses evaluates the a and mx mechanisms
+func (e *evaluator) addresses(name, arg, domain string) (bool, error) {
+	if err := e.count(); err != nil {
+		return false, err
+	}
+	target, cidr, err := e.domainArg(arg, domain, false)
+	if err != nil {
+		return false, err
+	}
+	mask, err := parseDualCIDR(cidr, e.o.IP)
+	if err != nil {
+		return false, err
+	}
+	hosts := []string{target}
+	if name == "mx" {
+		mxs, err := e.r.LookupMX(e.ctx, target)
+		if err := e.lookupError(err, len(mxs)); err != nil {
+			return false, err
+		}
+		if len(mxs) > maxNames {
+			return false, errTooManyLookups
+		}
+		hosts = hosts[:0]
+		for _, mx := range mxs {
+			hosts = append(hosts, mx.Host)
+		}
+	}
+	for _, host := range hosts {
+		addrs, err := e.r.LookupIPAddr(e.ctx, host)
+		if err := e.lookupError(err, len(addrs)); err != nil {
+			return false, err
+		}
+		for _, addr := range addrs {
+			if sameFamily(addr.IP, e.o.IP) && addr.IP.Mask(mask).Equal(e.o.IP.Mask(mask)) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// ptr evaluates the deprecated ptr mechanism
+func (e *evaluator) ptr(arg, domain string) (bool, error) {
+	if err := e.count(); err != nil {
+		return false, err
+	}
+	target, cidr, err := e.domainArg(arg, domain, false)
+	if err != nil || cidr != "" {
+		return false, errors.New("invalid ptr")
+	}
+	names, err := e.r.LookupAddr(e.ctx, e.o.IP.String())
+	if err != nil {
+		// failed PTR lookups do not cause errors, section 5.5
+		return false, nil
+	}
+	if len(names) > maxNames {
+		names = names[:maxNames]
+	}
+	target = strings.ToLower(target)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+		addrs, err := e.r.LookupIPAddr(e.ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(e.o.IP) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// network evaluates the ip4 and ip6 mechanisms
+func (e *evaluator) network(name, arg string) (bool, error) {
+	if !strings.HasPrefix(arg, ":") {
+		return false, fmt.Errorf("invalid %s", name)
+	}
+	value := arg[1:]
+	if !strings.Contains(value, "/") {
+		if name == "ip4" {
+			value += "/32"
+		} else {
+			value += "/128"
+		}
+	}
+	ip, network, err := net.ParseCIDR(value)
+	if err != nil || (ip.To4() != nil) != (name == "ip4") {
+		return false, fmt.Errorf("invalid %s %q", name, arg[1:])
+	}
+	return sameFamily(ip, e.o.IP) && network.Contains(e.o.IP), nil
+}
+
+func (e *evaluator) exists(arg, domain string) (bool, error) {
+	if err := e.count(); err != nil {
+		return false, err
+	}
+	target, _, err := e.domainArg(arg, domain, true)
+	if err != nil {
+		return false, err
+	}
+	addrs, err := e.r.LookupIPAddr(e.ctx, target)
+	if err := e.lookupError(err, len(addrs)); err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// explanation returns the expanded explanation string of the exp modifier
+func (e *evaluator) explanation(exp, domain string) string {
+	target, err := e.expand(exp, domain, false)
+	if err != nil {
+		return ""
+	}
+	txts, err := e.r.LookupTXT(e.ctx, target)
+	if err != nil || len(txts) != 1 {
+		return ""
+	}
+	text, err := e.expand(txts[0], domain, true)
+	if err != nil {
+		return ""
+	}
+	return text
+}
+
+// count counts a term that causes DNS lookups
+func (e *evaluator) count() error {
+	e.lookups++
+	if e.lookups > maxLookups {
+		return errTooManyLookups
+	}
+	return nil
+}
+
+// lookupError returns the error of a lookup of a mechanism, and counts
+// lookups without records
+func (e *evaluator) lookupError(err error, n int) error {
+	if err != nil && !isNotFound(err) {
+		return tempError{err}
+	}
+	if err != nil || n == 0 {
+		e.voids++
+		if e.voids > maxVoidLookups {
+			return errTooManyVoidLookups
+		}
+	}
+	return nil
+}
+
+// resultOf returns the result of an evaluation error
+func resultOf(err error) Result {
+	if _, ok := err.(tempError); ok {
+		return TempError
+	}
+	return PermError
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// parseDualCIDR parses the optional "/cidr4" and "//cidr6" lengths of the a
+// and mx mechanisms, it returns the mask for the family of ip
+func parseDualCIDR(cidr string, ip net.IP) (net.IPMask, error) {
+	v4, v6 := 32, 128
+	if cidr != "" {
+		var s4, s6 string
+		if i := strings.Index(cidr, "//"); i != -1 {
+			s4, s6 = cidr[:i], cidr[i+2:]
+		} else {
+			s4 = cidr
+		}
+		if s4 != "" {
+			if _, err := fmt.Sscanf(s4, "/%d", &v4); err != nil || v4 < 0 || v4 > 32 {
+				return nil, fmt.Errorf("invalid CIDR length %q", cidr)
+			}
+		}
+		if s6 != "" {
+			if _, err := fmt.Sscanf(s6, "%d", &v6); err != nil || v6 < 0 || v6 > 128 {
+				return nil, fmt.Errorf("invalid CIDR length %q", cidr)
+			}
+		}
+	}
+	if ip.To4() != nil {
+		return net.CIDRMask(v4, 32), nil
+	}
+	return net.CIDRMask(v6, 128), nil
+}
+
+// sameFamily returns true if both addresses are IPv4 or both are IPv6
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() != nil) == (b.To4() != nil)
+}
+
+// isName returns true if s is a valid modifier name
+func isName(s string) bool {
+	for i, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && (c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.')) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// validDomain returns true if domain is a fully qualified domain name
+func validDomain(domain string) bool {
+	if len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,172 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emailfabric/smtpd"
+)
+
+// testResolver is a Resolver with static records
+type testResolver map[string][]string
+
+func (r testResolver) lookup(name string) ([]string, error) {
+	if records, ok := r[strings.TrimSuffix(name, ".")]; ok {
+		return records, nil
+	}
+	if strings.HasPrefix(name, "tempfail.") {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r testResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.lookup("ptr:" + addr)
+}
+
+func (r testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := r.lookup("a:" + host)
+	var ips []net.IPAddr
+	for _, addr := range addrs {
+		ips = append(ips, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return ips, err
+}
+
+func (r testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, err := r.lookup("mx:" + name)
+	var mxs []*net.MX
+	for _, host := range hosts {
+		mxs = append(mxs, &net.MX{Host: host, Pref: 10})
+	}
+	return mxs, err
+}
+
+func (r testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if strings.HasPrefix(name, "tempfail.") {
+		return r.lookup(name)
+	}
+	return r.lookup("txt:" + name)
+}
+
+func TestMacros(t *testing.T) {
+
+	// examples of RFC 7208 section 7.4
+	e := &evaluator{o: &Outcome{Sender: "strong-bad@email.example.com", IP: net.ParseIP("192.0.2.3")}}
+	for macro, expected := range map[string]string{
+		"%{s}":                     "strong-bad@email.example.com",
+		"%{o}":                     "email.example.com",
+		"%{d}":                     "email.example.com",
+		"%{d4}":                    "email.example.com",
+		"%{d3}":                    "email.example.com",
+		"%{d2}":                    "example.com",
+		"%{d1}":                    "com",
+		"%{dr}":                    "com.example.email",
+		"%{d2r}":                   "example.email",
+		"%{l}":                     "strong-bad",
+		"%{l-}":                    "strong.bad",
+		"%{lr}":                    "strong-bad",
+		"%{lr-}":                   "bad.strong",
+		"%{l1r-}":                  "strong",
+		"%{ir}.%{v}._spf.%{d2}":    "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":     "bad.strong.lp._spf.example.com",
+		"%{lr-}.lp.%{ir}.%{v}.%%x": "bad.strong.lp.3.2.0.192.in-addr.%x",
+	} {
+		value, err := e.expand(macro, "email.example.com", false)
+		if err != nil || value != expected {
+			t.Errorf("%s: expected %q, got %q (%v)", macro, expected, value, err)
+		}
+	}
+	e.o.IP = net.ParseIP("2001:db8::cb01")
+	value, _ := e.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com", false)
+	if value != "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com" {
+		t.Errorf("unexpected IPv6 expansion %q", value)
+	}
+	for _, invalid := range []string{"%{x}", "%{d", "%", "%a", "%{c}"} {
+		if _, err := e.expand(invalid, "example.com", false); err == nil {
+			t.Errorf("%s: expected error", invalid)
+		}
+	}
+}
+
+var testRecords = testResolver{
+	"txt:example.com":          {"v=spf1 ip4:192.0.2.0/24 a:mail.example.com mx include:_spf.example.org -all", "other"},
+	"txt:_spf.example.org":     {"v=spf1 ip6:2001:db8::/32 ~all"},
+	"a:mail.example.com":       {"198.51.100.1"},
+	"mx:example.com":           {"mx.example.com"},
+	"a:mx.example.com":         {"198.51.100.2", "2001:db8:1::2"},
+	"txt:soft.example.com":     {"v=spf1 ~all"},
+	"txt:redirect.example.com": {"v=spf1 redirect=example.com"},
+	"txt:exp.example.com":      {"v=spf1 exp=explain.example.com -all"},
+	"txt:explain.example.com":  {"%{i} is not one of %{d}'s designated mail servers"},
+	"txt:multi.example.com":    {"v=spf1 -all", "v=spf1 +all"},
+	"txt:void.example.com":     {"v=spf1 a:a.example.com a:b.example.com a:c.example.com -all"},
+	"txt:loop.example.com":     {"v=spf1 include:loop.example.com -all"},
+	"txt:temp.example.com":     {"v=spf1 include:tempfail.example.com -all"},
+	"txt:mail.example.net":     {"v=spf1 a -all"},
+	"a:mail.example.net":       {"203.0.113.1"},
+}
+
+func TestCheckHost(t *testing.T) {
+
+	c := &Checker{Resolver: testRecords, Hostname: "mx.example.org"}
+	ctx := context.Background()
+	for _, test := range []struct {
+		ip     string
+		sender string
+		helo   string
+		result Result
+	}{
+		{"192.0.2.10", "user@example.com", "", Pass},
+		{"198.51.100.1", "user@example.com", "", Pass},
+		{"198.51.100.2", "user@example.com", "", Pass},
+		{"2001:db8:1::2", "user@example.com", "", Pass},
+		{"2001:db8:2::1", "user@example.com", "", Pass}, // included
+		{"203.0.113.1", "user@example.com", "", Fail},
+		{"203.0.113.1", "user@soft.example.com", "", SoftFail},
+		{"192.0.2.10", "user@redirect.example.com", "", Pass},
+		{"203.0.113.1", "user@redirect.example.com", "", Fail},
+		{"203.0.113.1", "user@none.example.com", "", None},
+		{"203.0.113.1", "user@multi.example.com", "", PermError},
+		{"203.0.113.1", "user@void.example.com", "", PermError},
+		{"203.0.113.1", "user@loop.example.com", "", PermError},
+		{"203.0.113.1", "user@temp.example.com", "", TempError},
+		{"203.0.113.1", "", "mail.example.net", Pass}, // HELO identity
+		{"203.0.113.2", "", "mail.example.net", Fail},
+	} {
+		o := c.CheckHost(ctx, net.ParseIP(test.ip), test.sender, test.helo)
+		if o.Result != test.result {
+			t.Errorf("%s %s%s: expected %s, got %s (%v)", test.ip, test.sender, test.helo, test.result, o.Result, o.Err)
+		}
+	}
+
+	o := c.CheckHost(ctx, net.ParseIP("203.0.113.1"), "user@exp.example.com", "")
+	if o.Explanation != "203.0.113.1 is not one of exp.example.com's designated mail servers" {
+		t.Errorf("unexpected explanation %q", o.Explanation)
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	c := &Checker{Resolver: testRecords, Hostname: "mx.example.org", Reject: []Result{Fail}}
+	sess := &smtpd.Session{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 25},
+		Helo:       "mail.example.com",
+		Envelope:   smtpd.Envelope{Sender: "user@example.com"},
+	}
+	o, err := c.Verify(context.Background(), sess)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	expected := `pass (mx.example.org: domain of user@example.com designates 192.0.2.10 as permitted sender) client-ip=192.0.2.10; envelope-from="user@example.com"; helo=mail.example.com; receiver=mx.example.org; identity=mailfrom;`
+	if header := o.ReceivedSPF(); header != expected {
+		t.Fatalf("unexpected Received-SPF %q", header)
+	}
+
+	sess.RemoteAddr = &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 25}
+	if o, err = c.Verify(context.Background(), sess); o.Result != Fail || err == nil || !strings.HasPrefix(err.Error(), "550 5.7.23 ") {
+		t.Fatalf("unexpected result %s %v", o.Result, err)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Package spool stores accepted messages on disk for a delivery agent.
+
+A Spool writes the message data and the envelope of a mail transaction in
+a directory and syncs them before Write returns. A handler that writes a
+message in Handler.Message before it returns, and thus before the server
+sends the 250 reply, does not lose accepted mail when the system crashes.
+
+Each entry consists of a data file and an envelope file. The envelope is
+written to a temporary file and renamed into place after the data is synced,
+which commits the entry. Recover removes the remains of uncommitted entries
+after a crash.
+*/
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+	"github.com/emailfabric/smtpd/internal/filestore"
+)
+
+// ErrNotFound is returned for unknown entries.
+var ErrNotFound = errors.New("spool: entry not found")
+
+const (
+	dataExt     = ".msg"
+	envelopeExt = ".env"
+)
+
+// Entry is a spooled message. The envelope and the client attributes of the
+// session the message was received in are kept in the embedded Metadata.
+type Entry struct {
+	ID string `json:"id"`
+	smtpd.Metadata
+	Size int64 `json:"size"` // size of the message data
+
+	// Delivery state kept by a delivery agent with Update: the number of
+	// delivery attempts and the time of the next attempt
+	Attempts    int       `json:"attempts,omitempty"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// Spool is a spool directory. A Spool can be shared by servers.
+type Spool struct {
+	// Directory of the spool, created when missing
+	Dir string
+}
+
+// Write spools the message read from r with the envelope of the current
+// transaction and the client attributes of sess.
+func (s *Spool) Write(sess *smtpd.Session, r io.Reader) (*Entry, error) {
+	e := &Entry{Metadata: *sess.Metadata(time.Now())}
+	if err := s.Add(e, r); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Add spools the message read from r with the envelope and attributes of e.
+// The ID, Received time and Size of e are set. The entry is committed to
+// disk when Add returns without error.
+func (s *Spool) Add(e *Entry, r io.Reader) error {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return fmt.Errorf("spool: %v", err)
+	}
+	e.ID = filestore.NewID()
+	if e.Received.IsZero() {
+		e.Received = time.Now()
+	}
+	if e.Version == 0 {
+		e.Version = smtpd.MetadataVersion
+	}
+	err := s.store().Add(e.ID, r, func(size int64) interface{} {
+		e.Size = size
+		return e
+	})
+	if err != nil {
+		return fmt.Errorf("spool: %v", err)
+	}
+	return nil
+}
+
+// List returns the spooled entries in the order they were received.
+func (s *Spool) List() ([]*Entry, error) {
+	ids, err := s.store().IDs()
+	if err != nil {
+		return nil, fmt.Errorf("spool: %v", err)
+	}
+	entries := make([]*Entry, 0, len(ids))
+	for _, id := range ids {
+		e, err := s.Get(id)
+		if err == ErrNotFound {
+			continue // removed meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Received.Before(entries[j].Received)
+	})
+	return entries, nil
+}
+
+// Get returns the entry with the given ID.
+func (s *Spool) Get(id string) (*Entry, error) {
+	if !filestore.ValidID(id) {
+		return nil, ErrNotFound
+	}
+	e := &Entry{}
+	err := s.store().ReadMeta(id, e)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("spool: %s: %v", id, err)
+	}
+	return e, nil
+}
+
+// Open returns the message data of the entry with the given ID.
+func (s *Spool) Open(id string) (io.ReadCloser, error) {
+	if !filestore.ValidID(id) {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(s.store().Path(id, dataExt))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("spool: %v", err)
+	}
+	return f, nil
+}
+
+// Update replaces the envelope of a spooled entry, for example to remove the
+// recipients a delivery agent delivered to.
+func (s *Spool) Update(e *Entry) error {
+	if _, err := s.Get(e.ID); err != nil {
+		return err
+	}
+	store := s.store()
+	os.Remove(store.Path(e.ID, filestore.TempExt))
+	if err := store.WriteMeta(e.ID, e); err != nil {
+		return fmt.Errorf("spool: %v", err)
+	}
+	if err := store.SyncDir(); err != nil {
+		return fmt.Errorf("spool: %v", err)
+	}
+	return nil
+}
+
+// Remove removes the entry with the given ID, usually after delivery.
+func (s *Spool) Remove(id string) error {
+	if !filestore.ValidID(id) {
+		return ErrNotFound
+	}
+	// the envelope is removed first, the data of an entry without envelope
+	// is removed by Recover
+	err := s.store().Remove(id)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("spool: %v", err)
+	}
+	return nil
+}
+
+// Recover removes the files of entries that were not committed or not
+// completely removed. It must be called before messages are written, for
+// example at startup after a crash.
+func (s *Spool) Recover() error {
+	names, err := filepath.Glob(filepath.Join(s.Dir, "*"))
+	if err != nil {
+		return fmt.Errorf("spool: %v", err)
+	}
+	for _, name := range names {
+		ext := filepath.Ext(name)
+		id := strings.TrimSuffix(filepath.Base(name), ext)
+		if !filestore.ValidID(id) {
+			continue
+		}
+		if ext == filestore.TempExt {
+			os.Remove(name)
+		} else if ext == dataExt {
+			if _, err := os.Stat(s.store().Path(id, envelopeExt)); os.IsNotExist(err) {
+				os.Remove(name)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Spool) store() *filestore.Store {
+	return &filestore.Store{Dir: s.Dir, DataExt: dataExt, MetaExt: envelopeExt}
+}
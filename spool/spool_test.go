@@ -0,0 +1,97 @@
+package spool
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emailfabric/smtpd"
+)
+
+func TestSpool(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	s := &Spool{Dir: dir}
+
+	sess := &smtpd.Session{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25},
+		Helo:       "mail.example.com",
+		Envelope: smtpd.Envelope{
+			Sender:     "user@example.com",
+			Recipients: []smtpd.Recipient{{Address: "a@example.org", Notify: []string{"FAILURE"}}, {Address: "b@example.org"}},
+			Body:       smtpd.Body8BitMIME,
+			EnvID:      "env1",
+		},
+	}
+	e, err := s.Write(sess, strings.NewReader("Subject: test\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if e.Size != 23 || e.Client.IP != "192.0.2.1" || e.Client.Protocol != "SMTP" {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	second, err := s.Write(sess, strings.NewReader("second"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// remains of an interrupted write and removal
+	ioutil.WriteFile(filepath.Join(dir, "0123456789abcdef01234567.msg"), []byte("partial"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "0123456789abcdef01234567.tmp"), []byte("{"), 0600)
+	if err := s.Recover(); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 4 {
+		t.Fatalf("unexpected files %v", names)
+	}
+
+	entries, err := s.List()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(entries) != 2 || entries[0].ID != e.ID || entries[1].ID != second.ID {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	env := entries[0].Envelope
+	if env.Sender != "user@example.com" || len(env.Recipients) != 2 || env.Recipients[0].Notify[0] != "FAILURE" || env.Body != smtpd.Body8BitMIME || env.EnvID != "env1" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+	f, err := s.Open(e.ID)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	data, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(data) != "Subject: test\r\n\r\nbody\r\n" {
+		t.Fatalf("unexpected data %q", data)
+	}
+
+	// delivered to the first recipient
+	e.Envelope.Recipients = e.Envelope.Recipients[1:]
+	if err := s.Update(e); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if e, _ = s.Get(e.ID); len(e.Envelope.Recipients) != 1 || e.Envelope.Recipients[0].Address != "b@example.org" {
+		t.Fatalf("unexpected updated entry %+v", e)
+	}
+
+	if err := s.Remove(e.ID); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := s.Remove(e.ID); err != ErrNotFound {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := s.Open("../" + e.ID); err != ErrNotFound {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if entries, _ = s.List(); len(entries) != 1 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
@@ -0,0 +1,72 @@
+package smtpd
+
+// Stats holds the runtime statistics of a server, see Server.Stats.
+type Stats struct {
+	// Open connections, and open connections by remote IP address
+	Connections      int
+	ConnectionsPerIP map[string]int
+
+	// Message transfers with DATA or BDAT in progress
+	ActiveTransfers int
+
+	// Messages received with DATA or BDAT, and their total size in bytes
+	Messages uint64
+	Bytes    uint64
+
+	// Replies to commands by status code
+	Replies map[int]uint64
+
+	// Successful TLS handshakes by protocol version, see TLSVersionCounts
+	TLSVersions map[string]uint64
+}
+
+// serverStats holds the counters of Stats that are not kept elsewhere
+type serverStats struct {
+	transfers int
+	messages  uint64
+	bytes     uint64
+	replies   map[int]uint64
+}
+
+// Stats returns the current statistics of the server, for example to expose
+// them in a health check.
+func (s *Server) Stats() Stats {
+	var stats Stats
+	stats.Connections, stats.ConnectionsPerIP = s.ConnectionCounts()
+	stats.TLSVersions = s.TLSVersionCounts()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats.ActiveTransfers = s.stats.transfers
+	stats.Messages = s.stats.messages
+	stats.Bytes = s.stats.bytes
+	stats.Replies = make(map[int]uint64, len(s.stats.replies))
+	for code, n := range s.stats.replies {
+		stats.Replies[code] = n
+	}
+	return stats
+}
+
+// countReply counts the reply to a command
+func (s *Server) countReply(code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stats.replies == nil {
+		s.stats.replies = make(map[int]uint64)
+	}
+	s.stats.replies[code]++
+}
+
+// countTransfer adds delta to the number of message transfers in progress
+func (s *Server) countTransfer(delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.transfers += delta
+}
+
+// addMessage counts a message received
+func (s *Server) addMessage(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.messages++
+	s.stats.bytes += uint64(size)
+}
@@ -0,0 +1,64 @@
+package smtpd
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// blockingHandler waits in Message until release is closed
+type blockingHandler struct {
+	testHandler
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *blockingHandler) Message(r io.Reader) error {
+	ioutil.ReadAll(r)
+	close(h.started)
+	<-h.release
+	return nil
+}
+
+func TestStats(t *testing.T) {
+
+	server := &Server{}
+	handler := &blockingHandler{started: make(chan struct{}), release: make(chan struct{})}
+	c, done := dialServer(t, server, handler)
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	cmd(t, c, 500, "FOO")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+	cmd(t, c, 354, "DATA")
+	c.PrintfLine("Subject: test\r\n\r\nThis is a test.\r\n.")
+	<-handler.started
+
+	stats := server.Stats()
+	if stats.Connections != 1 || stats.ConnectionsPerIP["127.0.0.1"] != 1 || stats.ActiveTransfers != 1 || stats.Messages != 0 {
+		t.Fatalf("unexpected stats during transfer %+v", stats)
+	}
+	close(handler.release)
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	stats = server.Stats()
+	if stats.Connections != 0 || len(stats.ConnectionsPerIP) != 0 || stats.ActiveTransfers != 0 {
+		t.Fatalf("unexpected connection stats %+v", stats)
+	}
+	if stats.Messages != 1 || stats.Bytes != 34 {
+		t.Fatalf("unexpected message stats %+v", stats)
+	}
+	if stats.Replies[250] != 4 || stats.Replies[500] != 1 || stats.Replies[221] != 1 {
+		t.Fatalf("unexpected replies %v", stats.Replies)
+	}
+}
@@ -0,0 +1,201 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	errEHLORequired = errors.New("503 5.5.1 Send EHLO first")
+	errTLSRequired  = errors.New("530 5.7.0 Must issue a STARTTLS command first")
+	errAuthRequired = errors.New("530 5.7.0 Authentication required")
+)
+
+// checkSubmission returns an error when a client may not start a mail
+// transaction in submission mode (RFC 6409)
+func (s *session) checkSubmission() error {
+	if !s.server.Submission {
+		return nil
+	}
+	if !s.extended {
+		return errEHLORequired
+	}
+	if !s.tls {
+		return errTLSRequired
+	}
+	if s.AuthUsername == "" {
+		return errAuthRequired
+	}
+	return nil
+}
+
+// AuthRequirer can optionally be implemented by a Handler or ContextHandler
+// to decide per session whether MAIL FROM requires authentication, for
+// example depending on the client address. It replaces Server.RequireAuth.
+type AuthRequirer interface {
+	RequireAuth(ctx context.Context) bool
+}
+
+// requireAuth returns true if the client must authenticate before MAIL FROM,
+// clients in Server.RelayNetworks need not authenticate
+func (s *session) requireAuth() bool {
+	if r, ok := s.impl.(AuthRequirer); ok {
+		return r.RequireAuth(s.ctx)
+	}
+	return s.server.RequireAuth && !s.Relay
+}
+
+// messageReader returns the reader passed to Handler.Message, which adds
+// missing headers to submitted messages when Server.SubmissionFixups is set
+// and the Received header when Server.AddReceived is set
+func (s *session) messageReader(r io.Reader) io.Reader {
+	now := time.Now()
+	if s.server.Submission && s.server.SubmissionFixups {
+		r = fixupHeaders(r, s.hostname(), s.fixupFrom(), now)
+	}
+	if s.server.AddReceived {
+		r = io.MultiReader(strings.NewReader(s.Received(s.hostname(), now)), r)
+	}
+	return r
+}
+
+// fixupFrom returns the address for a missing From header, the envelope
+// sender or else the authenticated username when it is an address
+func (s *session) fixupFrom() string {
+	if s.Envelope.Sender != "" {
+		return s.Envelope.Sender
+	}
+	if strings.Contains(s.AuthUsername, "@") {
+		return s.AuthUsername
+	}
+	return ""
+}
+
+// maxFixupHeader limits the size of the header read by fixupHeaders, larger
+// headers are passed without fix-ups
+const maxFixupHeader = 64 << 10
+
+// fixupHeaders returns a reader that adds the Date and Message-ID headers to
+// the message read from r when missing. A missing or empty From header is
+// replaced with one for from, unless from is empty.
+func fixupHeaders(r io.Reader, hostname, from string, now time.Time) io.Reader {
+	br := bufio.NewReader(r)
+	var lines [][]byte
+	size := 0
+	var hasDate, hasMessageID bool
+	complete := false // the whole header was read
+	fromLine := -1
+	var err error
+	for size < maxFixupHeader {
+		// read the line in buffer sized chunks up to the remaining budget, a
+		// longer line ends the header read and the rest is passed unchanged
+		var line []byte
+		for {
+			var chunk []byte
+			chunk, err = br.ReadSlice('\n')
+			line = append(line, chunk...)
+			if err != bufio.ErrBufferFull || size+len(line) >= maxFixupHeader {
+				break
+			}
+		}
+		if len(line) > 0 {
+			lines = append(lines, line)
+			size += len(line)
+		}
+		if err == bufio.ErrBufferFull {
+			err = nil
+			break
+		}
+		if err != nil {
+			complete = err == io.EOF
+			break
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			complete = true // end of header
+			break
+		}
+		if hasPrefixFold(line, "Date:") {
+			hasDate = true
+		} else if hasPrefixFold(line, "Message-ID:") {
+			hasMessageID = true
+		} else if hasPrefixFold(line, "From:") && fromLine == -1 {
+			fromLine = len(lines) - 1
+		}
+	}
+
+	var fixups bytes.Buffer
+	if complete && !hasDate {
+		fmt.Fprintf(&fixups, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	}
+	if complete && !hasMessageID {
+		fmt.Fprintf(&fixups, "Message-ID: <%s@%s>\r\n", randomID(), hostname)
+	}
+	if complete && from != "" {
+		if fromLine == -1 {
+			fmt.Fprintf(&fixups, "From: <%s>\r\n", from)
+		} else if n := emptyField(lines[fromLine:]); n > 0 {
+			// drop the empty From field including continuation lines
+			fmt.Fprintf(&fixups, "From: <%s>\r\n", from)
+			lines = append(lines[:fromLine], lines[fromLine+n:]...)
+		}
+	}
+	var header bytes.Buffer
+	for _, line := range lines {
+		header.Write(line)
+	}
+	rest := io.Reader(br)
+	if err == io.EOF {
+		rest = bytes.NewReader(nil)
+	} else if err != nil {
+		rest = &errReader{err}
+	}
+	return io.MultiReader(&fixups, &header, rest)
+}
+
+// emptyField returns the number of lines of the header field starting at
+// lines[0] when its value is empty, or 0
+func emptyField(lines [][]byte) int {
+	value := lines[0][bytes.IndexByte(lines[0], ':')+1:]
+	n := 1
+	for ; n < len(lines); n++ {
+		line := lines[n]
+		if len(line) == 0 || (line[0] != ' ' && line[0] != '\t') {
+			break
+		}
+		value = append(value[:len(value):len(value)], line...)
+	}
+	value = bytes.TrimSpace(value)
+	if len(value) > 0 && !bytes.Equal(value, []byte("<>")) {
+		return 0
+	}
+	return n
+}
+
+// hasPrefixFold reports whether line begins with prefix, ignoring case
+func hasPrefixFold(line []byte, prefix string) bool {
+	return len(line) >= len(prefix) && bytes.EqualFold(line[:len(prefix)], []byte(prefix))
+}
+
+// randomID returns a random identifier in hex
+func randomID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// errReader always fails with err
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(b []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,241 @@
+/*
+Package systemd integrates servers with the systemd service manager. It
+obtains the listeners of socket activation, notifies the service manager of
+the readiness and shutdown of the daemon, and sends the watchdog keep-alive
+pings.
+
+A service with socket activation, Type=notify and WatchdogSec= set serves
+with:
+
+	server := &smtpd.Server{...}
+	go func() {
+		<-sigterm
+		systemd.Shutdown(context.Background(), server)
+	}()
+	err := systemd.Serve(server)
+
+All functions do nothing when the process is not run by systemd.
+*/
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+)
+
+// States sent with Notify
+const (
+	Ready        = "READY=1"
+	Stopping     = "STOPPING=1"
+	Reloading    = "RELOADING=1"
+	WatchdogPing = "WATCHDOG=1"
+)
+
+// listenFdsStart is the first file descriptor passed with socket activation
+var listenFdsStart = 3
+
+// ErrNoListeners is returned by Serve when the process was not socket
+// activated.
+var ErrNoListeners = errors.New("systemd: no listeners passed")
+
+// Listeners returns the listeners passed with socket activation in the order
+// of the socket units, nil when the process was not socket activated. The
+// environment variables of socket activation are unset, so that they are not
+// passed to child processes.
+func Listeners() ([]net.Listener, error) {
+	files, _, err := activationFiles()
+	if err != nil {
+		return nil, err
+	}
+	return fileListeners(files)
+}
+
+// NamedListeners returns the listeners passed with socket activation by the
+// names given with FileDescriptorName= of the socket units.
+func NamedListeners() (map[string][]net.Listener, error) {
+	files, names, err := activationFiles()
+	if err != nil {
+		return nil, err
+	}
+	listeners, err := fileListeners(files)
+	if err != nil {
+		return nil, err
+	}
+	named := make(map[string][]net.Listener)
+	for i, l := range listeners {
+		name := "unknown" // default of systemd
+		if i < len(names) {
+			name = names[i]
+		}
+		named[name] = append(named[name], l)
+	}
+	return named, nil
+}
+
+// activationFiles returns the files passed with socket activation and their
+// names, and unsets the environment variables
+func activationFiles() ([]*os.File, []string, error) {
+	pid, fds, fdNames := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid == "" || fds == "" {
+		return nil, nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil, nil // passed to another process
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, nil, fmt.Errorf("systemd: invalid LISTEN_FDS %q", fds)
+	}
+	var names []string
+	if fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+	files := make([]*os.File, n)
+	for i := range files {
+		fd := listenFdsStart + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) {
+			name = names[i]
+		}
+		files[i] = os.NewFile(uintptr(fd), name)
+	}
+	return files, names, nil
+}
+
+// fileListeners returns listeners for the files and closes the files
+func fileListeners(files []*os.File) ([]net.Listener, error) {
+	var listeners []net.Listener
+	var err error
+	for _, f := range files {
+		if err == nil {
+			var l net.Listener
+			if l, err = net.FileListener(f); err == nil {
+				listeners = append(listeners, l)
+			} else {
+				err = fmt.Errorf("systemd: %s: %v", f.Name(), err)
+			}
+		}
+		f.Close() // the listener has a duplicate
+	}
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+	return listeners, nil
+}
+
+// Notify sends a state to the service manager, for example Ready. It returns
+// false without error when the service manager does not expect
+// notifications.
+func Notify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	if name[0] == '@' { // abstract namespace
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("systemd: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("systemd: %v", err)
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval within which the service manager
+// expects watchdog pings, zero when the watchdog is disabled.
+func WatchdogInterval() (time.Duration, error) {
+	usec, pid := os.Getenv("WATCHDOG_USEC"), os.Getenv("WATCHDOG_PID")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("systemd: invalid WATCHDOG_USEC %q", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// Watchdog sends watchdog pings at half the watchdog interval until ctx is
+// done. It returns immediately when the watchdog is disabled.
+func Watchdog(ctx context.Context) error {
+	interval, err := WatchdogInterval()
+	if interval == 0 {
+		return err
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		if _, err := Notify(WatchdogPing); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Serve serves server on the listeners passed with socket activation. It
+// notifies the service manager when the server is ready and sends watchdog
+// pings while it is serving. It returns smtpd.ErrServerClosed after Shutdown
+// or server.Close. When a listener fails, the server is closed and the error
+// is returned, so that the service manager can restart the daemon.
+func Serve(server *smtpd.Server) error {
+	listeners, err := Listeners()
+	if err != nil {
+		return err
+	}
+	if len(listeners) == 0 {
+		return ErrNoListeners
+	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- server.Serve(l)
+		}(l)
+	}
+	Notify(Ready)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Watchdog(ctx)
+
+	err = nil
+	for range listeners {
+		if serr := <-errs; err == nil || err == smtpd.ErrServerClosed {
+			if serr != smtpd.ErrServerClosed {
+				server.Close()
+			}
+			err = serr
+		}
+	}
+	return err
+}
+
+// Shutdown notifies the service manager that the daemon is stopping and
+// gracefully shuts down server, see smtpd.Server.Shutdown.
+func Shutdown(ctx context.Context, server *smtpd.Server) error {
+	Notify(Stopping)
+	return server.Shutdown(ctx)
+}
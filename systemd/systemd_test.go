@@ -0,0 +1,168 @@
+package systemd
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+)
+
+// activate passes listeners as with socket activation
+func activate(t *testing.T, names string, listeners ...*net.TCPListener) {
+	t.Helper()
+	// the descriptors must be consecutive as with socket activation
+	var files []*os.File
+	for _, l := range listeners {
+		f, err := l.File()
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		files = append(files, f)
+	}
+	for i := 1; i < len(files); i++ {
+		if files[i].Fd() != files[0].Fd()+uintptr(i) {
+			t.Skip("descriptors not consecutive")
+		}
+	}
+	listenFdsStart = int(files[0].Fd())
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", strconv.Itoa(len(files)))
+	os.Setenv("LISTEN_FDNAMES", names)
+}
+
+func listen(t *testing.T) *net.TCPListener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	return l.(*net.TCPListener)
+}
+
+func TestNamedListeners(t *testing.T) {
+
+	l1, l2 := listen(t), listen(t)
+	defer l1.Close()
+	defer l2.Close()
+	activate(t, "smtp:submission", l1, l2)
+
+	named, err := NamedListeners()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(named["smtp"]) != 1 || len(named["submission"]) != 1 ||
+		named["submission"][0].Addr().String() != l2.Addr().String() {
+		t.Fatalf("unexpected listeners %v", named)
+	}
+	for _, listeners := range named {
+		listeners[0].Close()
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatalf("environment not unset")
+	}
+	if listeners, err := Listeners(); listeners != nil || err != nil {
+		t.Fatalf("unexpected listeners %v %v", listeners, err)
+	}
+}
+
+// notifications listens on a notification socket and returns the states
+// received
+func notifications(t *testing.T) <-chan string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	os.Setenv("NOTIFY_SOCKET", name)
+	t.Cleanup(func() { os.Unsetenv("NOTIFY_SOCKET") })
+	states := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			states <- string(buf[:n])
+		}
+	}()
+	return states
+}
+
+func expectState(t *testing.T, states <-chan string, expected string) {
+	t.Helper()
+	select {
+	case state := <-states:
+		if state != expected {
+			t.Fatalf("expected %s, got %s", expected, state)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%s not received", expected)
+	}
+}
+
+type testHandler struct{}
+
+func (testHandler) Connect(source string) error                        { return nil }
+func (testHandler) Hello(hostname string) error                        { return nil }
+func (testHandler) AuthUser(identity, username string) (string, error) { return "", nil }
+func (testHandler) Sender(address string) error                        { return nil }
+func (testHandler) Recipient(address string) error                     { return nil }
+func (testHandler) Message(r io.Reader) error                          { return nil }
+
+func TestServe(t *testing.T) {
+
+	if ok, err := Notify(Ready); ok || err != nil {
+		t.Fatalf("unexpected notification %t %v", ok, err)
+	}
+	states := notifications(t)
+	os.Setenv("WATCHDOG_USEC", "20000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	l := listen(t)
+	defer l.Close()
+	activate(t, "", l)
+	server := &smtpd.Server{NewHandler: func() smtpd.Handler { return testHandler{} }}
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(server)
+	}()
+	expectState(t, states, Ready)
+	expectState(t, states, WatchdogPing)
+	expectState(t, states, WatchdogPing)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	conn.Close()
+
+	if err := Shutdown(context.Background(), server); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := <-served; err != smtpd.ErrServerClosed {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for state := ""; state != Stopping; {
+		select {
+		case state = <-states:
+			if state != Stopping && state != WatchdogPing {
+				t.Fatalf("unexpected state %s", state)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not received", Stopping)
+		}
+	}
+
+	if err := Serve(server); err != ErrNoListeners {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// AuthThrottle counts failed AUTH attempts per client IP address and per
+// username, delays failure replies exponentially and locks out addresses and
+// usernames that reach a threshold. Attempts for a locked out username fail
+// like a wrong password, whether or not the password is correct. An
+// AuthThrottle can be shared by servers.
+type AuthThrottle struct {
+	// Failures of an IP address or a username after which it is locked
+	// out, no limit if zero
+	MaxIPFailures   int
+	MaxUserFailures int
+
+	// Delay after the first failure of an IP address, doubled with every
+	// further failure up to MaxDelay, no delay if zero. MaxDelay is 30
+	// seconds if zero.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Duration after the last failure after which the failures are
+	// forgotten, and of a lockout, 15 minutes if zero
+	LockoutDuration time.Duration
+
+	// OnLockout is called when an IP address or a username gets locked out,
+	// with either ip or username set
+	OnLockout func(ctx context.Context, ip net.IP, username string)
+
+	mu      sync.Mutex
+	entries map[string]*throttleEntry
+	pruneAt int
+}
+
+type throttleEntry struct {
+	failures int
+	last     time.Time
+}
+
+var errAuthLocked = errors.New("454 4.7.0 Too many failed authentication attempts, try again later")
+
+func (t *AuthThrottle) lockoutDuration() time.Duration {
+	if t.LockoutDuration > 0 {
+		return t.LockoutDuration
+	}
+	return 15 * time.Minute
+}
+
+// defaultMaxAuthDelay is the maximum delay if MaxDelay is zero
+const defaultMaxAuthDelay = 30 * time.Second
+
+func (t *AuthThrottle) maxDelay() time.Duration {
+	if t.MaxDelay > 0 {
+		return t.MaxDelay
+	}
+	return defaultMaxAuthDelay
+}
+
+// failures returns the current failures for a key
+func (t *AuthThrottle) failures(key string, now time.Time) int {
+	e := t.entries[key]
+	if e == nil || now.Sub(e.last) >= t.lockoutDuration() {
+		return 0
+	}
+	return e.failures
+}
+
+// locked returns true if the IP address is locked out
+func (t *AuthThrottle) locked(ip net.IP) bool {
+	if t.MaxIPFailures <= 0 || ip == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failures("ip:"+ip.String(), time.Now()) >= t.MaxIPFailures
+}
+
+// fail counts a failure and returns the delay before replying
+func (t *AuthThrottle) fail(ctx context.Context, ip net.IP, username string) time.Duration {
+	now := time.Now()
+	var ipLocked, userLocked bool
+	var ipFailures int
+
+	t.mu.Lock()
+	if t.entries == nil {
+		t.entries = make(map[string]*throttleEntry)
+	}
+	if len(t.entries) >= t.pruneAt {
+		t.prune(now)
+	}
+	if ip != nil {
+		ipFailures = t.count("ip:"+ip.String(), now)
+		ipLocked = t.MaxIPFailures > 0 && ipFailures == t.MaxIPFailures
+	}
+	if username != "" {
+		userFailures := t.count("user:"+username, now)
+		userLocked = t.MaxUserFailures > 0 && userFailures == t.MaxUserFailures
+	}
+	t.mu.Unlock()
+
+	if t.OnLockout != nil {
+		if ipLocked {
+			t.OnLockout(ctx, ip, "")
+		}
+		if userLocked {
+			t.OnLockout(ctx, nil, username)
+		}
+	}
+
+	if t.BaseDelay <= 0 || ipFailures == 0 {
+		return 0
+	}
+	delay, max := t.BaseDelay, t.maxDelay()
+	for i := 1; i < ipFailures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// count increments the failures for a key and returns the new count
+func (t *AuthThrottle) count(key string, now time.Time) int {
+	n := t.failures(key, now) + 1
+	t.entries[key] = &throttleEntry{failures: n, last: now}
+	return n
+}
+
+// prune removes expired entries
+func (t *AuthThrottle) prune(now time.Time) {
+	for key, e := range t.entries {
+		if now.Sub(e.last) >= t.lockoutDuration() {
+			delete(t.entries, key)
+		}
+	}
+	t.pruneAt = 2 * len(t.entries)
+	if t.pruneAt < 1024 {
+		t.pruneAt = 1024
+	}
+}
+
+// userLocked returns true if the username is locked out
+func (t *AuthThrottle) userLocked(username string) bool {
+	if t.MaxUserFailures <= 0 || username == "" {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failures("user:"+username, time.Now()) >= t.MaxUserFailures
+}
+
+// succeed forgets the failures of the username
+func (t *AuthThrottle) succeed(username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, "user:"+username)
+}
+
+// remoteIP returns the IP address of a remote address, or nil
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,125 @@
+package smtpd
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuthThrottle(t *testing.T) {
+
+	var lockouts []string
+	throttle := &AuthThrottle{
+		MaxIPFailures:   3,
+		MaxUserFailures: 2,
+		BaseDelay:       time.Second,
+		MaxDelay:        3 * time.Second,
+		OnLockout: func(ctx context.Context, ip net.IP, username string) {
+			if ip != nil {
+				lockouts = append(lockouts, ip.String())
+			} else {
+				lockouts = append(lockouts, username)
+			}
+		},
+	}
+	ip1, ip2 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	ctx := context.Background()
+
+	delays := []time.Duration{
+		throttle.fail(ctx, ip1, ""),
+		throttle.fail(ctx, ip1, "user@example.com"),
+		throttle.fail(ctx, ip1, ""),
+		throttle.fail(ctx, ip1, ""),
+	}
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		if delays[i] != expected {
+			t.Errorf("unexpected delay %v after failure %d", delays[i], i+1)
+		}
+	}
+	if !throttle.locked(ip1) || throttle.locked(ip2) {
+		t.Fatalf("unexpected IP lockout")
+	}
+	if throttle.userLocked("user@example.com") {
+		t.Fatalf("unexpected user lockout")
+	}
+	throttle.succeed("user@example.com")
+	throttle.fail(ctx, ip2, "user@example.com")
+	throttle.fail(ctx, ip2, "user@example.com")
+	if !throttle.userLocked("user@example.com") {
+		t.Fatalf("user not locked out")
+	}
+	if len(lockouts) != 2 || lockouts[0] != "192.0.2.1" || lockouts[1] != "user@example.com" {
+		t.Fatalf("unexpected lockouts %v", lockouts)
+	}
+
+	// failures are forgotten after the lockout duration
+	throttle.entries["ip:192.0.2.1"].last = time.Now().Add(-time.Hour)
+	if throttle.locked(ip1) {
+		t.Fatalf("lockout did not expire")
+	}
+}
+
+func TestAuthThrottleMaxDelay(t *testing.T) {
+
+	// without MaxDelay the delay is capped instead of overflowing
+	throttle := &AuthThrottle{BaseDelay: time.Second}
+	ip := net.ParseIP("192.0.2.1")
+	var delay time.Duration
+	for i := 0; i < 100; i++ {
+		delay = throttle.fail(context.Background(), ip, "")
+		if delay <= 0 || delay > defaultMaxAuthDelay {
+			t.Fatalf("unexpected delay %v after failure %d", delay, i+1)
+		}
+	}
+	if delay != defaultMaxAuthDelay {
+		t.Fatalf("expected delay %v, got %v", defaultMaxAuthDelay, delay)
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+
+	server := &Server{AuthThrottle: &AuthThrottle{MaxIPFailures: 2}}
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	for i := 0; i < 2; i++ {
+		cmd(t, c, 334, "AUTH CRAM-MD5")
+		cmd(t, c, 535, "%s", base64.StdEncoding.EncodeToString([]byte("user@example.com 0123456789abcdef")))
+	}
+	cmd(t, c, 454, "AUTH CRAM-MD5")
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
+
+func TestAuthUserLockout(t *testing.T) {
+
+	server := &Server{
+		AuthThrottle:      &AuthThrottle{MaxUserFailures: 2},
+		AuthTLSMechanisms: []string{},
+	}
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	plain := func(password string) string {
+		return base64.StdEncoding.EncodeToString([]byte("\x00user@example.com\x00" + password))
+	}
+	wrong := cmd(t, c, 535, "AUTH PLAIN %s", plain("wrong"))
+	cmd(t, c, 535, "AUTH PLAIN %s", plain("wrong"))
+	// locked out, the correct password is refused like a wrong one
+	if msg := cmd(t, c, 535, "AUTH PLAIN %s", plain("password")); msg != wrong {
+		t.Fatalf("expected %q, got %q", wrong, msg)
+	}
+	if msg := cmd(t, c, 535, "AUTH PLAIN %s", plain("wrong")); msg != wrong {
+		t.Fatalf("expected %q, got %q", wrong, msg)
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+}
@@ -0,0 +1,143 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Default timeouts, RFC 5321 section 4.5.3.2
+const (
+	defaultCommandTimeout = 5 * time.Minute
+	defaultDataTimeout    = 3 * time.Minute
+	defaultWriteTimeout   = 5 * time.Minute
+)
+
+// Errors replied when the session ends because of a timeout
+var (
+	ErrIdleTimeout    = errors.New("421 4.4.2 Idle timeout, closing connection")
+	ErrDataTimeout    = errors.New("421 4.4.2 Timeout while receiving data, closing connection")
+	ErrSessionTimeout = errors.New("421 4.4.2 Session time limit exceeded, closing connection")
+)
+
+// TimeoutHandler can optionally be implemented by a Handler or
+// ContextHandler to be notified when the session ends because of a timeout.
+// The error is ErrIdleTimeout, ErrDataTimeout or ErrSessionTimeout.
+type TimeoutHandler interface {
+	Timeout(ctx context.Context, err error)
+}
+
+// timeoutOrDefault returns the configured timeout, the default when zero, or zero
+// when negative
+func timeoutOrDefault(configured, def time.Duration) time.Duration {
+	switch {
+	case configured < 0:
+		return 0
+	case configured == 0:
+		return def
+	}
+	return configured
+}
+
+// commandTimeout returns the maximum time to wait for a command line, idle
+// is true outside of a mail transaction
+func (s *Server) commandTimeout(idle bool) time.Duration {
+	if idle && s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return timeoutOrDefault(s.CommandTimeout, defaultCommandTimeout)
+}
+
+func (s *Server) dataTimeout() time.Duration {
+	return timeoutOrDefault(s.DataTimeout, defaultDataTimeout)
+}
+
+func (s *Server) writeTimeout() time.Duration {
+	return timeoutOrDefault(s.WriteTimeout, defaultWriteTimeout)
+}
+
+// newConn returns a conn for c with the write timeout of the server, which
+// writes the lines read and written to the debug log and the transcript of
+// the session. deadline is the end of the session or zero.
+func (s *session) newConn(c net.Conn, deadline time.Time) *conn {
+	var r io.Reader = c
+	var w io.Writer = c
+	if l := s.server.debugLog(); l != nil {
+		r = io.TeeReader(r, &logReadWriter{logger: l, id: s.ID})
+		w = io.MultiWriter(w, &logWriter{logger: l, id: s.ID})
+	}
+	if s.transcript != nil {
+		w = io.MultiWriter(w, transcriptWriter{s.transcript, 'S'})
+	}
+	conn := newConn(c, r, w, s.server.Pipelining)
+	conn.writeTimeout = s.server.writeTimeout()
+	conn.deadline = deadline
+	conn.errorDelay = s.server.ErrorDelay
+	conn.maxLine = s.server.readLimit()
+	return conn
+}
+
+// timeout replies the error for an expired read deadline and notifies the
+// handler, err is replaced by ErrSessionTimeout at the end of the session.
+// It returns the error replied.
+func (s *session) timeout(err error) error {
+	if !s.conn.deadline.IsZero() && !time.Now().Before(s.conn.deadline) {
+		err = ErrSessionTimeout
+	}
+	if h, ok := s.impl.(TimeoutHandler); ok {
+		h.Timeout(s.ctx, err)
+	}
+	if err == ErrIdleTimeout && len(s.outcomes) == 0 {
+		// no command received yet
+		s.conn.Reply("421 4.4.2 Timeout waiting for command")
+	} else {
+		s.conn.ErrorReply(err)
+	}
+	return err
+}
+
+// timeoutReader sets the read deadline of the connection before each read of
+// message data, so the client must send each block within the timeout
+type timeoutReader struct {
+	r        io.Reader
+	conn     *conn
+	timeout  time.Duration
+	timedOut bool
+}
+
+func (r *timeoutReader) Read(b []byte) (int, error) {
+	r.conn.SetReadTimeout(r.timeout)
+	n, err := r.r.Read(b)
+	if err != nil && isTimeout(err) {
+		r.timedOut = true
+	}
+	return n, err
+}
+
+// WriteTo uses the WriteTo method of r when available, the read deadline is
+// set again before each write, i.e. for each line of message data
+func (r *timeoutReader) WriteTo(w io.Writer) (int64, error) {
+	wt, ok := r.r.(io.WriterTo)
+	if !ok {
+		return io.Copy(w, struct{ io.Reader }{r})
+	}
+	r.conn.SetReadTimeout(r.timeout)
+	n, err := wt.WriteTo(deadlineWriter{w, r})
+	if err != nil && isTimeout(err) {
+		r.timedOut = true
+	}
+	return n, err
+}
+
+// deadlineWriter sets the read deadline of the timeoutReader before each write
+type deadlineWriter struct {
+	w io.Writer
+	r *timeoutReader
+}
+
+func (w deadlineWriter) Write(b []byte) (int, error) {
+	w.r.conn.SetReadTimeout(w.r.timeout)
+	return w.w.Write(b)
+}
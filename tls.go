@@ -0,0 +1,173 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// acmeTLSALPN is the ALPN protocol of the ACME TLS-ALPN-01 challenge (RFC
+// 8737)
+const acmeTLSALPN = "acme-tls/1"
+
+// DefaultTLSConfig returns a TLS configuration with modern defaults for an
+// SMTP server: TLS 1.2 or later with forward secrecy and AEAD cipher suites.
+// Set Certificates or GetCertificate before use.
+func DefaultTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	}
+}
+
+// legacyCipherSuites are added with Server.AllowLegacyTLS for clients that
+// only support CBC cipher suites
+var legacyCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+}
+
+// TLSVersionCounts returns the number of successful TLS handshakes by
+// negotiated protocol version, e.g. "TLS 1.3".
+func (s *Server) TLSVersionCounts() map[string]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]uint64, len(s.tlsVersions))
+	for version, n := range s.tlsVersions {
+		counts[tls.VersionName(version)] = n
+	}
+	return counts
+}
+
+// countTLSVersion counts a successful handshake
+func (s *Server) countTLSVersion(version uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tlsVersions == nil {
+		s.tlsVersions = make(map[uint16]uint64)
+	}
+	s.tlsVersions[version]++
+}
+
+// CertificateGetter provides certificates during the TLS handshake. It is
+// implemented by *autocert.Manager of golang.org/x/crypto/acme/autocert.
+type CertificateGetter interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// AutocertTLSConfig returns a TLS configuration for Server.TLSConfig that
+// obtains certificates from m, usually an autocert.Manager:
+//
+//	m := &autocert.Manager{
+//		Prompt:     autocert.AcceptTOS,
+//		HostPolicy: autocert.HostWhitelist("mx.example.com"),
+//		Cache:      autocert.DirCache("certs"),
+//	}
+//	server.TLSConfig = smtpd.AutocertTLSConfig(m)
+//
+// The configuration accepts the ACME TLS-ALPN-01 challenge, but the ACME
+// server only validates on port 443. Serve m.HTTPHandler on port 80 or run an
+// HTTPS server on port 443 with the same manager to answer challenges.
+func AutocertTLSConfig(m CertificateGetter) *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{acmeTLSALPN},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// CertStore holds a certificate loaded from PEM files that can be reloaded
+// while the server is running. Set the GetCertificate member of
+// Server.TLSConfig to the store's GetCertificate method, so renewed
+// certificates are used for new handshakes after Reload.
+type CertStore struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertStore returns a CertStore with the certificate and key loaded from
+// certFile and keyFile.
+func NewCertStore(certFile, keyFile string) (*CertStore, error) {
+	c := &CertStore{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificate and key files again. The current certificate
+// is kept when loading fails.
+func (c *CertStore) Reload() error {
+	modTime := c.filesModTime()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// files that failed to load are not retried by Watch until they change
+	c.modTime = modTime
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	return nil
+}
+
+// GetCertificate returns the current certificate.
+func (c *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Watch checks the modification time of the files at each interval and
+// reloads the certificate when they changed, until ctx is done. Errors are
+// logged and the check is repeated at the next interval.
+func (c *CertStore) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.mu.RLock()
+		modTime := c.modTime
+		c.mu.RUnlock()
+		if c.filesModTime().Equal(modTime) {
+			continue
+		}
+		if err := c.Reload(); err != nil {
+			log.Printf("smtpd: reloading certificate %s: %v", c.certFile, err)
+		}
+	}
+}
+
+// filesModTime returns the latest modification time of the files
+func (c *CertStore) filesModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
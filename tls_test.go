@@ -0,0 +1,153 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificateGetter struct {
+	cert *tls.Certificate
+	name string
+}
+
+func (g *testCertificateGetter) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	g.name = hello.ServerName
+	return g.cert, nil
+}
+
+func TestAutocertTLSConfig(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	getter := &testCertificateGetter{cert: &cert}
+	server := &Server{
+		TLSConfig:   AutocertTLSConfig(getter),
+		ImplicitTLS: true,
+	}
+
+	config := &tls.Config{InsecureSkipVerify: true, ServerName: "mx.example.com"}
+	c, done := dialServerTLS(t, server, testHandler{}, config)
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+	if getter.name != "mx.example.com" {
+		t.Fatalf("certificate not requested for server name, got %q", getter.name)
+	}
+}
+
+func TestCertStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "smtpd")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	copyFile := func(src, dst string) {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if err := ioutil.WriteFile(dst, data, 0600); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+
+	if _, err := NewCertStore(certFile, keyFile); err == nil {
+		t.Fatalf("expected error for missing files")
+	}
+	copyFile("testdata/cert.pem", certFile)
+	copyFile("testdata/key.pem", keyFile)
+	store, err := NewCertStore(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	first, _ := store.GetCertificate(nil)
+
+	// failed reload keeps the certificate
+	ioutil.WriteFile(certFile, []byte("invalid"), 0600)
+	if err := store.Reload(); err == nil {
+		t.Fatalf("expected error for invalid certificate")
+	}
+	if cert, _ := store.GetCertificate(nil); cert != first {
+		t.Fatalf("certificate replaced after failed reload")
+	}
+
+	// changed files are reloaded by Watch
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.Watch(ctx, 10*time.Millisecond)
+	copyFile("testdata/cert.pem", certFile)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(certFile, future, future)
+	for i := 0; i < 100; i++ {
+		if cert, _ := store.GetCertificate(nil); cert != first {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("certificate not reloaded")
+}
+
+func TestTLSOptions(t *testing.T) {
+
+	cert, err := tls.LoadX509KeyPair("testdata/cert.pem", "testdata/key.pem")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	config := DefaultTLSConfig()
+	config.Certificates = []tls.Certificate{cert}
+	server := &Server{
+		TLSConfig:     config,
+		TLSMinVersion: tls.VersionTLS13,
+		ImplicitTLS:   true,
+	}
+
+	// TLS 1.2 client is refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer listener.Close()
+	refused := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			refused <- err
+			return
+		}
+		defer conn.Close()
+		refused <- server.ServeSMTP(conn, testHandler{})
+	}()
+	client := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}
+	if conn, err := tls.Dial("tcp", listener.Addr().String(), client); err == nil {
+		conn.Close()
+		t.Fatalf("expected handshake to fail")
+	}
+	if err := <-refused; err == nil {
+		t.Fatalf("expected handshake error")
+	}
+
+	c, done := dialServerTLS(t, server, testHandler{}, &tls.Config{InsecureSkipVerify: true})
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 221, "QUIT")
+	<-done
+	if counts := server.TLSVersionCounts(); counts["TLS 1.3"] != 1 || len(counts) != 1 {
+		t.Fatalf("unexpected version counts %v", counts)
+	}
+}
@@ -0,0 +1,286 @@
+/*
+Package tlsrpt implements SMTP TLS Reporting (RFC 8460).
+
+A Collector aggregates the results of TLS sessions, either of inbound
+sessions through a smtpd.HandshakeHandler or of outbound delivery attempts,
+and produces aggregate reports that can be sent to the reporting address
+published by a domain. ParseReport reads reports received from others.
+*/
+package tlsrpt
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+	"github.com/emailfabric/smtpd/mtasts"
+)
+
+// Policy types
+const (
+	PolicyTypeSTS           = "sts"
+	PolicyTypeTLSA          = "tlsa"
+	PolicyTypeNoPolicyFound = "no-policy-found"
+)
+
+// Result types of failed sessions
+const (
+	ResultSTARTTLSNotSupported    = "starttls-not-supported"
+	ResultCertificateHostMismatch = "certificate-host-mismatch"
+	ResultCertificateExpired      = "certificate-expired"
+	ResultCertificateNotTrusted   = "certificate-not-trusted"
+	ResultValidationFailure       = "validation-failure"
+	ResultTLSAInvalid             = "tlsa-invalid"
+	ResultDNSSECInvalid           = "dnssec-invalid"
+	ResultDANERequired            = "dane-required"
+	ResultSTSPolicyFetchError     = "sts-policy-fetch-error"
+	ResultSTSPolicyInvalid        = "sts-policy-invalid"
+	ResultSTSWebPKIInvalid        = "sts-webpki-invalid"
+)
+
+// Report is an aggregate report.
+type Report struct {
+	OrganizationName string         `json:"organization-name"`
+	DateRange        DateRange      `json:"date-range"`
+	ContactInfo      string         `json:"contact-info"`
+	ReportID         string         `json:"report-id"`
+	Policies         []PolicyResult `json:"policies"`
+}
+
+// DateRange is the period covered by a report.
+type DateRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+// PolicyResult holds the results of the sessions with a policy.
+type PolicyResult struct {
+	Policy         Policy    `json:"policy"`
+	Summary        Summary   `json:"summary"`
+	FailureDetails []Failure `json:"failure-details,omitempty"`
+}
+
+// Policy identifies the policy that was applied to sessions.
+type Policy struct {
+	Type   string   `json:"policy-type"`
+	String []string `json:"policy-string,omitempty"`
+	Domain string   `json:"policy-domain"`
+	MXHost []string `json:"mx-host,omitempty"`
+}
+
+// Summary holds the number of successful and failed sessions.
+type Summary struct {
+	TotalSuccessful int64 `json:"total-successful-session-count"`
+	TotalFailure    int64 `json:"total-failure-session-count"`
+}
+
+// Failure describes failed sessions with the same details.
+type Failure struct {
+	ResultType            string `json:"result-type"`
+	SendingMTAIP          string `json:"sending-mta-ip,omitempty"`
+	ReceivingMXHostname   string `json:"receiving-mx-hostname,omitempty"`
+	ReceivingMXHelo       string `json:"receiving-mx-helo,omitempty"`
+	ReceivingIP           string `json:"receiving-ip,omitempty"`
+	FailedSessionCount    int64  `json:"failed-session-count"`
+	AdditionalInformation string `json:"additional-information,omitempty"`
+	FailureReasonCode     string `json:"failure-reason-code,omitempty"`
+}
+
+// STSPolicy returns the Policy for the MTA-STS policy p of domain, or a
+// policy of type "no-policy-found" when p is nil.
+func STSPolicy(domain string, p *mtasts.Policy) Policy {
+	if p == nil {
+		return Policy{Type: PolicyTypeNoPolicyFound, Domain: domain}
+	}
+	lines := []string{"version: " + p.Version, "mode: " + p.Mode}
+	for _, mx := range p.MX {
+		lines = append(lines, "mx: "+mx)
+	}
+	lines = append(lines, "max_age: "+strconv.FormatInt(int64(p.MaxAge/time.Second), 10))
+	return Policy{Type: PolicyTypeSTS, String: lines, Domain: domain, MXHost: p.MX}
+}
+
+// ResultType returns the result type for a TLS handshake error.
+func ResultType(err error) string {
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+	switch {
+	case errors.As(err, &hostErr):
+		return ResultCertificateHostMismatch
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return ResultCertificateExpired
+	case errors.As(err, &authorityErr):
+		return ResultCertificateNotTrusted
+	}
+	return ResultValidationFailure
+}
+
+// Collector aggregates session results for a report. It is safe for
+// concurrent use.
+type Collector struct {
+	// Sessions that negotiated an older TLS version are reported as failed
+	// with failure reason code "protocol-downgrade", if set
+	MinVersion uint16
+
+	mu       sync.Mutex
+	start    time.Time
+	policies []*PolicyResult
+}
+
+// result returns the result of policy, c.mu must be held
+func (c *Collector) result(policy Policy) *PolicyResult {
+	if c.start.IsZero() {
+		c.start = time.Now().UTC()
+	}
+	for _, r := range c.policies {
+		if r.Policy.Type == policy.Type && r.Policy.Domain == policy.Domain {
+			return r
+		}
+	}
+	r := &PolicyResult{Policy: policy}
+	c.policies = append(c.policies, r)
+	return r
+}
+
+// AddSuccess records a successful session.
+func (c *Collector) AddSuccess(policy Policy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.result(policy).Summary.TotalSuccessful++
+}
+
+// AddFailure records a failed session. The FailedSessionCount of failure is
+// ignored, failures with the same details are counted together.
+func (c *Collector) AddFailure(policy Policy, failure Failure) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.result(policy)
+	r.Summary.TotalFailure++
+	failure.FailedSessionCount = 0
+	for i := range r.FailureDetails {
+		if r.FailureDetails[i].details() == failure {
+			r.FailureDetails[i].FailedSessionCount++
+			return
+		}
+	}
+	failure.FailedSessionCount = 1
+	r.FailureDetails = append(r.FailureDetails, failure)
+}
+
+// details returns the failure without count for comparison
+func (f Failure) details() Failure {
+	f.FailedSessionCount = 0
+	return f
+}
+
+// AddSession records the result of the TLS handshake of an inbound session,
+// as passed to smtpd.HandshakeHandler.
+func (c *Collector) AddSession(policy Policy, sess *smtpd.Session, err error) {
+	failure := Failure{
+		SendingMTAIP:        hostIP(sess.RemoteAddr),
+		ReceivingIP:         hostIP(sess.LocalAddr),
+		ReceivingMXHostname: policy.Domain,
+	}
+	if sess.TLS != nil && sess.TLS.ServerName != "" {
+		failure.ReceivingMXHostname = sess.TLS.ServerName
+	}
+	switch {
+	case err != nil:
+		failure.ResultType = ResultType(err)
+		failure.AdditionalInformation = err.Error()
+	case sess.TLS != nil && c.MinVersion != 0 && sess.TLS.Version < c.MinVersion:
+		failure.ResultType = ResultValidationFailure
+		failure.FailureReasonCode = "protocol-downgrade"
+	default:
+		c.AddSuccess(policy)
+		return
+	}
+	c.AddFailure(policy, failure)
+}
+
+// Report returns the report of the results collected since the previous
+// report and resets the collector.
+func (c *Collector) Report(organization, contact, reportID string) *Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().UTC()
+	start := c.start
+	if start.IsZero() {
+		start = now
+	}
+	report := &Report{
+		OrganizationName: organization,
+		DateRange:        DateRange{Start: start, End: now},
+		ContactInfo:      contact,
+		ReportID:         reportID,
+		Policies:         make([]PolicyResult, 0, len(c.policies)),
+	}
+	for _, r := range c.policies {
+		report.Policies = append(report.Policies, *r)
+	}
+	c.policies = nil
+	c.start = now
+	return report
+}
+
+// Filename returns the file name for the report as recommended by RFC 8460,
+// for the receiving domain and the domain of the sender of the report.
+func (r *Report) Filename(receiver, sender string) string {
+	return fmt.Sprintf("%s!%s!%d!%d!%s.json.gz", receiver, sender,
+		r.DateRange.Start.Unix(), r.DateRange.End.Unix(), strings.Replace(r.ReportID, "!", "_", -1))
+}
+
+// WriteGzip writes the report as gzip compressed JSON.
+func (r *Report) WriteGzip(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	if err := json.NewEncoder(gz).Encode(r); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ParseReport reads a report in JSON format, which may be gzip compressed.
+func ParseReport(r io.Reader) (*Report, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+	report := &Report{}
+	if err := json.NewDecoder(r).Decode(report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// hostIP returns the IP address of addr, or an empty string
+func hostIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
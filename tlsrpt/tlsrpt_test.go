@@ -0,0 +1,89 @@
+package tlsrpt
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+	"github.com/emailfabric/smtpd/mtasts"
+)
+
+func TestResultType(t *testing.T) {
+
+	tests := map[error]string{
+		x509.HostnameError{Host: "mx.example.com"}:                     ResultCertificateHostMismatch,
+		x509.CertificateInvalidError{Reason: x509.Expired}:             ResultCertificateExpired,
+		x509.CertificateInvalidError{Reason: x509.NotAuthorizedToSign}: ResultValidationFailure,
+		x509.UnknownAuthorityError{}:                                   ResultCertificateNotTrusted,
+		errors.New("tls: handshake failure"):                           ResultValidationFailure,
+	}
+	for err, expected := range tests {
+		if result := ResultType(err); result != expected {
+			t.Errorf("%v: expected %s, got %s", err, expected, result)
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+
+	policy := STSPolicy("example.com", &mtasts.Policy{
+		Version: "STSv1",
+		Mode:    mtasts.ModeEnforce,
+		MX:      []string{"mx.example.com"},
+		MaxAge:  24 * time.Hour,
+	})
+	c := &Collector{MinVersion: tls.VersionTLS12}
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}
+	local := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 25}
+
+	c.AddSession(policy, &smtpd.Session{RemoteAddr: remote, LocalAddr: local,
+		TLS: &tls.ConnectionState{Version: tls.VersionTLS13, ServerName: "mx.example.com"}}, nil)
+	c.AddSession(policy, &smtpd.Session{RemoteAddr: remote, LocalAddr: local,
+		TLS: &tls.ConnectionState{Version: tls.VersionTLS10}}, nil)
+	for i := 0; i < 2; i++ {
+		c.AddSession(policy, &smtpd.Session{RemoteAddr: remote, LocalAddr: local}, x509.UnknownAuthorityError{})
+	}
+	c.AddFailure(STSPolicy("example.org", nil), Failure{ResultType: ResultSTARTTLSNotSupported, ReceivingMXHostname: "mx.example.org"})
+
+	report := c.Report("Example Org", "mailto:tlsrpt@example.net", "1")
+	if len(report.Policies) != 2 {
+		t.Fatalf("expected 2 policies, got %d", len(report.Policies))
+	}
+	r := report.Policies[0]
+	if r.Summary.TotalSuccessful != 1 || r.Summary.TotalFailure != 3 || len(r.FailureDetails) != 2 {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	if f := r.FailureDetails[0]; f.FailureReasonCode != "protocol-downgrade" || f.SendingMTAIP != "192.0.2.1" || f.ReceivingIP != "198.51.100.1" {
+		t.Fatalf("unexpected failure %+v", f)
+	}
+	if f := r.FailureDetails[1]; f.ResultType != ResultCertificateNotTrusted || f.FailedSessionCount != 2 {
+		t.Fatalf("unexpected failure %+v", f)
+	}
+	if p := report.Policies[1].Policy; p.Type != PolicyTypeNoPolicyFound || p.Domain != "example.org" {
+		t.Fatalf("unexpected policy %+v", p)
+	}
+	if next := c.Report("Example Org", "mailto:tlsrpt@example.net", "2"); len(next.Policies) != 0 {
+		t.Fatalf("collector not reset")
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteGzip(&buf); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	parsed, err := ParseReport(&buf)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if parsed.ReportID != "1" || len(parsed.Policies) != 2 || parsed.Policies[0].Policy.String[1] != "mode: enforce" {
+		t.Fatalf("unexpected parsed report %+v", parsed)
+	}
+	if name := report.Filename("example.com", "example.net"); !strings.HasPrefix(name, "example.com!example.net!") || !strings.HasSuffix(name, "!1.json.gz") {
+		t.Fatalf("unexpected filename %q", name)
+	}
+}
@@ -0,0 +1,188 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+)
+
+// Tracer starts the spans of distributed tracing, for example with
+// OpenTelemetry. A server with a Tracer creates a span per session with
+// child spans per mail transaction and per command. The command spans are
+// children of the transaction span from MAIL to the end of the transaction.
+//
+// The context returned by Start is passed to the handler calls of the
+// command, so that the handler can create child spans and propagate the
+// trace to its backends. An adapter for an OpenTelemetry tracer:
+//
+//	type otelTracer struct{ trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string, attrs ...smtpd.Attribute) (context.Context, smtpd.Span) {
+//		ctx, span := t.Tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+//		s := otelSpan{span}
+//		s.SetAttributes(attrs...)
+//		return ctx, s
+//	}
+//
+//	type otelSpan struct{ trace.Span }
+//
+//	func (s otelSpan) SetAttributes(attrs ...smtpd.Attribute) {
+//		for _, a := range attrs {
+//			switch v := a.Value.(type) {
+//			case string:
+//				s.Span.SetAttributes(attribute.String(a.Key, v))
+//			case int64:
+//				s.Span.SetAttributes(attribute.Int64(a.Key, v))
+//			}
+//		}
+//	}
+//
+//	func (s otelSpan) End() { s.Span.End() }
+type Tracer interface {
+	// Start starts a span as child of the span in ctx
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	End()
+}
+
+// Attribute is an attribute of a span. The value is a string or an int64.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Names of the spans and attributes
+const (
+	SpanSession     = "smtp.session"
+	SpanTransaction = "smtp.transaction"
+	SpanCommand     = "smtp.command" // followed by a space and the verb
+
+	AttrClientAddress = "client.address"    // IP address of the client
+	AttrClientPort    = "client.port"       // port of the client
+	AttrHelo          = "smtp.helo"         // hostname given with HELO/EHLO
+	AttrTLSVersion    = "tls.version"       // e.g. "TLS 1.3"
+	AttrAuthUsername  = "smtp.auth.user"    // authenticated user
+	AttrVerb          = "smtp.command"      // verb of the command
+	AttrReplyCode     = "smtp.reply_code"   // status code of the reply
+	AttrSender        = "smtp.sender"       // reverse path of the transaction
+	AttrMessageSize   = "smtp.message.size" // bytes of message data received
+)
+
+// trace holds the spans of a session
+type trace struct {
+	ctx     context.Context // context of the session span
+	span    Span
+	txCtx   context.Context // context of the transaction span
+	txSpan  Span
+	cmdSpan Span
+}
+
+// startSession starts the session span, the context of the session becomes
+// its context
+func (s *session) startSession() {
+	t := s.server.Tracer
+	if t == nil {
+		return
+	}
+	var attrs []Attribute
+	if ip := remoteIP(s.RemoteAddr); ip != nil {
+		attrs = append(attrs, Attribute{AttrClientAddress, ip.String()})
+		if _, port, err := net.SplitHostPort(s.RemoteAddr.String()); err == nil {
+			if n, err := strconv.ParseInt(port, 10, 64); err == nil {
+				attrs = append(attrs, Attribute{AttrClientPort, n})
+			}
+		}
+	}
+	s.ctx, s.trace.span = t.Start(s.ctx, SpanSession, attrs...)
+	s.trace.ctx = s.ctx
+}
+
+// endSession ends the open spans of the session
+func (s *session) endSession() {
+	if s.trace.span == nil {
+		return
+	}
+	if s.trace.cmdSpan != nil {
+		s.trace.cmdSpan.End()
+		s.trace.cmdSpan = nil
+	}
+	s.endTransaction()
+	var attrs []Attribute
+	if s.Helo != "" {
+		attrs = append(attrs, Attribute{AttrHelo, s.Helo})
+	}
+	if s.TLS != nil {
+		attrs = append(attrs, Attribute{AttrTLSVersion, tls.VersionName(s.TLS.Version)})
+	}
+	if s.AuthUsername != "" {
+		attrs = append(attrs, Attribute{AttrAuthUsername, s.AuthUsername})
+	}
+	s.trace.span.SetAttributes(attrs...)
+	s.trace.span.End()
+	s.trace.span = nil
+}
+
+// startCommand starts the span of a command, MAIL also starts the
+// transaction span. The handler calls of the command get the context of the
+// command span until the command is recorded.
+func (s *session) startCommand(verb string) {
+	t := s.server.Tracer
+	if t == nil || s.trace.span == nil {
+		return
+	}
+	if verb == "MAIL" && s.trace.txSpan == nil && !s.hasSender {
+		s.trace.txCtx, s.trace.txSpan = t.Start(s.trace.ctx, SpanTransaction)
+	}
+	parent := s.trace.ctx
+	if s.trace.txSpan != nil {
+		parent = s.trace.txCtx
+	}
+	s.ctx, s.trace.cmdSpan = t.Start(parent, SpanCommand+" "+verb, Attribute{AttrVerb, verb})
+}
+
+// endCommand ends the span of the command with the reply code, and the
+// transaction span when the command ended the transaction
+func (s *session) endCommand() {
+	if s.trace.cmdSpan == nil {
+		return
+	}
+	s.trace.cmdSpan.SetAttributes(Attribute{AttrReplyCode, int64(s.conn.code)})
+	s.trace.cmdSpan.End()
+	s.trace.cmdSpan = nil
+	s.ctx = s.trace.ctx
+	if !s.hasSender {
+		s.endTransaction()
+	}
+}
+
+// endTransaction ends the transaction span
+func (s *session) endTransaction() {
+	if s.trace.txSpan == nil {
+		return
+	}
+	s.trace.txSpan.End()
+	s.trace.txSpan, s.trace.txCtx = nil, nil
+}
+
+// traceSender adds the sender to the transaction span
+func (s *session) traceSender(addr string) {
+	if s.trace.txSpan != nil {
+		s.trace.txSpan.SetAttributes(Attribute{AttrSender, addr})
+	}
+}
+
+// traceMessage adds the size of the message and the reply code to the
+// transaction span
+func (s *session) traceMessage(size int64) {
+	if s.trace.txSpan != nil {
+		s.trace.txSpan.SetAttributes(
+			Attribute{AttrMessageSize, size},
+			Attribute{AttrReplyCode, int64(s.conn.code)},
+		)
+	}
+}
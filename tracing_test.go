@@ -0,0 +1,172 @@
+package smtpd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type spanKey struct{}
+
+type testSpan struct {
+	tracer *testTracer
+	name   string
+	parent string
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attribute) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *testSpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.ended = true
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	span := &testSpan{tracer: t, name: name, attrs: make(map[string]interface{})}
+	if parent, ok := ctx.Value(spanKey{}).(*testSpan); ok {
+		span.parent = parent.name
+	}
+	span.SetAttributes(attrs...)
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// tracedHandler records the span of the context of the handler calls
+type tracedHandler struct {
+	spans []string
+}
+
+func (h *tracedHandler) record(ctx context.Context) {
+	if span, ok := ctx.Value(spanKey{}).(*testSpan); ok {
+		h.spans = append(h.spans, span.name)
+	}
+}
+
+func (h *tracedHandler) Connect(ctx context.Context, source string) error {
+	h.record(ctx)
+	return nil
+}
+
+func (h *tracedHandler) Hello(ctx context.Context, hostname string) error {
+	h.record(ctx)
+	return nil
+}
+
+func (h *tracedHandler) AuthUser(ctx context.Context, identity, username string) (string, error) {
+	return "", fmt.Errorf("535 5.7.8 Authentication failed")
+}
+
+func (h *tracedHandler) Sender(ctx context.Context, address string) error {
+	h.record(ctx)
+	return nil
+}
+
+func (h *tracedHandler) Recipient(ctx context.Context, address string) error {
+	h.record(ctx)
+	if address == "unknown@example.com" {
+		return fmt.Errorf("550 5.1.1 No such user")
+	}
+	return nil
+}
+
+func (h *tracedHandler) Message(ctx context.Context, r io.Reader) error {
+	h.record(ctx)
+	_, err := ioutil.ReadAll(r)
+	return err
+}
+
+func TestTracer(t *testing.T) {
+
+	tracer := &testTracer{}
+	handler := &tracedHandler{}
+	c, done := dialServerContext(t, &Server{Tracer: tracer}, handler)
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 550, "RCPT TO:<unknown@example.com>")
+	cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+	cmd(t, c, 354, "DATA")
+	cmd(t, c, 250, "Subject: test\r\n\r\ntraced\r\n.")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RSET")
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	expected := []string{
+		"smtp.session",
+		"smtp.command EHLO",
+		"smtp.command MAIL",
+		"smtp.command RCPT",
+		"smtp.command RCPT",
+		"smtp.command DATA",
+		"smtp.command MAIL",
+	}
+	if !reflect.DeepEqual(handler.spans, expected) {
+		t.Fatalf("expected handler spans %v, got %v", expected, handler.spans)
+	}
+
+	type span struct {
+		name, parent string
+	}
+	var spans []span
+	for _, s := range tracer.spans {
+		if !s.ended {
+			t.Fatalf("span %s not ended", s.name)
+		}
+		spans = append(spans, span{s.name, s.parent})
+	}
+	expectedSpans := []span{
+		{"smtp.session", ""},
+		{"smtp.command EHLO", "smtp.session"},
+		{"smtp.transaction", "smtp.session"},
+		{"smtp.command MAIL", "smtp.transaction"},
+		{"smtp.command RCPT", "smtp.transaction"},
+		{"smtp.command RCPT", "smtp.transaction"},
+		{"smtp.command DATA", "smtp.transaction"},
+		{"smtp.transaction", "smtp.session"},
+		{"smtp.command MAIL", "smtp.transaction"},
+		{"smtp.command RSET", "smtp.transaction"},
+		{"smtp.command QUIT", "smtp.session"},
+	}
+	if !reflect.DeepEqual(spans, expectedSpans) {
+		t.Fatalf("expected spans %v, got %v", expectedSpans, spans)
+	}
+
+	session, tx := tracer.spans[0], tracer.spans[2]
+	if session.attrs[AttrClientAddress] != "127.0.0.1" || session.attrs[AttrHelo] != "localhost" {
+		t.Fatalf("unexpected session attributes %v", session.attrs)
+	}
+	if tx.attrs[AttrSender] != "sender@example.com" || tx.attrs[AttrMessageSize] != int64(25) ||
+		tx.attrs[AttrReplyCode] != int64(250) {
+		t.Fatalf("unexpected transaction attributes %v", tx.attrs)
+	}
+	if rcpt := tracer.spans[4]; rcpt.attrs[AttrVerb] != "RCPT" || rcpt.attrs[AttrReplyCode] != int64(550) {
+		t.Fatalf("unexpected command attributes %v", rcpt.attrs)
+	}
+}
@@ -0,0 +1,242 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transcripts configures the recording of the transcripts of sessions, for
+// example to troubleshoot interoperability with specific clients. Each line
+// of the client is preceded by "C: " and each line of the server by "S: ".
+// The responses of AUTH exchanges are replaced by "***".
+type Transcripts struct {
+	// Sink receives the transcript at the end of each session
+	Sink TranscriptSink
+
+	// Only pass transcripts of sessions with a 4xx or 5xx reply or that
+	// ended with an error
+	OnError bool
+
+	// Include the message data, which is left out otherwise
+	Data bool
+
+	// Maximum size of a transcript in bytes, 1 MiB if zero. The rest of
+	// longer sessions is replaced by "[truncated]".
+	MaxSize int
+}
+
+// TranscriptSink receives the transcripts of sessions recorded with
+// Server.Transcripts.
+type TranscriptSink interface {
+	// Transcript is called at the end of a session, the transcript may be
+	// retained. It is called by the session and should not block.
+	Transcript(sess *Session, transcript []byte)
+}
+
+const defaultMaxTranscript = 1 << 20
+
+// transcript records the lines of a session
+type transcript struct {
+	buf       bytes.Buffer
+	max       int
+	dir       byte // direction of an incomplete last line, 0 if complete
+	failed    bool // a 4xx or 5xx reply was recorded
+	truncated bool
+}
+
+// write records the lines in p of the client ('C') or the server ('S')
+func (t *transcript) write(dir byte, p []byte) {
+	if t.dir != 0 && t.dir != dir {
+		t.buf.WriteByte('\n')
+		t.dir = 0
+	}
+	for len(p) > 0 && !t.truncated {
+		if t.dir == 0 {
+			if t.buf.Len() >= t.max {
+				t.buf.WriteString("[truncated]\n")
+				t.truncated = true
+				return
+			}
+			if dir == 'S' && len(p) >= 3 && replyCode(string(p[:3])) >= 400 {
+				t.failed = true
+			}
+			t.buf.WriteByte(dir)
+			t.buf.WriteString(": ")
+		}
+		line := p
+		i := bytes.IndexByte(p, '\n')
+		if i >= 0 {
+			line, p = p[:i], p[i+1:]
+		} else {
+			p = nil
+		}
+		t.buf.Write(bytes.TrimSuffix(line, []byte{'\r'}))
+		if i >= 0 {
+			t.buf.WriteByte('\n')
+			t.dir = 0
+		} else {
+			t.dir = dir
+		}
+	}
+}
+
+// transcriptWriter records the data written to the transcript
+type transcriptWriter struct {
+	t   *transcript
+	dir byte
+}
+
+func (w transcriptWriter) Write(p []byte) (int, error) {
+	w.t.write(w.dir, p)
+	return len(p), nil
+}
+
+// startTranscript starts recording the transcript if configured
+func (s *session) startTranscript() {
+	tc := s.server.Transcripts
+	if tc == nil || tc.Sink == nil {
+		return
+	}
+	max := tc.MaxSize
+	if max <= 0 {
+		max = defaultMaxTranscript
+	}
+	s.transcript = &transcript{max: max}
+}
+
+// endTranscript passes the transcript to the sink, err is the error that
+// ended the session
+func (s *session) endTranscript(err error) {
+	t := s.transcript
+	if t == nil {
+		return
+	}
+	s.transcript = nil
+	if s.server.Transcripts.OnError && !t.failed && err == nil {
+		return
+	}
+	if t.dir != 0 {
+		t.buf.WriteByte('\n')
+	}
+	if err != nil && !t.truncated {
+		fmt.Fprintf(&t.buf, "[%v]\n", err)
+	}
+	s.server.Transcripts.Sink.Transcript(&s.Session, t.buf.Bytes())
+}
+
+// recordCommand records a command line read from the client, hiding the
+// initial response of AUTH
+func (s *session) recordCommand(line string, err error) {
+	if s.transcript == nil {
+		return
+	}
+	if err == errLineTooLong {
+		line = "[line too long]"
+	} else if err != nil {
+		return
+	}
+	verb, params := split1(strings.TrimSpace(line))
+	if strings.EqualFold(verb, "AUTH") {
+		if mech, resp := split1(params); resp != "" {
+			line = verb + " " + mech + " ***"
+		}
+	}
+	s.transcript.write('C', []byte(line+"\n"))
+}
+
+// recordAuthResp records a response of an AUTH exchange, which may contain
+// a password
+func (s *session) recordAuthResp(line string) {
+	if s.transcript == nil {
+		return
+	}
+	if line != "*" {
+		line = "***"
+	}
+	s.transcript.write('C', []byte(line+"\n"))
+}
+
+// recordData returns a reader that records the message data read from r if
+// Transcripts.Data is set
+func (s *session) recordData(r io.Reader) io.Reader {
+	if s.transcript == nil || !s.server.Transcripts.Data {
+		return r
+	}
+	return io.TeeReader(r, transcriptWriter{s.transcript, 'C'})
+}
+
+// TranscriptDir is a TranscriptSink that writes each transcript to a file in
+// a directory, named after the time and the session ID.
+type TranscriptDir struct {
+	Dir string
+
+	// Optional hook called with errors of writing transcripts
+	OnError func(err error)
+}
+
+// Transcript writes the transcript to a file.
+func (d *TranscriptDir) Transcript(sess *Session, transcript []byte) {
+	name := time.Now().UTC().Format("20060102T150405Z") + "-" + sess.ID + ".txt"
+	err := ioutil.WriteFile(filepath.Join(d.Dir, name), transcript, 0600)
+	if err != nil && d.OnError != nil {
+		d.OnError(fmt.Errorf("smtpd: writing transcript: %v", err))
+	}
+}
+
+// SessionTranscript is a transcript kept by a TranscriptRing.
+type SessionTranscript struct {
+	ID         string // see Session.ID
+	RemoteAddr net.Addr
+	End        time.Time // end of the session
+	Transcript []byte
+}
+
+// TranscriptRing is a TranscriptSink that keeps the most recent transcripts
+// in memory.
+type TranscriptRing struct {
+	mu      sync.Mutex
+	entries []SessionTranscript
+	next    int // index of the next entry to replace
+	full    bool
+}
+
+// NewTranscriptRing returns a TranscriptRing that keeps size transcripts.
+func NewTranscriptRing(size int) *TranscriptRing {
+	return &TranscriptRing{entries: make([]SessionTranscript, size)}
+}
+
+// Transcript keeps the transcript, replacing the oldest if the ring is full.
+func (r *TranscriptRing) Transcript(sess *Session, transcript []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) == 0 {
+		return
+	}
+	r.entries[r.next] = SessionTranscript{
+		ID:         sess.ID,
+		RemoteAddr: sess.RemoteAddr,
+		End:        time.Now(),
+		Transcript: transcript,
+	}
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Transcripts returns the transcripts kept, the oldest first.
+func (r *TranscriptRing) Transcripts() []SessionTranscript {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]SessionTranscript(nil), r.entries[:r.next]...)
+	}
+	return append(append([]SessionTranscript(nil), r.entries[r.next:]...), r.entries[:r.next]...)
+}
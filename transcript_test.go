@@ -0,0 +1,84 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTranscripts(t *testing.T) {
+
+	ring := NewTranscriptRing(2)
+	server := &Server{Transcripts: &Transcripts{Sink: ring, Data: true}}
+	c, done := dialServer(t, server, testHandler{})
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cmd(t, c, 250, "EHLO localhost")
+	cmd(t, c, 334, "AUTH CRAM-MD5")
+	cmd(t, c, 535, "dXNlciBzZWNyZXQ=")
+	cmd(t, c, 502, "AUTH PLAIN AHVzZXIAc2VjcmV0")
+	cmd(t, c, 250, "MAIL FROM:<sender@example.com>")
+	cmd(t, c, 250, "RCPT TO:<recipient@example.com>")
+	cmd(t, c, 354, "DATA")
+	cmd(t, c, 250, "Subject: test\r\n\r\nThis is a test.\r\n.")
+	cmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	transcripts := ring.Transcripts()
+	if len(transcripts) != 1 || transcripts[0].ID == "" {
+		t.Fatalf("unexpected transcripts %v", transcripts)
+	}
+	transcript := string(transcripts[0].Transcript)
+	for _, lines := range []string{
+		"C: EHLO localhost\nS: 250-",
+		"C: AUTH CRAM-MD5\nS: 334 ",
+		"C: ***\nS: 535 ",
+		"C: AUTH PLAIN ***\nS: 502 ",
+		"C: DATA\nS: 354 End data with <CR><LF>.<CR><LF>\nC: Subject: test\nC: \nC: This is a test.\nS: 250 2.0.0 OK\n",
+		"C: QUIT\nS: 221 ",
+	} {
+		if !strings.Contains(transcript, lines) {
+			t.Fatalf("%q not found in\n%s", lines, transcript)
+		}
+	}
+	if strings.Contains(transcript, "c2VjcmV0") {
+		t.Fatalf("credentials recorded in\n%s", transcript)
+	}
+
+	// sessions without errors are not passed with OnError
+	server.Transcripts.OnError = true
+	for _, command := range []struct {
+		line string
+		code int
+	}{{"NOOP", 250}, {"FOO", 500}} {
+		c, done := dialServer(t, server, testHandler{})
+		defer c.Close()
+		if _, _, err := c.ReadResponse(220); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		cmd(t, c, 250, "EHLO localhost")
+		cmd(t, c, command.code, "%s", command.line)
+		cmd(t, c, 221, "QUIT")
+		<-done
+	}
+	transcripts = ring.Transcripts()
+	if len(transcripts) != 2 || !strings.Contains(string(transcripts[1].Transcript), "C: FOO\nS: 500 ") {
+		t.Fatalf("unexpected transcripts %v", transcripts)
+	}
+}
+
+func TestTranscriptRing(t *testing.T) {
+
+	ring := NewTranscriptRing(2)
+	for _, id := range []string{"a", "b", "c"} {
+		ring.Transcript(&Session{ID: id}, []byte(id))
+	}
+	transcripts := ring.Transcripts()
+	if len(transcripts) != 2 || transcripts[0].ID != "b" || transcripts[1].ID != "c" {
+		t.Fatalf("unexpected transcripts %v", transcripts)
+	}
+}
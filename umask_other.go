@@ -0,0 +1,15 @@
+//go:build !unix
+// +build !unix
+
+package smtpd
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnix listens on the unix socket at path, the permissions are set by
+// the caller
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,26 @@
+//go:build unix
+// +build unix
+
+package smtpd
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskMu serializes the changes of the umask of the process
+var umaskMu sync.Mutex
+
+// listenUnix listens on the unix socket at path, which is created with
+// permissions perm so it is never accessible to others meanwhile. The umask
+// applies to the whole process, files created by other goroutines during
+// the call are restricted to perm as well.
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(int(^perm & os.ModePerm))
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,70 @@
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// PeerCred holds the credentials of the process connected to a unix socket.
+type PeerCred struct {
+	PID int
+	UID int
+	GID int
+}
+
+// ListenAndServeUnix listens on the unix socket at path and then calls Serve
+// to handle incoming connections. A stale socket file left by a previous run
+// is removed, and the permissions of the new socket file are set to perm. The
+// socket file is removed when the server is closed.
+func (s *Server) ListenAndServeUnix(path string, perm os.FileMode) error {
+	l, err := ListenUnix(path, perm)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ListenUnix creates a listener on the unix socket at path with file
+// permissions perm. On Unix systems the socket is created with these
+// permissions, so it can not be connected to by others in the meantime. A
+// stale socket file is removed first, but an error is returned when the
+// socket is still in use. The socket file is removed when the listener is
+// closed.
+func ListenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("smtpd: %s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("smtpd: socket %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := listenUnix(path, perm)
+	if err != nil {
+		return nil, err
+	}
+	// where the umask is not supported
+	if err := os.Chmod(path, perm); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// unixSource returns the source passed to Handler.Connect for a connection
+// on a unix socket, which includes the peer credentials when available
+func unixSource(conn *net.UnixConn, cred *PeerCred) string {
+	source := "unix:" + conn.LocalAddr().String()
+	if cred != nil {
+		source += fmt.Sprintf(" pid=%d uid=%d gid=%d", cred.PID, cred.UID, cred.GID)
+	}
+	return source
+}
+
+var errNoPeerCred = errors.New("smtpd: peer credentials not supported")
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package smtpd
+
+import "net"
+
+// peerCred returns the credentials of the peer process of a unix socket
+func peerCred(conn *net.UnixConn) (*PeerCred, error) {
+	return nil, errNoPeerCred
+}
@@ -0,0 +1,91 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+)
+
+// VirtualHost holds the configuration for a domain that clients select with
+// the TLS server name indication (SNI).
+type VirtualHost struct {
+	// Hostname to use in responses after the TLS handshake, defaults to
+	// Server.Hostname
+	Hostname string
+
+	// Certificates presented to clients that request the host, the first
+	// certificate supported by the client is used. Server.TLSConfig is used
+	// when empty.
+	Certificates []tls.Certificate
+
+	// AuthUser replaces the AuthUser member of the handler for clients of
+	// the host when set
+	AuthUser func(ctx context.Context, identity, username string) (password string, err error)
+}
+
+// virtualHost returns the virtual host for a TLS server name, or nil
+func (s *Server) virtualHost(serverName string) *VirtualHost {
+	if serverName == "" {
+		return nil
+	}
+	return s.VirtualHosts[strings.ToLower(strings.TrimSuffix(serverName, "."))]
+}
+
+// tlsConfig returns the TLS configuration for connections, with the TLS
+// options of the server applied and selecting the certificate of the virtual
+// host requested by the client
+func (s *Server) tlsConfig() *tls.Config {
+	if len(s.VirtualHosts) == 0 && s.TLSMinVersion == 0 && s.TLSCipherSuites == nil && !s.AllowLegacyTLS {
+		return s.TLSConfig
+	}
+	s.tlsOnce.Do(func() {
+		base := s.TLSConfig
+		config := base.Clone()
+		if s.TLSMinVersion != 0 {
+			config.MinVersion = s.TLSMinVersion
+		}
+		if s.TLSCipherSuites != nil {
+			config.CipherSuites = s.TLSCipherSuites
+		}
+		if s.AllowLegacyTLS {
+			config.MinVersion = tls.VersionTLS10
+			if config.CipherSuites != nil {
+				config.CipherSuites = append(append([]uint16(nil), config.CipherSuites...), legacyCipherSuites...)
+			}
+		}
+		if len(s.VirtualHosts) > 0 {
+			config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if vh := s.virtualHost(hello.ServerName); vh != nil && len(vh.Certificates) > 0 {
+					for i := range vh.Certificates {
+						if hello.SupportsCertificate(&vh.Certificates[i]) == nil {
+							return &vh.Certificates[i], nil
+						}
+					}
+					return &vh.Certificates[0], nil
+				}
+				if base.GetCertificate != nil {
+					return base.GetCertificate(hello)
+				}
+				return nil, nil // use base.Certificates
+			}
+		}
+		s.tlsConf = config
+	})
+	return s.tlsConf
+}
+
+// hostname returns the hostname to use in responses
+func (s *session) hostname() string {
+	if s.vhost != nil && s.vhost.Hostname != "" {
+		return s.vhost.Hostname
+	}
+	return s.server.hostname()
+}
+
+// authUser returns the password of a user from the virtual host or handler
+func (s *session) authUser(identity, username string) (string, error) {
+	if s.vhost != nil && s.vhost.AuthUser != nil {
+		return s.vhost.AuthUser(s.ctx, identity, username)
+	}
+	return s.handler.AuthUser(s.ctx, identity, username)
+}
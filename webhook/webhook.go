@@ -0,0 +1,443 @@
+/*
+Package webhook feeds accepted messages to a web application with HTTP POST
+requests, like the inbound parse webhooks of email services.
+
+A Sink is a handler that posts each message as a JSON Payload with the
+envelope, the client and the message, either raw or parsed into its header,
+text and HTML bodies and attachments. Requests are signed with HMAC-SHA256
+when a secret is set, see Verify, and are retried when the endpoint is not
+available. The client gets a temporary error reply when the endpoint did not
+accept the message after the retries or when too many requests are pending,
+so the client retries the message later and no message is lost.
+
+The endpoint accepts a message with a 2xx response. It can reject the message
+with a 4xx response, whose body can start with the SMTP reply to send to the
+client, e.g. "550 5.1.1 Unknown recipient". Responses 429 and 5xx are
+retried.
+*/
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+)
+
+// Format of the message in a Payload
+type Format int
+
+const (
+	Raw    Format = iota // the message as received
+	Parsed               // the header, bodies and attachments
+)
+
+// Request headers
+const (
+	HeaderID        = "X-Webhook-Id"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+var (
+	// ErrBusy is returned by Sink.Message when MaxPending requests are
+	// pending.
+	ErrBusy = errors.New("451 4.3.2 Too many pending messages, try again later")
+
+	// ErrSignature is returned by Verify for requests with a missing or
+	// invalid signature.
+	ErrSignature = errors.New("webhook: invalid signature")
+
+	errUnavailable = errors.New("451 4.3.0 Message could not be delivered, try again later")
+)
+
+// Payload is the JSON document posted for a message, with the envelope and
+// the client in the embedded Metadata.
+type Payload struct {
+	// Random identifier of the message, the same for retried requests
+	ID string `json:"id"`
+	smtpd.Metadata
+
+	// Raw message, encoded in base64 in JSON, or the parsed message
+	Raw     []byte   `json:"raw,omitempty"`
+	Message *Message `json:"message,omitempty"`
+}
+
+// Message is a parsed message. Header values with encoded words are decoded,
+// and the bodies are decoded from their transfer encoding and converted to
+// UTF-8 when their charset is US-ASCII, UTF-8 or ISO-8859-1.
+type Message struct {
+	Header      map[string][]string `json:"header"`
+	Text        string              `json:"text,omitempty"`
+	HTML        string              `json:"html,omitempty"`
+	Attachments []Attachment        `json:"attachments,omitempty"`
+}
+
+// Attachment is a part of a message other than the text and HTML bodies.
+type Attachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	Content     []byte `json:"content"` // encoded in base64 in JSON
+}
+
+// NewPayload returns the payload for a message of the current transaction of
+// sess. A message that can not be parsed is included raw.
+func NewPayload(sess *smtpd.Session, msg []byte, format Format) *Payload {
+	p := &Payload{ID: randomID(), Metadata: *sess.Metadata(time.Now())}
+	if format == Parsed {
+		p.Message, _ = Parse(bytes.NewReader(msg))
+	}
+	if p.Message == nil {
+		p.Raw = msg
+	}
+	return p
+}
+
+// Sink is a handler that posts messages to an endpoint. The members other
+// than Message are handled by the embedded ContextHandler, which decides
+// which clients, senders and recipients are accepted:
+//
+//	sink := &webhook.Sink{
+//		ContextHandler: policy,
+//		URL:            "https://app.example.com/inbound",
+//		Secret:         []byte("secret"),
+//	}
+//	server := &smtpd.Server{
+//		NewContextHandler: func() smtpd.ContextHandler { return sink },
+//	}
+//
+// A Sink can be shared by sessions.
+type Sink struct {
+	smtpd.ContextHandler
+
+	// URL of the endpoint
+	URL string
+
+	// Format of the posted messages, Raw by default
+	Format Format
+
+	// Key of the HMAC signature of the requests, requests are not signed
+	// when empty
+	Secret []byte
+
+	// Additional request headers, for example for authorization
+	Header http.Header
+
+	// Client used to post messages, defaults to a client with a timeout of
+	// 30 seconds
+	Client *http.Client
+
+	// Number of attempts to post a message, 3 if zero. The time between
+	// attempts is RetryInterval, 1 second if zero, and doubles after each
+	// attempt, unless the response has a Retry-After header.
+	MaxAttempts   int
+	RetryInterval time.Duration
+
+	// Maximum number of messages being posted at the same time, 10 if zero.
+	// Further messages are deferred with ErrBusy.
+	MaxPending int
+
+	// Optional hook called with the errors of failed attempts
+	OnError func(err error)
+
+	mu      sync.Mutex
+	pending chan struct{}
+}
+
+// Message posts the message.
+func (s *Sink) Message(ctx context.Context, r io.Reader) error {
+	pending := s.pendingChan()
+	select {
+	case pending <- struct{}{}:
+		defer func() { <-pending }()
+	default:
+		return ErrBusy
+	}
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	p := NewPayload(smtpd.SessionFromContext(ctx), msg, s.Format)
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return s.post(ctx, p.ID, body)
+}
+
+func (s *Sink) pendingChan() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == nil {
+		max := s.MaxPending
+		if max <= 0 {
+			max = 10
+		}
+		s.pending = make(chan struct{}, max)
+	}
+	return s.pending
+}
+
+// retryable is the error of an attempt that should be retried
+type retryable struct {
+	err   error
+	after time.Duration // requested with Retry-After, zero when not given
+}
+
+func (e *retryable) Error() string {
+	return e.err.Error()
+}
+
+// post posts a payload with retries
+func (s *Sink) post(ctx context.Context, id string, body []byte) error {
+	attempts := s.MaxAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	interval := s.RetryInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.send(ctx, id, body)
+		re, ok := err.(*retryable)
+		if !ok {
+			return err
+		}
+		s.error(re.err)
+		if attempt >= attempts {
+			return errUnavailable
+		}
+		wait := interval
+		if re.after > 0 {
+			wait = re.after
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errUnavailable
+		case <-timer.C:
+		}
+		interval *= 2
+	}
+}
+
+func (s *Sink) error(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+var reReply = regexp.MustCompile(`^[45]\d\d[ -]`)
+
+// send makes an attempt to post a payload
+func (s *Sink) send(ctx context.Context, id string, body []byte) error {
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		s.error(err)
+		return errUnavailable
+	}
+	req = req.WithContext(ctx)
+	for name, values := range s.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderID, id)
+	if len(s.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(HeaderTimestamp, timestamp)
+		req.Header.Set(HeaderSignature, Sign(s.Secret, timestamp, body))
+	}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return &retryable{err: err}
+	}
+	defer resp.Body.Close()
+	line, _ := bufio.NewReader(io.LimitReader(resp.Body, 512)).ReadString('\n')
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return &retryable{
+			err:   fmt.Errorf("webhook: %s responded %s", s.URL, resp.Status),
+			after: retryAfter(resp.Header.Get("Retry-After")),
+		}
+	case resp.StatusCode >= 400:
+		if line = strings.TrimRight(line, "\r\n"); reReply.MatchString(line) {
+			return errors.New(line)
+		}
+		return fmt.Errorf("554 5.6.0 Message rejected (%d)", resp.StatusCode)
+	default:
+		return &retryable{err: fmt.Errorf("webhook: %s responded %s", s.URL, resp.Status)}
+	}
+}
+
+// retryAfter returns the delay of a Retry-After header in seconds, or zero
+func retryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Sign returns the signature of a request body sent at timestamp, the value
+// of the X-Webhook-Timestamp header. The signature is "sha256=" followed by
+// the HMAC-SHA256 of the timestamp, a period and the body in hexadecimal.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a request received by an endpoint, body is
+// the request body. Requests with a timestamp that differs more than maxAge
+// from the current time are rejected to prevent replays, unless maxAge is
+// zero.
+func Verify(secret []byte, req *http.Request, body []byte, maxAge time.Duration) error {
+	timestamp := req.Header.Get(HeaderTimestamp)
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrSignature
+	}
+	if maxAge > 0 {
+		age := time.Since(time.Unix(sec, 0))
+		if age > maxAge || age < -maxAge {
+			return ErrSignature
+		}
+	}
+	expected := Sign(secret, timestamp, body)
+	if !hmac.Equal([]byte(req.Header.Get(HeaderSignature)), []byte(expected)) {
+		return ErrSignature
+	}
+	return nil
+}
+
+// Parse parses a message.
+func Parse(r io.Reader) (*Message, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{Header: make(map[string][]string)}
+	dec := new(mime.WordDecoder)
+	for name, values := range msg.Header {
+		for _, value := range values {
+			if decoded, err := dec.DecodeHeader(value); err == nil {
+				value = decoded
+			}
+			m.Header[name] = append(m.Header[name], value)
+		}
+	}
+	if err := m.addPart(textproto.MIMEHeader(msg.Header), msg.Body, 0); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// addPart adds the bodies and attachments of a part
+func (m *Message) addPart(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < 10 {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := m.addPart(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+	inline := disposition != "attachment" && filename == ""
+	switch {
+	case inline && mediaType == "text/plain" && m.Text == "":
+		m.Text = toUTF8(data, params["charset"])
+	case inline && mediaType == "text/html" && m.HTML == "":
+		m.HTML = toUTF8(data, params["charset"])
+	default:
+		m.Attachments = append(m.Attachments, Attachment{
+			Filename:    filename,
+			ContentType: mediaType,
+			Content:     data,
+		})
+	}
+	return nil
+}
+
+// toUTF8 converts text in a charset to UTF-8, text in unsupported charsets is
+// returned as is
+func toUTF8(data []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	return string(data)
+}
+
+// randomID returns a random identifier in hex
+func randomID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
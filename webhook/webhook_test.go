@@ -0,0 +1,195 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emailfabric/smtpd"
+)
+
+type acceptHandler struct{}
+
+func (acceptHandler) Connect(ctx context.Context, source string) error    { return nil }
+func (acceptHandler) Hello(ctx context.Context, hostname string) error    { return nil }
+func (acceptHandler) Sender(ctx context.Context, address string) error    { return nil }
+func (acceptHandler) Recipient(ctx context.Context, address string) error { return nil }
+func (acceptHandler) AuthUser(ctx context.Context, identity, username string) (string, error) {
+	return "", errors.New("535 5.7.8 Authentication failed")
+}
+func (acceptHandler) Message(ctx context.Context, r io.Reader) error { return nil }
+
+const parsedMessage = "From: sender@example.com\r\n" +
+	"Subject: =?utf-8?q?caf=C3=A9?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"b2\"\r\n" +
+	"\r\n" +
+	"--b2\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"caf=E9\r\n" +
+	"--b2\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>caf\xc3\xa9</p>\r\n" +
+	"--b2--\r\n" +
+	"--b1\r\n" +
+	"Content-Type: application/octet-stream; name=\"data.bin\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AQID\r\n" +
+	"--b1--\r\n"
+
+func TestParse(t *testing.T) {
+	m, err := Parse(strings.NewReader(parsedMessage))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if m.Header["Subject"][0] != "café" {
+		t.Fatalf("unexpected subject %q", m.Header["Subject"])
+	}
+	if m.Text != "café" || m.HTML != "<p>café</p>" {
+		t.Fatalf("unexpected bodies %q %q", m.Text, m.HTML)
+	}
+	if len(m.Attachments) != 1 || m.Attachments[0].Filename != "data.bin" || string(m.Attachments[0].Content) != "\x01\x02\x03" {
+		t.Fatalf("unexpected attachments %+v", m.Attachments)
+	}
+}
+
+func TestSink(t *testing.T) {
+
+	secret := []byte("secret")
+	var mu sync.Mutex
+	var payloads []*Payload
+	var ids []string
+	status := http.StatusOK
+	response := ""
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := Verify(secret, r, body, time.Minute); err != nil {
+			t.Errorf("%s", err.Error())
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, r.Header.Get(HeaderID))
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			io.WriteString(w, response)
+			return
+		}
+		p := &Payload{}
+		if err := json.Unmarshal(body, p); err != nil {
+			t.Errorf("%s", err.Error())
+		}
+		payloads = append(payloads, p)
+	}))
+	defer endpoint.Close()
+
+	sink := &Sink{
+		ContextHandler: acceptHandler{},
+		URL:            endpoint.URL,
+		Secret:         secret,
+		RetryInterval:  time.Millisecond,
+	}
+	server := &smtpd.Server{NewContextHandler: func() smtpd.ContextHandler { return sink }}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	go server.Serve(l)
+	defer server.Close()
+	send := func(msg string) error {
+		return smtp.SendMail(l.Addr().String(), nil, "sender@example.com", []string{"rcpt@example.org"}, []byte(msg))
+	}
+
+	// raw
+	if err := send("Subject: test\r\n\r\nraw\r\n"); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(payloads) != 1 || string(payloads[0].Raw) != "Subject: test\r\n\r\nraw\r\n" ||
+		payloads[0].Envelope.Sender != "sender@example.com" || payloads[0].Envelope.Recipients[0].Address != "rcpt@example.org" ||
+		payloads[0].Client.IP != "127.0.0.1" || payloads[0].Client.Protocol != "UTF8SMTP" {
+		t.Fatalf("unexpected payload %+v", payloads[0])
+	}
+
+	// parsed
+	sink.Format = Parsed
+	if err := send(parsedMessage); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(payloads) != 2 || payloads[1].Raw != nil || payloads[1].Message == nil || payloads[1].Message.Text != "café" {
+		t.Fatalf("unexpected payload %+v", payloads[1])
+	}
+
+	// retried with the same id until the attempts are exhausted
+	mu.Lock()
+	status = http.StatusServiceUnavailable
+	ids = nil
+	mu.Unlock()
+	if err := send("Subject: test\r\n\r\nretried\r\n"); !replied(err, 451, "4.3.0") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(ids) != 3 || ids[0] != ids[1] || ids[1] != ids[2] {
+		t.Fatalf("unexpected attempts %q", ids)
+	}
+
+	// rejected with the reply of the endpoint
+	mu.Lock()
+	status, response = http.StatusUnprocessableEntity, "550 5.1.1 Unknown recipient\n"
+	mu.Unlock()
+	if err := send("Subject: test\r\n\r\nrejected\r\n"); !replied(err, 550, "5.1.1 Unknown recipient") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	mu.Lock()
+	status, response = http.StatusForbidden, "forbidden"
+	mu.Unlock()
+	if err := send("Subject: test\r\n\r\nrejected\r\n"); !replied(err, 554, "5.6.0") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+// replied returns true if err is a reply with code and a message starting
+// with prefix
+func replied(err error, code int, prefix string) bool {
+	reply, ok := err.(*textproto.Error)
+	return ok && reply.Code == code && strings.HasPrefix(reply.Msg, prefix)
+}
+
+func TestSinkBusy(t *testing.T) {
+	sink := &Sink{MaxPending: 1}
+	sink.pendingChan() <- struct{}{}
+	if err := sink.Message(context.Background(), strings.NewReader("")); err != ErrBusy {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret, body := []byte("secret"), []byte("{}")
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set(HeaderTimestamp, "1000")
+	req.Header.Set(HeaderSignature, Sign(secret, "1000", body))
+	if err := Verify(secret, req, body, 0); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := Verify(secret, req, body, time.Hour); err != ErrSignature {
+		t.Fatalf("expected error for old timestamp")
+	}
+	if err := Verify(secret, req, []byte("{ }"), 0); err != ErrSignature {
+		t.Fatalf("expected error for modified body")
+	}
+}
@@ -0,0 +1,55 @@
+package smtpd
+
+import (
+	"bytes"
+	"io"
+)
+
+// DotWriter writes message data for the DATA command: lines starting with a
+// period are escaped with another period and Close ends the data with
+// ".\r\n". Like the reader passed to Handler.Message, it preserves line
+// endings, so the data it writes is read back unchanged. The data should
+// have CRLF line endings.
+type DotWriter struct {
+	w       io.Writer
+	midLine bool // not at the beginning of a line
+}
+
+// NewDotWriter returns a DotWriter that writes to w.
+func NewDotWriter(w io.Writer) *DotWriter {
+	return &DotWriter{w: w}
+}
+
+// Write writes message data.
+func (d *DotWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if !d.midLine && p[0] == '.' {
+			if _, err := d.w.Write([]byte{'.'}); err != nil {
+				return n, err
+			}
+		}
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+		}
+		written, err := d.w.Write(line)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		d.midLine = line[len(line)-1] != '\n'
+		p = p[len(line):]
+	}
+	return n, nil
+}
+
+// Close ends the data with CRLF if the last line is incomplete and the end
+// of data marker ".\r\n". It does not close the underlying writer.
+func (d *DotWriter) Close() error {
+	end := ".\r\n"
+	if d.midLine {
+		end = "\r\n.\r\n"
+	}
+	_, err := io.WriteString(d.w, end)
+	return err
+}
@@ -0,0 +1,40 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDotWriter(t *testing.T) {
+
+	for msg, expected := range map[string]string{
+		unstuffedMessage:              "Subject: test\r\n\r\n..leading dot\r\n.\r\n",
+		"":                            ".\r\n",
+		".\r\n..\r\nno final newline": "..\r\n...\r\nno final newline\r\n.\r\n",
+	} {
+		var buf bytes.Buffer
+		w := NewDotWriter(&buf)
+		// written in small chunks
+		io.Copy(w, iotest.OneByteReader(bytes.NewReader([]byte(msg))))
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if buf.String() != expected {
+			t.Fatalf("unexpected data %q", buf.String())
+		}
+
+		// read back
+		d := &dotReader{r: bufio.NewReader(&buf)}
+		data, err := ioutil.ReadAll(d)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if string(data) != msg && string(data) != msg+"\r\n" {
+			t.Fatalf("unexpected data read back %q", data)
+		}
+	}
+}
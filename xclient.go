@@ -0,0 +1,235 @@
+package smtpd
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// XCLIENT and XFORWARD attributes advertised with EHLO
+const (
+	xclientAttrs  = "NAME ADDR PORT PROTO HELO LOGIN"
+	xforwardAttrs = "NAME ADDR PORT PROTO HELO IDENT SOURCE"
+)
+
+// trusted returns true if addr is in one of the networks of
+// Server.TrustedProxies
+func (s *Server) trusted(addr net.Addr) bool {
+	return Networks(s.TrustedProxies).ContainsAddr(addr)
+}
+
+// parseForwardedAddr parses an ADDR attribute of XCLIENT or XFORWARD, IPv6
+// addresses are prefixed with "IPV6:"
+func parseForwardedAddr(value string) (net.IP, error) {
+	if len(value) > 5 && strings.EqualFold(value[:5], "IPV6:") {
+		value = value[5:]
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, errors.New("invalid address")
+	}
+	return ip, nil
+}
+
+// unknownSource is passed to Handler.Connect after XCLIENT when the address
+// of the original client is not available
+const unknownSource = "unknown"
+
+// unavailable returns true for the special attribute values that indicate
+// the information is not available
+func unavailable(value string) bool {
+	value = strings.ToUpper(value)
+	return value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]"
+}
+
+// xclient handles the XCLIENT command of a trusted proxy. The session is
+// restarted with the attributes of the original client, the handler's
+// Connect is called with the new remote address, or with "unknown" when the
+// address is not available. It returns false when the session must end.
+func (s *session) xclient(params string) bool {
+	if !s.server.trusted(s.netConn.RemoteAddr()) {
+		s.conn.Reply("550 5.7.0 Insufficient authorization")
+		return true
+	}
+	if s.hasSender {
+		s.conn.Reply("503 5.5.1 Mail transaction in progress")
+		return true
+	}
+	if params == "" {
+		s.conn.Reply("501 5.5.4 Syntax: XCLIENT attribute=value ...")
+		return true
+	}
+
+	addr, _ := s.RemoteAddr.(*net.TCPAddr)
+	if addr == nil {
+		addr = &net.TCPAddr{}
+	} else {
+		copied := *addr
+		addr = &copied
+	}
+	sess := s.Session
+	helo := s.forwardedHelo
+	for _, arg := range strings.Fields(params) {
+		i := strings.IndexByte(arg, '=')
+		if i == -1 {
+			s.conn.Reply("501 5.5.4 Syntax: XCLIENT attribute=value ...")
+			return true
+		}
+		name := strings.ToUpper(arg[:i])
+		value, err := decodeXtext(arg[i+1:])
+		if err != nil {
+			s.conn.Reply("501 5.5.4 Bad %s syntax", name)
+			return true
+		}
+		if unavailable(value) {
+			value = ""
+		}
+		switch name {
+		case "ADDR":
+			addr.IP = nil
+			if value != "" {
+				if addr.IP, err = parseForwardedAddr(value); err != nil {
+					s.conn.Reply("501 5.5.4 Bad ADDR syntax: %s", value)
+					return true
+				}
+			}
+		case "PORT":
+			addr.Port = 0
+			if value != "" {
+				port, err := strconv.Atoi(value)
+				if err != nil || port < 0 || port > 65535 {
+					s.conn.Reply("501 5.5.4 Bad PORT syntax: %s", value)
+					return true
+				}
+				addr.Port = port
+			}
+		case "NAME":
+			sess.RemoteHostname = value
+		case "HELO":
+			helo = value
+		case "LOGIN":
+			sess.AuthIdentity = ""
+			sess.AuthUsername = value
+		case "PROTO":
+			if value != "" && !strings.EqualFold(value, "SMTP") && !strings.EqualFold(value, "ESMTP") {
+				s.conn.Reply("501 5.5.4 Bad PROTO syntax: %s", value)
+				return true
+			}
+		default:
+			s.conn.Reply("501 5.5.4 Bad XCLIENT attribute name: %s", name)
+			return true
+		}
+	}
+
+	// continue as a new session of the original client
+	sess.RemoteAddr = addr
+	sess.Helo = helo
+	s.Session = sess
+	s.forwardedHelo = helo
+	s.reset()
+	if !s.checkAccess() {
+		s.conn.ErrorReply(errAccessDenied)
+		return false
+	}
+	s.startRDNS()
+	s.DNSBLListed, s.DNSBLBlocked = nil, false
+	if err := s.checkDNSBL(); err != nil {
+		s.conn.ErrorReply(err)
+		return false
+	}
+	if err := s.checkRDNS(); err != nil {
+		s.conn.ErrorReply(err)
+		return false
+	}
+	source := addr.String()
+	if addr.IP == nil {
+		source = unknownSource
+	}
+	err := s.handler.Connect(s.ctx, source)
+	if err != nil {
+		s.conn.ErrorReply(err)
+		return false
+	}
+	s.conn.Reply("220 %s %s", s.hostname(), s.server.protocol())
+	return true
+}
+
+// xforward handles the XFORWARD command of a trusted proxy. The attributes of
+// the original client are added to Session.Forwarded for the next mail
+// transaction.
+func (s *session) xforward(params string) {
+	if !s.server.trusted(s.netConn.RemoteAddr()) {
+		s.conn.Reply("550 5.7.0 Insufficient authorization")
+		return
+	}
+	if s.hasSender {
+		s.conn.Reply("503 5.5.1 Mail transaction in progress")
+		return
+	}
+	if params == "" {
+		s.conn.Reply("501 5.5.4 Syntax: XFORWARD attribute=value ...")
+		return
+	}
+
+	var fwd ForwardedClient
+	if s.Forwarded != nil {
+		fwd = *s.Forwarded
+	}
+	for _, arg := range strings.Fields(params) {
+		i := strings.IndexByte(arg, '=')
+		if i == -1 {
+			s.conn.Reply("501 5.5.4 Syntax: XFORWARD attribute=value ...")
+			return
+		}
+		name := strings.ToUpper(arg[:i])
+		value, err := decodeXtext(arg[i+1:])
+		if err != nil {
+			s.conn.Reply("501 5.5.4 Bad %s syntax", name)
+			return
+		}
+		if unavailable(value) {
+			value = ""
+		}
+		switch name {
+		case "ADDR":
+			fwd.IP = nil
+			if value != "" {
+				if fwd.IP, err = parseForwardedAddr(value); err != nil {
+					s.conn.Reply("501 5.5.4 Bad ADDR syntax: %s", value)
+					return
+				}
+			}
+		case "PORT":
+			fwd.Port = 0
+			if value != "" {
+				port, err := strconv.Atoi(value)
+				if err != nil || port < 0 || port > 65535 {
+					s.conn.Reply("501 5.5.4 Bad PORT syntax: %s", value)
+					return
+				}
+				fwd.Port = port
+			}
+		case "NAME":
+			fwd.Name = value
+		case "HELO":
+			fwd.Helo = value
+		case "PROTO":
+			fwd.Proto = strings.ToUpper(value)
+		case "IDENT":
+			fwd.Ident = value
+		case "SOURCE":
+			value = strings.ToUpper(value)
+			if value != "" && value != "LOCAL" && value != "REMOTE" {
+				s.conn.Reply("501 5.5.4 Bad SOURCE syntax: %s", value)
+				return
+			}
+			fwd.Source = value
+		default:
+			s.conn.Reply("501 5.5.4 Bad XFORWARD attribute name: %s", name)
+			return
+		}
+	}
+	s.Forwarded = &fwd
+	s.conn.Reply("250 2.0.0 OK")
+}